@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
 	"time"
 
 	smug "github.com/nod/smug-broker/smug"
@@ -16,6 +18,8 @@ type RuntimeOpts struct {
 	configFile  string
 	loglevel    string
 	showVersion bool
+	watchConfig bool
+	testMatch   string
 }
 
 func buildRuntimeOpts() *RuntimeOpts {
@@ -28,6 +32,10 @@ func buildRuntimeOpts() *RuntimeOpts {
 	flag.StringVar(&opts.loglevel, "loglevel", "warning", "logging level")
 	flag.BoolVar(&opts.showVersion, "version", false,
 		"display version and exit")
+	flag.BoolVar(&opts.watchConfig, "watch-config", false,
+		"follow a consul:// or etcd:// config for changes")
+	flag.StringVar(&opts.testMatch, "test-match", "",
+		"show which patterns would match this text, without sending, and exit")
 	return opts
 }
 
@@ -41,6 +49,48 @@ func ErrorAndExit(msg string) {
 	os.Exit(2)
 }
 
+// prints what each pattern broker would do with text.  nothing is sent
+func testMatch(cfg *smug.Config, text string) {
+	keys := []string{}
+	for key, bcfg := range cfg.Brokers {
+		if bcfg.Type == "pattern" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	matched := false
+	for _, key := range keys {
+		prb := &smug.PatternRoutingBroker{}
+		if err := prb.SetupFromConfig(cfg.Brokers[key]); err != nil {
+			ErrorAndExit(fmt.Sprintf("broker %s: %s", key, err))
+		}
+		for _, mr := range prb.TestMatch(text) {
+			matched = true
+			fmt.Printf("%s: pattern %q\n  %s %s\n", key, mr.Name, mr.Method, mr.Url)
+			for _, name := range sortedGroups(mr.Groups) {
+				fmt.Printf("  %s = %q\n", name, mr.Groups[name])
+			}
+			if mr.Err != nil {
+				fmt.Printf("  ERR building payload: %s\n", mr.Err)
+			} else {
+				fmt.Printf("  payload: %s\n", mr.Payload)
+			}
+		}
+	}
+	if !matched {
+		fmt.Println("no patterns match")
+	}
+}
+
+func sortedGroups(groups smug.NamedGroups) []string {
+	names := []string{}
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func parseConfig() (*RuntimeOpts, *smug.Config) {
 	runopts := buildRuntimeOpts()
 	flag.Parse()
@@ -56,7 +106,8 @@ func parseConfig() (*RuntimeOpts, *smug.Config) {
 		ErrorAndExit(fmt.Sprintf("missing required config file"))
 	}
 	// does the file at least exist?
-	if _, err := os.Stat(runopts.configFile); os.IsNotExist(err) {
+	_, err := os.Stat(runopts.configFile)
+	if !strings.Contains(runopts.configFile, "://") && os.IsNotExist(err) {
 		ErrorAndExit(fmt.Sprintf(
 			"config file not found: %s\n",
 			runopts.configFile,
@@ -67,118 +118,186 @@ func parseConfig() (*RuntimeOpts, *smug.Config) {
 	return runopts, cfg
 }
 
-func MakeIrcBroker(cfg *smug.BrokerConfig) smug.Broker {
-	server := cfg.Server
-	// cfg.GetBool("ssl")
-	nick := cfg.Nick
-	channel := cfg.Channel
-	ib := &smug.IrcBroker{}
-	ib.Setup(
-		server,
-		channel,
-		nick,
-		fmt.Sprintf("%s-%s", "smug", version),
-	)
-	return ib
-}
+func main() {
+	smug.Version = version
+	opts, cfg := parseConfig()
 
-func MakeSlackBroker(cfg *smug.BrokerConfig) smug.Broker {
-	token := cfg.ApiToken
-	channel := cfg.Channel
-	sb := &smug.SlackBroker{}
-	sb.Setup(token, channel)
-	return sb
-}
+	// setup logging first
+	smug.SetupLogging(opts.loglevel)
+
+	if opts.testMatch != "" {
+		testMatch(cfg, opts.testMatch)
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		ErrorAndExit(err.Error())
+	}
+
+	log := smug.NewLogger("smug", version)
+	maxprocs := runtime.GOMAXPROCS(-1)
+	log.Infof("starting smug ver:%s gomaxprocs:%d", version, maxprocs)
 
-func MakePatternBroker(cfg *smug.BrokerConfig) smug.Broker {
-	pb := &smug.PatternRoutingBroker{}
-	pb.Setup()
-	for _, p := range cfg.Patterns {
-		if p.RegEx == "" {
-			ErrorAndExit("pattern broker pattern.regex must not be blank")
+	smug.SetHttpDefaults(cfg.UserAgent, cfg.HttpHeaders)
+	dispatcher := smug.NewCentralDispatch()
+	if cfg.HeartbeatSplay != "" {
+		splay, err := time.ParseDuration(cfg.HeartbeatSplay)
+		if err != nil || splay >= smug.DefaultHeartbeat {
+			ErrorAndExit(fmt.Sprintf(
+				"heartbeat-splay must be a duration under %s", smug.DefaultHeartbeat))
 		}
-		if p.Url == "" {
-			ErrorAndExit("pattern broker pattern.url must not be blank")
+		dispatcher.HeartbeatSplay(splay)
+	}
+	if cfg.MetricsSummary != "" {
+		every, err := time.ParseDuration(cfg.MetricsSummary)
+		if err != nil || every <= 0 {
+			ErrorAndExit(fmt.Sprintf(
+				"invalid metrics-summary %s", cfg.MetricsSummary))
 		}
-		if p.Method == "" {
-			ErrorAndExit("pattern broker pattern.method must not be blank")
+		summary := smug.NewMetricsSummary()
+		dispatcher.Summarize(summary)
+		summary.Every(every)
+		defer summary.Stop()
+	}
+	smug.QuietHeartbeats(cfg.QuietHeartbeats)
+
+	// setup our localcmdbroker first, unless we're only relaying
+	if !cfg.RelayOnly {
+		lc := &smug.LocalCmdBroker{}
+		if err := lc.Setup("smug", "", version); err != nil {
+			ErrorAndExit(err.Error())
 		}
-		// now build our pattern
-		newp, err := smug.NewExtendedPattern(
-			p.Name, p.RegEx, p.Url, p.Headers, p.Vars, p.Method, p.Help)
-		if err != nil {
-			panic(fmt.Sprintf("error creating PatternBroker %s", err))
+		if err := lc.AllowMute(cfg.MuteActors); err != nil {
+			ErrorAndExit(err.Error())
 		}
-		pb.AddPattern(newp)
+		dispatcher.AddBroker(lc)
+		defer dispatcher.RemoveBroker(lc)
 	}
-	return pb
-}
-
-type BrokerBuilder func(*smug.BrokerConfig) smug.Broker
 
-func makeBroker(brokerKey string, cfg *smug.BrokerConfig) (smug.Broker, error) {
-	broker_types := map[string]BrokerBuilder{
-		"irc":     MakeIrcBroker,
-		"pattern": MakePatternBroker,
-		"slack":   MakeSlackBroker,
+	redact, err := smug.NewRedactorFromConfig(cfg.Redact)
+	if err != nil {
+		ErrorAndExit(err.Error())
 	}
-	brokerType := cfg.Type
-	if broker_factory, ok := broker_types[brokerType]; ok {
-		// valid broker, make it up!
-		return broker_factory(cfg), nil
-	} else {
-		return nil, fmt.Errorf("invalid broker type: %s", brokerType)
+	dispatcher.Redact(redact)
+	limit, err := smug.NewActorLimiterFromConfig(cfg.RateLimit)
+	if err != nil {
+		ErrorAndExit(err.Error())
 	}
-}
-
-func createBrokers(cfg *smug.Config) []smug.Broker {
-	brokers := []smug.Broker{}
-	for _, ab := range cfg.ActiveBrokers {
-		brcfg, found := cfg.Brokers[ab]
-		if !found {
-			panic(fmt.Sprintf("missing broker config: %s", ab))
-		}
-		b, err := makeBroker(ab, brcfg)
+	dispatcher.LimitActors(limit)
+	identities, err := smug.NewIdentityMap(cfg.Identities)
+	if err != nil {
+		ErrorAndExit(err.Error())
+	}
+	if cfg.NormalizeText != "" {
+		tn, err := smug.NewTextNormalizer(cfg.NormalizeText)
 		if err != nil {
-			panic(err)
+			ErrorAndExit(err.Error())
 		}
-		brokers = append(brokers, b)
+		dispatcher.Normalize(tn)
 	}
-	return brokers
-}
 
-func main() {
-	opts, cfg := parseConfig()
-
-	// setup logging first
-	smug.SetupLogging(opts.loglevel)
-
-	log := smug.NewLogger("smug", version)
-	maxprocs := runtime.GOMAXPROCS(-1)
-	log.Infof("starting smug ver:%s gomaxprocs:%d", version, maxprocs)
-
-	dispatcher := smug.NewCentralDispatch()
+	if opts.watchConfig {
+		if !smug.IsKVConfig(opts.configFile) {
+			ErrorAndExit("watch-config needs a consul:// or etcd:// config")
+		}
+		go func() {
+			err := smug.WatchConfig(opts.configFile, func(newcfg *smug.Config) {
+				// brokers can't be rebuilt in place, the rest applies now
+				rd, err := smug.NewRedactorFromConfig(newcfg.Redact)
+				if err != nil {
+					log.Warnf("ERR changed config not applied: %s", err)
+					return
+				}
+				dispatcher.Redact(rd)
+				smug.SetHttpDefaults(newcfg.UserAgent, newcfg.HttpHeaders)
+				log.Warnf("config changed, redaction and http defaults " +
+					"applied, restart for broker changes")
+			}, nil)
+			if err != nil {
+				log.Warnf("ERR watching config: %s", err)
+			}
+		}()
+	}
 
-	// setup our localcmdbroker first
-	lc := &smug.LocalCmdBroker{}
-	lc.Setup("smug", "", version)
-	dispatcher.AddBroker(lc)
-	defer dispatcher.RemoveBroker(lc)
+	var deadLetters *smug.DeadLetterFile
+	if cfg.DeadLetterFile != "" {
+		deadLetters = smug.NewDeadLetterFile(cfg.DeadLetterFile)
+		dispatcher.DeadLetters(deadLetters)
+	} else if cfg.RedriveDeadLetters {
+		ErrorAndExit("redrive-dead-letters needs a dead-letter-file")
+	}
 
 	// now brokers from config
-	brokers := createBrokers(cfg)
+	brokers, err := smug.NewBrokersFromConfig(cfg)
+	if err != nil {
+		ErrorAndExit(err.Error())
+	}
 	for _, b := range brokers {
+		bcfg := cfg.Brokers[smug.BrokerKey(b)]
+		if bcfg.Redact != nil {
+			rd, err := smug.NewRedactorFromConfig(bcfg.Redact)
+			if err != nil {
+				ErrorAndExit(err.Error())
+			}
+			dispatcher.RedactFrom(b, rd)
+		}
+		if bcfg.RateLimit != nil {
+			al, err := smug.NewActorLimiterFromConfig(bcfg.RateLimit)
+			if err != nil {
+				ErrorAndExit(err.Error())
+			}
+			dispatcher.LimitActorsFrom(b, al)
+		}
+		if ib, ok := b.(smug.IdentityBroker); ok {
+			ib.UseIdentities(identities)
+		}
+		if len(bcfg.EventKinds) > 0 {
+			kinds, err := smug.NewEventKinds(bcfg.EventKinds)
+			if err != nil {
+				ErrorAndExit(err.Error())
+			}
+			dispatcher.AcceptKinds(b, kinds)
+		}
+		if bcfg.StripQuotes {
+			// ahead of translation, so quotes aren't translated
+			dispatcher.AddTransform(b, smug.StripQuotes)
+		}
+		if bcfg.Translate != nil {
+			tr, err := smug.NewTranslatorFromConfig(bcfg.Translate)
+			if err != nil {
+				ErrorAndExit(err.Error())
+			}
+			tr.Start(dispatcher)
+			dispatcher.AddTransform(b, tr.Transform)
+		}
+		err := dispatcher.QueueSends(b, bcfg.SendQueue, bcfg.SendOverflow)
+		if err != nil {
+			ErrorAndExit(err.Error())
+		}
+		if bcfg.SendWorkers > 1 {
+			if err := dispatcher.SendWorkers(b, bcfg.SendWorkers); err != nil {
+				ErrorAndExit(err.Error())
+			}
+		}
 		dispatcher.AddBroker(b)
 		defer dispatcher.RemoveBroker(b)
 	}
 
+	if cfg.RedriveDeadLetters {
+		n, err := deadLetters.Redrive(dispatcher)
+		if err != nil {
+			log.Warnf("ERR re-driving dead letters: %s", err)
+		}
+		log.Infof("re-drove %d dead letters", n)
+	}
+
 	// just loop here for now so others can run like happy little trees
 	timepassed := 0 * time.Millisecond
 	sleeptime := 200 * time.Millisecond
 	for true {
 		time.Sleep(sleeptime)
 		timepassed += sleeptime
-		if timepassed >= (1000 * 2 * 60 * time.Millisecond) {
+		if timepassed >= smug.DefaultHeartbeat {
 			timepassed = 0 * time.Millisecond
 			dispatcher.Heartbeat()
 		}
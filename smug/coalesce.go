@@ -0,0 +1,137 @@
+// coalescing of rapid-fire lines
+// folks on line based networks like irc tend to send a thought over several
+// quick lines.  a Coalescer sits in front of a broker's send and joins
+// consecutive plain lines from the same actor into one message, flushing
+// after a quiet window, when the actor changes or when it grows too large.
+
+package smug
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultCoalesceMax = 2000
+
+// the quickest Run checks for quiet buffers, however short the window
+const minCoalesceTick = 10 * time.Millisecond
+
+type Coalescer struct {
+	window  time.Duration
+	maxLen  int
+	send    func(*Event)
+	now     func() time.Time
+	mux     sync.Mutex
+	pending *Event
+	lines   []string
+	size    int
+	last    time.Time
+	done    chan bool
+}
+
+// send is called with each (possibly merged) event in order.  a maxLen of 0
+// uses DefaultCoalesceMax
+func NewCoalescer(window time.Duration, maxLen int, send func(*Event)) *Coalescer {
+	if maxLen <= 0 {
+		maxLen = DefaultCoalesceMax
+	}
+	return &Coalescer{
+		window: window,
+		maxLen: maxLen,
+		send:   send,
+		now:    time.Now,
+		done:   make(chan bool),
+	}
+}
+
+// only simple text is worth joining, anything else goes straight through
+func coalescable(ev *Event) bool {
+	return !ev.IsCmdOutput && !ev.IsAction && ev.Presence == "" &&
+		len(ev.ContentBlocks) == 0 && len(ev.Attachments) == 0 &&
+		ev.SendAt.IsZero() && ev.Actor != ""
+}
+
+// whether ev would land in the same place, from the same actor, as pending
+func sameSource(a *Event, b *Event) bool {
+	return a.Origin == b.Origin && a.Actor == b.Actor &&
+		a.ReplyBroker == b.ReplyBroker && a.ReplyTarget == b.ReplyTarget &&
+		a.ThreadId == b.ThreadId && a.ThreadBroker == b.ThreadBroker
+}
+
+// must hold mux.  returns the merged pending event, if any, and resets
+func (co *Coalescer) takePending() *Event {
+	ev := co.pending
+	if ev != nil {
+		ev.Text = strings.Join(co.lines, "\n")
+		ev.RawText = ev.Text
+	}
+	co.pending, co.lines, co.size = nil, nil, 0
+	return ev
+}
+
+func (co *Coalescer) Add(ev *Event) {
+	out := []*Event{}
+	co.mux.Lock()
+	if co.pending != nil && (!coalescable(ev) ||
+		!sameSource(co.pending, ev) || co.size+len(ev.Text) > co.maxLen) {
+		out = append(out, co.takePending())
+	}
+	if coalescable(ev) {
+		if co.pending == nil {
+			cp := *ev
+			co.pending = &cp
+		}
+		co.lines = append(co.lines, ev.Text)
+		co.size += len(ev.Text) + 1
+		co.last = co.now()
+	} else {
+		out = append(out, ev)
+	}
+	co.mux.Unlock()
+	for _, o := range out {
+		co.send(o)
+	}
+}
+
+// flush anything that's been quiet for the window
+func (co *Coalescer) tick() {
+	co.mux.Lock()
+	var ev *Event
+	if co.pending != nil && co.now().Sub(co.last) >= co.window {
+		ev = co.takePending()
+	}
+	co.mux.Unlock()
+	if ev != nil {
+		co.send(ev)
+	}
+}
+
+// checks for quiet buffers a few times a window until Stop
+func (co *Coalescer) Run() {
+	every := co.window / 4
+	if every < minCoalesceTick {
+		every = minCoalesceTick
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			co.tick()
+		case <-co.done:
+			return
+		}
+	}
+}
+
+// stops Run and sends anything still buffered
+func (co *Coalescer) Stop() {
+	close(co.done)
+	co.mux.Lock()
+	ev := co.takePending()
+	co.mux.Unlock()
+	if ev != nil {
+		co.send(ev)
+	}
+}
@@ -0,0 +1,78 @@
+package smug
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	now := time.Date(2020, 3, 9, 9, 0, 0, 0, time.UTC)
+	sent := []*Event{}
+	co := NewCoalescer(2*time.Second, 20, func(ev *Event) { sent = append(sent, ev) })
+	co.now = func() time.Time { return now }
+	irc := &FakeBroker{}
+
+	co.Add(&Event{Origin: irc, Actor: "bob", Text: "so i was"})
+	now = now.Add(time.Second)
+	co.Add(&Event{Origin: irc, Actor: "bob", Text: "thinking"})
+	now = now.Add(time.Second)
+	co.tick()
+	if len(sent) != 0 {
+		t.Errorf("err: nothing should flush inside the window")
+	}
+	now = now.Add(time.Second)
+	co.tick()
+	if len(sent) != 1 || sent[0].Text != "so i was\nthinking" {
+		t.Fatalf("err: expected one merged message after the window %+v", sent)
+	}
+
+	// a different actor flushes what bob had
+	co.Add(&Event{Origin: irc, Actor: "bob", Text: "one"})
+	co.Add(&Event{Origin: irc, Actor: "alice", Text: "two"})
+	if len(sent) != 2 || sent[1].Text != "one" || sent[1].Actor != "bob" {
+		t.Errorf("err: actor change should flush %+v", sent[1:])
+	}
+
+	// too much text flushes before adding more
+	co.Add(&Event{Origin: irc, Actor: "alice", Text: strings.Repeat("x", 18)})
+	if len(sent) != 3 || sent[2].Text != "two" {
+		t.Errorf("err: size should flush %+v", sent[2:])
+	}
+
+	// anything fancier passes straight through, after what was pending
+	co.Add(&Event{Origin: irc, Actor: "alice", Text: "waves", IsAction: true})
+	if len(sent) != 5 || !sent[4].IsAction {
+		t.Errorf("err: action should flush and pass through, sent %d", len(sent))
+	}
+
+	co.Add(&Event{Origin: irc, Actor: "carol", Text: "bye"})
+	co.Stop()
+	if len(sent) != 6 || sent[5].Text != "bye" {
+		t.Errorf("err: stop should flush pending")
+	}
+}
+
+func TestSlackCoalesce(t *testing.T) {
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	sb.coalesce = NewCoalescer(time.Hour, 0, sb.post)
+	td := &TestDispatch{}
+	sb.HandleEvent(&Event{Actor: "bob", Text: "hey"}, td)
+	sb.HandleEvent(&Event{Actor: "bob", Text: "you there?"}, td)
+	if len(fs.posted) != 0 {
+		t.Errorf("err: lines should be held while coalescing")
+	}
+	sb.Deactivate()
+	if len(fs.posted) != 1 || postedText(fs.posted[0]) != "hey\nyou there?" {
+		t.Errorf("err: expected one joined post, have %d", len(fs.posted))
+	}
+}
+
+func TestCoalescerTinyWindow(t *testing.T) {
+	co := NewCoalescer(time.Nanosecond, 0, func(*Event) {})
+	go co.Run()
+	time.Sleep(20 * time.Millisecond)
+	co.Stop()
+}
@@ -3,9 +3,12 @@ package smug
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"reflect"
+	"regexp"
 	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -14,28 +17,406 @@ type PatternConfig struct {
 	Name    string            `yaml:"name"`
 	Help    string            `yaml:"help"`
 	RegEx   string            `yaml:"regex"`
-	Url     string            `yaml:"url"`
+	Url     string            `yaml:"-"`
 	Method  string            `yaml:"method"`
 	Headers map[string]string `yaml:"headers"`
 	Vars    map[string]string `yaml:"vars"`
+	// payload keys to send as int, float or bool instead of strings
+	Types map[string]string `yaml:"types"`
+	// a go template rendering the request body in place of the usual
+	// {actor, text, ...} json, over .actor .text .groups and .vars
+	Payload string `yaml:"payload"`
+	// threaded replies are also shown in the channel
+	ReplyBroadcast bool `yaml:"reply-broadcast"`
+	// how many follow-up requests a response may chain, to the same host, at
+	// most 10.  0 (default) disables
+	MaxChain int `yaml:"max-chain"`
+	// max bytes read from a response, defaults to 1MB
+	MaxResponse int64 `yaml:"max-response"`
+	// longer text isn't matched, defaults to 4096 bytes, -1 for no limit
+	MaxInput int `yaml:"max-input"`
+	// only these actors may use the pattern, as <broker>:<id> (eg
+	// slack:U0123ABC), empty allows everyone.  anyone else gets the
+	// not-allowed reply, or nothing
+	AllowedActors []string `yaml:"allowed-actors"`
+	NotAllowed    string   `yaml:"not-allowed"`
+	// only match direct messages (dm), only channels (channel) or any
+	Scope string `yaml:"scope"`
+	// slack: posted straight away and replaced by the answer, eg "…thinking"
+	Thinking string `yaml:"thinking"`
+	// go templates replied when the endpoint fails or has nothing to say,
+	// over .status .groups .actor and .text.  unset stays silent
+	OnError string `yaml:"on-error"`
+	OnEmpty string `yaml:"on-empty"`
+	// only tried once no other pattern matched, eg a hint for unknown
+	// commands
+	Default bool `yaml:"default"`
+	// every match is also sent to these, concurrently.  in yaml url may be
+	// a list, the first is Url and the rest end up here
+	FanOut []string `yaml:"-"`
+	// slack: react to the message that matched with these emoji (eg
+	// white_check_mark and x) once the endpoint answers, or fails
+	ReactOk    string `yaml:"react-ok"`
+	ReactError string `yaml:"react-error"`
+	// slack: and with this one (eg eyes) as soon as it matches
+	ReactReceived string `yaml:"react-received"`
+	// in place of regex, match this command word after command-prefix
+	// (default ..) and send what follows it, shell split, as args
+	Command       string `yaml:"command"`
+	CommandPrefix string `yaml:"command-prefix"`
+}
+
+// a single string or a list of them
+type StringList []string
+
+func (sl *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*sl = list
+		return nil
+	}
+	var one string
+	if err := unmarshal(&one); err != nil {
+		return err
+	}
+	*sl = StringList{one}
+	return nil
+}
+
+func (pc *PatternConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PatternConfig
+	var raw struct {
+		plain `yaml:",inline"`
+		Url   StringList `yaml:"url"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*pc = PatternConfig(raw.plain)
+	if len(raw.Url) > 0 {
+		pc.Url, pc.FanOut = raw.Url[0], raw.Url[1:]
+	}
+	return nil
+}
+
+type ScheduleConfig struct {
+	Schedule string `yaml:"schedule"`
+	At       string `yaml:"at"`
+	Timezone string `yaml:"timezone"`
+	Text     string `yaml:"text"`
+	Target   string `yaml:"target"`
+	// post into this thread of the target, eg a slack thread_ts
+	Thread         string `yaml:"thread"`
+	ReplyBroadcast bool   `yaml:"reply-broadcast"`
+}
+
+type RedactConfig struct {
+	// include the built in patterns for aws keys, jwts, tokens etc
+	Defaults bool     `yaml:"defaults"`
+	Patterns []string `yaml:"patterns"`
+}
+
+// a LibreTranslate style api to translate a broker's messages with
+type TranslateConfig struct {
+	Url    string `yaml:"url"`
+	ApiKey string `yaml:"api-key"`
+	// language to translate into, eg en
+	Target string `yaml:"target"`
+	// append (the default) adds the translation after the text, replace
+	// swaps it in
+	Mode string `yaml:"mode"`
+	// messages shorter than this many chars are left alone, default 12
+	MinLength int `yaml:"min-length"`
+	// per request, eg 3s (default 5s), and how many times failures are
+	// retried (default 1)
+	Timeout string `yaml:"timeout"`
+	Retries int    `yaml:"retries"`
+}
+
+// how many messages each actor may broadcast
+type RateLimitConfig struct {
+	// eg 5 per 10s
+	Messages int    `yaml:"messages"`
+	Per      string `yaml:"per"`
+	// how many may come at once, defaults to messages
+	Burst int `yaml:"burst"`
+	// drop (default) or coalesce, which holds messages over the limit and
+	// sends them joined together once the actor is allowed again
+	Excess string `yaml:"excess"`
+}
+
+type UrlRewriteConfig struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
 }
 
 // NOTE this is a super set of broker config needs.
 // not all brokers will use every member of this Config
 // however, doing it this way allows the yaml unmarshal to Just Work(TM)
 type BrokerConfig struct {
-	Type     string          `yaml:"type"`
+	// the key this stanza has under brokers, set when parsed
+	Key  string `yaml:"-"`
+	Type string `yaml:"type"`
+	// shown in logs and metrics instead of the broker's name, eg "slack"
+	Alias    string          `yaml:"alias"`
 	Server   string          `yaml:"server" envcfg:"SERVER"`
 	ApiToken string          `yaml:"token" envcfg:"APITOKEN"`
 	UseSSL   bool            `yaml:"ssl" envcfg:"SSL"`
 	Nick     string          `yaml:"nick" envcfg:"NICK"`
 	Channel  string          `yaml:"channel" envcfg:"CHANNEL"`
 	Patterns []PatternConfig `yaml:"patterns"`
+	// irc: comma separated keys for the comma separated channels, in order
+	ChannelKey string `yaml:"channel-key" envcfg:"CHANNELKEY"`
+	// pattern: concurrent submissions, how many may wait and what happens
+	// when the queue is full (drop or block)
+	Workers   int    `yaml:"workers"`
+	QueueSize int    `yaml:"queue-size"`
+	Overflow  string `yaml:"overflow"`
+	// pattern: stop trying patterns on a message after this long, eg 50ms
+	MatchBudget string `yaml:"match-budget"`
+	// pattern: refuse configs with more patterns than this, 0 for no limit
+	MaxPatterns int `yaml:"max-patterns"`
+	// pattern: answers that may wait to be broadcast, more are dropped
+	FeedbackSize int `yaml:"feedback-size"`
+	// mastodon: public, unlisted, private or direct
+	Visibility string `yaml:"visibility"`
+	// sqlite: database file and optional addr for the read-only query api.
+	// unix: the socket listened on.  inject: the addr listened on, with
+	// token as the bearer token requests need
+	Path   string `yaml:"path"`
+	Listen string `yaml:"listen"`
+	// unix: octal permissions for the socket, 0600 by default
+	SocketPerms string `yaml:"socket-perms"`
+	// sqlite: on startup resend events newer than replay-since (eg 30m) to
+	// the replay-target broker, at most replay-max of the latest
+	ReplaySince  string `yaml:"replay-since"`
+	ReplayTarget string `yaml:"replay-target"`
+	ReplayMax    int    `yaml:"replay-max"`
+	// sqlite: don't archive events from inject brokers
+	SkipInjected bool `yaml:"skip-injected"`
+	// email: imap server is server, password and addresses for the bridge
+	SmtpServer   string   `yaml:"smtp-server"`
+	Username     string   `yaml:"username"`
+	Password     string   `yaml:"password" envcfg:"PASSWORD"`
+	Folder       string   `yaml:"folder"`
+	From         string   `yaml:"from"`
+	To           []string `yaml:"to"`
+	PollInterval string   `yaml:"poll-interval"`
+	// poll: feed fetched every poll-interval.  json feeds find their list of
+	// items, and each item's id, text and link, by dotted path eg data.items
+	Url       string `yaml:"url"`
+	ItemsPath string `yaml:"items-path"`
+	IdPath    string `yaml:"id-path"`
+	TextPath  string `yaml:"text-path"`
+	LinkPath  string `yaml:"link-path"`
+	// cron: scheduled messages
+	Schedules []ScheduleConfig `yaml:"schedules"`
+	// inbound messages from actors matching any of these regexes are dropped
+	IgnoreActors []string `yaml:"ignore-actors"`
+	// regex replacements applied to urls in outbound text
+	UrlRewrites []UrlRewriteConfig `yaml:"url-rewrites"`
+	// irc: regex character class allowed in rendered nicks and their max len
+	NickChars string `yaml:"nick-chars"`
+	NickLen   int    `yaml:"nick-len"`
+	// inbound text with these is relayed command output, never routed
+	CmdOutputPrefixes []string `yaml:"cmd-output-prefixes"`
+	CmdOutputSuffixes []string `yaml:"cmd-output-suffixes"`
+	// slack: join an actor's lines sent within this duration (eg 2s) into one
+	// post of at most coalesce-max chars
+	Coalesce    string `yaml:"coalesce"`
+	CoalesceMax int    `yaml:"coalesce-max"`
+	// longer outbound messages are split ("chunk") or cut short ("truncate")
+	// per message-policy.  truncated ones end with truncate-marker and, if
+	// set, truncate-link pointing somewhere the full text can be found
+	MaxMessageLen  int    `yaml:"max-message-len"`
+	MessagePolicy  string `yaml:"message-policy"`
+	TruncateMarker string `yaml:"truncate-marker"`
+	TruncateLink   string `yaml:"truncate-link"`
+	// replaces the global redact settings for events from this broker
+	Redact *RedactConfig `yaml:"redact"`
+	// translate what this broker brings in before it's bridged
+	Translate *TranslateConfig `yaml:"translate"`
+	// drop quoted history from the start and end of what this broker brings
+	// in, off by default
+	StripQuotes bool `yaml:"strip-quotes"`
+	// replaces the global rate-limit for actors on this broker
+	RateLimit *RateLimitConfig `yaml:"rate-limit"`
+	// only send this broker these kinds of event: message, action, join,
+	// part or topic.  unset sends messages and actions, and the joins, parts
+	// and topics show-presence and sync-topic ask for
+	EventKinds []string `yaml:"event-kinds"`
+	// drop outbound text identical to something the same actor sent to the
+	// same place within this duration (eg 30s), off by default or at 0
+	Dedup string `yaml:"dedup"`
+	// what makes two messages the same for dedup, actor-text (default) or
+	// text.  dedup-match keys on what this regex finds in the text
+	DedupKey   string `yaml:"dedup-key"`
+	DedupMatch string `yaml:"dedup-match"`
+	// irc, slack, mastodon and pattern: give up connecting after this long
+	// (eg 10s) and check idle connections are alive this often (eg 1m),
+	// reconnecting when they're not.  unset leaves the library defaults
+	DialTimeout string `yaml:"dial-timeout"`
+	KeepAlive   string `yaml:"keepalive"`
+	// slack: prefix threaded replies with this many chars of the thread root
+	ThreadContext int `yaml:"thread-context"`
+	// slack: turn link and media previews on or off, unset leaves slack's
+	// defaults
+	UnfurlLinks *bool `yaml:"unfurl-links"`
+	UnfurlMedia *bool `yaml:"unfurl-media"`
+	// slack: reacting with one of these emoji re-sends the message's text,
+	// after the mapped prefix, as a command from the reacting user
+	ReactionCommands map[string]string `yaml:"reaction-commands"`
+	// slack: icon for actors with no avatar url, %s is the actor.  unset
+	// uses :avatar_%s:, blank leaves slack's default
+	AvatarEmoji *string `yaml:"avatar-emoji"`
+	// slack: avatar urls for actors without their own, by actor and from a
+	// yaml file of the same that's re-read when it changes
+	Avatars    map[string]string `yaml:"avatars"`
+	AvatarFile string            `yaml:"avatar-file"`
+	// slack: join the channel on startup if the bot isn't in it yet.  only
+	// works for public channels, private ones need the bot invited
+	JoinChannel bool `yaml:"join-channel"`
+	// slack: take slash commands and button presses over socket mode, which
+	// needs an app level token (xapp-...)
+	SocketMode bool   `yaml:"socket-mode"`
+	AppToken   string `yaml:"app-token" envcfg:"APPTOKEN"`
+	// slack: how long a user lookup that failed isn't retried, eg 10m.
+	// defaults to 5m, 0s retries every time
+	UserMissTTL string `yaml:"user-miss-ttl"`
+	// slack: keep the user cache in this file across restarts, with users
+	// fetched again this long after they last were.  defaults to 24h
+	UserCacheFile string `yaml:"user-cache-file"`
+	UserCacheTTL  string `yaml:"user-cache-ttl"`
+	// slack: bridge messages posted by integrations and other bots, which
+	// are ignored by default
+	BridgeBots bool `yaml:"bridge-bots"`
+	// slack: list at most this many of a message's files (0, the default,
+	// for all) and the rest as +N more, by name only with file-names
+	MaxFiles  int  `yaml:"max-files"`
+	FileNames bool `yaml:"file-names"`
+	// slack: bridge edits people make to their messages, off by default
+	BridgeEdits bool `yaml:"bridge-edits"`
+	// slack: on enterprise grid with an org wide token, list channels and
+	// user groups from workspace team-id, blank for the token's own
+	Enterprise bool   `yaml:"enterprise"`
+	TeamId     string `yaml:"team-id"`
+	// irc, slack: show other brokers' joins and parts, off by default
+	ShowPresence bool `yaml:"show-presence"`
+	// irc, slack: set our channel's topic when another broker's changes
+	SyncTopic bool `yaml:"sync-topic"`
+	// irc, mastodon: prefix messages from other types of broker with the
+	// origin's alias or name, eg "[slack] |alice| hi"
+	OriginPrefix bool `yaml:"origin-prefix"`
+	// irc, mastodon: show slack users' status emoji (or text) after their
+	// name, eg "|alice [🌴]| hi".  off by default
+	ShowStatus bool `yaml:"show-status"`
+	// irc, slack, mastodon: show when messages were sent, in this go time
+	// layout (eg 15:04) and IANA zone (blank for local), before them or
+	// after them per timestamp-position (prefix or suffix)
+	TimestampLayout   string `yaml:"timestamp-layout"`
+	TimestampZone     string `yaml:"timestamp-zone"`
+	TimestampPosition string `yaml:"timestamp-position"`
+	// events waiting on this broker (default 100) and what happens when
+	// that many are: drop-oldest (default) or block
+	SendQueue    int    `yaml:"send-queue"`
+	SendOverflow string `yaml:"send-overflow"`
+	// goroutines sending to this broker (default 1), split by destination
+	// so each channel keeps its order
+	SendWorkers int `yaml:"send-workers"`
 }
 
+// bump when the config format changes and add a step to configMigrations
+const ConfigVersion = 1
+
 type Config struct {
+	// missing means a config from before versioning, treated as version 0
+	Version       int                      `yaml:"version"`
 	ActiveBrokers []string                 `yaml:"active-brokers"`
 	Brokers       map[string]*BrokerConfig `yaml:"brokers"`
+	// mirror text verbatim, with no pattern routing or helper commands
+	RelayOnly bool `yaml:"relay-only"`
+	// who may ..mute, ..unmute and ..thread as <broker>:<id>, nobody when unset
+	MuteActors []string `yaml:"mute-actors"`
+	// secrets to scrub from every event before it's bridged
+	Redact *RedactConfig `yaml:"redact"`
+	// how often each actor may broadcast, unset doesn't limit them
+	RateLimit *RateLimitConfig `yaml:"rate-limit"`
+	// strip or replace control, bidi and invisible characters from every
+	// event, unset leaves them
+	NormalizeText string `yaml:"normalize-text"`
+	// spread each round of broker heartbeats over this long, eg 30s
+	HeartbeatSplay string `yaml:"heartbeat-splay"`
+	// log one summary across all brokers this often, eg 10m
+	MetricsSummary string `yaml:"metrics-summary"`
+	// per broker heartbeats only log at debug level
+	QuietHeartbeats bool `yaml:"quiet-heartbeats"`
+	// sent with outbound http requests, blank uses smug-broker/<version>
+	UserAgent   string            `yaml:"user-agent"`
+	HttpHeaders map[string]string `yaml:"http-headers"`
+	// events a broker couldn't take are appended here as json lines
+	DeadLetterFile string `yaml:"dead-letter-file"`
+	// re-send what's in dead-letter-file once brokers are up
+	RedriveDeadLetters bool `yaml:"redrive-dead-letters"`
+	// merged into every pattern of every pattern broker
+	PatternDefaults *PatternDefaults `yaml:"pattern-defaults"`
+	// the same person's names across brokers, each keyed by broker type or
+	// config key, eg {irc: alice, slack: U123}
+	Identities []map[string]string `yaml:"identities"`
+}
+
+// what patterns share, typically auth headers.  a pattern's own method,
+// max-response and thinking win over these, and its own headers, vars and
+// types win key by key
+type PatternDefaults struct {
+	Method      string            `yaml:"method"`
+	Headers     map[string]string `yaml:"headers"`
+	Vars        map[string]string `yaml:"vars"`
+	Types       map[string]string `yaml:"types"`
+	MaxResponse int64             `yaml:"max-response"`
+	Thinking    string            `yaml:"thinking"`
+}
+
+// fills in what pc leaves unset.  a nil PatternDefaults does nothing
+func (pd *PatternDefaults) Apply(pc *PatternConfig) {
+	if pd == nil {
+		return
+	}
+	if pc.Method == "" {
+		pc.Method = pd.Method
+	}
+	if pc.MaxResponse == 0 {
+		pc.MaxResponse = pd.MaxResponse
+	}
+	if pc.Thinking == "" {
+		pc.Thinking = pd.Thinking
+	}
+	pc.Headers = mergeDefaults(pd.Headers, pc.Headers, http.CanonicalHeaderKey)
+	pc.Vars = mergeDefaults(pd.Vars, pc.Vars, nil)
+	pc.Types = mergeDefaults(pd.Types, pc.Types, nil)
+}
+
+// defaults overlaid with own, keys compared after canon when it's set
+func mergeDefaults(
+	defaults map[string]string, own map[string]string, canon func(string) string,
+) map[string]string {
+	if len(defaults) == 0 {
+		return own
+	}
+	if canon == nil {
+		canon = func(k string) string { return k }
+	}
+	merged := make(map[string]string)
+	seen := make(map[string]bool)
+	for k, v := range own {
+		merged[k] = v
+		seen[canon(k)] = true
+	}
+	for k, v := range defaults {
+		if !seen[canon(k)] {
+			merged[k] = v
+		}
+	}
+	return merged
 }
 
 // populates from any environment variables
@@ -60,22 +441,194 @@ func envOverrides(cfg *Config) {
 	}
 }
 
+// $$ for a literal $, ${VAR}, ${VAR:-default} and $VAR.  anything else with
+// a $, like a regex anchor or a $1 replacement group, isn't ours and is left
+// alone
+var re_envrefs = regexp.MustCompile(
+	`\$(?:(\$)|\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}|([A-Za-z_][A-Za-z0-9_]*))`)
+
+// expands environment variable references in a config value.  unset
+// variables in braces expand to "", or the default if given.  a bare $VAR
+// only expands when VAR is set, so a template $var or a $host replacement
+// group that happens to look like one is kept
+func expandEnv(val string) string {
+	return re_envrefs.ReplaceAllStringFunc(val, func(ref string) string {
+		m := re_envrefs.FindStringSubmatch(ref)
+		switch {
+		case m[1] != "":
+			return "$"
+		case m[5] != "":
+			if val, found := os.LookupEnv(m[5]); found {
+				return val
+			}
+			return ref
+		}
+		if val := os.Getenv(m[2]); val != "" || m[3] == "" {
+			return val
+		}
+		return m[4]
+	})
+}
+
+// expands environment variable references in every string value under v,
+// after parsing so they can't change the yaml around them
+func expandEnvValues(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(expandEnv(v.String()))
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandEnvValues(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				expandEnvValues(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			expandEnvValues(v.Index(i))
+		}
+	case reflect.Map:
+		// map values aren't addressable, expand a copy and put it back
+		for _, key := range v.MapKeys() {
+			val := reflect.New(v.Type().Elem()).Elem()
+			val.Set(v.MapIndex(key))
+			expandEnvValues(val)
+			v.SetMapIndex(key, val)
+		}
+	}
+}
+
+// configMigrations[n] upgrades a version n config to n+1
+var configMigrations = map[int]func(*Config) error{
+	// version 0 predates versioning and strict parsing but is otherwise the
+	// same as version 1
+	0: func(*Config) error { return nil },
+}
+
+// parses a yaml config, rejecting unknown keys, then expands environment
+// variables in its values.  configs older than ConfigVersion are migrated forward with a
+// warning
+func ParseConfig(data []byte) (*Config, error) {
+	log := NewLogger("ctx", "config")
+	var ver struct {
+		Version int `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(data, &ver); err != nil {
+		return nil, err
+	}
+	if ver.Version > ConfigVersion {
+		return nil, fmt.Errorf(
+			"config version %d is newer than this smug supports (%d)",
+			ver.Version, ConfigVersion)
+	}
+	if ver.Version < 0 {
+		return nil, fmt.Errorf("invalid config version %d", ver.Version)
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		if ver.Version > 0 {
+			return nil, err
+		}
+		// unversioned configs were never checked, don't break them now
+		log.Warnf("config has unknown or invalid keys, these will be "+
+			"errors once version: %d is set: %s", ConfigVersion, err)
+		cfg = &Config{}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Version < ConfigVersion {
+		log.Warnf("config is version %d, migrating to %d. set version: %d "+
+			"to silence this", cfg.Version, ConfigVersion, ConfigVersion)
+		for v := cfg.Version; v < ConfigVersion; v++ {
+			if err := configMigrations[v](cfg); err != nil {
+				return nil, fmt.Errorf("migrating config from %d: %s", v, err)
+			}
+		}
+		cfg.Version = ConfigVersion
+	}
+	expandEnvValues(reflect.ValueOf(cfg))
+	for key, bcfg := range cfg.Brokers {
+		if bcfg == nil {
+			return nil, fmt.Errorf("broker %s has no config", key)
+		}
+		bcfg.Key = key
+		for i := range bcfg.Patterns {
+			cfg.PatternDefaults.Apply(&bcfg.Patterns[i])
+		}
+	}
+	return cfg, nil
+}
+
+// whether cfg has anything to run: active brokers, each with a config, and
+// at least one that brings messages in.  a pattern router only answers what
+// other brokers hear, on its own it would sit there forever
+func (cfg *Config) Validate() error {
+	if len(cfg.Brokers) == 0 {
+		return fmt.Errorf("no brokers configured")
+	}
+	if len(cfg.ActiveBrokers) == 0 {
+		return fmt.Errorf("no active-brokers, nothing to run")
+	}
+	listening := false
+	for _, key := range cfg.ActiveBrokers {
+		bcfg, found := cfg.Brokers[key]
+		if !found {
+			return fmt.Errorf("missing broker config: %s", key)
+		}
+		if !commandBrokerTypes[bcfg.Type] {
+			listening = true
+		}
+		if err := bcfg.validateWindows(); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	if !listening {
+		return fmt.Errorf("active-brokers are only pattern routers, " +
+			"activate a broker for their patterns to answer")
+	}
+	return nil
+}
+
+// dedup and coalesce windows must be durations no shorter than zero, which
+// turns them off
+func (bcfg *BrokerConfig) validateWindows() error {
+	for name, val := range map[string]string{
+		"dedup":    bcfg.Dedup,
+		"coalesce": bcfg.Coalesce,
+	} {
+		if val == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(val); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %s", name, val)
+		}
+	}
+	return nil
+}
+
 func LoadConfig(configPath string) *Config {
 	var configStr []byte
 	var err error
-	cfg := Config{}
 	if strings.HasPrefix(configPath, "http") {
 		configStr, err = FetchUrl(configPath)
+	} else if IsKVConfig(configPath) {
+		configStr, err = fetchKV(configPath)
 	} else {
 		configStr, err = ioutil.ReadFile(configPath)
 	}
 	if err != nil {
 		panic(err)
 	}
-	err = yaml.Unmarshal(configStr, &cfg)
+	cfg, err := ParseConfig(configStr)
 	if err != nil {
 		panic(err)
 	}
-	envOverrides(&cfg)
-	return &cfg
+	envOverrides(cfg)
+	return cfg
 }
@@ -15,6 +15,7 @@ func TestLoadConfig(t *testing.T) {
 func TestEnvConfig(t *testing.T) {
 	const sv = "blerg"
 	os.Setenv("SMUG_TESTER_SERVER", sv)
+	defer os.Unsetenv("SMUG_TESTER_SERVER")
 	fixcfg := LoadConfig("test_fixtures/test.yaml")
 	if fixcfg.Brokers["tester"].Server != sv {
 		t.Errorf(
@@ -23,3 +24,270 @@ func TestEnvConfig(t *testing.T) {
 		)
 	}
 }
+
+func TestStrictConfig(t *testing.T) {
+	typo := []byte(`
+version: 1
+brokers:
+  tester:
+    type   : "irc"
+    chanel : "#chan"
+`)
+	if _, err := ParseConfig(typo); err == nil {
+		t.Errorf("err: expected a typo'd key to fail parsing")
+	}
+
+	// unversioned configs only warn, then migrate up
+	cfg, err := ParseConfig(typo[len("\nversion: 1"):])
+	if err != nil {
+		t.Fatalf("err: unversioned config should still load %s", err)
+	}
+	if cfg.Version != ConfigVersion || cfg.Brokers["tester"].Type != "irc" {
+		t.Errorf("err: have %+v", cfg)
+	}
+	if cfg.Brokers["tester"].Key != "tester" {
+		t.Errorf("err: broker configs should know their key")
+	}
+
+	if _, err := ParseConfig([]byte("version: 99\n")); err == nil {
+		t.Errorf("err: expected a newer version to fail")
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("SMUG_TEST_HOST", "api.example.com")
+	os.Setenv("SMUG_TEST_EMPTY", "")
+	defer os.Unsetenv("SMUG_TEST_HOST")
+	defer os.Unsetenv("SMUG_TEST_EMPTY")
+	testwants := map[string]string{
+		// braced
+		"http://${SMUG_TEST_HOST}/v1":   "http://api.example.com/v1",
+		"${SMUG_TEST_NOPE}":             "",
+		"${SMUG_TEST_EMPTY}":            "",
+		"${SMUG_TEST_NOPE:-localhost}":  "localhost",
+		"${SMUG_TEST_EMPTY:-localhost}": "localhost",
+		"${SMUG_TEST_HOST:-localhost}":  "api.example.com",
+		"${SMUG_TEST_NOPE:-}":           "",
+		// bare, only when set
+		"http://$SMUG_TEST_HOST/v1": "http://api.example.com/v1",
+		"$SMUG_TEST_HOST.":          "api.example.com.",
+		"[$SMUG_TEST_EMPTY]":        "[]",
+		"$SMUG_TEST_NOPE":           "$SMUG_TEST_NOPE",
+		// escaped
+		"costs $$5":          "costs $5",
+		"$$SMUG_TEST_HOST":   "$SMUG_TEST_HOST",
+		"$${SMUG_TEST_HOST}": "${SMUG_TEST_HOST}",
+		"$$$SMUG_TEST_HOST":  "$api.example.com",
+		"token: $$/${SMUG":   "token: $/${SMUG",
+		// not ours
+		`^\.weather (\w+)$`:          `^\.weather (\w+)$`,
+		"replace: https://$1 ${1}":   "replace: https://$1 ${1}",
+		"$ alone, $ 5, $-":           "$ alone, $ 5, $-",
+		"{{ $n := .Actor }}{{ $n }}": "{{ $n := .Actor }}{{ $n }}",
+	}
+	for in, want := range testwants {
+		if have := expandEnv(in); have != want {
+			t.Errorf("err: have [%s] wanted [%s]", have, want)
+		}
+	}
+
+	cfg, err := ParseConfig([]byte(`
+version: 1
+brokers:
+  pat:
+    type: pattern
+    patterns:
+      - regex: "^hi$"
+        url: "https://${SMUG_TEST_HOST}/hi"
+        headers:
+          Host: "${SMUG_TEST_HOST}"
+        payload: '{"who": "{{ $a := .Actor }}{{ $a }}"}'
+      - regex: "^${SMUG_TEST_NOPE:-ho}: \\S+ # $comment"
+`))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p := cfg.Brokers["pat"].Patterns[0]; p.Url != "https://api.example.com/hi" || p.RegEx != "^hi$" {
+		t.Errorf("err: have %+v", p)
+	}
+	if p := cfg.Brokers["pat"].Patterns[0]; p.Headers["Host"] != "api.example.com" ||
+		p.Payload != `{"who": "{{ $a := .Actor }}{{ $a }}"}` {
+		t.Errorf("err: have %+v", p)
+	}
+	if p := cfg.Brokers["pat"].Patterns[1]; p.RegEx != `^ho: \S+ # $comment` {
+		t.Errorf("err: have [%s]", p.RegEx)
+	}
+}
+
+func TestPatternUrlList(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+version: 1
+brokers:
+  pat:
+    type: pattern
+    patterns:
+      - regex: "^..deploy"
+        url:
+          - "https://ci.example.com/deploy"
+          - "https://audit.example.com/log"
+        method: POST
+      - regex: "^hi$"
+        url: "https://api.example.com/hi"
+`))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	pats := cfg.Brokers["pat"].Patterns
+	if pats[0].Url != "https://ci.example.com/deploy" || len(pats[0].FanOut) != 1 ||
+		pats[0].FanOut[0] != "https://audit.example.com/log" || pats[0].Method != "POST" {
+		t.Errorf("err: have %+v", pats[0])
+	}
+	if pats[1].Url != "https://api.example.com/hi" || len(pats[1].FanOut) != 0 {
+		t.Errorf("err: have %+v", pats[1])
+	}
+	if _, err := ParseConfig([]byte(`
+version: 1
+brokers:
+  pat:
+    type: pattern
+    patterns:
+      - regex: "^hi$"
+        url: {host: example.com}
+`)); err == nil {
+		t.Errorf("err: a url that's neither a string nor a list should fail")
+	}
+}
+
+func TestPatternDefaults(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+version: 1
+pattern-defaults:
+  method: POST
+  headers:
+    Authorization: "Bearer shared"
+    X-Team: "ops"
+  vars:
+    units: metric
+  max-response: 2048
+brokers:
+  pat:
+    type: pattern
+    patterns:
+      - regex: "^..weather"
+        url: "https://api.example.com/weather"
+      - regex: "^..deploy"
+        url: "https://ci.example.com/deploy"
+        method: GET
+        headers:
+          authorization: "Bearer ci"
+        vars:
+          units: imperial
+          env: prod
+        max-response: 512
+`))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	pats := cfg.Brokers["pat"].Patterns
+	weather, deploy := pats[0], pats[1]
+	if weather.Method != "POST" || weather.MaxResponse != 2048 ||
+		weather.Headers["Authorization"] != "Bearer shared" ||
+		weather.Headers["X-Team"] != "ops" || weather.Vars["units"] != "metric" {
+		t.Errorf("err: defaults not merged %+v", weather)
+	}
+	if deploy.Method != "GET" || deploy.MaxResponse != 512 {
+		t.Errorf("err: the pattern's own settings should win %+v", deploy)
+	}
+	if len(deploy.Headers) != 2 || deploy.Headers["authorization"] != "Bearer ci" ||
+		deploy.Headers["X-Team"] != "ops" {
+		t.Errorf("err: headers should merge case insensitively %v", deploy.Headers)
+	}
+	if deploy.Vars["units"] != "imperial" || deploy.Vars["env"] != "prod" {
+		t.Errorf("err: vars should merge key by key %v", deploy.Vars)
+	}
+
+	// patterns share map defaults, one pattern's merge can't leak to another
+	weather.Headers["X-Team"] = "changed"
+	if cfg.PatternDefaults.Headers["X-Team"] != "ops" || deploy.Headers["X-Team"] != "ops" {
+		t.Errorf("err: merged maps should be copies")
+	}
+	var nilpd *PatternDefaults
+	pc := &PatternConfig{Method: "GET"}
+	nilpd.Apply(pc)
+	if pc.Method != "GET" || pc.Headers != nil {
+		t.Errorf("err: nil defaults should change nothing %+v", pc)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	for name, cfgyaml := range map[string]string{
+		"nil brokers": `
+version: 1
+active-brokers: [slack]
+`,
+		"empty active list": `
+version: 1
+active-brokers: []
+brokers:
+  slack:
+    type: slack
+`,
+		"missing broker config": `
+version: 1
+active-brokers: [slack, irc]
+brokers:
+  slack:
+    type: slack
+`,
+		"pattern router only": `
+version: 1
+active-brokers: [pat]
+brokers:
+  pat:
+    type: pattern
+`,
+		"negative coalesce": `
+version: 1
+active-brokers: [slack]
+brokers:
+  slack:
+    type: slack
+    coalesce: -1s
+`,
+		"unparsable dedup": `
+version: 1
+active-brokers: [slack]
+brokers:
+  slack:
+    type: slack
+    dedup: soon
+`,
+	} {
+		cfg, err := ParseConfig([]byte(cfgyaml))
+		if err != nil {
+			t.Fatalf("err: %s: %s", name, err)
+		}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("err: %s should fail validation", name)
+		}
+		if brokers, err := NewBrokersFromConfig(cfg); err == nil || len(brokers) != 0 {
+			t.Errorf("err: %s shouldn't build any brokers", name)
+		}
+	}
+
+	cfg, err := ParseConfig([]byte(`
+version: 1
+active-brokers: [pat, cron]
+brokers:
+  pat:
+    type: pattern
+  cron:
+    type: cron
+`))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("err: patterns with something to answer are fine: %s", err)
+	}
+}
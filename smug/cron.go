@@ -0,0 +1,356 @@
+// broker: cron
+// posts messages on a schedule without needing something external to poke us.
+// consumes nothing inbound, only produces events when an entry comes due.
+// schedules use the standard 5 field cron format:
+//   minute hour day-of-month month day-of-week
+// each field accepts *, n, a-b, */n, a-b/n and comma separated lists of those.
+
+package smug
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBroker("cron", func() Broker { return &CronBroker{} })
+}
+
+// how often we check for due entries
+const cronTick = 5 * time.Second
+
+/* ************************** *
+ * cron schedule parsing
+ * ************************** */
+
+type cronField map[int]bool
+
+type CronSchedule struct {
+	minute cronField
+	hour   cronField
+	dom    cronField
+	month  cronField
+	dow    cronField
+	// when both dom and dow are restricted cron matches on either
+	domStar bool
+	dowStar bool
+}
+
+func parseCronField(s string, min int, max int) (cronField, error) {
+	fld := make(cronField)
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step in %s", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s", part)
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %s", part)
+				}
+			} else if step > 1 {
+				// n/step means starting at n through the max
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%s out of range %d-%d", part, min, max)
+		}
+		for i := lo; i <= hi; i += step {
+			fld[i] = true
+		}
+	}
+	return fld, nil
+}
+
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron schedule needs 5 fields: %s", spec)
+	}
+	cs := &CronSchedule{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	var err error
+	if cs.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cs.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cs.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cs.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	// allow 7 as sunday like most crons do
+	if cs.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if cs.dow[7] {
+		cs.dow[0] = true
+	}
+	return cs, nil
+}
+
+func (cs *CronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := cs.dom[t.Day()], cs.dow[int(t.Weekday())]
+	if cs.domStar || cs.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// returns the first time strictly after t matching the schedule, evaluated in
+// t's location.  zero time if nothing matches within a few years.  times are
+// rounded with time.Date rather than Truncate, which rounds in utc and is off
+// in zones like india's that aren't a whole number of hours from it
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0,
+		t.Location()).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !cs.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+/* ************************** *
+ * entries
+ * ************************** */
+
+type CronEntry struct {
+	sched  *CronSchedule // nil for one-shot entries
+	loc    *time.Location
+	next   time.Time
+	text   string
+	target string
+	thread string
+	bcast  bool
+}
+
+// build an entry from either a cron schedule or a one-shot at time. at
+// accepts RFC3339 or "2006-01-02 15:04" in the given timezone
+func NewCronEntry(
+	schedule string,
+	at string,
+	timezone string,
+	text string,
+	target string,
+) (*CronEntry, error) {
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone %s: %s", timezone, err)
+		}
+	}
+	ce := &CronEntry{loc: loc, text: text, target: target}
+	switch {
+	case schedule != "" && at != "":
+		return nil, fmt.Errorf("cron entry must have schedule or at, not both")
+	case schedule != "":
+		sched, err := ParseCronSchedule(schedule)
+		if err != nil {
+			return nil, err
+		}
+		ce.sched = sched
+	case at != "":
+		when, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			when, err = time.ParseInLocation("2006-01-02 15:04", at, loc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid at time %s", at)
+		}
+		ce.next = when
+	default:
+		return nil, fmt.Errorf("cron entry needs a schedule or at time")
+	}
+	return ce, nil
+}
+
+// post into a thread of the target broker, optionally also to the channel
+func (ce *CronEntry) InThread(thread string, broadcast bool) error {
+	if thread != "" && ce.target == "" {
+		return fmt.Errorf("cron entry thread needs a target")
+	}
+	ce.thread = thread
+	ce.bcast = broadcast
+	return nil
+}
+
+// schedule our next run after now.  false if the entry will never run again
+func (ce *CronEntry) advance(now time.Time) bool {
+	if ce.sched == nil {
+		// one-shot, only valid until it has fired
+		return ce.next.After(now)
+	}
+	ce.next = ce.sched.Next(now.In(ce.loc))
+	return !ce.next.IsZero()
+}
+
+/* ************************** *
+ * cron broker
+ * ************************** */
+
+type CronBroker struct {
+	log     *Logger
+	nick    string
+	mux     sync.Mutex
+	entries []*CronEntry
+	now     func() time.Time
+	done    chan bool
+	stop    sync.Once
+	metrics Metrics
+}
+
+func (cb *CronBroker) Name() string {
+	return "cron"
+}
+
+func (cb *CronBroker) logger() *Logger { return cb.log }
+
+func (cb *CronBroker) Heartbeat() bool {
+	cb.mux.Lock()
+	m := cb.metrics
+	cb.metrics = Metrics{}
+	cb.mux.Unlock()
+	cb.log.logMetrics(m)
+	return true
+}
+
+// args [nick]
+func (cb *CronBroker) Setup(args ...string) error {
+	cb.log = NewLogger("broker", DisplayName(cb))
+	cb.nick = "smug"
+	if len(args) > 0 && args[0] != "" {
+		cb.nick = args[0]
+	}
+	cb.now = time.Now
+	cb.done = make(chan bool)
+	return nil
+}
+
+func (cb *CronBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	if err := cb.Setup(cfg.Nick); err != nil {
+		return err
+	}
+	for _, s := range cfg.Schedules {
+		ce, err := NewCronEntry(s.Schedule, s.At, s.Timezone, s.Text, s.Target)
+		if err != nil {
+			return fmt.Errorf("cron broker schedule: %s", err)
+		}
+		if err := ce.InThread(s.Thread, s.ReplyBroadcast); err != nil {
+			return fmt.Errorf("cron broker schedule: %s", err)
+		}
+		cb.AddEntry(ce)
+	}
+	return nil
+}
+
+func (cb *CronBroker) AddEntry(ce *CronEntry) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	if !ce.advance(cb.now()) {
+		cb.log.Warnf("cron entry will never run: %s", ce.text)
+		return
+	}
+	cb.entries = append(cb.entries, ce)
+}
+
+// we don't consume anything
+func (cb *CronBroker) HandleEvent(ev *Event, dis Dispatcher) {}
+
+// fire anything due and drop one-shots that are spent
+func (cb *CronBroker) tick(dis Dispatcher) {
+	now := cb.now()
+	due := []*CronEntry{}
+	cb.mux.Lock()
+	live := cb.entries[:0]
+	for _, ce := range cb.entries {
+		if !ce.next.After(now) {
+			due = append(due, ce)
+			if ce.sched == nil || !ce.advance(now) {
+				continue
+			}
+		}
+		live = append(live, ce)
+	}
+	cb.entries = live
+	for _, ce := range due {
+		cb.metrics.sent(&Event{Text: ce.text})
+	}
+	cb.mux.Unlock()
+
+	for _, ce := range due {
+		ev := &Event{
+			Origin: cb,
+			Actor:  cb.nick,
+			Text:   ce.text,
+			ts:     now,
+		}
+		if ce.target != "" {
+			if ev.ReplyBroker = dis.FindBroker(ce.target); ev.ReplyBroker == nil {
+				cb.log.Warnf("cron target broker not found: %s", ce.target)
+				continue
+			}
+			if ce.thread != "" {
+				ev.ThreadId = ce.thread
+				ev.ThreadBroker = ev.ReplyBroker
+				ev.ReplyBroadcast = ce.bcast
+			}
+		}
+		dis.Broadcast(ev)
+	}
+}
+
+func (cb *CronBroker) Activate(dis Dispatcher) {
+	ticker := time.NewTicker(cronTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cb.tick(dis)
+		case <-cb.done:
+			return
+		}
+	}
+}
+
+func (cb *CronBroker) Deactivate() {
+	cb.stop.Do(func() { close(cb.done) })
+}
@@ -0,0 +1,134 @@
+package smug
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	utc := time.UTC
+	start := time.Date(2020, 3, 4, 8, 30, 0, 0, utc) // a wednesday
+	testwants := map[string]time.Time{
+		"* * * * *":    time.Date(2020, 3, 4, 8, 31, 0, 0, utc),
+		"0 9 * * 1":    time.Date(2020, 3, 9, 9, 0, 0, 0, utc),
+		"*/15 * * * *": time.Date(2020, 3, 4, 8, 45, 0, 0, utc),
+		"0 0 1 * *":    time.Date(2020, 4, 1, 0, 0, 0, 0, utc),
+		"30 8 * * 3":   time.Date(2020, 3, 11, 8, 30, 0, 0, utc),
+		"0 12 * 6 0,7": time.Date(2020, 6, 7, 12, 0, 0, 0, utc),
+	}
+	for spec, want := range testwants {
+		cs, err := ParseCronSchedule(spec)
+		if err != nil {
+			t.Errorf("err: parsing %s: %s", spec, err)
+			continue
+		}
+		if have := cs.Next(start); !have.Equal(want) {
+			t.Errorf("err: %s have [%s] wanted [%s]", spec, have, want)
+		}
+	}
+	for _, bad := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCronSchedule(bad); err == nil {
+			t.Errorf("err: expected %s to fail parsing", bad)
+		}
+	}
+}
+
+func TestCronBrokerFires(t *testing.T) {
+	now := time.Date(2020, 3, 9, 8, 59, 0, 0, time.UTC)
+	cb := &CronBroker{}
+	cb.Setup("bot")
+	cb.now = func() time.Time { return now }
+
+	weekly, _ := NewCronEntry("0 9 * * 1", "", "UTC", "standup!", "")
+	cb.AddEntry(weekly)
+	once, _ := NewCronEntry("", "2020-03-09 09:30", "UTC", "lunch", "")
+	cb.AddEntry(once)
+
+	td := &TestDispatch{}
+	cb.tick(td)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: nothing should fire before 9am")
+	}
+
+	now = now.Add(time.Minute)
+	cb.tick(td)
+	if td.lastbroadcast == nil || td.lastbroadcast.Text != "standup!" {
+		t.Errorf("err: expected standup at 9am")
+		return
+	}
+	if td.lastbroadcast.Actor != "bot" || td.lastbroadcast.Origin != cb {
+		t.Errorf("err: cron event has wrong actor or origin")
+	}
+
+	td.lastbroadcast = nil
+	now = now.Add(30 * time.Minute)
+	cb.tick(td)
+	if td.lastbroadcast == nil || td.lastbroadcast.Text != "lunch" {
+		t.Errorf("err: expected one-shot lunch at 9:30")
+	}
+	if len(cb.entries) != 1 {
+		t.Errorf("err: one-shot entry should be dropped after firing")
+	}
+
+	td.lastbroadcast = nil
+	now = now.Add(24 * time.Hour)
+	cb.tick(td)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: nothing should fire the next day")
+	}
+}
+
+func TestCronTimezone(t *testing.T) {
+	ce, err := NewCronEntry("0 9 * * *", "", "America/New_York", "hi", "")
+	if err != nil {
+		t.Skipf("no tz data available: %s", err)
+	}
+	ce.advance(time.Date(2020, 3, 4, 0, 0, 0, 0, time.UTC))
+	want := time.Date(2020, 3, 4, 14, 0, 0, 0, time.UTC)
+	if !ce.next.Equal(want) {
+		t.Errorf("err: have [%s] wanted [%s]", ce.next.UTC(), want)
+	}
+}
+
+func TestCronHalfHourZone(t *testing.T) {
+	for _, tz := range []string{"Asia/Kolkata", "Australia/Adelaide", "Asia/Kathmandu"} {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			t.Skipf("no tz data available: %s", err)
+		}
+		cs, _ := ParseCronSchedule("0 9 * * *")
+		start := time.Date(2020, 3, 4, 7, 10, 0, 0, loc)
+		want := time.Date(2020, 3, 4, 9, 0, 0, 0, loc)
+		if have := cs.Next(start); !have.Equal(want) {
+			t.Errorf("err: %s have [%s] wanted [%s]", tz, have, want)
+		}
+	}
+}
+
+func TestCronThreadNeedsTarget(t *testing.T) {
+	ce, _ := NewCronEntry("0 9 * * *", "", "UTC", "hi", "")
+	if err := ce.InThread("100.1", true); err == nil {
+		t.Errorf("err: expected a thread without target to error")
+	}
+	ce, _ = NewCronEntry("0 9 * * *", "", "UTC", "hi", "slack-general")
+	if err := ce.InThread("100.1", true); err != nil || ce.thread != "100.1" {
+		t.Errorf("err: thread not set %s", err)
+	}
+}
+
+func TestCronDeactivateTwice(t *testing.T) {
+	cb := &CronBroker{}
+	cb.Setup("bot")
+	stopped := make(chan bool)
+	go func() {
+		cb.Activate(&TestDispatch{})
+		stopped <- true
+	}()
+	cb.Deactivate()
+	cb.Deactivate()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Errorf("err: activate never returned")
+	}
+}
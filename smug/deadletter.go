@@ -0,0 +1,203 @@
+// dead letters
+// events a broker couldn't take, because its send queue overflowed or
+// handling them panicked, are handed to a DeadLetterSink with where
+// they were headed and why instead of vanishing.  DeadLetterFile keeps them
+// as json lines so they can be re-driven later.
+
+package smug
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+type DeadLetterSink interface {
+	// target is the broker's config key, or its Name() without one
+	DeadLetter(target string, ev *Event, reason string)
+}
+
+// the config key or Name() FindBroker can get b back from
+func deadLetterTarget(b Broker) string {
+	if key := BrokerKey(b); key != "" {
+		return key
+	}
+	return b.Name()
+}
+
+// the parts of an event worth keeping, origins and callbacks don't survive
+// a restart.  brokers an event was replying or threaded to are kept by
+// config key or name
+type deadLetter struct {
+	Time   int64  `json:"time"`
+	Target string `json:"target"`
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+	Text   string `json:"text"`
+	Avatar string `json:"avatar,omitempty"`
+	Action bool   `json:"action,omitempty"`
+	// where the answer was going, so a dm isn't re-driven into a channel
+	Private     bool   `json:"private,omitempty"`
+	ReplyBroker string `json:"reply_broker,omitempty"`
+	ReplyTarget string `json:"reply_target,omitempty"`
+	// so command output isn't taken for a command when it's re-driven
+	CmdOutput     bool   `json:"cmd_output,omitempty"`
+	ThreadId      string `json:"thread_id,omitempty"`
+	ThreadBroker  string `json:"thread_broker,omitempty"`
+	Channel       string `json:"channel,omitempty"`
+	ChannelBroker string `json:"channel_broker,omitempty"`
+}
+
+func newDeadLetter(target string, ev *Event, reason string) *deadLetter {
+	dl := &deadLetter{
+		Time:        time.Now().Unix(),
+		Target:      target,
+		Reason:      reason,
+		Actor:       ev.Actor,
+		Text:        ev.Text,
+		Avatar:      ev.Avatar,
+		Action:      ev.IsAction,
+		Private:     ev.Private,
+		ReplyTarget: ev.ReplyTarget,
+		CmdOutput:   ev.IsCmdOutput,
+		ThreadId:    ev.ThreadId,
+		Channel:     ev.Channel,
+	}
+	if ev.ReplyBroker != nil {
+		dl.ReplyBroker = deadLetterTarget(ev.ReplyBroker)
+	}
+	if ev.ThreadBroker != nil {
+		dl.ThreadBroker = deadLetterTarget(ev.ThreadBroker)
+	}
+	if ev.ChannelBroker != nil {
+		dl.ChannelBroker = deadLetterTarget(ev.ChannelBroker)
+	}
+	return dl
+}
+
+// the event dl was, nil if a broker it was replying, threaded or in a channel
+// on is gone.
+// the reply and thread can't be left off, a dm would end up in a channel
+func (dl *deadLetter) event(dis Dispatcher) *Event {
+	ev := &Event{
+		Actor:       dl.Actor,
+		Text:        dl.Text,
+		Avatar:      dl.Avatar,
+		IsAction:    dl.Action,
+		Private:     dl.Private,
+		ReplyTarget: dl.ReplyTarget,
+		IsCmdOutput: dl.CmdOutput,
+		ThreadId:    dl.ThreadId,
+		Channel:     dl.Channel,
+	}
+	if dl.ReplyBroker != "" {
+		if ev.ReplyBroker = dis.FindBroker(dl.ReplyBroker); ev.ReplyBroker == nil {
+			return nil
+		}
+	}
+	if dl.ThreadBroker != "" {
+		if ev.ThreadBroker = dis.FindBroker(dl.ThreadBroker); ev.ThreadBroker == nil {
+			return nil
+		}
+	}
+	if dl.ChannelBroker != "" {
+		if ev.ChannelBroker = dis.FindBroker(dl.ChannelBroker); ev.ChannelBroker == nil {
+			return nil
+		}
+	}
+	if ev.Private && ev.ReplyBroker == nil {
+		return nil
+	}
+	return ev
+}
+
+// appends dead letters to a file, one json object per line
+type DeadLetterFile struct {
+	path string
+	log  *Logger
+	mux  sync.Mutex
+}
+
+func NewDeadLetterFile(path string) *DeadLetterFile {
+	return &DeadLetterFile{path: path, log: NewLogger("ctx", "dead-letter")}
+}
+
+func (df *DeadLetterFile) DeadLetter(target string, ev *Event, reason string) {
+	df.write(newDeadLetter(target, ev, reason))
+}
+
+func (df *DeadLetterFile) write(dl *deadLetter) {
+	line, _ := json.Marshal(dl)
+	df.mux.Lock()
+	defer df.mux.Unlock()
+	fh, err := os.OpenFile(df.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		df.log.Warnf("ERR dead-lettering to %s for %s: %s [%s]",
+			df.path, dl.Target, err, dl.Reason)
+		return
+	}
+	defer fh.Close()
+	if _, err := fh.Write(append(line, '\n')); err != nil {
+		df.log.Warnf("ERR dead-lettering to %s for %s: %s", df.path, dl.Target, err)
+	}
+}
+
+// sends everything in the file to its target again and empties it.  letters
+// whose target, or the broker they were replying to, is gone are kept,
+// anything failing again is dead-lettered afresh.  returns how many were
+// re-sent
+func (df *DeadLetterFile) Redrive(dis Dispatcher) (int, error) {
+	df.mux.Lock()
+	letters, err := df.take()
+	df.mux.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, dl := range letters {
+		if dis.FindBroker(dl.Target) == nil {
+			df.log.Warnf("ERR no broker %s to re-drive to, keeping", dl.Target)
+			df.write(dl)
+			continue
+		}
+		ev := dl.event(dis)
+		if ev == nil {
+			df.log.Warnf("ERR can't re-drive a reply to %s on %s, keeping",
+				dl.ReplyBroker, dl.Target)
+			df.write(dl)
+			continue
+		}
+		dis.BroadcastTo(ev, dl.Target)
+		sent++
+	}
+	return sent, nil
+}
+
+// reads and removes the file, must hold mux
+func (df *DeadLetterFile) take() ([]*deadLetter, error) {
+	fh, err := os.Open(df.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	letters := []*deadLetter{}
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), int(DefaultMaxBodySize))
+	for scanner.Scan() {
+		dl := &deadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), dl); err != nil {
+			df.log.Warnf("ERR skipping unreadable dead letter: %s", err)
+			continue
+		}
+		letters = append(letters, dl)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return letters, os.Remove(df.path)
+}
@@ -5,48 +5,843 @@ package smug
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
 	"sync"
+	"time"
 )
 
+// how often main asks the dispatcher for a round of heartbeats
+const DefaultHeartbeat = 2 * time.Minute
+
+// events waiting on a broker before the oldest are dropped
+const DefaultSendQueue = 100
+
+// how many times a broker gets to handle an event it panics on before it's
+// dead-lettered, and the wait before the first retry, doubling after each
+const (
+	deliveryAttempts = 3
+	deliveryBackoff  = 100 * time.Millisecond
+)
+
+// SendQueue hands events to one broker, in order, from its own goroutine so
+// a slow destination never holds up a broadcast
+type SendQueue struct {
+	log     *Logger
+	events  chan queuedEvent
+	block   bool
+	mux     sync.Mutex
+	dropped int64
+	// gets events that are dropped or can't be delivered
+	dead func(ev *Event, reason string)
+	// goroutines handing events to the broker, see Workers, and the queue
+	// each takes from in place of events.  set by start
+	workers int
+	shards  []chan queuedEvent
+	broker  Broker
+	// one per event waiting in a shard, so together they hold no more than
+	// the queue's size
+	slots chan struct{}
+	// how long events take from Push until the broker's handled them, for
+	// the events it sends
+	latency *LatencyEMA
+	now     func() time.Time
+	// closed by Close, letting go of pushes waiting for room.  closeMux
+	// keeps Close from closing events under a push
+	done     chan struct{}
+	closeMux sync.RWMutex
+	closed   bool
+}
+
+// an event waiting in a SendQueue, and when it was pushed
+type queuedEvent struct {
+	ev     *Event
+	pushed time.Time
+}
+
+// overflow is "drop-oldest" (the default) or "block" and decides what
+// happens when size events are already waiting.  block holds up the
+// broadcast, and whoever sent it, until there's room
+func NewSendQueue(size int, overflow string) (*SendQueue, error) {
+	if size <= 0 {
+		size = DefaultSendQueue
+	}
+	sq := &SendQueue{
+		events:  make(chan queuedEvent, size),
+		latency: NewLatencyEMA(DefaultLatencyWeight),
+		now:     time.Now,
+		done:    make(chan struct{}),
+	}
+	switch overflow {
+	case "", "drop-oldest":
+	case "block":
+		sq.block = true
+	default:
+		return nil, fmt.Errorf("send overflow must be either drop-oldest or block")
+	}
+	return sq, nil
+}
+
+// hands events to the broker from n goroutines rather than one, for brokers
+// that can send to several places at once.  events are split between them
+// by conversation, so replies to one dm or target, and what's relayed from
+// one channel or thread, still arrive in order.  the queue's size is shared
+// by all of them.  when it's full drop-oldest drops from the new event's own
+// conversation, or the longest backlog if it has none waiting, and block
+// holds up the push until any worker has taken an event.
+// the broker's HandleEvent must be safe to call concurrently.  call before
+// the queue's broker is added
+func (sq *SendQueue) Workers(n int) {
+	sq.workers = n
+}
+
+// starts handing what's queued to b.  called once, before anything's pushed
+func (sq *SendQueue) start(b Broker, dis Dispatcher) {
+	sq.broker = b
+	if sq.workers <= 1 {
+		go sq.drain(sq.events, b, dis)
+		return
+	}
+	sq.slots = make(chan struct{}, cap(sq.events))
+	sq.shards = make([]chan queuedEvent, sq.workers)
+	for i := range sq.shards {
+		// never fills, slots runs out first
+		sq.shards[i] = make(chan queuedEvent, cap(sq.events))
+		go sq.drain(sq.shards[i], b, dis)
+	}
+}
+
+// where ev waits for its worker
+func (sq *SendQueue) queueFor(ev *Event) chan queuedEvent {
+	if sq.shards == nil {
+		return sq.events
+	}
+	return sq.shards[sendShard(sq.broker, ev, len(sq.shards))]
+}
+
+// which of n workers sends ev to b.  replies go by where on b they're
+// headed, everything else by where it was said, so each conversation keeps
+// its order
+func sendShard(b Broker, ev *Event, n int) int {
+	conv := ""
+	if ev.ReplyBroker == b && ev.ReplyTarget != "" {
+		conv = ev.ReplyTarget
+	} else if ev.Origin != nil {
+		conv = strings.Join([]string{
+			deadLetterTarget(ev.Origin), ev.Channel, ev.ThreadId}, "\x00")
+	}
+	h := fnv.New32a()
+	h.Write([]byte(conv))
+	return int(h.Sum32() % uint32(n))
+}
+
+// delivers events to b until closed.  an event b keeps panicking on is
+// dead-lettered after deliveryAttempts rather than taking the dispatcher down
+func (sq *SendQueue) drain(events chan queuedEvent, b Broker, dis Dispatcher) {
+	for qe := range events {
+		if sq.slots != nil {
+			<-sq.slots
+		}
+		if err := sq.deliverWithRetries(b, qe.ev, dis); err != nil {
+			sq.deadLetter(qe.ev, err.Error())
+		} else if qe.ev.ReplyBroker == nil || qe.ev.ReplyBroker == b {
+			// replies to another broker are dropped by b, timing those
+			// would only pull the average down
+			sq.latency.Observe(sq.now().Sub(qe.pushed))
+		}
+	}
+}
+
+// tries ev on b until it's handled or deliveryAttempts are up, backing off
+// between tries.  closing the queue stops the retries
+func (sq *SendQueue) deliverWithRetries(b Broker, ev *Event, dis Dispatcher) error {
+	wait := deliveryBackoff
+	for i := 1; ; i++ {
+		err := sq.deliver(b, ev, dis)
+		if err == nil {
+			return nil
+		}
+		sq.log.Warnf("ERR delivering, attempt %d of %d: %s", i, deliveryAttempts, err)
+		if i >= deliveryAttempts {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-sq.done:
+			return err
+		}
+		wait *= 2
+	}
+}
+
+func (sq *SendQueue) deliver(b Broker, ev *Event, dis Dispatcher) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic handling event: %v", r)
+		}
+	}()
+	b.HandleEvent(ev, dis)
+	return nil
+}
+
+func (sq *SendQueue) deadLetter(ev *Event, reason string) {
+	if sq.dead != nil {
+		sq.dead(ev, reason)
+	}
+}
+
+// queues ev, making room by dropping the oldest waiting event if need be.
+// once the queue's closed ev is dropped.  answers dropped either way take
+// their placeholder with them
+func (sq *SendQueue) Push(ev *Event) {
+	qe := queuedEvent{ev: ev, pushed: sq.now()}
+	sq.closeMux.RLock()
+	defer sq.closeMux.RUnlock()
+	if sq.closed {
+		dropPlaceholder(ev)
+		return
+	}
+	events := sq.queueFor(ev)
+	if sq.shards != nil {
+		sq.offerShard(events, qe)
+		return
+	}
+	if sq.block {
+		select {
+		case events <- qe:
+		case <-sq.done:
+		}
+		return
+	}
+	sq.offer(events, qe)
+}
+
+// puts qe on events, dropping the oldest waiting there until there's room
+func (sq *SendQueue) offer(events chan queuedEvent, qe queuedEvent) {
+	for {
+		select {
+		case events <- qe:
+			return
+		default:
+		}
+		select {
+		case old := <-events:
+			sq.drop(old)
+		default:
+		}
+	}
+}
+
+// puts qe on shard once there's a slot for it, waiting for one or making
+// one as the overflow says
+func (sq *SendQueue) offerShard(shard chan queuedEvent, qe queuedEvent) {
+	if sq.block {
+		select {
+		case sq.slots <- struct{}{}:
+		case <-sq.done:
+			return
+		}
+	} else {
+		for !sq.takeSlot() {
+			sq.dropOldest(shard)
+		}
+	}
+	shard <- qe
+}
+
+func (sq *SendQueue) takeSlot() bool {
+	select {
+	case sq.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// drops the oldest event waiting on shard, or with none there the oldest on
+// the shard with the most, giving up its slot
+func (sq *SendQueue) dropOldest(shard chan queuedEvent) {
+	from := shard
+	if len(from) == 0 {
+		for _, s := range sq.shards {
+			if len(s) > len(from) {
+				from = s
+			}
+		}
+	}
+	select {
+	case old := <-from:
+		<-sq.slots
+		sq.drop(old)
+	default:
+		// a worker's taking one, its slot is about to free up
+	}
+}
+
+func (sq *SendQueue) drop(old queuedEvent) {
+	sq.mux.Lock()
+	sq.dropped++
+	sq.mux.Unlock()
+	dropPlaceholder(old.ev)
+	sq.deadLetter(old.ev, "send queue full")
+}
+
+// stops taking events, what's already queued is still delivered
+func (sq *SendQueue) Close() {
+	close(sq.done)
+	sq.closeMux.Lock()
+	defer sq.closeMux.Unlock()
+	sq.closed = true
+	if sq.shards == nil {
+		close(sq.events)
+	}
+	for _, shard := range sq.shards {
+		close(shard)
+	}
+}
+
+// events waiting on the broker
+func (sq *SendQueue) Depth() int {
+	depth := len(sq.events)
+	for _, shard := range sq.shards {
+		depth += len(shard)
+	}
+	return depth
+}
+
+// dropped since the last call
+func (sq *SendQueue) takeDropped() int64 {
+	sq.mux.Lock()
+	defer sq.mux.Unlock()
+	d := sq.dropped
+	sq.dropped = 0
+	return d
+}
+
 type CentralDispatch struct {
 	mux     sync.RWMutex
 	log     *Logger
 	brokers []Broker
+	splay   time.Duration
+	redact  *Redactor
+	// per origin broker, replacing redact
+	redactFrom map[Broker]*Redactor
+	// what each broker has yet to handle
+	queues map[Broker]*SendQueue
+	// runs f after d, lets tests see when heartbeats would happen
+	after func(d time.Duration, f func())
+	// where undeliverable events go, nil just logs them
+	deadLetters DeadLetterSink
+	// muted brokers, see Disable
+	disabled map[Broker]bool
+	// strips untrusted characters from every event, nil leaves them
+	normalize *TextNormalizer
+	// gathers heartbeats, talkers and failures, see Summarize
+	summary *MetricsSummary
+	// how often actors may broadcast, and per origin broker replacements
+	limit     *ActorLimiter
+	limitFrom map[Broker]*ActorLimiter
+	// the kinds of event each broker is sent, all of them for those without
+	kinds map[Broker]EventKinds
+	// run in order over what each broker brings in, see AddTransform
+	transforms map[Broker][]TransformFunc
 }
 
+// rewrites an inbound event before it's broadcast, returning nil drops it.
+// may change ev in place or return another event
+type TransformFunc func(*Event) *Event
+
 func NewCentralDispatch() *CentralDispatch {
 	return &CentralDispatch{log: NewLogger("ctx", "dispatch")}
 }
 
+// spreads each round of heartbeats over splay rather than beating every
+// broker at once.  each broker gets its own slice of splay and beats at a
+// random point within it.  keep splay under the heartbeat interval
+func (cd *CentralDispatch) HeartbeatSplay(splay time.Duration) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	cd.splay = splay
+}
+
+// scrubs every event with rd before it's published
+func (cd *CentralDispatch) Redact(rd *Redactor) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	cd.redact = rd
+}
+
+// cleans every event with tn before it's published
+func (cd *CentralDispatch) Normalize(tn *TextNormalizer) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	cd.normalize = tn
+}
+
+// scrubs events from b with rd instead of the global redactor, a nil rd
+// leaves b's events alone
+func (cd *CentralDispatch) RedactFrom(b Broker, rd *Redactor) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	if cd.redactFrom == nil {
+		cd.redactFrom = make(map[Broker]*Redactor)
+	}
+	cd.redactFrom[b] = rd
+}
+
+// limits how often each actor may broadcast with al, nil doesn't limit them
+func (cd *CentralDispatch) LimitActors(al *ActorLimiter) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	cd.limit = al
+	if al != nil {
+		al.Send(cd.publish)
+	}
+}
+
+// limits actors on b with al instead of the global limiter, a nil al leaves
+// b's actors unlimited
+func (cd *CentralDispatch) LimitActorsFrom(b Broker, al *ActorLimiter) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	if cd.limitFrom == nil {
+		cd.limitFrom = make(map[Broker]*ActorLimiter)
+	}
+	cd.limitFrom[b] = al
+	if al != nil {
+		al.Send(cd.publish)
+	}
+}
+
+// only sends b events of these kinds.  nil sends it messages and actions,
+// and the joins, parts and topics it opts in to, see accepts
+func (cd *CentralDispatch) AcceptKinds(b Broker, kinds EventKinds) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	if cd.kinds == nil {
+		cd.kinds = make(map[Broker]EventKinds)
+	}
+	cd.kinds[b] = kinds
+}
+
+// runs fn over every event from b before it's broadcast, after the
+// transforms added for b before it.  lets embedders translate, tag or filter
+// what a broker brings in without forking it
+func (cd *CentralDispatch) AddTransform(b Broker, fn TransformFunc) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	if cd.transforms == nil {
+		cd.transforms = make(map[Broker][]TransformFunc)
+	}
+	cd.transforms[b] = append(cd.transforms[b], fn)
+}
+
+// replaces b's transforms with fns, in order.  none removes them all
+func (cd *CentralDispatch) SetTransforms(b Broker, fns ...TransformFunc) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	if len(fns) == 0 {
+		delete(cd.transforms, b)
+		return
+	}
+	if cd.transforms == nil {
+		cd.transforms = make(map[Broker][]TransformFunc)
+	}
+	cd.transforms[b] = append([]TransformFunc(nil), fns...)
+}
+
+// ev after the transforms for its origin, nil if one dropped it.  must not
+// hold mux, a transform may well broadcast
+func (cd *CentralDispatch) transform(ev *Event) *Event {
+	if ev.Origin == nil {
+		return ev
+	}
+	cd.mux.RLock()
+	chain := cd.transforms[ev.Origin]
+	cd.mux.RUnlock()
+	for _, fn := range chain {
+		if ev = fn(ev); ev == nil {
+			return nil
+		}
+	}
+	return ev
+}
+
+// collects the heartbeat metrics of each of our brokers, who broadcasts and
+// what fails into ms.  nil stops collecting
+func (cd *CentralDispatch) Summarize(ms *MetricsSummary) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	cd.summary = ms
+}
+
+// events a broker couldn't take go to sink, as well as the log
+func (cd *CentralDispatch) DeadLetters(sink DeadLetterSink) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	cd.deadLetters = sink
+}
+
+func (cd *CentralDispatch) deadLetter(b Broker, ev *Event, reason string) {
+	target := deadLetterTarget(b)
+	cd.mux.RLock()
+	sink := cd.deadLetters
+	cd.summary.failed(b)
+	cd.mux.RUnlock()
+	if cd.log != nil {
+		cd.log.Warnf("dead letter for %s from %s: %s", target, ev.Actor, reason)
+	}
+	if sink != nil {
+		sink.DeadLetter(target, ev, reason)
+	}
+}
+
+// sends to b go through a queue of size with this overflow, see
+// NewSendQueue.  brokers added without one get the defaults.  call before
+// AddBroker
+func (cd *CentralDispatch) QueueSends(b Broker, size int, overflow string) error {
+	sq, err := NewSendQueue(size, overflow)
+	if err != nil {
+		return err
+	}
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	for _, added := range cd.brokers {
+		if added == b {
+			return fmt.Errorf("broker already added: %s", DisplayName(b))
+		}
+	}
+	if cd.queues == nil {
+		cd.queues = make(map[Broker]*SendQueue)
+	}
+	cd.queues[b] = sq
+	return nil
+}
+
+// spreads sends to b over this many goroutines, see SendQueue.Workers.  only
+// for brokers that say they can take concurrent sends.  call before AddBroker
+func (cd *CentralDispatch) SendWorkers(b Broker, workers int) error {
+	if cb, ok := b.(ConcurrentBroker); workers > 1 && (!ok || !cb.ConcurrentSends()) {
+		return fmt.Errorf("%s can only send one event at a time", DisplayName(b))
+	}
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	for _, added := range cd.brokers {
+		if added == b {
+			return fmt.Errorf("broker already added: %s", DisplayName(b))
+		}
+	}
+	if cd.queues == nil {
+		cd.queues = make(map[Broker]*SendQueue)
+	}
+	sq, found := cd.queues[b]
+	if !found {
+		sq, _ = NewSendQueue(DefaultSendQueue, "")
+		cd.queues[b] = sq
+	}
+	sq.Workers(workers)
+	return nil
+}
+
+// mutes b, it stays connected but what it hears isn't broadcast and nothing
+// is sent to it until Enable
+func (cd *CentralDispatch) Disable(b Broker) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	if cd.disabled == nil {
+		cd.disabled = make(map[Broker]bool)
+	}
+	cd.disabled[b] = true
+	if cd.log != nil {
+		cd.log.Infof("disabled %s", DisplayName(b))
+	}
+}
+
+func (cd *CentralDispatch) Enable(b Broker) {
+	cd.mux.Lock()
+	defer cd.mux.Unlock()
+	if cd.disabled[b] && cd.log != nil {
+		cd.log.Infof("enabled %s", DisplayName(b))
+	}
+	delete(cd.disabled, b)
+}
+
+func (cd *CentralDispatch) Enabled(b Broker) bool {
+	cd.mux.RLock()
+	defer cd.mux.RUnlock()
+	return !cd.disabled[b]
+}
+
 func (cd *CentralDispatch) Broadcast(ev *Event) {
-	// publish to all
+	if ev = cd.transform(ev); ev == nil {
+		return
+	}
 	cd.mux.RLock()
+	al, found := cd.limitFrom[ev.Origin]
+	if !found {
+		al = cd.limit
+	}
+	cd.mux.RUnlock()
+	if al.Allow(ev) {
+		cd.publish(ev)
+	} else {
+		dropPlaceholder(ev)
+	}
+}
+
+// removes the placeholder ev was going to replace, for answers that won't
+// be sent
+func dropPlaceholder(ev *Event) {
+	if pb, ok := ev.ReplacesBroker.(PlaceholderBroker); ok && ev.Replaces != "" {
+		pb.DropPlaceholder(ev, ev.Replaces)
+	}
+}
+
+// sends ev to every broker but its origin
+func (cd *CentralDispatch) publish(ev *Event) {
+	cd.mux.RLock()
+	if cd.disabled[ev.Origin] {
+		cd.mux.RUnlock()
+		dropPlaceholder(ev)
+		return
+	}
+	cd.redactEvent(ev)
+	cd.summary.talked(ev)
+	queues := []*SendQueue{}
 	for _, b := range cd.brokers {
-		if ev.Origin != b {
-			go b.HandleEvent(ev, cd)
+		if ev.Origin != b && !cd.disabled[b] && cd.accepts(b, ev) {
+			queues = append(queues, cd.queues[b])
 		}
 	}
 	cd.mux.RUnlock()
+	// outside the lock, a push may block or dead-letter what it drops
+	for _, sq := range queues {
+		sq.Push(ev)
+	}
+}
+
+// publish to just the brokers with these config keys or names.  unknown
+// names are logged and skipped
+func (cd *CentralDispatch) BroadcastTo(ev *Event, names ...string) {
+	if ev = cd.transform(ev); ev == nil {
+		return
+	}
+	cd.mux.RLock()
+	if cd.disabled[ev.Origin] {
+		cd.mux.RUnlock()
+		return
+	}
+	cd.redactEvent(ev)
+	sent := make(map[Broker]bool)
+	queues := []*SendQueue{}
+	for _, name := range names {
+		b := cd.findBroker(name)
+		if b == nil {
+			cd.log.Warnf("broadcast target broker not found: %s", name)
+			continue
+		}
+		if b != ev.Origin && !sent[b] && !cd.disabled[b] && cd.accepts(b, ev) {
+			queues = append(queues, cd.queues[b])
+			sent[b] = true
+		}
+	}
+	cd.mux.RUnlock()
+	for _, sq := range queues {
+		sq.Push(ev)
+	}
+}
+
+// normalizes too, must hold mux
+func (cd *CentralDispatch) redactEvent(ev *Event) {
+	cd.normalize.NormalizeEvent(ev)
+	rd, found := cd.redactFrom[ev.Origin]
+	if !found {
+		rd = cd.redact
+	}
+	rd.RedactEvent(ev)
+}
+
+// the kinds of event a broker accepts, see Event.Kind
+type EventKinds map[string]bool
+
+// a nil or empty kinds is the default, see Accepts
+func NewEventKinds(kinds []string) (EventKinds, error) {
+	if len(kinds) == 0 {
+		return nil, nil
+	}
+	ek := make(EventKinds)
+	for _, kind := range kinds {
+		switch kind = strings.ToLower(kind); kind {
+		case EventMessage, EventAction, PresenceJoin, PresencePart, EventTopic:
+			ek[kind] = true
+		default:
+			return nil, fmt.Errorf(
+				"unknown event kind %s, expected message, action, join, part or topic",
+				kind)
+		}
+	}
+	return ek, nil
+}
+
+// nil, the default, only accepts messages and actions
+func (ek EventKinds) Accepts(ev *Event) bool {
+	if ek == nil {
+		kind := ev.Kind()
+		return kind == EventMessage || kind == EventAction
+	}
+	return ek[ev.Kind()]
+}
+
+// whether b is sent ev, must hold mux.  joins and parts only go to brokers
+// showing presence and topics to those syncing them, which is all it takes
+// without event-kinds of its own.  otherwise they must be listed too
+func (cd *CentralDispatch) accepts(b Broker, ev *Event) bool {
+	kinds := cd.kinds[b]
+	switch kind := ev.Kind(); kind {
+	case PresenceJoin, PresencePart:
+		return showsPresence(b) && (kinds == nil || kinds[kind])
+	case EventTopic:
+		return syncsTopic(b) && (kinds == nil || kinds[kind])
+	}
+	return kinds.Accepts(ev)
+}
+
+func showsPresence(b Broker) bool {
+	pb, ok := b.(PresenceBroker)
+	return ok && pb.ShowsPresence()
+}
+
+func syncsTopic(b Broker) bool {
+	tb, ok := b.(TopicBroker)
+	return ok && tb.SyncsTopic()
+}
+
+// a broker as it stood when a round of heartbeats began.  beats work from
+// this rather than taking mux again, a broker's Heartbeat may well add,
+// remove or mute brokers
+type brokerBeat struct {
+	b       Broker
+	sq      *SendQueue
+	summary *MetricsSummary
 }
 
 func (cd *CentralDispatch) Heartbeat() {
 	// publish to all
 	cd.mux.RLock()
+	splay, after := cd.splay, cd.after
+	beats := make([]brokerBeat, len(cd.brokers))
+	for i, b := range cd.brokers {
+		beats[i] = brokerBeat{b: b, sq: cd.queues[b], summary: cd.summary}
+	}
+	cd.mux.RUnlock()
+	if splay <= 0 || len(beats) == 0 {
+		for _, bb := range beats {
+			cd.beat(bb)
+		}
+		return
+	}
+	if after == nil {
+		after = func(d time.Duration, f func()) { time.AfterFunc(d, f) }
+	}
+	slot := splay / time.Duration(len(beats))
+	for i, bb := range beats {
+		bb := bb
+		offset := slot * time.Duration(i)
+		if slot > 0 {
+			offset += time.Duration(rand.Int63n(int64(slot)))
+		}
+		after(offset, func() {
+			// it may have been removed while waiting its turn
+			if cd.hasBroker(bb.b) {
+				cd.beat(bb)
+			}
+		})
+	}
+}
+
+// whether b is still one of ours
+func (cd *CentralDispatch) hasBroker(b Broker) bool {
+	cd.mux.RLock()
+	defer cd.mux.RUnlock()
+	for _, n := range cd.brokers {
+		if n == b {
+			return true
+		}
+	}
+	return false
+}
+
+// must not hold mux
+func (cd *CentralDispatch) beat(bb brokerBeat) {
+	if bb.b.Heartbeat() != true {
+		cd.log.Warnf("failed heartbeat: %s", DisplayName(bb.b))
+		bb.summary.failed(bb.b)
+	}
+	if mb, ok := bb.b.(meteredBroker); ok {
+		if m, ok := mb.logger().takeBeat(); ok {
+			bb.summary.record(bb.b, m)
+		}
+	}
+	if bb.sq != nil {
+		bb.sq.log.logSendQueue(bb.sq.Depth(), bb.sq.takeDropped(), bb.sq.latency.Value())
+	}
+}
+
+// each broker's send queue as it stands, in the order they were added
+func (cd *CentralDispatch) SendStats() []SendStat {
+	cd.mux.RLock()
+	defer cd.mux.RUnlock()
+	stats := []SendStat{}
 	for _, b := range cd.brokers {
-		if b.Heartbeat() != true {
-			cd.log.Warnf("failed heartbeat: %v", b)
+		sq := cd.queues[b]
+		if sq == nil {
+			continue
 		}
+		stats = append(stats, SendStat{
+			Broker:  DisplayName(b),
+			Queued:  sq.Depth(),
+			Latency: sq.latency.Value(),
+		})
 	}
-	cd.mux.RUnlock()
+	return stats
 }
 
 func (cd *CentralDispatch) NumBrokers() int {
 	return len(cd.brokers)
 }
 
+// finds a broker by its config key or Name()
+func (cd *CentralDispatch) FindBroker(name string) Broker {
+	cd.mux.RLock()
+	defer cd.mux.RUnlock()
+	return cd.findBroker(name)
+}
+
+// must hold mux
+func (cd *CentralDispatch) findBroker(name string) Broker {
+	for _, b := range cd.brokers {
+		if b.Name() == name || BrokerKey(b) == name {
+			return b
+		}
+	}
+	return nil
+}
+
 func (cd *CentralDispatch) AddBroker(b Broker) {
 	go b.Activate(cd)
 	cd.mux.Lock()
+	if cd.queues == nil {
+		cd.queues = make(map[Broker]*SendQueue)
+	}
+	sq, found := cd.queues[b]
+	if !found {
+		sq, _ = NewSendQueue(DefaultSendQueue, "")
+		cd.queues[b] = sq
+	}
+	sq.log = NewLogger("sends", DisplayName(b))
+	sq.dead = func(ev *Event, reason string) { cd.deadLetter(b, ev, reason) }
+	sq.start(b, cd)
 	cd.brokers = append(cd.brokers, b)
 	cd.mux.Unlock()
 }
@@ -62,7 +857,13 @@ func (cd *CentralDispatch) RemoveBroker(b Broker) error {
 			break
 		}
 	}
+	sq, queued := cd.queues[b]
+	delete(cd.queues, b)
+	delete(cd.disabled, b)
 	cd.mux.Unlock()
+	if queued {
+		sq.Close()
+	}
 	if !found {
 		return fmt.Errorf("broker not found: %s", b.Name())
 	}
@@ -0,0 +1,501 @@
+// broker: email
+// polls an imap folder for new mail, broadcasting each as an event, and sends
+// anything it receives to a configured address over smtp.  quoted reply
+// chains are stripped from inbound mail so replies bridge as just the reply.
+
+package smug
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBroker("email", func() Broker { return &EmailBroker{} })
+}
+
+const DefaultEmailPoll = time.Minute
+
+/* ************************** *
+ * transports
+ * ************************** */
+
+type mailFetcher interface {
+	// raw rfc822 of each unseen message, which are then marked seen
+	Fetch() ([][]byte, error)
+}
+
+type mailSender interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+type smtpSender struct {
+	server   string // host:port
+	user     string
+	password string
+}
+
+func (ss *smtpSender) Send(from string, to []string, msg []byte) error {
+	var auth smtp.Auth
+	if ss.user != "" {
+		host, _, _ := net.SplitHostPort(ss.server)
+		auth = smtp.PlainAuth("", ss.user, ss.password, host)
+	}
+	return smtp.SendMail(ss.server, auth, from, to, msg)
+}
+
+// just enough imap to pull unseen messages out of one folder
+type imapClient struct {
+	server   string // host:port, always tls
+	user     string
+	password string
+	folder   string
+	dial     func() (net.Conn, error)
+}
+
+type imapResponse struct {
+	line    string
+	literal []byte
+}
+
+type imapConn struct {
+	r   *bufio.Reader
+	w   io.Writer
+	tag int
+}
+
+func imapQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+var re_imapliteral = regexp.MustCompile(`\{(\d+)\}$`)
+
+// reads one response line, along with its literal if it ends with {n}
+func (c *imapConn) readResponse() (*imapResponse, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	resp := &imapResponse{line: strings.TrimRight(line, "\r\n")}
+	if m := re_imapliteral.FindStringSubmatch(resp.line); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		resp.literal = make([]byte, n)
+		if _, err := io.ReadFull(c.r, resp.literal); err != nil {
+			return nil, err
+		}
+		// the rest of the line after the literal, usually just ")"
+		if _, err := c.r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// sends a command and returns the untagged responses to it
+func (c *imapConn) cmd(format string, args ...interface{}) ([]*imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	_, err := fmt.Fprintf(c.w, "%s %s\r\n", tag, fmt.Sprintf(format, args...))
+	if err != nil {
+		return nil, err
+	}
+	untagged := []*imapResponse{}
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(resp.line, tag+" ") {
+			untagged = append(untagged, resp)
+			continue
+		}
+		if status := resp.line[len(tag)+1:]; !strings.HasPrefix(status, "OK") {
+			return nil, fmt.Errorf("imap: %s", status)
+		}
+		return untagged, nil
+	}
+}
+
+func (ic *imapClient) Fetch() ([][]byte, error) {
+	dial := ic.dial
+	if dial == nil {
+		dial = func() (net.Conn, error) {
+			return tls.Dial("tcp", ic.server, nil)
+		}
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := &imapConn{r: bufio.NewReader(conn), w: conn}
+	if _, err := c.r.ReadString('\n'); err != nil { // greeting
+		return nil, err
+	}
+	if _, err := c.cmd("LOGIN %s %s",
+		imapQuote(ic.user), imapQuote(ic.password)); err != nil {
+		return nil, err
+	}
+	defer c.cmd("LOGOUT")
+	if _, err := c.cmd("SELECT %s", imapQuote(ic.folder)); err != nil {
+		return nil, err
+	}
+	found, err := c.cmd("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	uids := []string{}
+	for _, resp := range found {
+		if strings.HasPrefix(resp.line, "* SEARCH") {
+			uids = append(uids, strings.Fields(resp.line)[2:]...)
+		}
+	}
+	msgs := [][]byte{}
+	for _, uid := range uids {
+		// BODY[] rather than BODY.PEEK[] so the server marks it seen
+		fetched, err := c.cmd("UID FETCH %s BODY[]", uid)
+		if err != nil {
+			return msgs, err
+		}
+		for _, resp := range fetched {
+			if resp.literal != nil {
+				msgs = append(msgs, resp.literal)
+			}
+		}
+	}
+	return msgs, nil
+}
+
+/* ************************** *
+ * parsing and formatting
+ * ************************** */
+
+var re_replyheader = regexp.MustCompile(`^On .+ wrote:$`)
+
+// drops the quoted chain a reply drags along, and any signature
+func StripQuotedReply(body string) string {
+	kept := []string{}
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, ">") || strings.TrimSpace(line) == "--" ||
+			re_replyheader.MatchString(line) ||
+			strings.Contains(line, "-----Original Message-----") {
+			break
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+func decodeTransfer(r io.Reader, encoding string) io.Reader {
+	if strings.EqualFold(encoding, "quoted-printable") {
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// finds the first text/plain part of the body, descending into multiparts
+func plainTextBody(ctype string, body io.Reader) (string, error) {
+	mtype, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		// no or broken content-type, assume plain
+		mtype = "text/plain"
+	}
+	if strings.HasPrefix(mtype, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			// NextPart already undoes quoted-printable
+			txt, err := plainTextBody(part.Header.Get("Content-Type"), part)
+			if err != nil || txt != "" {
+				return txt, err
+			}
+		}
+	}
+	if mtype != "text/plain" {
+		return "", nil
+	}
+	txt, err := ioutil.ReadAll(body)
+	return string(txt), err
+}
+
+// builds an event from a raw rfc822 message
+func ParseEmail(raw []byte) (*Event, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	dec := &mime.WordDecoder{}
+	actor := msg.Header.Get("From")
+	if from, err := mail.ParseAddress(actor); err == nil {
+		actor = from.Address
+		if from.Name != "" {
+			actor = from.Name
+		}
+	}
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	body, err := plainTextBody(
+		msg.Header.Get("Content-Type"),
+		decodeTransfer(msg.Body, msg.Header.Get("Content-Transfer-Encoding")),
+	)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(subject + "\n" + StripQuotedReply(body))
+	ev := &Event{
+		Actor:   actor,
+		Text:    text,
+		RawText: body,
+		ts:      time.Now(),
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		ev.ts = date
+	}
+	return ev, nil
+}
+
+// renders ev as a multipart message, the text first then a part per block
+func FormatEmail(ev *Event, from string, to []string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	subject := "smug"
+	if ev.Actor != "" {
+		subject = fmt.Sprintf("smug: %s", ev.Actor)
+	}
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf,
+		"Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	text := ev.Text
+	if ev.IsAction {
+		text = ev.ActionText()
+	}
+	parts := []string{text}
+	for _, blk := range ev.ContentBlocks {
+		lines := []string{}
+		for _, s := range []string{blk.Title, blk.Text, blk.ImgUrl} {
+			if s != "" {
+				lines = append(lines, s)
+			}
+		}
+		parts = append(parts, strings.Join(lines, "\n"))
+	}
+	for _, p := range parts {
+		hdr := textproto.MIMEHeader{}
+		hdr.Set("Content-Type", "text/plain; charset=utf-8")
+		hdr.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := mw.CreatePart(hdr)
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		io.WriteString(qw, p)
+		qw.Close()
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/* ************************** *
+ * email broker
+ * ************************** */
+
+type EmailBroker struct {
+	log      *Logger
+	fetcher  mailFetcher
+	sender   mailSender
+	from     string
+	to       []string
+	interval time.Duration
+	done     chan bool
+	mux      sync.RWMutex
+	metrics  Metrics
+	// only ignore-actors and url-rewrites apply to email
+	chatOptions
+}
+
+func (eb *EmailBroker) Name() string {
+	return fmt.Sprintf("email-%s", eb.from)
+}
+
+func (eb *EmailBroker) logger() *Logger { return eb.log }
+
+func (eb *EmailBroker) Heartbeat() bool {
+	eb.mux.Lock()
+	m := eb.metrics
+	eb.metrics = Metrics{}
+	eb.mux.Unlock()
+	eb.log.logMetrics(m)
+	return true
+}
+
+// args [imap server, smtp server, user, password, folder, from, to, interval]
+// to may be a comma separated list, interval a duration like 30s
+func (eb *EmailBroker) Setup(args ...string) error {
+	if len(args) != 8 {
+		return fmt.Errorf("email broker needs 8 args, got %d", len(args))
+	}
+	imapServer, smtpServer, user, password := args[0], args[1], args[2], args[3]
+	folder := args[4]
+	eb.from = args[5]
+	for _, addr := range strings.Split(args[6], ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			eb.to = append(eb.to, addr)
+		}
+	}
+	eb.log = NewLogger("broker", DisplayName(eb))
+	eb.done = make(chan bool)
+	if eb.from == "" || len(eb.to) == 0 {
+		return fmt.Errorf("email broker needs from and to addresses")
+	}
+	eb.interval = DefaultEmailPoll
+	if args[7] != "" {
+		d, err := time.ParseDuration(args[7])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid poll interval %s", args[7])
+		}
+		eb.interval = d
+	}
+	if folder == "" {
+		folder = "INBOX"
+	}
+	if eb.fetcher == nil {
+		eb.fetcher = &imapClient{
+			server:   imapServer,
+			user:     user,
+			password: password,
+			folder:   folder,
+		}
+	}
+	if eb.sender == nil {
+		eb.sender = &smtpSender{
+			server:   smtpServer,
+			user:     user,
+			password: password,
+		}
+	}
+	return nil
+}
+
+func (eb *EmailBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	err := eb.Setup(
+		cfg.Server,
+		cfg.SmtpServer,
+		cfg.Username,
+		cfg.Password,
+		cfg.Folder,
+		cfg.From,
+		strings.Join(cfg.To, ","),
+		cfg.PollInterval,
+	)
+	if err != nil {
+		return err
+	}
+	if err := eb.IgnoreActors(cfg.IgnoreActors...); err != nil {
+		return err
+	}
+	return eb.RewriteUrls(cfg.UrlRewrites)
+}
+
+func (eb *EmailBroker) HandleEvent(ev *Event, dis Dispatcher) {
+	if ev.ReplyBroker != nil && ev.ReplyBroker != eb {
+		return
+	}
+	eb.mux.Lock()
+	eb.metrics.rcvd(ev)
+	eb.mux.Unlock()
+	out := *ev
+	out.Text = eb.rewrites.Rewrite(ev.Text)
+	msg, err := FormatEmail(&out, eb.from, eb.to)
+	if err != nil {
+		eb.log.Warnf("ERR formatting email: %s", err)
+		return
+	}
+	if err := eb.sender.Send(eb.from, eb.to, msg); err != nil {
+		eb.log.Warnf("ERR sending email: %s", err)
+	}
+}
+
+// our own mail coming back around is ignored
+func (eb *EmailBroker) fromSelf(raw []byte) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return false
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	return err == nil && strings.EqualFold(from.Address, eb.from)
+}
+
+func (eb *EmailBroker) poll(dis Dispatcher) {
+	msgs, err := eb.fetcher.Fetch()
+	if err != nil {
+		eb.log.Warnf("ERR fetching mail: %s", err)
+	}
+	for _, raw := range msgs {
+		if eb.fromSelf(raw) {
+			continue
+		}
+		ev, err := ParseEmail(raw)
+		if err != nil {
+			eb.log.Warnf("ERR parsing mail: %s", err)
+			continue
+		}
+		if ev.Text == "" || eb.ignore.Ignored(ev.Actor) {
+			continue
+		}
+		ev.Origin = eb
+		eb.mux.Lock()
+		eb.metrics.sent(ev)
+		eb.mux.Unlock()
+		dis.Broadcast(ev)
+	}
+}
+
+func (eb *EmailBroker) Activate(dis Dispatcher) {
+	ticker := time.NewTicker(eb.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			eb.poll(dis)
+		case <-eb.done:
+			return
+		}
+	}
+}
+
+func (eb *EmailBroker) Deactivate() {
+	close(eb.done)
+}
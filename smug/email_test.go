@@ -0,0 +1,199 @@
+package smug
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// FakeMail hands out canned messages and captures anything sent
+type FakeMail struct {
+	inbox [][]byte
+	sent  [][]byte
+}
+
+func (fm *FakeMail) Fetch() ([][]byte, error) {
+	msgs := fm.inbox
+	fm.inbox = nil
+	return msgs, nil
+}
+
+func (fm *FakeMail) Send(from string, to []string, msg []byte) error {
+	fm.sent = append(fm.sent, msg)
+	return nil
+}
+
+func crlf(s string) []byte {
+	return []byte(strings.Replace(s, "\n", "\r\n", -1))
+}
+
+var plainEmail = crlf(`From: Bob Smith <bob@example.com>
+To: chat@example.com
+Subject: lunch?
+Date: Mon, 09 Mar 2020 12:00:00 +0000
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+tacos at noon, caf=C3=A9 after
+
+On Sun, Mar 8, 2020 at 9:00 PM Alice <alice@example.com> wrote:
+> anyone hungry?
+`)
+
+var multipartEmail = crlf(`From: carol@example.com
+To: chat@example.com
+Subject: =?utf-8?q?re:_plans?=
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="XYZ"
+
+--XYZ
+Content-Type: text/plain; charset=utf-8
+
+sounds good
+--
+carol
+--XYZ
+Content-Type: text/html; charset=utf-8
+
+<p>sounds good</p>
+--XYZ--
+`)
+
+func TestParseEmail(t *testing.T) {
+	ev, err := ParseEmail(plainEmail)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ev.Actor != "Bob Smith" {
+		t.Errorf("err: have actor [%s]", ev.Actor)
+	}
+	if want := "lunch?\ntacos at noon, café after"; ev.Text != want {
+		t.Errorf("err: have [%s] wanted [%s]", ev.Text, want)
+	}
+	if ev.ts.Year() != 2020 {
+		t.Errorf("err: expected the message date, have %s", ev.ts)
+	}
+
+	ev, err = ParseEmail(multipartEmail)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ev.Actor != "carol@example.com" {
+		t.Errorf("err: have actor [%s]", ev.Actor)
+	}
+	if want := "re: plans\nsounds good"; ev.Text != want {
+		t.Errorf("err: have [%s] wanted [%s]", ev.Text, want)
+	}
+}
+
+func TestFormatEmail(t *testing.T) {
+	ev := &Event{
+		Actor: "bob",
+		Text:  "look at this",
+		ContentBlocks: []*EventBlock{
+			{Title: "a chart", ImgUrl: "http://x.com/c.png"},
+		},
+	}
+	raw, err := FormatEmail(ev, "smug@example.com", []string{"team@example.com"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if msg.Header.Get("Subject") != "smug: bob" ||
+		msg.Header.Get("To") != "team@example.com" {
+		t.Errorf("err: bad headers %+v", msg.Header)
+	}
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	parts := []string{}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		parts = append(parts, string(body))
+	}
+	if len(parts) != 2 || parts[0] != "look at this" ||
+		parts[1] != "a chart\r\nhttp://x.com/c.png" {
+		t.Errorf("err: have parts %q", parts)
+	}
+}
+
+func TestEmailBroker(t *testing.T) {
+	fm := &FakeMail{}
+	eb := &EmailBroker{fetcher: fm, sender: fm}
+	err := eb.Setup("", "", "", "", "", "chat@example.com", "team@example.com", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ours, _ := FormatEmail(&Event{Text: "echo"}, "chat@example.com", eb.to)
+	fm.inbox = [][]byte{ours, plainEmail}
+	td := &TestDispatch{}
+	eb.poll(td)
+	if td.lastbroadcast == nil || td.lastbroadcast.Actor != "Bob Smith" ||
+		td.lastbroadcast.Origin != eb {
+		t.Errorf("err: expected bob's mail broadcast %+v", td.lastbroadcast)
+	}
+
+	eb.HandleEvent(&Event{Actor: "alice", Text: "hi"}, td)
+	if len(fm.sent) != 1 || !bytes.Contains(fm.sent[0], []byte("Subject: smug: alice")) {
+		t.Errorf("err: expected one mail sent, have %d", len(fm.sent))
+	}
+
+	if err := eb.Setup("", "", "", "", "", "", "", ""); err == nil {
+		t.Errorf("err: expected missing addresses to fail setup")
+	}
+}
+
+func TestImapFetch(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	msg := "Subject: hi\r\n\r\nhello\r\n"
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		server.Write([]byte("* OK ready\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			tag, cmd := fields[0], strings.Join(fields[1:], " ")
+			switch {
+			case strings.HasPrefix(cmd, "UID SEARCH"):
+				server.Write([]byte("* SEARCH 7\r\n"))
+			case strings.HasPrefix(cmd, "UID FETCH 7"):
+				server.Write([]byte("* 1 FETCH (UID 7 BODY[] {" +
+					fmtInt64(int64(len(msg))) + "}\r\n" + msg + ")\r\n"))
+			case strings.HasPrefix(cmd, "LOGIN") && !strings.Contains(cmd, `"pw"`):
+				server.Write([]byte(tag + " NO bad login\r\n"))
+				continue
+			}
+			server.Write([]byte(tag + " OK done\r\n"))
+		}
+	}()
+	ic := &imapClient{
+		user:     "bob",
+		password: "pw",
+		folder:   "INBOX",
+		dial:     func() (net.Conn, error) { return client, nil },
+	}
+	msgs, err := ic.Fetch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(msgs) != 1 || string(msgs[0]) != msg {
+		t.Errorf("err: have %q", msgs)
+	}
+}
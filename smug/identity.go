@@ -0,0 +1,74 @@
+// identities
+// the same person often goes by a different name on each network, alice on
+// irc and U123 on slack.  an IdentityMap ties those names together, from the
+// identities config, so mentions and avatars carry across the bridge.  each
+// identity is keyed by broker type, or by config key where two brokers of a
+// type need different names.
+
+package smug
+
+import (
+	"fmt"
+	"strings"
+)
+
+// one person's name on each broker
+type Identity map[string]string
+
+type IdentityMap struct {
+	identities []Identity
+}
+
+func NewIdentityMap(ids []map[string]string) (*IdentityMap, error) {
+	im := &IdentityMap{}
+	for i, names := range ids {
+		if len(names) < 2 {
+			return nil, fmt.Errorf(
+				"identity %d needs names on at least two brokers", i+1)
+		}
+		id := make(Identity)
+		for broker, name := range names {
+			if name == "" {
+				return nil, fmt.Errorf("identity %d has a blank %s name", i+1, broker)
+			}
+			id[strings.ToLower(broker)] = name
+		}
+		im.identities = append(im.identities, id)
+	}
+	return im, nil
+}
+
+// the identity going by name on from, nil if there's none.  a nil from
+// matches name on any broker.  a nil map knows nobody
+func (im *IdentityMap) Lookup(from Broker, name string) Identity {
+	if im == nil || name == "" {
+		return nil
+	}
+	for _, id := range im.identities {
+		if from == nil {
+			for _, n := range id {
+				if strings.EqualFold(n, name) {
+					return id
+				}
+			}
+		} else if strings.EqualFold(id.On(from), name) {
+			return id
+		}
+	}
+	return nil
+}
+
+// the name on b, by its config key or else its type.  blank if there's none
+func (id Identity) On(b Broker) string {
+	if id == nil {
+		return ""
+	}
+	label := labelOf(b)
+	if name := id[strings.ToLower(label.key)]; label.key != "" && name != "" {
+		return name
+	}
+	if label.kind != "" {
+		return id[label.kind]
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package smug
+
+import (
+	"testing"
+
+	libsl "github.com/slack-go/slack"
+)
+
+func TestIdentityMentions(t *testing.T) {
+	if _, err := NewIdentityMap([]map[string]string{{"irc": "alice"}}); err == nil {
+		t.Errorf("err: an identity with one name should error")
+	}
+	im, err := NewIdentityMap([]map[string]string{
+		{"irc": "alice", "slack": "U1234"},
+		{"irc": "bob", "slack": "robert"},
+		{"IRC": "carol", "slack": "U456", "work": "U999"},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ib := &IrcBroker{channel: "#chan"}
+	fs := &FakeSlackAPI{users: map[string]*libsl.User{"U1234": {ID: "U1234", Name: "alice.smith"}}}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	work := &SlackBroker{chanid: "C2", api: fs}
+	work.SetupInternals()
+	LabelBroker(ib, &BrokerConfig{Type: "irc"})
+	LabelBroker(sb, &BrokerConfig{Type: "slack"})
+	LabelBroker(work, &BrokerConfig{Type: "slack", Key: "work"})
+	defer func() {
+		UnlabelBroker(ib)
+		UnlabelBroker(sb)
+		UnlabelBroker(work)
+	}()
+	sb.usercache.CacheUser(&SlackUser{Id: "U777", Nick: "robert",
+		Avatar: "https://example.com/robert.png"})
+	sb.UseIdentities(im)
+	work.UseIdentities(im)
+
+	sb.post(&Event{Origin: ib, Actor: "bob", Text: "alice: lunch? @bob @Carol"})
+	if have := postedText(fs.posted[0]); have != "<@U1234>: lunch? <@U777> <@U456>" {
+		t.Errorf("err: mentions not resolved through the map, have %q", have)
+	}
+	if vals := postedValues(fs.posted[0]); vals.Get("icon_url") != "https://example.com/robert.png" {
+		t.Errorf("err: expected robert's avatar for bob, have %v", vals)
+	}
+	work.post(&Event{Origin: ib, Actor: "carol", Text: "ping @carol"})
+	if have := postedText(fs.posted[1]); have != "ping <@U999>" {
+		t.Errorf("err: the config key's name should win, have %q", have)
+	}
+	// names are only matched on the broker they came from
+	sb.post(&Event{Origin: sb, Actor: "robert", Text: "hey @alice"})
+	if have := postedText(fs.posted[2]); have != "hey @alice" {
+		t.Errorf("err: slack's own alice isn't irc's, have %q", have)
+	}
+	if id := im.Lookup(nil, "ROBERT"); id.On(ib) != "bob" {
+		t.Errorf("err: a nil origin should match any name, have %v", id)
+	}
+	if (*IdentityMap)(nil).Lookup(ib, "alice") != nil {
+		t.Errorf("err: a nil map knows nobody")
+	}
+}
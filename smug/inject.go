@@ -0,0 +1,172 @@
+// broker: inject
+// a small http endpoint for putting events on the bridge by hand, for ops
+// announcements or integration tests.  POST /inject with the token takes
+// {"actor", "text", "target"} and broadcasts it from this broker, to just
+// the target broker when one's named.  injected events are marked so
+// archives can leave them out, and never run commands.
+
+package smug
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBroker("inject", func() Broker { return &InjectBroker{} })
+}
+
+// what POST /inject takes.  target is a broker's config key or name, blank
+// for everyone
+type injectRequest struct {
+	Actor  string `json:"actor"`
+	Text   string `json:"text"`
+	Target string `json:"target"`
+	Action bool   `json:"action"`
+}
+
+type InjectBroker struct {
+	log    *Logger
+	listen string
+	token  string
+	// actor for requests that don't name one
+	nick    string
+	server  *http.Server
+	mux     sync.Mutex
+	dis     Dispatcher
+	metrics Metrics
+}
+
+func (ib *InjectBroker) Name() string {
+	return fmt.Sprintf("inject-%s", ib.listen)
+}
+
+func (ib *InjectBroker) logger() *Logger { return ib.log }
+
+func (ib *InjectBroker) Heartbeat() bool {
+	ib.mux.Lock()
+	m := ib.metrics
+	ib.metrics = Metrics{}
+	ib.mux.Unlock()
+	ib.log.logMetrics(m)
+	return true
+}
+
+// args [listen addr, token, nick]
+// requests must carry the token as Authorization: Bearer <token>
+func (ib *InjectBroker) Setup(args ...string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("inject broker needs 3 args, got %d", len(args))
+	}
+	ib.listen, ib.token = args[0], args[1]
+	if ib.listen == "" {
+		return fmt.Errorf("inject broker needs a listen addr")
+	}
+	if ib.token == "" {
+		return fmt.Errorf("inject broker needs a token")
+	}
+	ib.nick = "smug"
+	if args[2] != "" {
+		ib.nick = args[2]
+	}
+	ib.log = NewLogger("broker", DisplayName(ib))
+	ib.server = &http.Server{Addr: ib.listen, Handler: ib}
+	return nil
+}
+
+func (ib *InjectBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	return ib.Setup(cfg.Listen, cfg.ApiToken, cfg.Nick)
+}
+
+// we don't consume anything
+func (ib *InjectBroker) HandleEvent(ev *Event, dis Dispatcher) {}
+
+func (ib *InjectBroker) authorized(r *http.Request) bool {
+	want := []byte("Bearer " + ib.token)
+	have := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(want, have) == 1
+}
+
+// POST /inject {"actor": "ops", "text": "deploying at 5", "target": "irc"}
+func (ib *InjectBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/inject" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "post only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ib.authorized(r) {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+	body, err := ReadLimited(r.Body, DefaultMaxBodySize)
+	if errors.Is(err, ErrBodyTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &injectRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Text == "" {
+		http.Error(w, "text must not be blank", http.StatusBadRequest)
+		return
+	}
+	ib.mux.Lock()
+	dis := ib.dis
+	ib.mux.Unlock()
+	if dis == nil {
+		http.Error(w, "not active yet", http.StatusServiceUnavailable)
+		return
+	}
+	if req.Target != "" && dis.FindBroker(req.Target) == nil {
+		http.Error(w, "no broker "+req.Target, http.StatusNotFound)
+		return
+	}
+	if req.Actor == "" {
+		req.Actor = ib.nick
+	}
+	ev := &Event{
+		Origin:     ib,
+		Actor:      req.Actor,
+		Text:       req.Text,
+		RawText:    req.Text,
+		IsAction:   req.Action,
+		IsInjected: true,
+		ts:         time.Now(),
+	}
+	ib.mux.Lock()
+	ib.metrics.sent(ev)
+	ib.mux.Unlock()
+	if req.Target != "" {
+		dis.BroadcastTo(ev, req.Target)
+	} else {
+		dis.Broadcast(ev)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (ib *InjectBroker) Activate(dis Dispatcher) {
+	ib.mux.Lock()
+	ib.dis = dis
+	ib.mux.Unlock()
+	ib.log.Infof("injecting events from %s", ib.listen)
+	if err := ib.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		ib.log.Errorf("ERR inject http: %s", err)
+	}
+}
+
+func (ib *InjectBroker) Deactivate() {
+	ib.server.Close()
+}
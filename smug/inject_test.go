@@ -0,0 +1,133 @@
+package smug
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestInjectBroker(t *testing.T) {
+	ib := &InjectBroker{}
+	if err := ib.Setup("127.0.0.1:0", "", ""); err == nil {
+		t.Errorf("err: an inject broker without a token should error")
+	}
+	if err := ib.Setup("127.0.0.1:0", "s3cret", "ops"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cd := &CentralDispatch{}
+	irc := &ChanBroker{events: make(chan *Event, 10)}
+	slack := &ChanBroker{events: make(chan *Event, 10)}
+	LabelBroker(irc, &BrokerConfig{Type: "irc", Key: "irc-main"})
+	LabelBroker(slack, &BrokerConfig{Type: "slack", Key: "slack-main"})
+	defer func() {
+		UnlabelBroker(irc)
+		UnlabelBroker(slack)
+	}()
+	cd.AddBroker(irc)
+	cd.AddBroker(slack)
+	ib.dis = cd
+
+	inject := func(token string, body string) int {
+		r := httptest.NewRequest("POST", "/inject", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		ib.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := inject("wrong", `{"text": "hi"}`); code != http.StatusUnauthorized {
+		t.Errorf("err: a bad token should be refused, have %d", code)
+	}
+	if code := inject("", `{"text": "hi"}`); code != http.StatusUnauthorized {
+		t.Errorf("err: no token should be refused, have %d", code)
+	}
+	if code := inject("s3cret", `{"text": "", "actor": "ops"}`); code != http.StatusBadRequest {
+		t.Errorf("err: blank text should be refused, have %d", code)
+	}
+	if code := inject("s3cret", `{"text": "hi", "target": "nope"}`); code != http.StatusNotFound {
+		t.Errorf("err: an unknown target should be refused, have %d", code)
+	}
+	body := `{"actor": "deployer", "text": "deploying at 5", "target": "irc-main"}`
+	if code := inject("s3cret", body); code != http.StatusAccepted {
+		t.Fatalf("err: expected the event accepted, have %d", code)
+	}
+	select {
+	case ev := <-irc.events:
+		if ev.Origin != ib || ev.Actor != "deployer" || ev.Text != "deploying at 5" ||
+			!ev.IsInjected {
+			t.Errorf("err: expected the injected event, have %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("err: the target broker didn't get the event")
+	}
+	if code := inject("s3cret", `{"text": "hello all"}`); code != http.StatusAccepted {
+		t.Fatalf("err: expected the event accepted, have %d", code)
+	}
+	for _, cb := range []*ChanBroker{irc, slack} {
+		select {
+		case ev := <-cb.events:
+			if ev.Actor != "ops" || ev.Text != "hello all" {
+				t.Errorf("err: expected the untargeted event as ops, have %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("err: an untargeted event should reach everyone")
+		}
+	}
+	select {
+	case ev := <-slack.events:
+		t.Errorf("err: only the target should get a targeted event, have %+v", ev)
+	default:
+	}
+
+	// too big is 413, a body that can't be read is just a bad request
+	huge := `{"text": "` + strings.Repeat("a", int(DefaultMaxBodySize)) + `"}`
+	if code := inject("s3cret", huge); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("err: an oversized body should be 413, have %d", code)
+	}
+	r := httptest.NewRequest("POST", "/inject", iotest.TimeoutReader(strings.NewReader("{}")))
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	ib.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("err: a failed read should be 400, have %d", w.Code)
+	}
+}
+
+func TestInjectedCommands(t *testing.T) {
+	ran := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { ran <- true }))
+	defer srv.Close()
+	pb := &PatternRoutingBroker{}
+	pb.Setup()
+	p, _ := NewPatternFromConfig(&PatternConfig{
+		RegEx: `^\.\.deploy`, Url: srv.URL, Method: "POST"})
+	pb.AddPattern(p)
+	pb.HandleEvent(&Event{Actor: "ops", Text: "..deploy", IsInjected: true}, nil)
+
+	cd := &CentralDispatch{}
+	listener := &ChanBroker{events: make(chan *Event, 1)}
+	cd.AddBroker(listener)
+	lcb := &LocalCmdBroker{}
+	lcb.Setup("smug", "", "1.0")
+	lcb.HandleEvent(&Event{Actor: "ops", Text: "..version", IsInjected: true}, cd)
+
+	select {
+	case <-ran:
+		t.Errorf("err: an injected event ran a pattern")
+	case ev := <-listener.events:
+		t.Errorf("err: an injected event ran a command, have %q", ev.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// while the same said by someone does
+	lcb.HandleEvent(&Event{Actor: "ops", Text: "..version"}, cd)
+	select {
+	case <-listener.events:
+	case <-time.After(time.Second):
+		t.Errorf("err: ..version should answer when it's not injected")
+	}
+}
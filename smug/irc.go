@@ -15,86 +15,254 @@ import (
 	libirc "github.com/thoj/go-ircevent"
 )
 
+func init() {
+	RegisterBroker("irc", func() Broker { return &IrcBroker{} })
+}
+
+// the parts of the irc connection we use, lets tests fake the network
+type ircConn interface {
+	AddCallback(string, func(*libirc.Event)) int
+	Join(string)
+	Privmsg(string, string)
+	Action(string, string)
+	SendRawf(string, ...interface{})
+}
+
+// servers cut lines at 512 bytes including the command, chunk well before
+var defaultIrcLimit = &MessageLimiter{maxLen: 500, bytes: true}
+
 type IrcBroker struct {
 	log      *Logger
-	conn     *libirc.Connection
+	conn     ircConn
 	channel  string
+	channels []string
+	keys     map[string]string
 	nick     string
 	botname  string
 	prefix   string
 	server   string
+	nicks    *NickSanitizer
+	presence bool
 	mux      sync.RWMutex
-	msgsRcvd int64
-	msgsSent int64
+	metrics  Metrics
+	// prefix text bridged from other networks with where it came from
+	originPrefix bool
+	// show actors' statuses after their names
+	showStatus bool
+	// our channel's last known topic
+	topic string
+	chatOptions
+	topicSyncer
 }
 
 func (ib *IrcBroker) Name() string {
 	return fmt.Sprintf("irc-%s-%s-as-%s", ib.server, ib.channel, ib.nick)
 }
 
+func (ib *IrcBroker) logger() *Logger { return ib.log }
+
 func (ib *IrcBroker) Heartbeat() bool {
 	ib.mux.Lock()
-	ms, mr := ib.msgsSent, ib.msgsRcvd
-	ib.msgsSent, ib.msgsRcvd = 0, 0
+	m := ib.metrics
+	ib.metrics = Metrics{}
 	ib.mux.Unlock()
-	ib.log.logMetrics(mr, ms)
+	ib.log.logMetrics(m)
 	return true
 }
 
-// args [server, channel, nick, botname]
-func (ib *IrcBroker) Setup(args ...string) {
+// chars is a regex character class of what's allowed in rendered nicks,
+// blank for the irc defaults.  maxlen <= 0 uses DefaultNickLen
+func (ib *IrcBroker) SanitizeNicks(chars string, maxlen int) error {
+	ns, err := NewNickSanitizer(chars, maxlen)
+	if err != nil {
+		return err
+	}
+	ib.nicks = ns
+	return nil
+}
+
+// channels is a comma separated list, the first is where we announce
+// ourselves.  keys are matched to channels by position, blank for none
+func (ib *IrcBroker) setChannels(channels string, keys string) {
+	ib.channels = nil
+	ib.keys = map[string]string{}
+	ks := strings.Split(keys, ",")
+	for i, ch := range strings.Split(channels, ",") {
+		ch = strings.TrimSpace(ch)
+		if ch == "" {
+			continue
+		}
+		ib.channels = append(ib.channels, ch)
+		if i < len(ks) && strings.TrimSpace(ks[i]) != "" {
+			ib.keys[ch] = strings.TrimSpace(ks[i])
+		}
+	}
+	if len(ib.channels) > 0 {
+		ib.channel = ib.channels[0]
+	}
+}
+
+// join every channel, with its key if it has one.  runs on each welcome so
+// a reconnect puts us back where we were
+func (ib *IrcBroker) joinChannels(conn ircConn) {
+	for _, ch := range ib.channels {
+		ib.log.Infof("irc joining %s / %s", ib.server, ch)
+		if key, ok := ib.keys[ch]; ok {
+			conn.Join(ch + " " + key)
+		} else {
+			conn.Join(ch)
+		}
+	}
+}
+
+// one of ours, as opposed to a private message
+func (ib *IrcBroker) joined(target string) bool {
+	for _, ch := range ib.channels {
+		if strings.EqualFold(ch, target) {
+			return true
+		}
+	}
+	return target == ib.channel
+}
+
+// inbound from a channel other than the first carries it along, so answers
+// to it go back there rather than the first channel
+func (ib *IrcBroker) fromChannel(ev *Event, target string) {
+	if !strings.EqualFold(target, ib.channel) && ib.joined(target) {
+		ev.Channel = target
+		ev.ChannelBroker = ib
+	}
+}
+
+// show joins and parts from other brokers in the channel
+func (ib *IrcBroker) ShowPresence(show bool) {
+	ib.presence = show
+}
+
+func (ib *IrcBroker) ShowsPresence() bool {
+	return ib.presence
+}
+
+// prefix messages from other kinds of broker with theirs, eg [slack]
+func (ib *IrcBroker) PrefixOrigins(on bool) {
+	ib.originPrefix = on
+}
+
+// show the status actors have on their network, eg a slack user's status
+// emoji, after their name: |alice [🌴]|
+func (ib *IrcBroker) ShowStatus(on bool) {
+	ib.showStatus = on
+}
+
+// args [server, channels, nick, botname, keys]
+func (ib *IrcBroker) Setup(args ...string) error {
+	// servers cut lines by bytes, not chars
+	ib.limitBytes = true
 	ib.server = args[0]
-	ib.channel = args[1]
 	ib.nick = args[2]
 	if len(args) > 3 {
 		ib.botname = args[3]
 	} else {
 		ib.botname = "smug"
 	}
-	ib.log = NewLogger("broker", ib.Name())
+	var keys string
+	if len(args) > 4 {
+		keys = args[4]
+	}
+	ib.setChannels(args[1], keys)
+	ib.log = NewLogger("broker", DisplayName(ib))
+	ib.SanitizeNicks("", 0)
 
 	if !strings.Contains(ib.server, ":") {
 		// port not included, let's naively append the default :6667
 		ib.server = ib.server + ":6667"
 	}
 
-	ib.conn = libirc.IRC(ib.nick, ib.botname)
-	ib.conn.Log = log.New(os.Stderr, "", log.LstdFlags)
-	// ib.conn.VerboseCallbackHandler = true
-	ib.conn.UseTLS = true // XXX should be a param
-	if ib.conn.UseTLS {
-		ib.conn.TLSConfig = &tls.Config{InsecureSkipVerify: true} // XXX
+	conn := libirc.IRC(ib.nick, ib.botname)
+	ib.applyTimeouts(conn)
+	// who's logged in as who, for ActorId
+	conn.RequestCaps = append(conn.RequestCaps, "account-tag")
+	conn.Log = log.New(os.Stderr, "", log.LstdFlags)
+	// conn.VerboseCallbackHandler = true
+	conn.UseTLS = true // XXX should be a param
+	if conn.UseTLS {
+		conn.TLSConfig = &tls.Config{InsecureSkipVerify: true} // XXX
 	}
-	ib.conn.AddCallback(
+	conn.AddCallback(
 		"001",
 		func(e *libirc.Event) {
-			ib.log.Infof("irc joining %s / %s", ib.server, ib.channel)
-			ib.conn.Join(ib.channel)
-			ib.conn.Privmsg(ib.channel, fmt.Sprintf("%s online", ib.botname))
+			ib.joinChannels(conn)
+			conn.Privmsg(ib.channel, fmt.Sprintf("%s online", ib.botname))
 		})
-	// ib.conn.AddCallback("366", func(e *irc.Event) { }) // ignore end of names
-	err := ib.conn.Connect(ib.server)
+	// conn.AddCallback("366", func(e *irc.Event) { }) // ignore end of names
+	err := conn.Connect(ib.server)
+	if err != nil {
+		return fmt.Errorf("irc connect to %s: %s", ib.server, err)
+	}
+	ib.conn = conn
+	return nil
+}
+
+func (ib *IrcBroker) applyTimeouts(conn *libirc.Connection) {
+	if ib.timeouts == nil {
+		return
+	}
+	if ib.timeouts.Dial > 0 {
+		conn.Timeout = ib.timeouts.Dial
+	}
+	if ib.timeouts.KeepAlive > 0 {
+		conn.KeepAlive = ib.timeouts.KeepAlive
+		conn.PingFreq = ib.timeouts.KeepAlive
+	}
+}
+
+func (ib *IrcBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	nt, err := NewNetTimeouts(cfg.DialTimeout, cfg.KeepAlive)
+	if err != nil {
+		return err
+	}
+	ib.ConnTimeouts(nt)
+	err = ib.Setup(
+		cfg.Server,
+		cfg.Channel,
+		cfg.Nick,
+		fmt.Sprintf("%s-%s", "smug", Version),
+		cfg.ChannelKey,
+	)
+	if err != nil {
+		return err
+	}
+	ib.ShowPresence(cfg.ShowPresence)
+	ib.PrefixOrigins(cfg.OriginPrefix)
+	ib.ShowStatus(cfg.ShowStatus)
+	ib.SyncTopic(cfg.SyncTopic)
+	err = ib.StampTimes(cfg.TimestampLayout, cfg.TimestampZone, cfg.TimestampPosition)
 	if err != nil {
-		ib.log.Errorf("ERR %s", err)
-		ib.conn = nil // error'd here, set this connection to nil XXX
+		return err
+	}
+	if err := ib.configure(cfg); err != nil {
+		return err
 	}
+	return ib.SanitizeNicks(cfg.NickChars, cfg.NickLen)
 }
 
 func (ib *IrcBroker) MsgTarget(target string, msg string, prefix string) {
-	maxlen := 500
+	limit := ib.limit
+	if limit == nil {
+		limit = defaultIrcLimit
+	}
 	for i, s := range strings.Split(msg, "\n") {
 		if i > 6 {
 			return
 		} // just stop
 		if len(s) > 0 {
-			if len(s) > maxlen {
-				outs := ChunkSplit(s, maxlen)
+			if outs := limit.Limit(s); len(outs) > 1 {
 				for _, s := range outs {
 					ib.conn.Privmsg(target, prefix+s)
 					time.Sleep(100 * time.Millisecond) //slow down a flood
 				}
 			} else {
-				ib.conn.Privmsg(target, prefix+s)
+				ib.conn.Privmsg(target, prefix+outs[0])
 				if i > 0 {
 					time.Sleep(100 * time.Millisecond)
 				} //slow down a flood
@@ -108,22 +276,172 @@ func (ib *IrcBroker) HandleEvent(ev *Event, dis Dispatcher) {
 		// not intended for us, just ignore silently
 		return
 	}
+	// incr our counters
+	ib.mux.Lock()
+	ib.metrics.rcvd(ev)
+	ib.mux.Unlock()
+	go ib.sendEvent(ev)
+}
+
+func (ib *IrcBroker) sendEvent(ev *Event) {
+	target := ib.channel
+	if ev.ChannelBroker == ib && ev.Channel != "" {
+		// answering something said in one of our other channels
+		target = ev.Channel
+	}
+	if ev.ReplyBroker == ib && ev.ReplyTarget != "" {
+		// private message for a user
+		target = ev.ReplyTarget
+	}
+	if ev.Presence != "" {
+		ib.MsgTarget(target, ev.PresenceText(), "")
+		return
+	}
+	if ev.IsTopic {
+		ib.setTopic(ev.Text)
+		return
+	}
+	actor := ib.nicks.Sanitize(ev.Actor)
+	if ib.showStatus {
+		actor = ActorLabel(actor, ev.ActorStatus)
+	}
+	text := ib.rewrites.Rewrite(ev.ThreadContext + ev.Text)
+	if ib.dedup.DupEvent(target, ev, text) {
+		return
+	}
+	origin := ib.stamp.Prefix(ev)
+	if ib.originPrefix {
+		origin += OriginPrefix(ev, ib)
+	}
+	text += ib.stamp.Suffix(ev)
+	if ev.IsAction {
+		// best we can do is emote on their behalf
+		ib.conn.Action(target, fmt.Sprintf("%s%s %s", origin, actor, text))
+		return
+	}
 	var prefix string
 	if ev.IsCmdOutput {
-		prefix = ""
+		prefix = origin
 	} else {
-		prefix = fmt.Sprintf("|%s| ", ev.Actor)
+		prefix = fmt.Sprintf("%s|%s| ", origin, actor)
+	}
+	ib.MsgTarget(target, text, prefix)
+}
+
+func (ib *IrcBroker) handlePrivmsg(e *libirc.Event, dis Dispatcher) {
+	if ib.ignore.Ignored(e.Nick) {
+		return
+	}
+	ev := &Event{
+		Origin:  ib,
+		Actor:   e.Nick,
+		ActorId: ircAccount(e),
+		Text:    e.Message(),
+		ts:      time.Now(),
+	}
+	ib.cmdout.Mark(ev)
+	if len(e.Arguments) > 0 && e.Arguments[0] == ib.nick {
+		// a private message, answers go back to them alone
+		ev.ReplyTarget = e.Nick
+		ev.ReplyBroker = ib
+		ev.Private = true
+	} else if len(e.Arguments) > 0 {
+		ib.fromChannel(ev, e.Arguments[0])
 	}
-	// incr our counters
 	ib.mux.Lock()
-	ib.msgsRcvd += 1
+	ib.metrics.sent(ev)
 	ib.mux.Unlock()
-	if ev.ReplyBroker == ib {
-		// private message for a user
-		go ib.MsgTarget(ev.ReplyTarget, ev.Text, prefix)
-	} else {
-		go ib.MsgTarget(ib.channel, ev.Text, prefix)
+	dis.Broadcast(ev)
+}
+
+// the services account e's sender is logged in to, as account-tag tells us.
+// blank when they aren't or the server doesn't say
+func ircAccount(e *libirc.Event) string {
+	if acct := e.Tags["account"]; acct != "*" {
+		return acct
+	}
+	return ""
+}
+
+// a /me from one of our channels
+func (ib *IrcBroker) handleAction(e *libirc.Event, dis Dispatcher) {
+	if len(e.Arguments) < 2 || !ib.joined(e.Arguments[0]) ||
+		ib.ignore.Ignored(e.Nick) {
+		return
+	}
+	ev := &Event{
+		IsAction: true,
+		Origin:   ib,
+		Actor:    e.Nick,
+		ActorId:  ircAccount(e),
+		Text:     e.Message(),
+		ts:       time.Now(),
+	}
+	ib.fromChannel(ev, e.Arguments[0])
+	ib.mux.Lock()
+	ib.metrics.sent(ev)
+	ib.mux.Unlock()
+	dis.Broadcast(ev)
+}
+
+// someone joining or leaving one of our channels
+func (ib *IrcBroker) handlePresence(
+	e *libirc.Event, presence string, dis Dispatcher) {
+	if len(e.Arguments) < 1 || e.Nick == ib.nick || !ib.joined(e.Arguments[0]) ||
+		ib.ignore.Ignored(e.Nick) {
+		return
+	}
+	ev := &Event{
+		Presence: presence,
+		Origin:   ib,
+		Actor:    e.Nick,
+		Text:     e.Arguments[0],
+		ts:       time.Now(),
+	}
+	ib.fromChannel(ev, e.Arguments[0])
+	ib.mux.Lock()
+	ib.metrics.sent(ev)
+	ib.mux.Unlock()
+	dis.Broadcast(ev)
+}
+
+// only our main channel's topic is synced
+func (ib *IrcBroker) setTopic(topic string) {
+	ib.mux.Lock()
+	same := !ib.topicSync || topic == ib.topic
+	ib.topic = topic
+	ib.mux.Unlock()
+	if !same {
+		ib.conn.SendRawf("TOPIC %s :%s", ib.channel, topic)
+	}
+}
+
+// someone changing our channel's topic.  the change we just made coming back
+// around, ours or a matching one, isn't sent on so bridges don't loop
+func (ib *IrcBroker) handleTopic(e *libirc.Event, dis Dispatcher) {
+	if len(e.Arguments) < 1 || !strings.EqualFold(e.Arguments[0], ib.channel) ||
+		e.Nick == ib.nick || ib.ignore.Ignored(e.Nick) {
+		return
+	}
+	topic := e.Message()
+	ib.mux.Lock()
+	same := topic == ib.topic
+	ib.topic = topic
+	ib.mux.Unlock()
+	if same {
+		return
+	}
+	ev := &Event{
+		IsTopic: true,
+		Origin:  ib,
+		Actor:   e.Nick,
+		Text:    topic,
+		ts:      time.Now(),
 	}
+	ib.mux.Lock()
+	ib.metrics.sent(ev)
+	ib.mux.Unlock()
+	dis.Broadcast(ev)
 }
 
 func (ib *IrcBroker) Activate(dis Dispatcher) {
@@ -133,37 +451,19 @@ func (ib *IrcBroker) Activate(dis Dispatcher) {
 	// XXX this should ensure some sort of singleton to ensure Run should only
 	// ever be called once...
 	ib.conn.AddCallback("PRIVMSG", func(e *libirc.Event) {
-		// are we a priv msg?
-
-		// event needs IsPrivateMsg which then responds with the RespondTo broker set on
-		// replies.  Is this best way?  Should all messages go to all brokers?  Or should a
-		// broker have an option that says "RecvsPrivate"
-
-		ev := &Event{
-			Origin: ib,
-			Actor:  e.Nick,
-			Text:   e.Message(),
-			ts:     time.Now(),
-		}
-		if len(e.Arguments) > 0 && e.Arguments[0] == ib.nick {
-			ev.ReplyTarget = e.Nick
-			ev.ReplyBroker = ib
-		}
-		ib.mux.Lock()
-		ib.msgsSent++
-		ib.mux.Unlock()
-		dis.Broadcast(ev)
+		ib.handlePrivmsg(e, dis)
 	})
 	ib.conn.AddCallback("CTCP_ACTION", func(e *libirc.Event) {
-		if e.Arguments[0] == ib.channel {
-			ev := &Event{
-				Origin: ib,
-				Actor:  e.Nick,
-				Text:   fmt.Sprintf("_ %s %s _", e.Nick, e.Arguments[1]),
-				ts:     time.Now(),
-			}
-			dis.Broadcast(ev)
-		}
+		ib.handleAction(e, dis)
+	})
+	ib.conn.AddCallback("JOIN", func(e *libirc.Event) {
+		ib.handlePresence(e, PresenceJoin, dis)
+	})
+	ib.conn.AddCallback("PART", func(e *libirc.Event) {
+		ib.handlePresence(e, PresencePart, dis)
+	})
+	ib.conn.AddCallback("TOPIC", func(e *libirc.Event) {
+		ib.handleTopic(e, dis)
 	})
 }
 
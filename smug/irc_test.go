@@ -68,3 +68,353 @@ func TestConvertSlackRefs(t *testing.T) {
 
 }
 */
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	libirc "github.com/thoj/go-ircevent"
+)
+
+func TestIrcIgnoredActors(t *testing.T) {
+	ib := &IrcBroker{channel: "#chan", nick: "smug"}
+	ib.IgnoreActors(`.*-bot$`)
+	td := &TestDispatch{}
+	ib.handlePrivmsg(
+		&libirc.Event{Nick: "relay-bot", Arguments: []string{"#chan", "hi"}},
+		td,
+	)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: ignored actor was broadcast")
+	}
+	ib.handlePrivmsg(
+		&libirc.Event{Nick: "bob", Arguments: []string{"#chan", "hi"}},
+		td,
+	)
+	if td.lastbroadcast == nil || td.lastbroadcast.Actor != "bob" {
+		t.Errorf("err: expected bob to be broadcast")
+	}
+}
+
+// FakeIrcConn captures everything we'd send to the network as "CMD target msg"
+type FakeIrcConn struct {
+	mux  sync.Mutex
+	sent []string
+}
+
+func (fc *FakeIrcConn) AddCallback(string, func(*libirc.Event)) int { return 0 }
+func (fc *FakeIrcConn) Join(ch string)                              { fc.send("JOIN", ch, "") }
+func (fc *FakeIrcConn) Privmsg(t string, m string)                  { fc.send("PRIVMSG", t, m) }
+func (fc *FakeIrcConn) Action(t string, m string)                   { fc.send("ACTION", t, m) }
+func (fc *FakeIrcConn) SendRawf(f string, a ...interface{})         { fc.send(fmt.Sprintf(f, a...), "", "") }
+
+func (fc *FakeIrcConn) send(cmd string, target string, msg string) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	fc.sent = append(fc.sent, strings.TrimSpace(cmd+" "+target+" "+msg))
+}
+
+func TestActionRoundTrip(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{channel: "#chan", nick: "smug", conn: fc}
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1", api: fs}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	td := &TestDispatch{}
+
+	// irc /me -> slack italics
+	ib.handleAction(
+		&libirc.Event{Nick: "alice", Arguments: []string{"#chan", "waves"}}, td)
+	if !td.lastbroadcast.IsAction || td.lastbroadcast.Text != "waves" {
+		t.Errorf("err: irc action parsed badly %+v", td.lastbroadcast)
+	}
+	sb.HandleEvent(td.lastbroadcast, td)
+	if txt := postedText(fs.posted[0]); txt != "_waves_" {
+		t.Errorf("err: slack action got [%s]", txt)
+	}
+
+	// slack /me -> irc ctcp action
+	me := slackMsg("U2", "C1", "shrugs")
+	me.SubType = "me_message"
+	sb.handleMessage(me, td)
+	if !td.lastbroadcast.IsAction {
+		t.Errorf("err: slack me_message should be an action")
+	}
+	ib.sendEvent(td.lastbroadcast)
+	if len(fc.sent) != 1 || fc.sent[0] != "ACTION #chan bob shrugs" {
+		t.Errorf("err: irc action sent %v", fc.sent)
+	}
+
+	// plain brokers fall back to * actor text
+	if txt := td.lastbroadcast.ActionText(); txt != "* bob shrugs" {
+		t.Errorf("err: action text got [%s]", txt)
+	}
+}
+
+func TestIrcUrlRewrites(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{channel: "#chan", conn: fc}
+	ib.RewriteUrls([]UrlRewriteConfig{{Match: `internal\.corp`, Replace: "proxy.example.com"}})
+	ib.sendEvent(&Event{Actor: "bob", Text: "see http://internal.corp/x"})
+	if len(fc.sent) != 1 || fc.sent[0] != "PRIVMSG #chan |bob| see http://proxy.example.com/x" {
+		t.Errorf("err: rewritten url sent %v", fc.sent)
+	}
+}
+
+func TestIrcDedup(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{channel: "#chan", conn: fc}
+	ib.Dedup(time.Minute)
+	ib.sendEvent(&Event{Actor: "smug", Text: "weather: 3C"})
+	ib.sendEvent(&Event{Actor: "smug", Text: "weather: 3C"})
+	// someone else saying the same isn't a repeat
+	ib.sendEvent(&Event{Actor: "bob", Text: "weather: 3C"})
+	ib.sendEvent(&Event{Actor: "bob", Text: "weather: 3C", ReplyBroker: ib, ReplyTarget: "bob"})
+	if len(fc.sent) != 3 || fc.sent[1] != "PRIVMSG #chan |bob| weather: 3C" ||
+		fc.sent[2] != "PRIVMSG bob |bob| weather: 3C" {
+		t.Errorf("err: expected the channel repeat dropped %v", fc.sent)
+	}
+
+	ib.Dedup(0)
+	ib.sendEvent(&Event{Actor: "smug", Text: "weather: 3C"})
+	if len(fc.sent) != 4 {
+		t.Errorf("err: expected a 0 ttl to stop deduping %v", fc.sent)
+	}
+}
+
+func TestIrcChannelKeys(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{log: NewLogger("broker", "test"), conn: fc}
+	ib.setChannels("#main, #ops,#dev", ",s3cret")
+	ib.joinChannels(fc)
+	want := []string{"JOIN #main", "JOIN #ops s3cret", "JOIN #dev"}
+	if strings.Join(fc.sent, "|") != strings.Join(want, "|") {
+		t.Errorf("err: joined with %v", fc.sent)
+	}
+	if ib.channel != "#main" {
+		t.Errorf("err: primary channel is %s", ib.channel)
+	}
+}
+
+func TestIrcMultiChannelRouting(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{nick: "smug", conn: fc}
+	ib.setChannels("#main,#ops", "")
+	td := &TestDispatch{}
+
+	ib.handlePrivmsg(
+		&libirc.Event{Nick: "bob", Arguments: []string{"#ops", "..status"}}, td)
+	ev := td.lastbroadcast
+	if ev.ChannelBroker != ib || ev.Channel != "#ops" || ev.ThreadBroker != nil {
+		t.Errorf("err: expected #ops carried on the event %+v", ev)
+	}
+	// an answer copies the channel from what it answers
+	lcb := &LocalCmdBroker{}
+	lcb.Setup("smug", "", "1.0")
+	answer := lcb.NewEvent(ev)
+	answer.Text = "ok"
+	ib.sendEvent(answer)
+
+	ib.handlePrivmsg(
+		&libirc.Event{Nick: "bob", Arguments: []string{"#main", "hi"}}, td)
+	if td.lastbroadcast.ChannelBroker != nil {
+		t.Errorf("err: primary channel should not be carried along")
+	}
+	ib.sendEvent(&Event{Actor: "alice", Text: "hey"})
+
+	ib.handleAction(
+		&libirc.Event{Nick: "bob", Arguments: []string{"#ops", "waves"}}, td)
+	if td.lastbroadcast.Channel != "#ops" {
+		t.Errorf("err: action from #ops lost its channel")
+	}
+
+	want := []string{"PRIVMSG #ops ok", "PRIVMSG #main |alice| hey"}
+	if strings.Join(fc.sent, "|") != strings.Join(want, "|") {
+		t.Errorf("err: routed to %v", fc.sent)
+	}
+}
+
+func TestPresenceEvents(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{nick: "smug", conn: fc}
+	ib.setChannels("#main,#ops", "")
+	td := &TestDispatch{}
+
+	ib.handlePresence(
+		&libirc.Event{Nick: "smug", Arguments: []string{"#main"}}, PresenceJoin, td)
+	ib.handlePresence(
+		&libirc.Event{Nick: "bob", Arguments: []string{"#elsewhere"}}, PresenceJoin, td)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: our own joins and other channels aren't bridged")
+	}
+	ib.handlePresence(
+		&libirc.Event{Nick: "bob", Arguments: []string{"#main"}}, PresencePart, td)
+	if ev := td.lastbroadcast; ev == nil || ev.PresenceText() != "bob left #main" {
+		t.Errorf("err: irc part parsed badly %+v", ev)
+	}
+
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", channel: "general", mybotid: "UBOT", api: fs}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "alice"})
+	sb.handlePresence("U2", "C9", PresenceJoin, td)
+	sb.handlePresence("U2", "C1", PresenceJoin, td)
+	if ev := td.lastbroadcast; ev.Origin != sb || ev.PresenceText() != "alice joined #general" {
+		t.Errorf("err: slack join parsed badly %+v", ev)
+	}
+
+	// rendered by brokers that show presence
+	ib.sendEvent(td.lastbroadcast)
+	if len(fc.sent) != 1 || fc.sent[0] != "PRIVMSG #main alice joined #general" {
+		t.Errorf("err: irc presence sent %v", fc.sent)
+	}
+	sb.post(&Event{Presence: PresenceJoin, Actor: "bob", Text: "#main"})
+	if txt := postedText(fs.posted[0]); txt != "_bob joined #main_" {
+		t.Errorf("err: slack presence got [%s]", txt)
+	}
+}
+
+func TestIrcOriginPrefix(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{channel: "#chan", conn: fc}
+	other := &IrcBroker{channel: "#other"}
+	sb := &SlackBroker{chanid: "C1"}
+	LabelBroker(ib, &BrokerConfig{Type: "irc"})
+	LabelBroker(other, &BrokerConfig{Type: "irc"})
+	LabelBroker(sb, &BrokerConfig{Type: "slack", Alias: "slack"})
+	defer func() {
+		UnlabelBroker(ib)
+		UnlabelBroker(other)
+		UnlabelBroker(sb)
+	}()
+
+	ib.sendEvent(&Event{Origin: sb, Actor: "alice", Text: "hi"})
+	if fc.sent[0] != "PRIVMSG #chan |alice| hi" {
+		t.Errorf("err: prefix should be off by default %v", fc.sent)
+	}
+	ib.PrefixOrigins(true)
+	ib.sendEvent(&Event{Origin: sb, Actor: "alice", Text: "hi"})
+	ib.sendEvent(&Event{Origin: sb, Actor: "alice", Text: "waves", IsAction: true})
+	ib.sendEvent(&Event{Origin: other, Actor: "bob", Text: "hi"})
+	want := []string{
+		"PRIVMSG #chan [slack] |alice| hi",
+		"ACTION #chan [slack] alice waves",
+		"PRIVMSG #chan |bob| hi",
+	}
+	if strings.Join(fc.sent[1:], "\n") != strings.Join(want, "\n") {
+		t.Errorf("err: expected the prefix only from slack, have %q", fc.sent[1:])
+	}
+}
+
+func TestIrcShowStatus(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{channel: "#chan", conn: fc}
+	ev := &Event{Actor: "alice", ActorStatus: "🌴", Text: "hi"}
+	ib.sendEvent(ev)
+	ib.ShowStatus(true)
+	ib.sendEvent(ev)
+	ib.sendEvent(&Event{Actor: "bob", Text: "hi", ThreadContext: "re: lunch: "})
+	want := []string{
+		"PRIVMSG #chan |alice| hi",
+		"PRIVMSG #chan |alice [🌴]| hi",
+		"PRIVMSG #chan |bob| re: lunch: hi",
+	}
+	if strings.Join(fc.sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("err: expected the status only once shown, have %q", fc.sent)
+	}
+}
+
+func TestIrcTimestamps(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{channel: "#chan", conn: fc}
+	if err := ib.StampTimes("15:04", "UTC", "bottom"); err == nil {
+		t.Errorf("err: bad position should error")
+	}
+	if err := ib.StampTimes("15:04", "UTC", ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sent := time.Date(2020, 3, 4, 14, 5, 0, 0, time.UTC)
+	ib.sendEvent(&Event{Actor: "alice", Text: "hi", ts: sent})
+	ib.sendEvent(&Event{Actor: "alice", Text: "waves", IsAction: true, ts: sent})
+	ib.sendEvent(&Event{Actor: "bob", Text: "no time"})
+	ib.StampTimes("Jan 2 15:04", "UTC", "suffix")
+	ib.sendEvent(&Event{Actor: "alice", Text: "later", ts: sent})
+	want := []string{
+		"PRIVMSG #chan [14:05] |alice| hi",
+		"ACTION #chan [14:05] alice waves",
+		"PRIVMSG #chan |bob| no time",
+		"PRIVMSG #chan |alice| later [Mar 4 14:05]",
+	}
+	if strings.Join(fc.sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("err: expected stamped lines, have %q", fc.sent)
+	}
+}
+
+func TestTopicSync(t *testing.T) {
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{channel: "#chan", nick: "smug", conn: fc}
+	ib.SyncTopic(true)
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", mybotid: "UBOT", api: fs}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	td := &TestDispatch{}
+
+	changed := slackMsg("U2", "C1", "set the channel topic: deploy freeze")
+	changed.SubType = "channel_topic"
+	changed.Topic = "deploy freeze"
+	sb.handleMessage(changed, td)
+	ev := td.lastbroadcast
+	if ev == nil || !ev.IsTopic || ev.Text != "deploy freeze" || ev.Actor != "bob" {
+		t.Fatalf("err: expected a topic event %+v", ev)
+	}
+	ib.sendEvent(ev)
+	if len(fc.sent) != 1 || fc.sent[0] != "TOPIC #chan :deploy freeze" {
+		t.Errorf("err: irc topic not set %v", fc.sent)
+	}
+
+	// irc telling us about the change we made goes no further
+	td.lastbroadcast = nil
+	ib.handleTopic(&libirc.Event{Nick: "smug",
+		Arguments: []string{"#chan", "deploy freeze"}}, td)
+	ib.handleTopic(&libirc.Event{Nick: "ChanServ",
+		Arguments: []string{"#chan", "deploy freeze"}}, td)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: our own topic change came back %+v", td.lastbroadcast)
+	}
+
+	// slack doesn't sync so never sees it
+	cd := &CentralDispatch{}
+	cb := &ChanBroker{events: make(chan *Event, 1)}
+	cd.AddBroker(cb)
+	cd.Broadcast(ev)
+	cd.Broadcast(&Event{Origin: ib, Text: "hi"})
+	if got := <-cb.events; got.IsTopic {
+		t.Errorf("err: topic delivered to a broker that doesn't sync")
+	}
+	sb.HandleEvent(ev, td)
+	if len(fs.topics) != 0 || len(fs.posted) != 0 {
+		t.Errorf("err: topic applied without sync-topic %v", fs.topics)
+	}
+}
+
+func TestIrcConnTimeouts(t *testing.T) {
+	conn := libirc.IRC("smug", "smug")
+	ib := &IrcBroker{}
+	ib.applyTimeouts(conn)
+	if conn.Timeout != time.Minute || conn.PingFreq != 15*time.Minute {
+		t.Errorf("err: without timeouts the library defaults should stay")
+	}
+	nt, _ := NewNetTimeouts("10s", "30s")
+	ib.ConnTimeouts(nt)
+	ib.applyTimeouts(conn)
+	if conn.Timeout != 10*time.Second || conn.KeepAlive != 30*time.Second ||
+		conn.PingFreq != 30*time.Second {
+		t.Errorf("err: have timeout %s keepalive %s ping %s",
+			conn.Timeout, conn.KeepAlive, conn.PingFreq)
+	}
+}
@@ -0,0 +1,242 @@
+// config from a kv store
+// lets LoadConfig read consul://agent:8500/path/to/key or
+// etcd://host:2379/path/to/key so a fleet can share one config, and
+// WatchConfig follow that key for changes.  both stores are spoken to over
+// their plain http apis so there's nothing extra to vendor.
+
+package smug
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long consul holds a blocking query and how often etcd is re-read
+const (
+	consulWait = 5 * time.Minute
+	etcdPoll   = 30 * time.Second
+)
+
+// wait before trying a kv store again after an error, doubling each
+// failure in a row up to kvRetryMax
+var (
+	kvRetry    = 10 * time.Second
+	kvRetryMax = 5 * time.Minute
+)
+
+type KVClient interface {
+	// the value of key and the index it was last changed at
+	Get(key string) ([]byte, uint64, error)
+	// like Get, once key has changed past index or enough time has gone by
+	Wait(key string, index uint64) ([]byte, uint64, error)
+}
+
+// whether path names a kv store rather than a file or http url
+func IsKVConfig(path string) bool {
+	return strings.HasPrefix(path, "consul://") ||
+		strings.HasPrefix(path, "etcd://")
+}
+
+// the client and key for a consul:// or etcd:// path.  swapped out in tests
+var newKVClient = func(path string) (KVClient, string, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, "", err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, "", fmt.Errorf("kv config needs a host and key: %s", path)
+	}
+	base := "http://" + u.Host
+	switch u.Scheme {
+	case "consul":
+		return &consulKV{base: base, client: NewHttpClient()}, key, nil
+	case "etcd":
+		return &etcdKV{base: base, client: NewHttpClient(), poll: etcdPoll}, key, nil
+	}
+	return nil, "", fmt.Errorf("unknown kv store %s", u.Scheme)
+}
+
+func fetchKV(path string) ([]byte, error) {
+	kv, key, err := newKVClient(path)
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := kv.Get(key)
+	return body, err
+}
+
+// sleeps for wait, false if done closed first
+func kvSleep(wait time.Duration, done chan bool) bool {
+	select {
+	case <-time.After(wait):
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func kvBackoff(wait time.Duration) time.Duration {
+	if wait *= 2; wait > kvRetryMax {
+		wait = kvRetryMax
+	}
+	return wait
+}
+
+// follows the kv store at path, parsing each new value and handing it to
+// onChange until done is closed.  values that don't parse are logged and
+// skipped, leaving whatever was last good in place.  errors reaching the
+// store, even before the first read, are retried with backoff
+func WatchConfig(path string, onChange func(*Config), done chan bool) error {
+	kv, key, err := newKVClient(path)
+	if err != nil {
+		return err
+	}
+	log := NewLogger("ctx", "config")
+	wait := kvRetry
+	var index uint64
+	for {
+		if _, index, err = kv.Get(key); err == nil {
+			break
+		}
+		log.Warnf("ERR reading config %s, retrying in %s: %s", path, wait, err)
+		if !kvSleep(wait, done) {
+			return nil
+		}
+		wait = kvBackoff(wait)
+	}
+	wait = kvRetry
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		body, next, err := kv.Wait(key, index)
+		if err != nil {
+			log.Warnf("ERR watching config %s, retrying in %s: %s", path, wait, err)
+			if !kvSleep(wait, done) {
+				return nil
+			}
+			wait = kvBackoff(wait)
+			continue
+		}
+		wait = kvRetry
+		if next == index {
+			continue
+		}
+		index = next
+		cfg, err := ParseConfig(body)
+		if err != nil {
+			log.Warnf("ERR parsing changed config %s: %s", path, err)
+			continue
+		}
+		envOverrides(cfg)
+		onChange(cfg)
+	}
+}
+
+/* ************************** *
+ * consul
+ * ************************** */
+
+type consulKV struct {
+	base   string
+	client *http.Client
+}
+
+func (ck *consulKV) query(key string, params url.Values) ([]byte, uint64, error) {
+	params.Set("raw", "")
+	u := fmt.Sprintf("%s/v1/kv/%s?%s", ck.base, key, params.Encode())
+	resp, err := ck.client.Get(u)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, fmt.Errorf("consul key not found: %s", key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned %s for %s", resp.Status, key)
+	}
+	body, err := ReadLimited(resp.Body, DefaultMaxBodySize)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return body, index, nil
+}
+
+func (ck *consulKV) Get(key string) ([]byte, uint64, error) {
+	return ck.query(key, url.Values{})
+}
+
+// a blocking query, consul answers once the key changes or the wait is up
+func (ck *consulKV) Wait(key string, index uint64) ([]byte, uint64, error) {
+	return ck.query(key, url.Values{
+		"index": {strconv.FormatUint(index, 10)},
+		"wait":  {consulWait.String()},
+	})
+}
+
+/* ************************** *
+ * etcd
+ * ************************** */
+
+// talks to etcd's v3 json gateway
+type etcdKV struct {
+	base   string
+	client *http.Client
+	poll   time.Duration
+}
+
+func (ek *etcdKV) Get(key string) ([]byte, uint64, error) {
+	req, _ := json.Marshal(map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(key))})
+	resp, err := ek.client.Post(
+		ek.base+"/v3/kv/range", "application/json", bytes.NewReader(req))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("etcd returned %s for %s", resp.Status, key)
+	}
+	body, err := ReadLimited(resp.Body, DefaultMaxBodySize)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the gateway sends int64s as strings
+	var rng struct {
+		Kvs []struct {
+			Value       string `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+	if err := json.Unmarshal(body, &rng); err != nil {
+		return nil, 0, err
+	}
+	if len(rng.Kvs) == 0 {
+		return nil, 0, fmt.Errorf("etcd key not found: %s", key)
+	}
+	val, err := base64.StdEncoding.DecodeString(rng.Kvs[0].Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	rev, _ := strconv.ParseUint(rng.Kvs[0].ModRevision, 10, 64)
+	return val, rev, nil
+}
+
+// the gateway's watch is a stream, re-reading every so often is plenty for
+// config
+func (ek *etcdKV) Wait(key string, index uint64) ([]byte, uint64, error) {
+	time.Sleep(ek.poll)
+	return ek.Get(key)
+}
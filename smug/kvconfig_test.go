@@ -0,0 +1,153 @@
+package smug
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// FakeKV hands out its values in order, one per Get or Wait
+type FakeKV struct {
+	values []string
+	index  uint64
+	keys   []string
+	done   chan bool
+	// how many reads fail before values are handed out
+	fails int
+}
+
+func (fk *FakeKV) Get(key string) ([]byte, uint64, error) {
+	fk.keys = append(fk.keys, key)
+	if fk.fails > 0 {
+		fk.fails--
+		return nil, 0, fmt.Errorf("unreachable")
+	}
+	if len(fk.values) == 0 {
+		close(fk.done)
+		return nil, fk.index, fmt.Errorf("no more values")
+	}
+	val := fk.values[0]
+	fk.values = fk.values[1:]
+	fk.index++
+	return []byte(val), fk.index, nil
+}
+
+func (fk *FakeKV) Wait(key string, index uint64) ([]byte, uint64, error) {
+	return fk.Get(key)
+}
+
+// returns a func putting the real clients back
+func useFakeKV(fk *FakeKV) func() {
+	orig, retry := newKVClient, kvRetry
+	newKVClient = func(path string) (KVClient, string, error) {
+		return fk, path[len("consul://agent/"):], nil
+	}
+	kvRetry = 0
+	return func() { newKVClient, kvRetry = orig, retry }
+}
+
+const kvConfig = `
+version: 1
+active-brokers: [kv]
+brokers:
+  kv:
+    type: irc
+    server: %s
+`
+
+func TestKVConfig(t *testing.T) {
+	fk := &FakeKV{values: []string{fmt.Sprintf(kvConfig, "one.example.com")}}
+	defer useFakeKV(fk)()
+	cfg := LoadConfig("consul://agent/smug/config")
+	if fk.keys[0] != "smug/config" || cfg.Brokers["kv"].Server != "one.example.com" {
+		t.Errorf("err: config not loaded from kv %v %+v", fk.keys, cfg)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	fk := &FakeKV{
+		values: []string{
+			fmt.Sprintf(kvConfig, "one.example.com"),
+			fmt.Sprintf(kvConfig, "two.example.com"),
+			"brokers: [not, a, map]",
+			fmt.Sprintf(kvConfig, "three.example.com"),
+		},
+		done: make(chan bool),
+	}
+	defer useFakeKV(fk)()
+	seen := []string{}
+	err := WatchConfig("consul://agent/smug/config", func(cfg *Config) {
+		seen = append(seen, cfg.Brokers["kv"].Server)
+	}, fk.done)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(seen) != 2 || seen[0] != "two.example.com" || seen[1] != "three.example.com" {
+		t.Errorf("err: expected each good change once, have %v", seen)
+	}
+}
+
+func TestWatchConfigRetries(t *testing.T) {
+	fk := &FakeKV{
+		values: []string{
+			fmt.Sprintf(kvConfig, "one.example.com"),
+			fmt.Sprintf(kvConfig, "two.example.com"),
+		},
+		done:  make(chan bool),
+		fails: 3,
+	}
+	defer useFakeKV(fk)()
+	seen := []string{}
+	err := WatchConfig("consul://agent/smug/config", func(cfg *Config) {
+		seen = append(seen, cfg.Brokers["kv"].Server)
+	}, fk.done)
+	if err != nil {
+		t.Fatalf("err: a store that's down at first should be retried: %s", err)
+	}
+	if len(seen) != 1 || seen[0] != "two.example.com" {
+		t.Errorf("err: expected the change after the retries, have %v", seen)
+	}
+
+	if kvBackoff(time.Minute) != 2*time.Minute || kvBackoff(4*time.Minute) != kvRetryMax {
+		t.Errorf("err: backoff should double up to %s", kvRetryMax)
+	}
+}
+
+func TestKVClients(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/kv/smug/config":
+				w.Header().Set("X-Consul-Index", "42")
+				w.Write([]byte("version: 1"))
+			case "/v3/kv/range":
+				val := base64.StdEncoding.EncodeToString([]byte("version: 1"))
+				fmt.Fprintf(w, `{"kvs": [{"value": %q, "mod_revision": "7"}]}`, val)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer srv.Close()
+	host := srv.URL[len("http://"):]
+
+	for scheme, want := range map[string]uint64{"consul": 42, "etcd": 7} {
+		kv, key, err := newKVClient(scheme + "://" + host + "/smug/config")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		val, index, err := kv.Get(key)
+		if err != nil || string(val) != "version: 1" || index != want {
+			t.Errorf("err: %s got %q at %d %v", scheme, val, index, err)
+		}
+	}
+	kv, _, _ := newKVClient("consul://" + host + "/smug/config")
+	if _, _, err := kv.Get("nope"); err == nil {
+		t.Errorf("err: expected a missing key to error")
+	}
+	if _, _, err := newKVClient("consul://" + host); err == nil {
+		t.Errorf("err: expected a path without a key to error")
+	}
+}
@@ -21,6 +21,20 @@ var smugversion string
 
 const Prefix = ".."
 
+// whether text runs one of the commands LocalCmdBroker answers
+func isLocalCommand(text string) bool {
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		return false
+	}
+	for _, op := range []string{opVer, opMute, opUnmute, opThread, opStats} {
+		if args[0] == Prefix+op {
+			return true
+		}
+	}
+	return false
+}
+
 /*
  * ********************************************************
  * version command
@@ -56,6 +70,236 @@ func (vc *VersionCommand) match(ev *Event) bool {
 	return false
 }
 
+/*
+ * ********************************************************
+ * mute/unmute commands
+ * ********************************************************
+ */
+
+const (
+	opMute   = "mute"
+	opUnmute = "unmute"
+)
+
+// ..mute <broker> silences a broker, by config key or name, without
+// disconnecting it and ..unmute <broker> brings it back.  only allowed
+// actors may, see LocalCmdBroker.AllowMute
+type MuteCommand struct {
+	log *Logger
+	// unmutes rather than mutes
+	unmute bool
+	// the broker running us, muting it would leave no way back
+	self Broker
+	// who may, nobody when nil
+	allowed *ActorAllowlist
+}
+
+func (mc *MuteCommand) op() string {
+	if mc.unmute {
+		return opUnmute
+	}
+	return opMute
+}
+
+func (mc *MuteCommand) exec(oldE *Event, newE *Event, dis Dispatcher) {
+	newE.Text = mc.toggle(oldE, dis)
+	newE.RawText = newE.Text
+	newE.ts = time.Now()
+	dis.Broadcast(newE)
+}
+
+func (mc *MuteCommand) toggle(ev *Event, dis Dispatcher) string {
+	args := strings.Fields(ev.Text)
+	if len(args) != 2 {
+		return fmt.Sprintf("usage: %s%s <broker>", Prefix, mc.op())
+	}
+	if !mc.allowed.Allows(ev) {
+		mc.log.Infof("%s isn't allowed to %s %s", ev.Actor, mc.op(), args[1])
+		return fmt.Sprintf("%s isn't allowed to %s brokers", ev.Actor, mc.op())
+	}
+	bs, ok := dis.(BrokerSwitch)
+	if !ok {
+		return "brokers can't be muted here"
+	}
+	b := dis.FindBroker(args[1])
+	if b == nil {
+		return fmt.Sprintf("no broker %s", args[1])
+	}
+	if b == mc.self {
+		return fmt.Sprintf("%s can't mute itself", args[1])
+	}
+	if mc.unmute {
+		bs.Enable(b)
+		mc.log.Infof("%s unmuted %s", ev.Actor, DisplayName(b))
+		return fmt.Sprintf("unmuted %s", args[1])
+	}
+	bs.Disable(b)
+	mc.log.Infof("%s muted %s", ev.Actor, DisplayName(b))
+	return fmt.Sprintf("muted %s", args[1])
+}
+
+func (mc *MuteCommand) help() string {
+	if mc.unmute {
+		return fmt.Sprintf("%s%s <broker> - lets a muted broker talk again",
+			Prefix, opUnmute)
+	}
+	return fmt.Sprintf("%s%s <broker> - stops relaying to and from a broker",
+		Prefix, opMute)
+}
+
+func (mc *MuteCommand) match(ev *Event) bool {
+	args := strings.Fields(ev.Text)
+	return len(args) > 0 && args[0] == Prefix+mc.op()
+}
+
+/*
+ * ********************************************************
+ * thread command
+ * ********************************************************
+ */
+
+const opThread = "thread"
+
+const (
+	// messages a thread summary shows, the root and the latest replies
+	threadSummaryMax = 30
+	// characters of each message shown
+	threadLineMax = 300
+)
+
+// ..thread <broker>, run in a thread, sends the thread's messages to a
+// broker without threads so folks there can catch up.  only the actors who
+// may mute may, as it carries a thread somewhere its readers didn't choose
+type ThreadCommand struct {
+	log *Logger
+	// who may, nobody when nil
+	allowed *ActorAllowlist
+}
+
+func (tc *ThreadCommand) exec(oldE *Event, newE *Event, dis Dispatcher) {
+	newE.Text = tc.send(oldE, newE, dis)
+	newE.RawText = newE.Text
+	newE.ts = time.Now()
+	dis.Broadcast(newE)
+}
+
+// sends the summary, returning what to answer with
+func (tc *ThreadCommand) send(ev *Event, newE *Event, dis Dispatcher) string {
+	args := strings.Fields(ev.Text)
+	if len(args) != 2 {
+		return fmt.Sprintf("usage: %s%s <broker>", Prefix, opThread)
+	}
+	if !tc.allowed.Allows(ev) {
+		tc.log.Infof("%s isn't allowed to send threads to %s", ev.Actor, args[1])
+		return fmt.Sprintf("%s isn't allowed to send threads", ev.Actor)
+	}
+	if ev.ThreadId == "" {
+		return fmt.Sprintf("%s%s only works in a thread", Prefix, opThread)
+	}
+	if ev.Private {
+		return "private threads aren't sent anywhere"
+	}
+	tr, ok := ev.ThreadBroker.(ThreadReader)
+	if !ok {
+		return "threads here can't be read"
+	}
+	if dis.FindBroker(args[1]) == nil {
+		return fmt.Sprintf("no broker %s", args[1])
+	}
+	msgs, err := tr.ReadThread(ev)
+	if err != nil {
+		tc.log.Warnf("ERR reading thread %s: %s", ev.ThreadId, err)
+		return "couldn't read the thread"
+	}
+	summary := *newE
+	summary.ReplyBroker, summary.ReplyTarget = nil, ""
+	summary.ThreadId, summary.ThreadBroker = "", nil
+	summary.Text = threadSummary(msgs, DisplayName(ev.ThreadBroker), ev.Actor)
+	summary.RawText = summary.Text
+	summary.ts = time.Now()
+	dis.BroadcastTo(&summary, args[1])
+	tc.log.Infof("%s sent thread %s to %s", ev.Actor, ev.ThreadId, args[1])
+	return fmt.Sprintf("sent %d messages to %s", len(msgs), args[1])
+}
+
+// a line per message under a header, the root and the latest replies when
+// there are too many to show
+func threadSummary(msgs []*Event, from string, asker string) string {
+	lines := []string{fmt.Sprintf("thread on %s, %d messages, for %s:",
+		from, len(msgs), asker)}
+	for i, m := range msgs {
+		skipped := len(msgs) - threadSummaryMax
+		if skipped > 0 && i > 0 && i <= skipped {
+			if i == 1 {
+				lines = append(lines, fmt.Sprintf("… %d more", skipped))
+			}
+			continue
+		}
+		text := []rune(strings.Join(strings.Fields(m.Text), " "))
+		if len(text) > threadLineMax {
+			text = append(text[:threadLineMax], '…')
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", m.Actor, string(text)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (tc *ThreadCommand) help() string {
+	return fmt.Sprintf("%s%s <broker> - sends the thread it's run in to a broker",
+		Prefix, opThread)
+}
+
+func (tc *ThreadCommand) match(ev *Event) bool {
+	args := strings.Fields(ev.Text)
+	return len(args) > 0 && args[0] == Prefix+opThread
+}
+
+/*
+ * ********************************************************
+ * stats command
+ * ********************************************************
+ */
+
+const opStats = "stats"
+
+// ..stats shows how sends to each broker are going, what's queued and how
+// long they've been taking
+type StatsCommand struct{}
+
+func (sc *StatsCommand) exec(oldE *Event, newE *Event, dis Dispatcher) {
+	newE.Text = sendStatsText(dis)
+	newE.RawText = newE.Text
+	newE.ts = time.Now()
+	dis.Broadcast(newE)
+}
+
+func sendStatsText(dis Dispatcher) string {
+	ss, ok := dis.(SendStatter)
+	if !ok {
+		return "no stats here"
+	}
+	lines := []string{}
+	for _, st := range ss.SendStats() {
+		latency := "-"
+		if st.Latency > 0 {
+			latency = st.Latency.Round(time.Millisecond).String()
+		}
+		lines = append(lines, fmt.Sprintf("%s: %d queued, %s latency",
+			st.Broker, st.Queued, latency))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (sc *StatsCommand) help() string {
+	return fmt.Sprintf("%s%s - shows each broker's send queue and latency",
+		Prefix, opStats)
+}
+
+func (sc *StatsCommand) match(ev *Event) bool {
+	args := strings.Fields(ev.Text)
+	return len(args) > 0 && args[0] == Prefix+opStats
+}
+
 /*
  * ********************************************************
  * ** local cmd broker handles incoming local commands   **
@@ -68,49 +312,83 @@ type LocalCmdBroker struct {
 	botNick    string
 	botAvatar  string
 	mux        sync.RWMutex
-	msgsSent   int64
-	msgsRcvd   int64
+	metrics    Metrics
 }
 
 func (lcb *LocalCmdBroker) Name() string {
 	return "localcmd"
 }
 
+func (lcb *LocalCmdBroker) logger() *Logger { return lcb.log }
+
 func (lcb *LocalCmdBroker) Heartbeat() bool {
 	lcb.mux.Lock()
-	ms, mr := lcb.msgsSent, lcb.msgsRcvd
-	lcb.msgsSent, lcb.msgsRcvd = 0, 0
+	m := lcb.metrics
+	lcb.metrics = Metrics{}
 	lcb.mux.Unlock()
-	lcb.log.logMetrics(mr, ms)
+	lcb.log.logMetrics(m)
 	return true
 }
 
 // args [botnick, botavatar, version string]
-func (lcb *LocalCmdBroker) Setup(args ...string) {
+func (lcb *LocalCmdBroker) Setup(args ...string) error {
 	lcb.log = NewLogger("broker", "locmd")
 	if len(args) != 3 {
-		lcb.log.Fatal("command broker thrown with too few args")
+		return fmt.Errorf("command broker thrown with too few args")
 	}
 	lcb.botNick = args[0]
 	lcb.botAvatar = args[1]
 	lcb.prefixCmds = []Command{
 		&VersionCommand{Version: args[2], log: lcb.log},
+		&MuteCommand{log: lcb.log, self: lcb},
+		&MuteCommand{log: lcb.log, unmute: true, self: lcb},
+		&ThreadCommand{log: lcb.log},
+		&StatsCommand{},
 	}
+	return nil
+}
+
+// who may ..mute, ..unmute and ..thread, as <broker>:<id>, see
+// ActorAllowlist.  nobody may until this is called with someone
+func (lcb *LocalCmdBroker) AllowMute(actors []string) error {
+	allowed, err := NewActorAllowlist(actors)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range lcb.prefixCmds {
+		switch c := cmd.(type) {
+		case *MuteCommand:
+			c.allowed = allowed
+		case *ThreadCommand:
+			c.allowed = allowed
+		}
+	}
+	return nil
 }
 
 func (lcb *LocalCmdBroker) NewEvent(oldEvent *Event) *Event {
+	thread, tb := oldEvent.ReplyThread()
 	return &Event{
-		IsCmdOutput: true,
-		Origin:      lcb,
-		Actor:       lcb.botNick,
-		Avatar:      lcb.botAvatar,
-		ts:          time.Now(),
-		ReplyBroker: oldEvent.ReplyBroker,
-		ReplyTarget: oldEvent.ReplyTarget,
+		IsCmdOutput:   true,
+		Origin:        lcb,
+		Actor:         lcb.botNick,
+		Avatar:        lcb.botAvatar,
+		ts:            time.Now(),
+		ReplyBroker:   oldEvent.ReplyBroker,
+		ReplyTarget:   oldEvent.ReplyTarget,
+		Private:       oldEvent.Private,
+		ThreadId:      thread,
+		ThreadBroker:  tb,
+		Channel:       oldEvent.Channel,
+		ChannelBroker: oldEvent.ChannelBroker,
 	}
 }
 
 func (lcb *LocalCmdBroker) HandleEvent(ev *Event, dis Dispatcher) {
+	if ev.IsInjected {
+		// the inject token doesn't let anyone mute or move brokers
+		return
+	}
 	// short circuit if not prefixed by cmd prefix
 	// there may come a time when we have embedded commands
 	if len(ev.Text) >= len(Prefix) && ev.Text[:len(Prefix)] == Prefix {
@@ -119,7 +397,7 @@ func (lcb *LocalCmdBroker) HandleEvent(ev *Event, dis Dispatcher) {
 			if cmd.match(ev) {
 				cmd.exec(ev, lcb.NewEvent(ev), dis)
 				lcb.mux.Lock()
-				lcb.msgsRcvd++
+				lcb.metrics.rcvd(ev)
 				lcb.mux.Unlock()
 				return
 			}
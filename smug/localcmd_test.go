@@ -7,21 +7,28 @@ import (
 
 type TestDispatch struct {
 	lastbroadcast *Event
+	broadcasts    []*Event
 }
 
 // our mock Broadcast captures the last event broadcast to it in the
-// lastbroadcast member. this is not threadsafe in any way
+// lastbroadcast member, and all of them in broadcasts. this is not
+// threadsafe in any way
 func (td *TestDispatch) Broadcast(ev *Event) {
 	td.lastbroadcast = ev
+	td.broadcasts = append(td.broadcasts, ev)
+}
+func (td *TestDispatch) BroadcastTo(ev *Event, names ...string) {
+	td.lastbroadcast = ev
 }
 func (td *TestDispatch) AddBroker(Broker)          {}
 func (td *TestDispatch) RemoveBroker(Broker) error { return fmt.Errorf("wat?") }
 func (td *TestDispatch) NumBrokers() int           { return 0 }
+func (td *TestDispatch) FindBroker(string) Broker  { return nil }
 func (td *TestDispatch) Heartbeat()                {}
 
 func TestLocalVersionCommand(t *testing.T) {
 	myver := "99.99.99"
-	vc := &VersionCommand{Version: myver, log: NewLogger("testvc")}
+	vc := &VersionCommand{Version: myver, log: NewLogger("test", "testvc")}
 	td := &TestDispatch{}
 
 	// test our version command match
@@ -40,3 +47,70 @@ func TestLocalVersionCommand(t *testing.T) {
 			td.lastbroadcast.Text)
 	}
 }
+
+func TestLocalMuteCommand(t *testing.T) {
+	kind := registerTestBroker(t, "mute", func() Broker {
+		return &ChanBroker{events: make(chan *Event, 5)}
+	})
+	cd := NewCentralDispatch()
+	noisy, _ := NewBrokerFromConfig(&BrokerConfig{Key: "noisy", Type: kind})
+	cd.AddBroker(noisy)
+	slack, _ := NewBrokerFromConfig(&BrokerConfig{Key: "slack", Type: kind})
+	lcb := &LocalCmdBroker{}
+	lcb.Setup("smug", "", "1.0")
+	if err := lcb.AllowMute([]string{"alice"}); err == nil {
+		t.Errorf("err: expected a bare nick refused")
+	}
+	if err := lcb.AllowMute([]string{"slack:U1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	mute, unmute := lcb.prefixCmds[1].(*MuteCommand), lcb.prefixCmds[2].(*MuteCommand)
+
+	if !mute.match(&Event{Text: "..mute noisy"}) || mute.match(&Event{Text: "..muted"}) ||
+		mute.match(&Event{Text: "..unmute noisy"}) {
+		t.Errorf("err: mute matched the wrong commands")
+	}
+	for _, c := range []struct {
+		cmd  *MuteCommand
+		text string
+		want string
+	}{
+		{mute, "..mute", "usage: ..mute <broker>"},
+		{mute, "..mute nope", "no broker nope"},
+		{mute, "..mute noisy", "muted noisy"},
+		{unmute, "..unmute noisy", "unmuted noisy"},
+	} {
+		ev := &Event{Origin: slack, Actor: "alice", ActorId: "U1", Text: c.text}
+		if have := c.cmd.toggle(ev, cd); have != c.want {
+			t.Errorf("err: %s expected [%s] have [%s]", c.text, c.want, have)
+		}
+		if c.text == "..mute noisy" && cd.Enabled(noisy) {
+			t.Errorf("err: noisy should be disabled")
+		}
+	}
+	if !cd.Enabled(noisy) {
+		t.Errorf("err: noisy should be enabled again")
+	}
+	// taking alice's nick, or her id on another network, gets nowhere
+	for _, ev := range []*Event{
+		{Origin: slack, Actor: "alice", ActorId: "U2", Text: "..mute noisy"},
+		{Origin: noisy, Actor: "alice", ActorId: "U1", Text: "..mute noisy"},
+		{Actor: "alice", Text: "..mute noisy"},
+	} {
+		if have := mute.toggle(ev, cd); have != "alice isn't allowed to mute brokers" ||
+			!cd.Enabled(noisy) {
+			t.Errorf("err: expected only allowed actors to mute, have %s", have)
+		}
+	}
+	fresh := &LocalCmdBroker{}
+	fresh.Setup("smug", "", "1.0")
+	denied := fresh.prefixCmds[1].(*MuteCommand)
+	if have := denied.toggle(&Event{Origin: slack, Actor: "alice", ActorId: "U1",
+		Text: "..mute noisy"}, cd); have != "alice isn't allowed to mute brokers" {
+		t.Errorf("err: expected nobody allowed to mute by default, have %s", have)
+	}
+	if have := mute.toggle(&Event{Origin: slack, Actor: "alice", ActorId: "U1",
+		Text: "..mute noisy"}, &TestDispatch{}); have != "brokers can't be muted here" {
+		t.Errorf("err: expected dispatchers without a switch to refuse, have %s", have)
+	}
+}
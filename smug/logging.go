@@ -4,19 +4,164 @@ package smug
 
 import (
 	"os"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Logger struct {
 	log.Entry
+	lastBeat time.Time
+	// what NewLogger was given, eg the broker's name
+	context string
+	// the metrics last logged, until the dispatcher takes them for its
+	// MetricsSummary
+	beatMux sync.Mutex
+	beat    *Metrics
 }
 
-func (lg *Logger) logMetrics(rcvd int64, sent int64) {
+var (
+	beatsMux sync.RWMutex
+	// heartbeats and queue depths log at debug rather than info
+	quietBeats bool
+)
+
+// only show per broker heartbeats at debug level, eg when a MetricsSummary
+// already covers them
+func QuietHeartbeats(quiet bool) {
+	beatsMux.Lock()
+	defer beatsMux.Unlock()
+	quietBeats = quiet
+}
+
+func beatLevel() log.Level {
+	beatsMux.RLock()
+	defer beatsMux.RUnlock()
+	if quietBeats {
+		return log.DebugLevel
+	}
+	return log.InfoLevel
+}
+
+// counts since the last heartbeat.  rcvd is what a broker gets from the
+// dispatcher, sent what it broadcasts.  bytes are of event text
+type Metrics struct {
+	Rcvd      int64
+	Sent      int64
+	BytesRcvd int64
+	BytesSent int64
+}
+
+func (m *Metrics) rcvd(ev *Event) {
+	m.Rcvd++
+	m.BytesRcvd += int64(len(ev.Text))
+}
+
+func (m *Metrics) sent(ev *Event) {
+	m.Sent++
+	m.BytesSent += int64(len(ev.Text))
+}
+
+// per second over the interval, 0 if there was no interval
+func perSec(n int64, secs float64) float64 {
+	if secs <= 0 {
+		return 0
+	}
+	return float64(n) / secs
+}
+
+// how much each new latency counts towards a LatencyEMA
+const DefaultLatencyWeight = 0.2
+
+// an exponential moving average of latencies.  recent ones count most, so it
+// follows an endpoint slowing down without being thrown by one slow send
+type LatencyEMA struct {
+	mux    sync.Mutex
+	weight float64
+	avg    float64
+	primed bool
+}
+
+// weight, between 0 and 1, is how much each new latency counts
+func NewLatencyEMA(weight float64) *LatencyEMA {
+	if weight <= 0 || weight > 1 {
+		weight = DefaultLatencyWeight
+	}
+	return &LatencyEMA{weight: weight}
+}
+
+func (le *LatencyEMA) Observe(d time.Duration) {
+	le.mux.Lock()
+	defer le.mux.Unlock()
+	if !le.primed {
+		// the first is all there is to go on
+		le.avg, le.primed = float64(d), true
+		return
+	}
+	le.avg += le.weight * (float64(d) - le.avg)
+}
+
+// the average so far, zero before any were observed
+func (le *LatencyEMA) Value() time.Duration {
+	le.mux.Lock()
+	defer le.mux.Unlock()
+	return time.Duration(le.avg)
+}
+
+// the metrics logged since the last take, if any
+func (lg *Logger) takeBeat() (Metrics, bool) {
+	lg.beatMux.Lock()
+	defer lg.beatMux.Unlock()
+	m := lg.beat
+	lg.beat = nil
+	if m == nil {
+		return Metrics{}, false
+	}
+	return *m, true
+}
+
+// logs m along with rates over the time since our last heartbeat
+func (lg *Logger) logMetrics(m Metrics) {
+	now := time.Now()
+	secs := now.Sub(lg.lastBeat).Seconds()
+	lg.lastBeat = now
+	lg.beatMux.Lock()
+	lg.beat = &m
+	lg.beatMux.Unlock()
 	lg.WithFields(log.Fields{
-		"rcvd": rcvd,
-		"sent": sent,
-	}).Info("heartbeat")
+		"rcvd":               m.Rcvd,
+		"sent":               m.Sent,
+		"rcvd_bytes":         m.BytesRcvd,
+		"sent_bytes":         m.BytesSent,
+		"interval_secs":      secs,
+		"rcvd_per_sec":       perSec(m.Rcvd, secs),
+		"sent_per_sec":       perSec(m.Sent, secs),
+		"rcvd_bytes_per_sec": perSec(m.BytesRcvd, secs),
+		"sent_bytes_per_sec": perSec(m.BytesSent, secs),
+	}).Log(beatLevel(), "heartbeat")
+}
+
+func (lg *Logger) logQueue(depth int, dropped int64) {
+	lg.WithFields(log.Fields{
+		"queued":  depth,
+		"dropped": dropped,
+	}).Log(beatLevel(), "queue")
+}
+
+func (lg *Logger) logSendQueue(depth int, dropped int64, latency time.Duration) {
+	lg.WithFields(log.Fields{
+		"queued":     depth,
+		"dropped":    dropped,
+		"latency_ms": latency.Seconds() * 1000,
+	}).Log(beatLevel(), "queue")
+}
+
+func (lg *Logger) logFeedback(depth int, dropped int64) {
+	lg.WithFields(log.Fields{
+		"queued":  depth,
+		"dropped": dropped,
+	}).Log(beatLevel(), "feedback")
 }
 
 func init() {
@@ -40,5 +185,9 @@ func SetupLogging(loglevel string) {
 }
 
 func NewLogger(key string, context string) *Logger {
-	return &Logger{*log.WithFields(log.Fields{key: context})}
+	return &Logger{
+		Entry:    *log.WithFields(log.Fields{key: context}),
+		lastBeat: time.Now(),
+		context:  context,
+	}
 }
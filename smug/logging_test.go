@@ -0,0 +1,74 @@
+package smug
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogMetrics(t *testing.T) {
+	buf := &bytes.Buffer{}
+	lgr := log.New()
+	lgr.SetOutput(buf)
+	lgr.SetFormatter(&log.JSONFormatter{})
+	lgr.SetLevel(log.InfoLevel)
+	lg := &Logger{
+		Entry:    *lgr.WithFields(log.Fields{"broker": "test"}),
+		lastBeat: time.Now().Add(-10 * time.Second),
+	}
+
+	m := Metrics{}
+	m.rcvd(&Event{Text: "hello"})
+	m.rcvd(&Event{Text: "world!"})
+	m.sent(&Event{Text: "0123456789"})
+	lg.logMetrics(m)
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("err: heartbeat not json %s: %s", err, buf.String())
+	}
+	testwants := map[string]float64{
+		"rcvd":       2,
+		"sent":       1,
+		"rcvd_bytes": 11,
+		"sent_bytes": 10,
+	}
+	for k, want := range testwants {
+		if fields[k] != want {
+			t.Errorf("err: %s have %v wanted %v", k, fields[k], want)
+		}
+	}
+	// roughly 10 seconds have passed
+	if rate, _ := fields["sent_bytes_per_sec"].(float64); rate < 0.9 || rate > 1.0 {
+		t.Errorf("err: sent_bytes_per_sec have %v wanted ~1", fields["sent_bytes_per_sec"])
+	}
+	if rate, _ := fields["rcvd_per_sec"].(float64); rate < 0.19 || rate > 0.2 {
+		t.Errorf("err: rcvd_per_sec have %v wanted ~0.2", fields["rcvd_per_sec"])
+	}
+}
+
+func TestLatencyEMA(t *testing.T) {
+	le := NewLatencyEMA(0.5)
+	if le.Value() != 0 {
+		t.Errorf("err: expected nothing before any latencies, have %s", le.Value())
+	}
+	for _, c := range []struct {
+		latency time.Duration
+		want    time.Duration
+	}{
+		{100 * time.Millisecond, 100 * time.Millisecond},
+		{200 * time.Millisecond, 150 * time.Millisecond},
+		{50 * time.Millisecond, 100 * time.Millisecond},
+		{100 * time.Millisecond, 100 * time.Millisecond},
+	} {
+		if le.Observe(c.latency); le.Value() != c.want {
+			t.Errorf("err: after %s expected %s, have %s", c.latency, c.want, le.Value())
+		}
+	}
+	if NewLatencyEMA(3).weight != DefaultLatencyWeight {
+		t.Errorf("err: a weight over 1 should use the default")
+	}
+}
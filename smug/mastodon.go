@@ -0,0 +1,353 @@
+// broker: mastodon
+// streams a hashtag or timeline from a mastodon instance as inbound events and
+// posts anything it receives as statuses
+
+package smug
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBroker("mastodon", func() Broker { return &MastodonBroker{} })
+}
+
+// mastodon's default status length
+const tootMaxLen = 500
+
+// how long a call to the mastodon api may take, streams aside
+var mastodonTimeout = 30 * time.Second
+
+var defaultTootLimit = &MessageLimiter{
+	maxLen: tootMaxLen, truncate: true, tail: "…"}
+
+type MastodonAccount struct {
+	Acct   string `json:"acct"`
+	Avatar string `json:"avatar"`
+}
+
+type Toot struct {
+	Id      string          `json:"id"`
+	Content string          `json:"content"`
+	Account MastodonAccount `json:"account"`
+}
+
+/* ************************** *
+ * mastodon api surface
+ * ************************** */
+
+type mastodonAPI interface {
+	// our own account name, used to ignore our own statuses
+	Me() (string, error)
+	PostStatus(status string, visibility string) error
+	// blocks, sending toots until the stream ends, errors or ctx is done
+	Stream(ctx context.Context, timeline string, toots chan<- *Toot) error
+}
+
+type mastodonClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+func (mc *mastodonClient) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+mc.token)
+	resp, err := mc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("mastodon api %s: %s", req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (mc *mastodonClient) Me() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mastodonTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx,
+		"GET", mc.server+"/api/v1/accounts/verify_credentials", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := mc.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var acct MastodonAccount
+	if err := json.NewDecoder(resp.Body).Decode(&acct); err != nil {
+		return "", err
+	}
+	return acct.Acct, nil
+}
+
+func (mc *mastodonClient) PostStatus(status string, visibility string) error {
+	form := url.Values{"status": {status}, "visibility": {visibility}}
+	ctx, cancel := context.WithTimeout(context.Background(), mastodonTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx,
+		"POST", mc.server+"/api/v1/statuses", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := mc.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// timeline is either #hashtag, home or public
+func (mc *mastodonClient) Stream(ctx context.Context, timeline string, toots chan<- *Toot) error {
+	path := "/api/v1/streaming/public"
+	if strings.HasPrefix(timeline, "#") {
+		path = "/api/v1/streaming/hashtag?tag=" +
+			url.QueryEscape(timeline[1:])
+	} else if timeline == "home" {
+		path = "/api/v1/streaming/user"
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", mc.server+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := mc.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return parseTootStream(bufio.NewScanner(resp.Body), toots)
+}
+
+// server-sent events, we only care about the data of update events
+func parseTootStream(sc *bufio.Scanner, toots chan<- *Toot) error {
+	sc.Buffer(make([]byte, 64*1024), int(DefaultMaxBodySize))
+	event := ""
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:") && event == "update":
+			toot := &Toot{}
+			data := strings.TrimSpace(line[len("data:"):])
+			if err := json.Unmarshal([]byte(data), toot); err == nil {
+				toots <- toot
+			}
+		case line == "":
+			event = ""
+		}
+	}
+	return sc.Err()
+}
+
+/* ************************** *
+ * mastodon broker
+ * ************************** */
+
+var (
+	re_tootbreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>\s*<p>`)
+	re_toottags   = regexp.MustCompile(`<[^>]*>`)
+)
+
+// toots arrive as html, reduce to plain text similar to slack's SimplifyParse
+func SimplifyToot(s string) string {
+	s = re_tootbreaks.ReplaceAllString(s, "\n")
+	s = re_toottags.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+type MastodonBroker struct {
+	log        *Logger
+	api        mastodonAPI
+	server     string
+	timeline   string
+	visibility string
+	me         string
+	done       chan bool
+	// cancelled by Deactivate, hanging up the stream
+	stream  context.Context
+	hangup  context.CancelFunc
+	mux     sync.RWMutex
+	metrics Metrics
+	// prefix statuses from other networks with where they came from
+	originPrefix bool
+	// show actors' statuses after their names
+	showStatus bool
+	chatOptions
+}
+
+func (mb *MastodonBroker) Name() string {
+	return fmt.Sprintf("mastodon-%s-%s", mb.server, mb.timeline)
+}
+
+func (mb *MastodonBroker) logger() *Logger { return mb.log }
+
+func (mb *MastodonBroker) Heartbeat() bool {
+	mb.mux.Lock()
+	m := mb.metrics
+	mb.metrics = Metrics{}
+	mb.mux.Unlock()
+	mb.log.logMetrics(m)
+	return true
+}
+
+// prefix statuses from other kinds of broker with theirs, eg [irc]
+func (mb *MastodonBroker) PrefixOrigins(on bool) {
+	mb.originPrefix = on
+}
+
+// show the status actors have on their network, eg a slack user's status
+// emoji, after their name: alice [🌴]: hi
+func (mb *MastodonBroker) ShowStatus(on bool) {
+	mb.showStatus = on
+}
+
+// args [server, token, timeline, visibility]
+func (mb *MastodonBroker) Setup(args ...string) error {
+	mb.server = strings.TrimRight(args[0], "/")
+	mb.timeline = args[2]
+	mb.visibility = "unlisted"
+	if len(args) > 3 && args[3] != "" {
+		mb.visibility = args[3]
+	}
+	mb.log = NewLogger("broker", DisplayName(mb))
+	mb.done = make(chan bool)
+	mb.stream, mb.hangup = context.WithCancel(context.Background())
+	if mb.api == nil {
+		if !strings.HasPrefix(mb.server, "http") {
+			mb.server = "https://" + mb.server
+		}
+		mb.api = &mastodonClient{
+			server: mb.server,
+			token:  args[1],
+			client: mb.timeouts.HttpClient(),
+		}
+	}
+	me, err := mb.api.Me()
+	if err != nil {
+		return fmt.Errorf("unable to verify mastodon credentials: %s", err)
+	}
+	mb.me = me
+	return nil
+}
+
+func (mb *MastodonBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	nt, err := NewNetTimeouts(cfg.DialTimeout, cfg.KeepAlive)
+	if err != nil {
+		return err
+	}
+	mb.ConnTimeouts(nt)
+	err = mb.Setup(cfg.Server, cfg.ApiToken, cfg.Channel, cfg.Visibility)
+	if err != nil {
+		return err
+	}
+	mb.PrefixOrigins(cfg.OriginPrefix)
+	mb.ShowStatus(cfg.ShowStatus)
+	err = mb.StampTimes(cfg.TimestampLayout, cfg.TimestampZone, cfg.TimestampPosition)
+	if err != nil {
+		return err
+	}
+	return mb.configure(cfg)
+}
+
+func (mb *MastodonBroker) HandleEvent(ev *Event, dis Dispatcher) {
+	if ev.ReplyBroker != nil && ev.ReplyBroker != mb {
+		return
+	}
+	mb.mux.Lock()
+	mb.metrics.rcvd(ev)
+	mb.mux.Unlock()
+	status := ev.ThreadContext + ev.Text
+	if ev.IsAction {
+		status = ev.ActionText()
+	} else if !ev.IsCmdOutput && ev.Actor != "" {
+		actor := ev.Actor
+		if mb.showStatus {
+			actor = ActorLabel(actor, ev.ActorStatus)
+		}
+		status = fmt.Sprintf("%s: %s%s", actor, ev.ThreadContext, ev.Text)
+	}
+	if mb.originPrefix {
+		status = OriginPrefix(ev, mb) + status
+	}
+	status = mb.stamp.Stamp(ev, status)
+	status = mb.rewrites.Rewrite(status)
+	if mb.dedup.DupEvent(mb.visibility, ev, status) {
+		return
+	}
+	limit := mb.limit
+	if limit == nil {
+		limit = defaultTootLimit
+	}
+	for _, s := range limit.Limit(status) {
+		if err := mb.api.PostStatus(s, mb.visibility); err != nil {
+			mb.log.Warnf("ERR posting status: %s", err)
+			return
+		}
+	}
+}
+
+func (mb *MastodonBroker) handleToot(toot *Toot, dis Dispatcher) {
+	if toot.Account.Acct == mb.me || mb.ignore.Ignored(toot.Account.Acct) {
+		// our own status coming back around
+		return
+	}
+	txt := SimplifyToot(toot.Content)
+	ev := &Event{
+		Origin:  mb,
+		Actor:   toot.Account.Acct,
+		ActorId: toot.Account.Acct,
+		Avatar:  toot.Account.Avatar,
+		Text:    txt,
+		RawText: toot.Content,
+		ts:      time.Now(),
+	}
+	mb.cmdout.Mark(ev)
+	mb.mux.Lock()
+	mb.metrics.sent(ev)
+	mb.mux.Unlock()
+	dis.Broadcast(ev)
+}
+
+func (mb *MastodonBroker) Activate(dis Dispatcher) {
+	toots := make(chan *Toot, 10)
+	go func() {
+		for {
+			err := mb.api.Stream(mb.stream, mb.timeline, toots)
+			mb.log.Warnf("mastodon stream ended: %v", err)
+			select {
+			case <-mb.done:
+				return
+			case <-time.After(10 * time.Second):
+				// back off a bit before reconnecting
+			}
+		}
+	}()
+	for {
+		select {
+		case toot := <-toots:
+			mb.handleToot(toot, dis)
+		case <-mb.done:
+			return
+		}
+	}
+}
+
+func (mb *MastodonBroker) Deactivate() {
+	mb.hangup()
+	close(mb.done)
+}
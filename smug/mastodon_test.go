@@ -0,0 +1,134 @@
+package smug
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type FakeMastodonAPI struct {
+	posted []string
+}
+
+func (fm *FakeMastodonAPI) Me() (string, error) { return "smug", nil }
+func (fm *FakeMastodonAPI) PostStatus(status string, visibility string) error {
+	fm.posted = append(fm.posted, visibility+"|"+status)
+	return nil
+}
+func (fm *FakeMastodonAPI) Stream(context.Context, string, chan<- *Toot) error {
+	return nil
+}
+
+func TestSimplifyToot(t *testing.T) {
+	testwants := map[string]string{
+		"hi there":      SimplifyToot("<p>hi there</p>"),
+		"a\nb":          SimplifyToot("<p>a</p><p>b</p>"),
+		"c\nd":          SimplifyToot("<p>c<br />d</p>"),
+		"#go & vim > x": SimplifyToot(`<p><a href="http://x" class="hashtag">#<span>go</span></a> &amp; vim &gt; x</p>`),
+	}
+	for want, have := range testwants {
+		if want != have {
+			t.Errorf("err: have [%s] wanted [%s]", have, want)
+		}
+	}
+}
+
+func TestTootStream(t *testing.T) {
+	stream := strings.Join([]string{
+		":thump",
+		"event: update",
+		`data: {"id":"1","content":"<p>hi</p>","account":{"acct":"bob"}}`,
+		"",
+		"event: delete",
+		"data: 1",
+		"",
+	}, "\n")
+	toots := make(chan *Toot, 5)
+	parseTootStream(bufio.NewScanner(strings.NewReader(stream)), toots)
+	if len(toots) != 1 {
+		t.Errorf("err: expected 1 toot, got %d", len(toots))
+		return
+	}
+	if toot := <-toots; toot.Account.Acct != "bob" {
+		t.Errorf("err: toot parsed badly %+v", toot)
+	}
+}
+
+func TestMastodonClientDeadlines(t *testing.T) {
+	orig := mastodonTimeout
+	mastodonTimeout = 50 * time.Millisecond
+	defer func() { mastodonTimeout = orig }()
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v1/streaming/public" {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+			}
+			<-release
+		}))
+	defer srv.Close()
+	defer close(release)
+	nt, _ := NewNetTimeouts("5s", "")
+	mc := &mastodonClient{server: srv.URL, token: "tok", client: nt.HttpClient()}
+
+	started := time.Now()
+	if err := mc.PostStatus("hi", "public"); err == nil {
+		t.Errorf("err: a hung post should time out")
+	}
+	if _, err := mc.Me(); err == nil {
+		t.Errorf("err: a hung credentials check should time out")
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("err: took %s to give up", time.Since(started))
+	}
+
+	// streams run until they're hung up
+	ctx, cancel := context.WithCancel(context.Background())
+	ended := make(chan error)
+	go func() { ended <- mc.Stream(ctx, "public", make(chan *Toot)) }()
+	select {
+	case <-ended:
+		t.Fatalf("err: a stream shouldn't be held to the api timeout")
+	case <-time.After(150 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Errorf("err: cancelling didn't end the stream")
+	}
+}
+
+func TestMastodonBroker(t *testing.T) {
+	fm := &FakeMastodonAPI{}
+	mb := &MastodonBroker{api: fm}
+	if err := mb.Setup("example.com", "tok", "#smug", "public"); err != nil {
+		t.Errorf("err: setup failed %s", err)
+		return
+	}
+	td := &TestDispatch{}
+
+	mb.handleToot(&Toot{Content: "<p>mine</p>", Account: MastodonAccount{Acct: "smug"}}, td)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: our own toot should not be broadcast")
+	}
+	mb.handleToot(&Toot{Content: "<p>hello</p>", Account: MastodonAccount{Acct: "bob"}}, td)
+	if td.lastbroadcast == nil || td.lastbroadcast.Text != "hello" {
+		t.Errorf("err: expected toot to be broadcast")
+	}
+
+	mb.HandleEvent(&Event{Actor: "alice", Text: "hi", ThreadContext: "re: lunch: "}, td)
+	mb.HandleEvent(&Event{Actor: "alice", Text: strings.Repeat("x", 600)}, td)
+	if len(fm.posted) != 2 || fm.posted[0] != "public|alice: re: lunch: hi" {
+		t.Errorf("err: posted %v", fm.posted)
+		return
+	}
+	if n := len([]rune(strings.TrimPrefix(fm.posted[1], "public|"))); n != tootMaxLen {
+		t.Errorf("err: long status should be truncated to %d, got %d", tootMaxLen, n)
+	}
+}
@@ -0,0 +1,315 @@
+// broker: poll
+// fetches a feed every so often and broadcasts any items it hasn't seen
+// before, so rss/atom feeds or a json status endpoint can be piped into chat
+// without something external sending webhooks.  consumes nothing inbound.
+
+package smug
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBroker("poll", func() Broker { return &PollBroker{} })
+}
+
+const DefaultPollInterval = 5 * time.Minute
+
+// ids remembered for deduping, enough to cover any sane feed's length
+const pollSeenMax = 1000
+
+/* ************************** *
+ * feed parsing
+ * ************************** */
+
+type FeedItem struct {
+	Id   string
+	Text string
+	Link string
+}
+
+// rss 2.0 items or atom entries, whichever the document has
+type xmlFeed struct {
+	Items []struct {
+		Guid  string `xml:"guid"`
+		Title string `xml:"title"`
+		Link  string `xml:"link"`
+	} `xml:"channel>item"`
+	Entries []struct {
+		Id    string `xml:"id"`
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+func ParseXmlFeed(body []byte) ([]*FeedItem, error) {
+	var feed xmlFeed
+	if err := xml.Unmarshal(body, &feed); err != nil {
+		return nil, err
+	}
+	items := []*FeedItem{}
+	for _, it := range feed.Items {
+		fi := &FeedItem{Id: it.Guid, Text: it.Title, Link: it.Link}
+		if fi.Id == "" {
+			fi.Id = fi.Link
+		}
+		items = append(items, fi)
+	}
+	for _, ent := range feed.Entries {
+		fi := &FeedItem{Id: ent.Id, Text: ent.Title}
+		for _, l := range ent.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				fi.Link = l.Href
+				break
+			}
+		}
+		items = append(items, fi)
+	}
+	return items, nil
+}
+
+// walks a dotted path like data.items.0.id through decoded json, nil if any
+// step is missing.  an empty path is v itself
+func jsonPath(v interface{}, path string) interface{} {
+	if path == "" {
+		return v
+	}
+	for _, step := range strings.Split(path, ".") {
+		switch cur := v.(type) {
+		case map[string]interface{}:
+			v = cur[step]
+		case []interface{}:
+			i, err := strconv.Atoi(step)
+			if err != nil || i < 0 || i >= len(cur) {
+				return nil
+			}
+			v = cur[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func jsonString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprint(v))
+}
+
+// where a json feed keeps its list of items and the id, text and link of each
+type JsonFeedPaths struct {
+	Items string
+	Id    string
+	Text  string
+	Link  string
+}
+
+func ParseJsonFeed(body []byte, paths *JsonFeedPaths) ([]*FeedItem, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	// keep big numeric ids from turning into floats
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	list, ok := jsonPath(doc, paths.Items).([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("no list of items at %q", paths.Items)
+	}
+	items := []*FeedItem{}
+	for _, it := range list {
+		items = append(items, &FeedItem{
+			Id:   jsonString(jsonPath(it, paths.Id)),
+			Text: jsonString(jsonPath(it, paths.Text)),
+			Link: jsonString(jsonPath(it, paths.Link)),
+		})
+	}
+	return items, nil
+}
+
+/* ************************** *
+ * poll broker
+ * ************************** */
+
+type PollBroker struct {
+	log      *Logger
+	url      string
+	nick     string
+	interval time.Duration
+	paths    *JsonFeedPaths
+	fetch    func(string) ([]byte, error)
+	// ids already broadcast, oldest first, and whether we've polled yet
+	seen    map[string]bool
+	order   []string
+	primed  bool
+	done    chan bool
+	mux     sync.Mutex
+	metrics Metrics
+}
+
+func (pb *PollBroker) Name() string {
+	return fmt.Sprintf("poll-%s", pb.url)
+}
+
+func (pb *PollBroker) logger() *Logger { return pb.log }
+
+func (pb *PollBroker) Heartbeat() bool {
+	pb.mux.Lock()
+	m := pb.metrics
+	pb.metrics = Metrics{}
+	pb.mux.Unlock()
+	pb.log.logMetrics(m)
+	return true
+}
+
+// args [url, interval, nick]
+// interval a duration like 10m, nick the actor items are posted as
+func (pb *PollBroker) Setup(args ...string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("poll broker needs 3 args, got %d", len(args))
+	}
+	pb.url = args[0]
+	if pb.url == "" {
+		return fmt.Errorf("poll broker needs a url")
+	}
+	pb.log = NewLogger("broker", DisplayName(pb))
+	pb.interval = DefaultPollInterval
+	if args[1] != "" {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid poll interval %s", args[1])
+		}
+		pb.interval = d
+	}
+	pb.nick = "smug"
+	if args[2] != "" {
+		pb.nick = args[2]
+	}
+	pb.paths = &JsonFeedPaths{Id: "id", Text: "title", Link: "url"}
+	if pb.fetch == nil {
+		pb.fetch = FetchUrl
+	}
+	pb.seen = make(map[string]bool)
+	pb.done = make(chan bool)
+	return nil
+}
+
+func (pb *PollBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	if err := pb.Setup(cfg.Url, cfg.PollInterval, cfg.Nick); err != nil {
+		return err
+	}
+	pb.JsonPaths(cfg.ItemsPath, cfg.IdPath, cfg.TextPath, cfg.LinkPath)
+	return nil
+}
+
+// where json feeds keep their items, blank keeps the default.  items
+// defaults to the top level list, and each item's id, title and url
+func (pb *PollBroker) JsonPaths(items, id, text, link string) {
+	pb.paths.Items = items
+	if id != "" {
+		pb.paths.Id = id
+	}
+	if text != "" {
+		pb.paths.Text = text
+	}
+	if link != "" {
+		pb.paths.Link = link
+	}
+}
+
+// we don't consume anything
+func (pb *PollBroker) HandleEvent(ev *Event, dis Dispatcher) {}
+
+func (pb *PollBroker) parse(body []byte) ([]*FeedItem, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return ParseJsonFeed(trimmed, pb.paths)
+	}
+	return ParseXmlFeed(trimmed)
+}
+
+// remember id, forgetting the oldest once we're holding too many.  false if
+// it was already seen
+func (pb *PollBroker) remember(id string) bool {
+	if pb.seen[id] {
+		return false
+	}
+	pb.seen[id] = true
+	pb.order = append(pb.order, id)
+	if len(pb.order) > pollSeenMax {
+		delete(pb.seen, pb.order[0])
+		pb.order = pb.order[1:]
+	}
+	return true
+}
+
+// fetch the feed and broadcast what's new.  the first poll only learns what's
+// already there so a restart doesn't repost the whole feed
+func (pb *PollBroker) poll(dis Dispatcher) {
+	body, err := pb.fetch(pb.url)
+	if err != nil {
+		pb.log.Warnf("ERR fetching %s: %s", pb.url, err)
+		return
+	}
+	items, err := pb.parse(body)
+	if err != nil {
+		pb.log.Warnf("ERR parsing %s: %s", pb.url, err)
+		return
+	}
+	fresh := []*FeedItem{}
+	pb.mux.Lock()
+	for _, it := range items {
+		if it.Id == "" || !pb.remember(it.Id) {
+			continue
+		}
+		if pb.primed {
+			fresh = append(fresh, it)
+		}
+	}
+	pb.primed = true
+	pb.mux.Unlock()
+
+	// feeds list newest first, post them in the order they happened
+	for i := len(fresh) - 1; i >= 0; i-- {
+		it := fresh[i]
+		text := strings.TrimSpace(it.Text + " " + it.Link)
+		if text == "" {
+			continue
+		}
+		ev := &Event{Origin: pb, Actor: pb.nick, Text: text}
+		pb.mux.Lock()
+		pb.metrics.sent(ev)
+		pb.mux.Unlock()
+		dis.Broadcast(ev)
+	}
+}
+
+func (pb *PollBroker) Activate(dis Dispatcher) {
+	pb.poll(dis)
+	ticker := time.NewTicker(pb.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pb.poll(dis)
+		case <-pb.done:
+			return
+		}
+	}
+}
+
+func (pb *PollBroker) Deactivate() {
+	close(pb.done)
+}
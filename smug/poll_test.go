@@ -0,0 +1,79 @@
+package smug
+
+import (
+	"fmt"
+	"testing"
+)
+
+const rssFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>status</title>%s</channel></rss>`
+
+const rssItem = `<item><title>%s</title><link>https://status.example.com/%s</link>
+<guid>%s</guid></item>`
+
+func TestPollBroker(t *testing.T) {
+	items := ""
+	pb := &PollBroker{fetch: func(string) ([]byte, error) {
+		return []byte(fmt.Sprintf(rssFeed, items)), nil
+	}}
+	if err := pb.Setup("https://status.example.com/rss", "", "status"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	td := &TestDispatch{}
+	items = fmt.Sprintf(rssItem, "db slow", "1", "1")
+	pb.poll(td)
+	if len(td.broadcasts) != 0 {
+		t.Errorf("err: first poll should only learn the feed %+v", td.broadcasts)
+	}
+
+	// newest first, like real feeds
+	items = fmt.Sprintf(rssItem, "db fixed", "3", "3") +
+		fmt.Sprintf(rssItem, "db down", "2", "2") + items
+	pb.poll(td)
+	pb.poll(td)
+	if len(td.broadcasts) != 2 {
+		t.Fatalf("err: expected the 2 new items once each, have %d",
+			len(td.broadcasts))
+	}
+	first, second := td.broadcasts[0], td.broadcasts[1]
+	if first.Text != "db down https://status.example.com/2" ||
+		second.Text != "db fixed https://status.example.com/3" {
+		t.Errorf("err: have %q then %q", first.Text, second.Text)
+	}
+	if first.Actor != "status" || first.Origin != pb {
+		t.Errorf("err: have %+v", first)
+	}
+
+	if err := pb.Setup("", "", ""); err == nil {
+		t.Errorf("err: expected a missing url to fail setup")
+	}
+}
+
+func TestPollJsonFeed(t *testing.T) {
+	body := `{"data": {"alerts": [
+		{"key": 12345678901234, "msg": "disk full", "href": "http://x.com/a"}]}}`
+	pb := &PollBroker{fetch: func(string) ([]byte, error) {
+		return []byte(body), nil
+	}}
+	pb.Setup("http://x.com/alerts.json", "1m", "")
+	pb.JsonPaths("data.alerts", "key", "msg", "href")
+	td := &TestDispatch{}
+	pb.poll(td)
+	body = `{"data": {"alerts": [
+		{"key": 12345678901235, "msg": "disk ok"},
+		{"key": 12345678901234, "msg": "disk full", "href": "http://x.com/a"}]}}`
+	pb.poll(td)
+	if len(td.broadcasts) != 1 || td.broadcasts[0].Text != "disk ok" {
+		t.Fatalf("err: expected only the new alert %+v", td.broadcasts)
+	}
+	if !pb.seen["12345678901235"] {
+		t.Errorf("err: numeric ids should keep their digits %v", pb.seen)
+	}
+
+	items, err := ParseXmlFeed([]byte(`<feed xmlns="http://www.w3.org/2005/Atom">
+		<entry><id>tag:x,1</id><title>hello</title>
+		<link rel="alternate" href="http://x.com/1"/></entry></feed>`))
+	if err != nil || len(items) != 1 || items[0].Link != "http://x.com/1" {
+		t.Errorf("err: atom entry not parsed %v %v", items, err)
+	}
+}
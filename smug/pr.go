@@ -11,22 +11,32 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+func init() {
+	RegisterBroker("pattern", func() Broker { return &PatternRoutingBroker{} })
+}
+
 // --------------------------------------------------
 // MetaPattern
 // the pattern archetype that all patterns should obey
 // --------------------------------------------------
 
 type MetaPattern interface {
-	Handle(*Event, chan *Event) bool
+	Handle(*Event, *Feedback) bool
 	HelpText() string
 }
 
@@ -42,18 +52,24 @@ func (hp *HelperPattern) HelpText() string {
 	return ""
 }
 
-func (hp *HelperPattern) Handle(ev *Event, feedback chan *Event) bool {
+func (hp *HelperPattern) Handle(ev *Event, feedback *Feedback) bool {
 	if strings.HasPrefix(ev.Text, "..list") {
-		feedback <- &Event{
+		thread, tb := ev.ReplyThread()
+		feedback.Send(&Event{
 			IsCmdOutput:   true,
 			Origin:        nil, // PRB will set this
 			ReplyBroker:   ev.ReplyBroker,
 			ReplyTarget:   ev.ReplyTarget,
+			Private:       ev.Private,
 			Actor:         "",
 			Text:          hp.pbroker.HelpText(),
 			ContentBlocks: nil,
+			ThreadId:      thread,
+			ThreadBroker:  tb,
+			Channel:       ev.Channel,
+			ChannelBroker: ev.ChannelBroker,
 			ts:            time.Now(),
-		}
+		})
 		return true
 	}
 	return false
@@ -69,10 +85,54 @@ type Pattern struct {
 	url     string
 	headers map[string]string
 	vars    map[string]string
+	types   map[string]string
 	method  string
 	help    string
+	maxResp int64
+	bcast   bool
+	// how many next requests a response may chain, 0 disables chaining
+	maxChain int
+	// nil submits on a fresh goroutine.  swapped when the router resizes
+	// its pool, so read it through workers
+	poolMux sync.RWMutex
+	pool    *SubmitPool
+	// makes the requests, nil for one with no timeouts of its own
+	client *http.Client
+	// renders the request body when set, see PayloadTemplate
+	tmpl *template.Template
+	// who may use this pattern, nil allows everyone
+	allowed    *ActorAllowlist
+	notAllowed string
+	// longer text is never matched.  0 uses DefaultMaxPatternInput, < 0
+	// matches any length
+	maxInput int
+	// where messages may come from, see Scope
+	scope string
+	// posted while waiting on the endpoint, where the origin supports it
+	thinking string
+	// replied when the request fails or comes back empty, see ReplyTemplates
+	onError *template.Template
+	onEmpty *template.Template
+	// a catch-all, tried only when no other pattern matched
+	fallback bool
+	// more urls each match is sent to alongside url, see FanOut
+	fanOut []string
+	// emoji the matched message gets once the endpoint answers or fails
+	reactOk    string
+	reactError string
+	// emoji it gets as soon as it matches, before the endpoint is asked
+	reactReceived string
 }
 
+// bytes of text a pattern will try matching, unless configured otherwise
+const DefaultMaxPatternInput = 4096
+
+// the most follow-up requests max-chain may allow
+const MaxChainLimit = 10
+
+// how long one message may spend being matched against every pattern
+const DefaultMatchBudget = 100 * time.Millisecond
+
 // for our group matches
 type NamedGroups map[string]string
 
@@ -102,11 +162,264 @@ func NewExtendedPattern(
 		re:      re,
 		url:     url,
 		headers: headers,
+		vars:    vars,
 		method:  method,
 		help:    help,
+		maxResp: DefaultMaxBodySize,
 	}, nil
 }
 
+// builds a pattern with any of the optional settings from config applied
+func NewPatternFromConfig(pc *PatternConfig) (*Pattern, error) {
+	p, err := NewExtendedPattern(
+		pc.Name, pc.RegEx, pc.Url, pc.Headers, pc.Vars, pc.Method, pc.Help)
+	if err != nil {
+		return nil, err
+	}
+	if pc.MaxResponse > 0 {
+		p.maxResp = pc.MaxResponse
+	}
+	for k, typ := range pc.Types {
+		if _, err := coerceValue(typ, ""); err == errUnknownType {
+			return nil, fmt.Errorf("unknown type %s for %s", typ, k)
+		}
+	}
+	p.types = pc.Types
+	if pc.Payload != "" {
+		if err := p.PayloadTemplate(pc.Payload); err != nil {
+			return nil, err
+		}
+	}
+	p.bcast = pc.ReplyBroadcast
+	if pc.MaxChain < 0 || pc.MaxChain > MaxChainLimit {
+		return nil, fmt.Errorf("max-chain must be between 0 and %d", MaxChainLimit)
+	}
+	p.maxChain = pc.MaxChain
+	p.maxInput = pc.MaxInput
+	if err := p.AllowActors(pc.AllowedActors, pc.NotAllowed); err != nil {
+		return nil, err
+	}
+	if err := p.Scope(pc.Scope); err != nil {
+		return nil, err
+	}
+	p.thinking = pc.Thinking
+	p.fallback = pc.Default
+	if err := p.FanOut(pc.FanOut...); err != nil {
+		return nil, err
+	}
+	p.Reactions(pc.ReactReceived, pc.ReactOk, pc.ReactError)
+	if err := p.ReplyTemplates(pc.OnError, pc.OnEmpty); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// go templates replied in place of silence when the endpoint fails (a
+// network error, or a status other than 200 or 204) or returns an empty 200.
+// a 204 or silent response is meant to be quiet and gets neither.  they
+// see .status (0 when there was no response), .groups, .actor and .text.
+// blank leaves that case silent
+func (p *Pattern) ReplyTemplates(onError string, onEmpty string) error {
+	var err error
+	if p.onError, err = replyTemplate(p.name, "on-error", onError); err != nil {
+		return err
+	}
+	p.onEmpty, err = replyTemplate(p.name, "on-empty", onEmpty)
+	return err
+}
+
+func replyTemplate(name string, which string, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(name + " " + which).
+		Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %s", which, err)
+	}
+	return tmpl, nil
+}
+
+// the on-error or on-empty reply, blank when there's no template for it
+func (p *Pattern) failureReply(
+	failed bool, status int, actor string, text string, named NamedGroups,
+) string {
+	tmpl := p.onEmpty
+	if failed {
+		tmpl = p.onError
+	}
+	if tmpl == nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, map[string]interface{}{
+		"status": status,
+		"groups": map[string]string(named),
+		"actor":  actor,
+		"text":   text,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERR rendering %s: %s\n", tmpl.Name(), err)
+		return ""
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// sends every match to these urls as well, all at once.  their replies are
+// merged, in order, into one.  endpoints that fail are logged and left out
+func (p *Pattern) FanOut(urls ...string) error {
+	for _, u := range urls {
+		if !strings.HasPrefix(strings.ToLower(u), "http") {
+			return fmt.Errorf("fan-out url must begin with http: %s", u)
+		}
+	}
+	p.fanOut = urls
+	return nil
+}
+
+// where the origin supports it (see ReactionBroker) the message that matched
+// gets the received emoji straight away, then the ok emoji once the endpoint
+// answers, silently or not, or the error one if it fails.  blank skips that
+// reaction
+func (p *Pattern) Reactions(received string, ok string, failed string) {
+	p.reactReceived, p.reactOk, p.reactError = received, ok, failed
+}
+
+// the pool matches are submitted on, nil for fresh goroutines
+func (p *Pattern) workers() *SubmitPool {
+	p.poolMux.RLock()
+	defer p.poolMux.RUnlock()
+	return p.pool
+}
+
+func (p *Pattern) setWorkers(sp *SubmitPool) {
+	p.poolMux.Lock()
+	defer p.poolMux.Unlock()
+	p.pool = sp
+}
+
+// reacts to ev with what the endpoint's result calls for
+func (p *Pattern) reactResult(ev *Event, failed bool) {
+	if failed {
+		p.react(ev, p.reactError)
+	} else {
+		p.react(ev, p.reactOk)
+	}
+}
+
+func (p *Pattern) react(ev *Event, emoji string) {
+	rb, ok := ev.Origin.(ReactionBroker)
+	if !ok || emoji == "" {
+		return
+	}
+	if err := rb.React(ev, emoji); err != nil {
+		fmt.Fprintf(os.Stderr, "ERR reacting with %s: %s\n", emoji, err)
+	}
+}
+
+// "dm" only matches private messages, "channel" only those everyone sees.
+// "any", or blank, matches both
+func (p *Pattern) Scope(scope string) error {
+	switch scope {
+	case "", "any":
+		p.scope = ""
+	case "dm", "channel":
+		p.scope = scope
+	default:
+		return fmt.Errorf("scope must be dm, channel or any")
+	}
+	return nil
+}
+
+func (p *Pattern) inScope(ev *Event) bool {
+	switch p.scope {
+	case "dm":
+		return ev.Private
+	case "channel":
+		return !ev.Private
+	}
+	return true
+}
+
+// limits the pattern to these actors, "<broker>:<id>" as NewActorAllowlist
+// takes them.  others are answered with notAllowed, or ignored if it's
+// blank.  no actors allows everyone
+func (p *Pattern) AllowActors(actors []string, notAllowed string) error {
+	p.allowed = nil
+	if len(actors) > 0 {
+		aa, err := NewActorAllowlist(actors)
+		if err != nil {
+			return err
+		}
+		p.allowed = aa
+	}
+	p.notAllowed = notAllowed
+	return nil
+}
+
+func (p *Pattern) actorAllowed(ev *Event) bool {
+	return p.allowed == nil || p.allowed.Allows(ev)
+}
+
+// funcs available to payload templates.  json quotes any value, eg
+// {"text": {{json .text}}}
+var payloadFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// renders request bodies with this go template instead of the usual json.
+// the template sees .actor, .text, .groups (named regex groups), .vars and,
+// for command patterns, .args.
+// bodies that don't render as valid json aren't sent
+func (p *Pattern) PayloadTemplate(text string) error {
+	tmpl, err := template.New(p.name).Funcs(payloadFuncs).
+		Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid payload template: %s", err)
+	}
+	p.tmpl = tmpl
+	return nil
+}
+
+func (p *Pattern) render(
+	actor string, text string, named NamedGroups, args []string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := p.tmpl.Execute(&buf, map[string]interface{}{
+		"actor":  actor,
+		"text":   text,
+		"groups": map[string]string(named),
+		"vars":   p.vars,
+		"args":   args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rendering payload template: %s", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("payload template did not render json: %s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+var errUnknownType = fmt.Errorf("unknown type")
+
+// converts a payload value to the json type named by typ
+func coerceValue(typ string, val string) (interface{}, error) {
+	switch typ {
+	case "string":
+		return val, nil
+	case "int":
+		return strconv.ParseInt(val, 10, 64)
+	case "float":
+		return strconv.ParseFloat(val, 64)
+	case "bool":
+		return strconv.ParseBool(val)
+	}
+	return nil, errUnknownType
+}
+
 func (p *Pattern) HelpText() string {
 	return p.help
 }
@@ -137,96 +450,714 @@ func (p *Pattern) ExtractMatches(text string) ([]string, NamedGroups) {
 	return matches, named
 }
 
-func (p *Pattern) Handle(ev *Event, feedback chan *Event) bool {
+// true if text is short enough to be worth matching
+func (p *Pattern) fits(text string) bool {
+	max := p.maxInput
+	if max == 0 {
+		max = DefaultMaxPatternInput
+	}
+	return max < 0 || len(text) <= max
+}
+
+// whether ev is worth matching at all
+func (p *Pattern) considers(ev *Event) bool {
+	if !p.fits(ev.Text) || !p.inScope(ev) {
+		return false
+	}
+	return p.actorAllowed(ev) || p.notAllowed != ""
+}
+
+func (p *Pattern) Handle(ev *Event, feedback *Feedback) bool {
+	if !p.considers(ev) {
+		return false
+	}
 	matches, named := p.ExtractMatches(ev.Text)
 	if len(matches) == 0 {
 		return false
 	}
-	go p.Submit(ev, ev.Actor, ev.Text, named, feedback)
+	p.answer(ev, named, nil, feedback)
 	return true
 }
 
+// answers ev, which matched: the not-allowed reply for actors who may not
+// use the pattern, a submission for everyone else
+func (p *Pattern) answer(
+	ev *Event, named NamedGroups, args []string, feedback *Feedback,
+) {
+	if !p.actorAllowed(ev) {
+		thread, tb := ev.ReplyThread()
+		feedback.Send(&Event{
+			IsCmdOutput:   true,
+			Origin:        nil, // PRB will set this
+			ReplyBroker:   ev.ReplyBroker,
+			ReplyTarget:   ev.ReplyTarget,
+			Private:       ev.Private,
+			Text:          p.notAllowed,
+			ThreadId:      thread,
+			ThreadBroker:  tb,
+			Channel:       ev.Channel,
+			ChannelBroker: ev.ChannelBroker,
+			ts:            time.Now(),
+		})
+		return
+	}
+	// let them know we heard, even while it waits on a worker
+	p.react(ev, p.reactReceived)
+	submit := func() { p.submit(ev, ev.Actor, ev.Text, named, args, feedback) }
+	if pool := p.workers(); pool == nil {
+		go submit()
+	} else if !pool.Do(submit) {
+		fmt.Fprintf(os.Stderr, "ERR submit queue full, dropped match for %s\n", p.url)
+	}
+}
+
 type JsonBlock struct {
-	Text  string `json:text`
-	Img   string `json:img`
-	Title string `json:title`
+	Text  string `json:"text"`
+	Img   string `json:"img"`
+	Title string `json:"title"`
+	// code for preformatted text, optionally with its lang
+	Type string `json:"type"`
+	Lang string `json:"lang"`
+}
+
+type JsonField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type JsonAttachment struct {
+	Color  string      `json:"color"`
+	Title  string      `json:"title"`
+	Text   string      `json:"text"`
+	Fields []JsonField `json:"fields"`
 }
 
 type JsonResponse struct {
-	Text   string      `json:text`
-	Blocks []JsonBlock `json:blocks`
+	Text        string           `json:"text"`
+	Blocks      []JsonBlock      `json:"blocks"`
+	Attachments []JsonAttachment `json:"attachments"`
+	// acknowledge without posting anything back
+	Silent bool `json:"silent"`
+	// unix seconds, deliver later on brokers that support scheduling
+	SendAt int64 `json:"send_at"`
+	// threaded replies are also shown in the channel
+	ReplyBroadcast bool `json:"reply_broadcast"`
+	// make this request and use its response instead, if chaining is enabled
+	Next *JsonRequest `json:"next"`
 }
 
-func (p *Pattern) Submit(
-	originEvt *Event,
-	actor string,
-	text string,
-	named NamedGroups,
-	feedback chan *Event,
-) {
-	payload := map[string]string{
+type JsonRequest struct {
+	Url     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	// sent as-is as a json body
+	Body json.RawMessage `json:"body"`
+}
+
+// json bodies are parsed as a JsonResponse, anything else is taken as the
+// reply text verbatim so trivial endpoints don't need to wrap their output
+func ParseResponse(contentType string, body []byte) (*JsonResponse, error) {
+	mtype, _, _ := mime.ParseMediaType(contentType)
+	if mtype == "application/json" || strings.HasSuffix(mtype, "+json") {
+		var dat JsonResponse
+		if err := json.Unmarshal(body, &dat); err != nil {
+			return nil, err
+		}
+		return &dat, nil
+	}
+	return &JsonResponse{Text: strings.TrimRight(string(body), "\r\n")}, nil
+}
+
+// json body for a submission.  values with a type hint are coerced, falling
+// back to the string if they don't convert
+func (p *Pattern) payload(
+	actor string, text string, named NamedGroups) ([]byte, error) {
+	return p.payloadArgs(actor, text, named, nil)
+}
+
+// the payload with a command's args, see CommandPattern.  nil leaves them out
+func (p *Pattern) payloadArgs(
+	actor string, text string, named NamedGroups, args []string) ([]byte, error) {
+	if p.tmpl != nil {
+		return p.render(actor, text, named, args)
+	}
+	strs := map[string]string{
 		"actor": actor,
 		"text":  text,
 	}
 	for k, v := range named {
-		payload[k] = v
+		strs[k] = v
 	}
 	for k, v := range p.vars {
+		strs[k] = v
+	}
+	payload := make(map[string]interface{}, len(strs))
+	for k, v := range strs {
 		payload[k] = v
+		typ, found := p.types[k]
+		if !found {
+			continue
+		}
+		cv, err := coerceValue(typ, v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr,
+				"ERR unable to send %s=%q as %s: %s\n", k, v, typ, err)
+			continue
+		}
+		payload[k] = cv
+	}
+	if args != nil {
+		payload["args"] = args
 	}
-	reqbody, err := json.Marshal(payload)
+	return json.Marshal(payload)
+}
+
+// makes one request, returning the parsed response or nil when there is
+// nothing to post, and the response status (0 without one).  failed is set
+// when the request didn't work, errors are logged
+func (p *Pattern) request(
+	method string,
+	url string,
+	headers map[string]string,
+	reqbody []byte,
+) (dat *JsonResponse, status int, failed bool) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(reqbody))
 	if err != nil {
-		return
+		fmt.Fprintf(os.Stderr, "ERR building request to %s: %s\n", url, err)
+		return nil, 0, true
 	}
-	req, err := http.NewRequest(p.method, p.url, bytes.NewBuffer(reqbody))
 	req.Header.Set("Content-Type", "application/json")
-	for h, v := range p.headers {
+	for h, v := range headers {
 		req.Header.Set(h, v)
 	}
-	client := &http.Client{}
+	client := p.client
+	if client == nil {
+		client = NewHttpClient()
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Fprintf(
 			os.Stderr,
 			"ERR readthis post failed to %s body=%s %+v\n",
-			p.url, reqbody, err,
+			url, reqbody, err,
 		)
-		return
+		return nil, 0, true
 	}
 	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	if err != nil || !strings.HasPrefix(resp.Status, "200") {
+	status = resp.StatusCode
+	if status == http.StatusNoContent {
+		// endpoint acted and means to say nothing, same as silent
+		return &JsonResponse{Silent: true}, status, false
+	}
+	body, err := ReadLimited(resp.Body, p.maxResp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERR resp from %s dropped: %s\n", url, err)
+		return nil, status, true
+	}
+	if !strings.HasPrefix(resp.Status, "200") {
 		fmt.Fprintf(os.Stderr,
-			"ERR resp  %s %+v %s\n", err, resp.Status, string(body),
+			"ERR resp  %+v %s\n", resp.Status, string(body),
 		)
-		return
+		return nil, status, true
 	}
 	// now attempt to see if anything returned
-	if len(string(body)) > 0 {
-		var dat JsonResponse
-		if err = json.Unmarshal(body, &dat); err != nil {
-			// just abadon hope here
-			fmt.Printf("ERR WITH JSON UNMARSHAL got body of %s", string(body))
-			return
+	if len(string(body)) == 0 {
+		return nil, status, false
+	}
+	dat, err = ParseResponse(resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		// just abadon hope here
+		fmt.Printf("ERR WITH JSON UNMARSHAL got body of %s", string(body))
+		return nil, status, true
+	}
+	return dat, status, false
+}
+
+// follows any chain of next requests from the one made to from, up to
+// maxChain of them, returning what the last one did as request does.  each
+// must go to from's scheme and host, a response can't send us elsewhere
+func (p *Pattern) followChain(
+	from string, dat *JsonResponse, status int, failed bool,
+) (*JsonResponse, int, bool) {
+	for depth := 0; dat != nil && dat.Next != nil; depth++ {
+		if depth >= p.maxChain {
+			if p.maxChain > 0 {
+				fmt.Fprintf(os.Stderr,
+					"ERR chain from %s deeper than %d, stopping\n",
+					p.url, p.maxChain)
+			}
+			break
 		}
-		text := dat.Text
-		blocks := []*EventBlock{}
-		for _, blk := range dat.Blocks {
-			blocks = append(blocks,
-				&EventBlock{Title: blk.Title, Text: blk.Text, ImgUrl: blk.Img},
-			)
+		nx := dat.Next
+		if !sameOrigin(from, nx.Url) {
+			fmt.Fprintf(os.Stderr,
+				"ERR chained url %s must be on the same scheme and host as %s\n",
+				nx.Url, from)
+			return nil, 0, true
 		}
-		feedback <- &Event{
-			IsCmdOutput:   true,
-			Origin:        nil, // PRB will set this
-			ReplyBroker:   originEvt.ReplyBroker,
-			ReplyTarget:   originEvt.ReplyTarget,
-			Actor:         "",
-			Text:          text,
-			ContentBlocks: blocks,
-			ts:            time.Now(),
+		method := strings.ToUpper(nx.Method)
+		if method == "" {
+			method = "GET"
 		}
+		// only the headers given for this step, ours may be secrets meant for
+		// the original endpoint
+		dat, status, failed = p.request(method, nx.Url, nx.Headers, nx.Body)
+	}
+	return dat, status, failed
+}
+
+// the request to url and any chain it starts
+func (p *Pattern) fetch(url string, reqbody []byte) (*JsonResponse, int, bool) {
+	dat, status, failed := p.request(p.method, url, p.headers, reqbody)
+	return p.followChain(url, dat, status, failed)
+}
+
+// whether b is an http(s) url with a's scheme and host, port included
+func sameOrigin(a string, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil || (ub.Scheme != "http" && ub.Scheme != "https") {
+		return false
 	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// fetches from url and every fan-out url concurrently on the pattern's pool,
+// merging what they reply.  it only counts as failed if nothing replied and
+// something failed, taking the status of the first failure
+func (p *Pattern) fetchAll(reqbody []byte) (*JsonResponse, int, bool) {
+	if len(p.fanOut) == 0 {
+		return p.fetch(p.url, reqbody)
+	}
+	urls := append([]string{p.url}, p.fanOut...)
+	type fetched struct {
+		dat    *JsonResponse
+		status int
+		failed bool
+	}
+	results := make([]fetched, len(urls))
+	jobs := make([]func(), len(urls))
+	for i, url := range urls {
+		i, url := i, url
+		jobs[i] = func() {
+			r := &results[i]
+			r.dat, r.status, r.failed = p.fetch(url, reqbody)
+		}
+	}
+	p.workers().DoAll(jobs)
+
+	var merged *JsonResponse
+	silent, status, failed := false, 0, false
+	for _, r := range results {
+		switch {
+		case r.failed:
+			if !failed {
+				status, failed = r.status, true
+			}
+		case r.dat == nil:
+		case r.dat.Silent:
+			silent = true
+		case merged == nil:
+			merged = r.dat
+		default:
+			merged = mergeResponses(merged, r.dat)
+		}
+	}
+	if merged != nil {
+		return merged, http.StatusOK, false
+	}
+	if silent && !failed {
+		return &JsonResponse{Silent: true}, http.StatusOK, false
+	}
+	return nil, status, failed
+}
+
+// b's reply after a's.  the earliest send_at wins
+func mergeResponses(a *JsonResponse, b *JsonResponse) *JsonResponse {
+	out := *a
+	switch {
+	case out.Text == "":
+		out.Text = b.Text
+	case b.Text != "":
+		out.Text += "\n" + b.Text
+	}
+	out.Blocks = append(append([]JsonBlock{}, a.Blocks...), b.Blocks...)
+	out.Attachments = append(
+		append([]JsonAttachment{}, a.Attachments...), b.Attachments...)
+	out.ReplyBroadcast = a.ReplyBroadcast || b.ReplyBroadcast
+	if b.SendAt > 0 && (out.SendAt == 0 || b.SendAt < out.SendAt) {
+		out.SendAt = b.SendAt
+	}
+	return &out
+}
+
+func (p *Pattern) Submit(
+	originEvt *Event,
+	actor string,
+	text string,
+	named NamedGroups,
+	feedback *Feedback,
+) {
+	p.submit(originEvt, actor, text, named, nil, feedback)
+}
+
+func (p *Pattern) submit(
+	originEvt *Event,
+	actor string,
+	text string,
+	named NamedGroups,
+	args []string,
+	feedback *Feedback,
+) {
+	reqbody, err := p.payloadArgs(actor, text, named, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERR building payload for %s: %s\n", p.url, err)
+		return
+	}
+	// let them know we heard while the endpoint thinks it over
+	var holder PlaceholderBroker
+	var holderId string
+	if pb, ok := originEvt.Origin.(PlaceholderBroker); ok && p.thinking != "" {
+		if id, err := pb.Placeholder(originEvt, p.thinking); err == nil {
+			holder, holderId = pb, id
+		} else {
+			fmt.Fprintf(os.Stderr, "ERR posting placeholder: %s\n", err)
+		}
+	}
+	dat, status, failed := p.fetchAll(reqbody)
+	p.reactResult(originEvt, failed)
+	if dat == nil {
+		// an apology or a shrug if the pattern has one for this
+		if reply := p.failureReply(failed, status, actor, text, named); reply != "" {
+			dat = &JsonResponse{Text: reply}
+		}
+	}
+	if dat == nil || dat.Silent {
+		if holder != nil {
+			holder.DropPlaceholder(originEvt, holderId)
+		}
+		return
+	}
+	blocks := []*EventBlock{}
+	for _, blk := range dat.Blocks {
+		eb := &EventBlock{Title: blk.Title, Text: blk.Text, ImgUrl: blk.Img}
+		if blk.Type == "code" {
+			eb.Type, eb.Lang = CONTENT_CODE, blk.Lang
+		}
+		blocks = append(blocks, eb)
+	}
+	var atts []*EventAttachment
+	for _, ja := range dat.Attachments {
+		att := &EventAttachment{Color: ja.Color, Title: ja.Title, Text: ja.Text}
+		for _, jf := range ja.Fields {
+			att.Fields = append(att.Fields,
+				&EventField{Title: jf.Title, Value: jf.Value, Short: jf.Short})
+		}
+		atts = append(atts, att)
+	}
+	thread, threadBroker := originEvt.ReplyThread()
+	ev := &Event{
+		IsCmdOutput:   true,
+		Origin:        nil, // PRB will set this
+		ReplyBroker:   originEvt.ReplyBroker,
+		ReplyTarget:   originEvt.ReplyTarget,
+		Private:       originEvt.Private,
+		Actor:         "",
+		Text:          dat.Text,
+		ContentBlocks: blocks,
+		Attachments:   atts,
+		// answer in the thread we were asked in, or under what asked
+		ThreadId:       thread,
+		ThreadBroker:   threadBroker,
+		Channel:        originEvt.Channel,
+		ChannelBroker:  originEvt.ChannelBroker,
+		ReplyBroadcast: p.bcast || dat.ReplyBroadcast,
+		ts:             time.Now(),
+	}
+	if dat.SendAt > 0 {
+		ev.SendAt = time.Unix(dat.SendAt, 0)
+		if holder != nil {
+			// nothing to stand in for until then
+			holder.DropPlaceholder(originEvt, holderId)
+		}
+	} else if holder != nil {
+		ev.Replaces = holderId
+		ev.ReplacesBroker = originEvt.Origin
+	}
+	if !feedback.Send(ev) && ev.Replaces != "" {
+		// nothing's coming to replace it
+		holder.DropPlaceholder(originEvt, holderId)
+	}
+}
+
+// --------------------------------------------------
+// CommandPattern
+// a pattern for simple bot commands, eg !deploy web "at noon", without a
+// regex.  what follows the command word is split like a shell would and
+// sent as args, ["web", "at noon"], along with the usual actor and text
+// --------------------------------------------------
+
+type CommandPattern struct {
+	*Pattern
+	prefix  string
+	command string
+}
+
+// a command pattern sending to url, as NewPattern, matching command after
+// prefix (.. when blank)
+func NewCommandPattern(prefix string, command string, url string) (*CommandPattern, error) {
+	p, err := NewPattern("", url)
+	if err != nil {
+		return nil, err
+	}
+	return newCommandPattern(prefix, command, p)
+}
+
+// builds a command pattern from config, pc.RegEx is ignored
+func NewCommandPatternFromConfig(pc *PatternConfig) (*CommandPattern, error) {
+	noRegex := *pc
+	noRegex.RegEx = ""
+	p, err := NewPatternFromConfig(&noRegex)
+	if err != nil {
+		return nil, err
+	}
+	return newCommandPattern(pc.CommandPrefix, pc.Command, p)
+}
+
+func newCommandPattern(prefix string, command string, p *Pattern) (*CommandPattern, error) {
+	if command == "" || strings.IndexFunc(command, unicode.IsSpace) >= 0 {
+		return nil, fmt.Errorf("command must be a single word")
+	}
+	if prefix == "" {
+		prefix = Prefix
+	}
+	return &CommandPattern{Pattern: p, prefix: prefix, command: command}, nil
+}
+
+// the words after the command in text, false if text isn't the command.
+// the command word is matched case insensitively
+func (cp *CommandPattern) Args(text string) ([]string, bool) {
+	text = strings.TrimSpace(text)
+	word := cp.prefix + cp.command
+	if len(text) < len(word) || !strings.EqualFold(text[:len(word)], word) {
+		return nil, false
+	}
+	rest := text[len(word):]
+	if r, _ := utf8.DecodeRuneInString(rest); rest != "" && !unicode.IsSpace(r) {
+		// a longer word, eg ..deployment for ..deploy
+		return nil, false
+	}
+	return ShellSplit(rest), true
+}
+
+func (cp *CommandPattern) Handle(ev *Event, feedback *Feedback) bool {
+	if !cp.considers(ev) {
+		return false
+	}
+	args, ok := cp.Args(ev.Text)
+	if !ok {
+		return false
+	}
+	cp.answer(ev, NamedGroups{}, args, feedback)
+	return true
+}
+
+// the configured help after the command, or just the command without any
+func (cp *CommandPattern) HelpText() string {
+	if cp.help == "" {
+		return cp.prefix + cp.command
+	}
+	return cp.prefix + cp.command + " - " + cp.help
+}
+
+// --------------------------------------------------
+// SubmitPool
+// bounds how many pattern submissions run at once so a flood of matches
+// can't open thousands of requests against an endpoint
+// --------------------------------------------------
+
+const (
+	DefaultSubmitWorkers = 10
+	DefaultSubmitQueue   = 100
+)
+
+type SubmitPool struct {
+	jobs    chan func()
+	block   bool
+	mux     sync.Mutex
+	dropped int64
+	// held while queueing so Close can't close jobs under a sender
+	closing sync.RWMutex
+	closed  bool
+}
+
+// overflow is "drop" (the default) or "block" and decides what happens when
+// the queue is full
+func NewSubmitPool(workers int, queue int, overflow string) (*SubmitPool, error) {
+	if workers <= 0 {
+		workers = DefaultSubmitWorkers
+	}
+	if queue <= 0 {
+		queue = DefaultSubmitQueue
+	}
+	sp := &SubmitPool{jobs: make(chan func(), queue)}
+	switch overflow {
+	case "", "drop":
+	case "block":
+		sp.block = true
+	default:
+		return nil, fmt.Errorf("overflow must be either drop or block")
+	}
+	for i := 0; i < workers; i++ {
+		go sp.work()
+	}
+	return sp, nil
+}
+
+func (sp *SubmitPool) work() {
+	for job := range sp.jobs {
+		job()
+	}
+}
+
+// queues job, false if it was dropped because the queue is full or the
+// pool is closed
+func (sp *SubmitPool) Do(job func()) bool {
+	sp.closing.RLock()
+	defer sp.closing.RUnlock()
+	if sp.closed {
+		return false
+	}
+	if sp.block {
+		sp.jobs <- job
+		return true
+	}
+	select {
+	case sp.jobs <- job:
+		return true
+	default:
+		sp.mux.Lock()
+		sp.dropped++
+		sp.mux.Unlock()
+		return false
+	}
+}
+
+// runs jobs on whichever workers are free, returning once they all have.
+// any no worker takes up the caller runs itself, so a job already on a
+// worker can wait on its own without every worker stuck waiting.  a nil
+// pool runs each on a fresh goroutine
+func (sp *SubmitPool) DoAll(jobs []func()) {
+	var wg sync.WaitGroup
+	wg.Add(len(jobs))
+	if sp == nil {
+		for _, job := range jobs {
+			go func(job func()) {
+				defer wg.Done()
+				job()
+			}(job)
+		}
+		wg.Wait()
+		return
+	}
+	// whoever claims a job first runs it, a worker or us
+	claimed := make([]int32, len(jobs))
+	run := func(i int) {
+		if atomic.CompareAndSwapInt32(&claimed[i], 0, 1) {
+			defer wg.Done()
+			jobs[i]()
+		}
+	}
+	sp.closing.RLock()
+	for i := range jobs {
+		if sp.closed {
+			break
+		}
+		i := i
+		select {
+		case sp.jobs <- func() { run(i) }:
+		default:
+			// full, we'll get to it
+		}
+	}
+	sp.closing.RUnlock()
+	for i := range jobs {
+		run(i)
+	}
+	wg.Wait()
+}
+
+// jobs waiting on a worker
+func (sp *SubmitPool) Depth() int {
+	return len(sp.jobs)
+}
+
+// dropped since the last call
+func (sp *SubmitPool) takeDropped() int64 {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	d := sp.dropped
+	sp.dropped = 0
+	return d
+}
+
+// workers exit once anything queued has run.  anything queued after is
+// refused, or for DoAll run by the caller
+func (sp *SubmitPool) Close() {
+	sp.closing.Lock()
+	defer sp.closing.Unlock()
+	if !sp.closed {
+		sp.closed = true
+		close(sp.jobs)
+	}
+}
+
+// --------------------------------------------------
+// Feedback
+// answers wait in their broker's feedback queue to be broadcast.  a full
+// one drops them rather than stalling the workers sending answers, counting
+// what it drops for the heartbeat
+// --------------------------------------------------
+
+const DefaultFeedbackSize = 100
+
+type Feedback struct {
+	events  chan *Event
+	dropped int64
+}
+
+func NewFeedback(size int) *Feedback {
+	if size <= 0 {
+		size = DefaultFeedbackSize
+	}
+	return &Feedback{events: make(chan *Event, size)}
+}
+
+// queues ev, false if it was dropped because the queue is full
+func (fb *Feedback) Send(ev *Event) bool {
+	select {
+	case fb.events <- ev:
+		return true
+	default:
+	}
+	atomic.AddInt64(&fb.dropped, 1)
+	fmt.Fprintf(os.Stderr, "ERR feedback queue full, dropped answer for %s\n",
+		ev.ReplyTarget)
+	return false
+}
+
+// answers waiting to be broadcast
+func (fb *Feedback) Depth() int {
+	return len(fb.events)
+}
+
+// dropped since the last call
+func (fb *Feedback) takeDropped() int64 {
+	return atomic.SwapInt64(&fb.dropped, 0)
 }
 
 // --------------------------------------------------
@@ -236,25 +1167,84 @@ func (p *Pattern) Submit(
 type PatternRoutingBroker struct {
 	log      *Logger
 	pmux     sync.RWMutex
-	feedback chan *Event
+	feedback *Feedback
+	pool     *SubmitPool
 	patterns []MetaPattern
-	msgsActn int64
-	msgsRcvd int64
+	// what patterns make their requests with, see ConnTimeouts
+	client *http.Client
+	// matching a message stops trying patterns once it's taken this long
+	budget time.Duration
+	now    func() time.Time
+	// sent counts events that triggered a pattern
+	metrics Metrics
 }
 
 func (prb *PatternRoutingBroker) AddPattern(newp MetaPattern) {
 	prb.pmux.Lock()
+	if p := basePattern(newp); p != nil {
+		if p.workers() == nil {
+			p.setWorkers(prb.pool)
+		}
+		if p.client == nil {
+			p.client = prb.client
+		}
+	}
 	prb.patterns = append(prb.patterns, newp)
 	prb.pmux.Unlock()
 }
 
+// patterns still untried once matching a message has taken longer than
+// budget are skipped.  <= 0 tries every pattern however long it takes
+func (prb *PatternRoutingBroker) MatchBudget(budget time.Duration) {
+	prb.pmux.Lock()
+	defer prb.pmux.Unlock()
+	prb.budget = budget
+}
+
+// how long patterns' requests wait to connect and how often idle
+// connections are checked.  call before adding patterns
+func (prb *PatternRoutingBroker) ConnTimeouts(nt *NetTimeouts) {
+	prb.pmux.Lock()
+	defer prb.pmux.Unlock()
+	prb.client = nt.HttpClient()
+}
+
+// resize the pool submissions flow through.  patterns already added that
+// were on the old pool move to the new one
+func (prb *PatternRoutingBroker) SetWorkers(
+	workers int, queue int, overflow string) error {
+	sp, err := NewSubmitPool(workers, queue, overflow)
+	if err != nil {
+		return err
+	}
+	prb.pmux.Lock()
+	old := prb.pool
+	prb.pool = sp
+	for _, ptn := range prb.patterns {
+		if p := basePattern(ptn); p != nil && p.workers() == old {
+			p.setWorkers(sp)
+		}
+	}
+	prb.pmux.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (prb *PatternRoutingBroker) logger() *Logger { return prb.log }
+
 func (prb *PatternRoutingBroker) Heartbeat() bool {
 	prb.pmux.Lock()
-	mr, ma := prb.msgsRcvd, prb.msgsActn
-	prb.msgsRcvd = 0
-	prb.msgsActn = 0
+	m := prb.metrics
+	prb.metrics = Metrics{}
+	pool := prb.pool
 	prb.pmux.Unlock()
-	prb.log.logMetrics(mr, ma)
+	prb.log.logMetrics(m)
+	if pool != nil {
+		prb.log.logQueue(pool.Depth(), pool.takeDropped())
+	}
+	prb.log.logFeedback(prb.feedback.Depth(), prb.feedback.takeDropped())
 	return true
 }
 
@@ -273,30 +1263,212 @@ func (prb *PatternRoutingBroker) HelpText() string {
 	return strings.Join(retval, "\n")
 }
 
+// how many answers may wait to be broadcast before more are dropped.  call
+// before Activate
+func (prb *PatternRoutingBroker) FeedbackSize(size int) {
+	prb.feedback = NewFeedback(size)
+}
+
 // args [regex,apiurl,method,headers]
-func (prb *PatternRoutingBroker) Setup(args ...string) {
-	prb.log = NewLogger("broker", prb.Name())
-	prb.feedback = make(chan *Event, 100)
+func (prb *PatternRoutingBroker) Setup(args ...string) error {
+	prb.log = NewLogger("broker", DisplayName(prb))
+	prb.feedback = NewFeedback(DefaultFeedbackSize)
+	prb.budget = DefaultMatchBudget
 	prb.AddPattern(&HelperPattern{pbroker: prb})
+	return prb.SetWorkers(DefaultSubmitWorkers, DefaultSubmitQueue, "drop")
+}
+
+func (prb *PatternRoutingBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	if err := prb.Setup(); err != nil {
+		return err
+	}
+	err := prb.SetWorkers(cfg.Workers, cfg.QueueSize, cfg.Overflow)
+	if err != nil {
+		return err
+	}
+	nt, err := NewNetTimeouts(cfg.DialTimeout, cfg.KeepAlive)
+	if err != nil {
+		return err
+	}
+	prb.ConnTimeouts(nt)
+	prb.FeedbackSize(cfg.FeedbackSize)
+	if cfg.MatchBudget != "" {
+		budget, err := time.ParseDuration(cfg.MatchBudget)
+		if err != nil {
+			return fmt.Errorf("invalid match-budget %s", cfg.MatchBudget)
+		}
+		prb.MatchBudget(budget)
+	}
+	if cfg.MaxPatterns > 0 && len(cfg.Patterns) > cfg.MaxPatterns {
+		return fmt.Errorf("pattern broker has %d patterns, max-patterns is %d",
+			len(cfg.Patterns), cfg.MaxPatterns)
+	}
+	// names have to tell patterns apart in help, blank ones can't anyway
+	names := make(map[string]int)
+	for i, p := range cfg.Patterns {
+		name := strings.ToLower(p.Name)
+		if name == "" {
+			continue
+		}
+		if first, found := names[name]; found {
+			return fmt.Errorf("pattern broker patterns %d and %d are both named %s",
+				first+1, i+1, p.Name)
+		}
+		names[name] = i
+	}
+	for _, p := range cfg.Patterns {
+		if p.RegEx == "" && p.Command == "" {
+			return fmt.Errorf("pattern broker pattern.regex must not be blank")
+		}
+		if p.RegEx != "" && p.Command != "" {
+			return fmt.Errorf("pattern broker pattern %s has both regex and command", p.Name)
+		}
+		if p.Url == "" {
+			return fmt.Errorf("pattern broker pattern.url must not be blank")
+		}
+		if p.Method == "" {
+			return fmt.Errorf("pattern broker pattern.method must not be blank")
+		}
+		// now build our pattern
+		var newp MetaPattern
+		var err error
+		if p.Command != "" {
+			newp, err = NewCommandPatternFromConfig(&p)
+		} else {
+			newp, err = NewPatternFromConfig(&p)
+		}
+		if err != nil {
+			return fmt.Errorf("error creating pattern %s: %s", p.Name, err)
+		}
+		prb.AddPattern(newp)
+	}
+	return nil
 }
 
 func (prb *PatternRoutingBroker) HandleEvent(ev *Event, dis Dispatcher) {
+	if ev.IsCmdOutput || ev.IsInjected || ev.Origin == prb {
+		// never let command output (ours or a relayed bot's), or whoever
+		// holds the inject token, trigger commands
+		return
+	}
 	prb.pmux.Lock()
-	prb.msgsRcvd++
+	prb.metrics.rcvd(ev)
+	budget := prb.budget
 	prb.pmux.Unlock()
-	for _, ptn := range prb.patterns {
+	now := prb.now
+	if now == nil {
+		now = time.Now
+	}
+	start := now()
+	for i, ptn := range prb.patterns {
+		if budget > 0 && i > 0 && now().Sub(start) > budget {
+			prb.log.Warnf("matching text from %s took over %s, skipped %d patterns",
+				ev.Actor, budget, len(prb.patterns)-i)
+			// something skipped might have matched, so no catch-alls either
+			return
+		}
+		if isDefault(ptn) {
+			continue
+		}
 		if ptn.Handle(ev, prb.feedback) {
-			prb.pmux.Lock()
-			prb.msgsActn++
-			prb.pmux.Unlock()
-			break
+			prb.handled(ev)
+			return
+		}
+	}
+	// nothing else wanted it, the catch-alls get a turn unless localcmd will
+	// be answering it
+	if isLocalCommand(ev.Text) {
+		return
+	}
+	for _, ptn := range prb.patterns {
+		if isDefault(ptn) && ptn.Handle(ev, prb.feedback) {
+			prb.handled(ev)
+			return
+		}
+	}
+}
+
+func (prb *PatternRoutingBroker) handled(ev *Event) {
+	prb.pmux.Lock()
+	prb.metrics.sent(ev)
+	prb.pmux.Unlock()
+}
+
+func isDefault(ptn MetaPattern) bool {
+	p := basePattern(ptn)
+	return p != nil && p.fallback
+}
+
+// the Pattern behind ptn, nil for those that aren't one
+func basePattern(ptn MetaPattern) *Pattern {
+	switch p := ptn.(type) {
+	case *Pattern:
+		return p
+	case *CommandPattern:
+		return p.Pattern
+	}
+	return nil
+}
+
+// what a pattern would do with some text, see TestMatch
+type MatchResult struct {
+	Name    string
+	Method  string
+	Url     string
+	Groups  NamedGroups
+	Payload string
+	// set when the payload couldn't be built
+	Err error
+}
+
+// which patterns text would match, in the order they're tried (catch-alls
+// last), with their named groups and the request each would make.  nothing
+// is sent, it's for checking patterns while writing them.  only the first is
+// used for real
+func (prb *PatternRoutingBroker) TestMatch(text string) []MatchResult {
+	prb.pmux.RLock()
+	defer prb.pmux.RUnlock()
+	ordered := []MetaPattern{}
+	for _, ptn := range prb.patterns {
+		if !isDefault(ptn) {
+			ordered = append(ordered, ptn)
+		}
+	}
+	for _, ptn := range prb.patterns {
+		if isDefault(ptn) && !isLocalCommand(text) {
+			ordered = append(ordered, ptn)
+		}
+	}
+	results := []MatchResult{}
+	for _, ptn := range ordered {
+		p := basePattern(ptn)
+		if p == nil || !p.fits(text) {
+			continue
+		}
+		var args []string
+		named := NamedGroups{}
+		if cp, ok := ptn.(*CommandPattern); ok {
+			var matched bool
+			if args, matched = cp.Args(text); !matched {
+				continue
+			}
+		} else {
+			var matches []string
+			if matches, named = p.ExtractMatches(text); len(matches) == 0 {
+				continue
+			}
 		}
+		mr := MatchResult{Name: p.name, Method: p.method, Url: p.url, Groups: named}
+		body, err := p.payloadArgs("", text, named, args)
+		mr.Payload, mr.Err = string(body), err
+		results = append(results, mr)
 	}
+	return results
 }
 
 func (prb *PatternRoutingBroker) Activate(dis Dispatcher) {
 	for {
-		ev := <-(prb.feedback)
+		ev := <-prb.feedback.events
 		ev.Origin = prb
 		dis.Broadcast(ev)
 	}
@@ -1,24 +1,33 @@
 package smug
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	libirc "github.com/thoj/go-ircevent"
 )
 
 func TestHelpPattern(t *testing.T) {
 	pb := &PatternRoutingBroker{}
 	pb.AddPattern(&Pattern{help: "help me"})
 	hp := &HelperPattern{pbroker: pb}
-	val := hp.Handle(&Event{Text: "nope"}, make(chan *Event, 5))
+	val := hp.Handle(&Event{Text: "nope"}, NewFeedback(5))
 	if val {
 		t.Errorf("should not trigger helper pattern")
 	}
-	feedback := make(chan *Event, 5)
+	feedback := NewFeedback(5)
 	val = hp.Handle(&Event{Text: "..list"}, feedback)
 	if !val {
 		t.Errorf("did not trigger on keyword")
 	}
-	listev := <-feedback
+	listev := <-feedback.events
 	if !strings.HasPrefix(listev.Text, "help me") {
 		t.Errorf("invalid help returned %s", listev.Text)
 	}
@@ -65,3 +74,1004 @@ func TestExtendedPatterns(t *testing.T) {
        }
    }
 */
+
+const jsonType = "application/json"
+
+func submitTo(t *testing.T, status int, ctype string, body string) *Feedback {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ctype)
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+	defer srv.Close()
+	p, err := NewPattern(`.*`, srv.URL)
+	if err != nil {
+		t.Fatalf("test pattern %s", err)
+	}
+	feedback := NewFeedback(5)
+	p.Submit(&Event{}, "bob", "hi", NamedGroups{}, feedback)
+	return feedback
+}
+
+func TestSilentResponses(t *testing.T) {
+	if submitTo(t, http.StatusNoContent, "", "").Depth() != 0 {
+		t.Errorf("err: 204 should not produce feedback")
+	}
+	silent := submitTo(t, http.StatusOK, jsonType, `{"silent":true,"text":"x"}`)
+	if silent.Depth() != 0 {
+		t.Errorf("err: silent response should not produce feedback")
+	}
+	feedback := submitTo(t, http.StatusOK, jsonType, `{"text":"hello"}`)
+	if feedback.Depth() != 1 {
+		t.Errorf("err: expected feedback from normal response")
+		return
+	}
+	if ev := <-feedback.events; ev.Text != "hello" {
+		t.Errorf("err: feedback text got %s", ev.Text)
+	}
+}
+
+func TestResponseContentTypes(t *testing.T) {
+	testwants := map[string][]string{
+		// want: content-type, body
+		"hello":        {"application/json; charset=utf-8", `{"text":"hello"}`},
+		"howdy":        {"application/vnd.api+json", `{"text":"howdy"}`},
+		"hello world":  {"text/plain", "hello world\n"},
+		`{"text":"x"}`: {"text/html", `{"text":"x"}`},
+	}
+	for want, args := range testwants {
+		dat, err := ParseResponse(args[0], []byte(args[1]))
+		if err != nil {
+			t.Errorf("err: parsing %s: %s", args[0], err)
+			continue
+		}
+		if dat.Text != want {
+			t.Errorf("err: have [%s] wanted [%s]", dat.Text, want)
+		}
+	}
+	if _, err := ParseResponse(jsonType, []byte("not json")); err == nil {
+		t.Errorf("err: expected bad json to error")
+	}
+
+	code := submitTo(t, http.StatusOK, jsonType,
+		`{"blocks": [{"type": "code", "lang": "sh", "text": "make test"}, {"text": "x"}]}`)
+	if ev := <-code.events; len(ev.ContentBlocks) != 2 ||
+		ev.ContentBlocks[0].Type != CONTENT_CODE || ev.ContentBlocks[0].Lang != "sh" ||
+		ev.ContentBlocks[1].Type != CONTENT_DISPLAY {
+		t.Errorf("err: expected a code block then a display block")
+	}
+
+	feedback := submitTo(t, http.StatusOK, "text/plain", "plain reply")
+	if feedback.Depth() != 1 {
+		t.Errorf("err: expected feedback from plain text response")
+		return
+	}
+	if ev := <-feedback.events; ev.Text != "plain reply" {
+		t.Errorf("err: plain feedback got %s", ev.Text)
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	big := strings.Repeat("x", 64)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(big))
+		}))
+	defer srv.Close()
+	p, err := NewPatternFromConfig(&PatternConfig{
+		RegEx: ".*", Url: srv.URL, Method: "POST", MaxResponse: 32,
+	})
+	if err != nil {
+		t.Fatalf("test pattern %s", err)
+	}
+	feedback := NewFeedback(5)
+	p.Submit(&Event{}, "bob", "hi", NamedGroups{}, feedback)
+	if feedback.Depth() != 0 {
+		t.Errorf("err: oversized response should be dropped")
+	}
+	p.maxResp = 64
+	p.Submit(&Event{}, "bob", "hi", NamedGroups{}, feedback)
+	if feedback.Depth() != 1 {
+		t.Errorf("err: response at the limit should be delivered")
+	}
+}
+
+func TestCmdOutputNotRouted(t *testing.T) {
+	pb := &PatternRoutingBroker{}
+	pb.Setup()
+	pb.HandleEvent(&Event{IsCmdOutput: true, Text: "..list"}, nil)
+	if pb.feedback.Depth() != 0 {
+		t.Errorf("err: command output should never trigger patterns")
+	}
+
+	// relayed output from another bridge's bot, marked by the inbound broker
+	ib := &IrcBroker{channel: "#chan", nick: "smug"}
+	ib.MarkCmdOutput([]string{"[bot]"}, nil)
+	td := &TestDispatch{}
+	ib.handlePrivmsg(
+		&libirc.Event{Nick: "relay", Arguments: []string{"#chan", "[bot] ..list"}},
+		td,
+	)
+	if td.lastbroadcast == nil || !td.lastbroadcast.IsCmdOutput ||
+		td.lastbroadcast.Text != "..list" {
+		t.Errorf("err: expected relayed output to be marked %+v", td.lastbroadcast)
+		return
+	}
+	pb.HandleEvent(td.lastbroadcast, nil)
+	if pb.feedback.Depth() != 0 {
+		t.Errorf("err: relayed command output should not re-trigger patterns")
+	}
+
+	pb.HandleEvent(&Event{Text: "..list"}, nil)
+	if pb.feedback.Depth() != 1 {
+		t.Errorf("err: expected a normal event to still trigger patterns")
+	}
+}
+
+func TestFeedbackFull(t *testing.T) {
+	pb := &PatternRoutingBroker{}
+	if err := pb.SetupFromConfig(&BrokerConfig{FeedbackSize: 2}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			pb.HandleEvent(&Event{Origin: &FakeBroker{}, Text: "..list"}, nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("err: a full feedback channel shouldn't block")
+	}
+	if pb.feedback.Depth() != 2 {
+		t.Errorf("err: expected 2 answers waiting, have %d", pb.feedback.Depth())
+	}
+	if d := pb.feedback.takeDropped(); d != 3 {
+		t.Errorf("err: expected 3 dropped, have %d", d)
+	}
+	if d := pb.feedback.takeDropped(); d != 0 {
+		t.Errorf("err: drops should be counted once, have %d", d)
+	}
+}
+
+func TestOwnEventsNotRouted(t *testing.T) {
+	pb := &PatternRoutingBroker{}
+	pb.Setup()
+	td := &TestDispatch{}
+	pb.HandleEvent(&Event{Origin: pb, Text: "..list"}, td)
+	if pb.feedback.Depth() != 0 {
+		t.Errorf("err: our own events should never trigger patterns")
+	}
+	pb.HandleEvent(&Event{Origin: &FakeBroker{}, Actor: "bob", Text: "..list"}, td)
+	if pb.feedback.Depth() != 1 {
+		t.Errorf("err: expected a user command to still trigger patterns")
+	}
+}
+
+func TestSubmitPoolConcurrency(t *testing.T) {
+	var mux sync.Mutex
+	inflight, peak, seen := 0, 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			inflight++
+			if inflight > peak {
+				peak = inflight
+			}
+			mux.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mux.Lock()
+			inflight--
+			seen++
+			mux.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer srv.Close()
+
+	pb := &PatternRoutingBroker{}
+	pb.Setup()
+	if err := pb.SetWorkers(2, 20, "block"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	p, _ := NewPattern(`^go`, srv.URL)
+	pb.AddPattern(p)
+	for i := 0; i < 8; i++ {
+		pb.HandleEvent(&Event{Actor: "bob", Text: "go"}, nil)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		mux.Lock()
+		done := seen == 8
+		mux.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if seen != 8 {
+		t.Errorf("err: expected 8 submissions, saw %d", seen)
+	}
+	if peak > 2 {
+		t.Errorf("err: %d concurrent submissions, limit was 2", peak)
+	}
+}
+
+func TestSubmitPoolDrops(t *testing.T) {
+	sp, err := NewSubmitPool(1, 1, "drop")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer sp.Close()
+	hold := make(chan bool)
+	started := make(chan bool)
+	sp.Do(func() { started <- true; <-hold })
+	<-started
+	if !sp.Do(func() {}) {
+		t.Errorf("err: expected a queue slot to be free")
+	}
+	if sp.Do(func() {}) {
+		t.Errorf("err: expected a full queue to drop")
+	}
+	if sp.Depth() != 1 || sp.takeDropped() != 1 {
+		t.Errorf("err: have depth %d", sp.Depth())
+	}
+	close(hold)
+	if _, err := NewSubmitPool(1, 1, "explode"); err == nil {
+		t.Errorf("err: expected invalid overflow to error")
+	}
+}
+
+func TestSubmitPoolDoAll(t *testing.T) {
+	sp, err := NewSubmitPool(1, 1, "block")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer sp.Close()
+	// the only worker fans out and waits, it mustn't wait on itself
+	var ran int32
+	done := make(chan bool)
+	sp.Do(func() {
+		jobs := []func(){}
+		for i := 0; i < 4; i++ {
+			jobs = append(jobs, func() { atomic.AddInt32(&ran, 1) })
+		}
+		sp.DoAll(jobs)
+		done <- true
+	})
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("err: fanning out from a worker never finished")
+	}
+	if atomic.LoadInt32(&ran) != 4 {
+		t.Errorf("err: expected every job run once, have %d", ran)
+	}
+	(*SubmitPool)(nil).DoAll([]func(){func() { atomic.AddInt32(&ran, 1) }})
+	if atomic.LoadInt32(&ran) != 5 {
+		t.Errorf("err: expected a nil pool to run jobs too")
+	}
+}
+
+func TestSetWorkersMovesPatterns(t *testing.T) {
+	prb := &PatternRoutingBroker{}
+	if err := prb.SetWorkers(1, 1, "drop"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	old := prb.pool
+	p := &Pattern{name: "early"}
+	prb.AddPattern(p)
+	own, _ := NewSubmitPool(1, 1, "drop")
+	defer own.Close()
+	mine := &Pattern{name: "mine"}
+	mine.setWorkers(own)
+	prb.AddPattern(mine)
+
+	if err := prb.SetWorkers(2, 5, "drop"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer prb.pool.Close()
+	if p.workers() != prb.pool {
+		t.Errorf("err: a pattern added early should move to the new pool")
+	}
+	if mine.workers() != own {
+		t.Errorf("err: a pattern's own pool should be left alone")
+	}
+	// anything still holding the closed pool is refused, not a panic
+	if old.Do(func() {}) {
+		t.Errorf("err: a closed pool shouldn't take jobs")
+	}
+	var ran int32
+	old.DoAll([]func(){func() { atomic.AddInt32(&ran, 1) }})
+	if atomic.LoadInt32(&ran) != 1 {
+		t.Errorf("err: DoAll on a closed pool should run jobs itself")
+	}
+	old.Close()
+}
+
+func TestTypedPayload(t *testing.T) {
+	p, err := NewPatternFromConfig(&PatternConfig{
+		RegEx:  `^\.\.roll (?P<count>\S+) (?P<loud>\S+)`,
+		Url:    "http://feh.com/roll",
+		Method: "POST",
+		Vars:   map[string]string{"sides": "20"},
+		Types:  map[string]string{"count": "int", "loud": "bool", "sides": "int"},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	payloadFor := func(text string) map[string]interface{} {
+		_, named := p.ExtractMatches(text)
+		body, err := p.payload("joe", text, named)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		dat := map[string]interface{}{}
+		json.Unmarshal(body, &dat)
+		return dat
+	}
+	dat := payloadFor("..roll 3 true")
+	if dat["count"] != float64(3) || dat["loud"] != true || dat["sides"] != float64(20) {
+		t.Errorf("err: values not coerced %+v", dat)
+	}
+	if dat["actor"] != "joe" {
+		t.Errorf("err: untyped values should stay strings %+v", dat)
+	}
+	dat = payloadFor("..roll lots yes")
+	if dat["count"] != "lots" || dat["loud"] != "yes" {
+		t.Errorf("err: bad coercions should fall back to strings %+v", dat)
+	}
+
+	_, err = NewPatternFromConfig(&PatternConfig{
+		RegEx:  `x`,
+		Url:    "http://feh.com/roll",
+		Method: "POST",
+		Types:  map[string]string{"count": "integer"},
+	})
+	if err == nil {
+		t.Errorf("err: expected unknown type to error")
+	}
+}
+
+func TestChainedRequests(t *testing.T) {
+	var mux sync.Mutex
+	hits := map[string]int{}
+	elsewhere := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			hits["elsewhere"]++
+			mux.Unlock()
+		}))
+	defer elsewhere.Close()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			hits[r.URL.Path]++
+			mux.Unlock()
+			w.Header().Set("Content-Type", jsonType)
+			switch r.URL.Path {
+			case "/auth":
+				w.Write([]byte(`{"text": "authed", "next": {"url": "` + srv.URL + `/fetch",
+					"method": "POST", "headers": {"X-Token": "abc"},
+					"body": {"q": 1}}}`))
+			case "/fetch":
+				body, _ := ioutil.ReadAll(r.Body)
+				if r.Header.Get("X-Token") != "abc" || string(body) != `{"q": 1}` {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Write([]byte(`{"text": "fetched"}`))
+			case "/loop":
+				w.Write([]byte(`{"text": "looping", "next": {"url": "` +
+					srv.URL + `/loop"}}`))
+			case "/away":
+				w.Write([]byte(`{"text": "away", "next": {"url": "` +
+					elsewhere.URL + `/metadata"}}`))
+			}
+		}))
+	defer srv.Close()
+
+	submit := func(path string, maxChain int) *Feedback {
+		p, err := NewPatternFromConfig(&PatternConfig{
+			RegEx: ".*", Url: srv.URL + path, Method: "POST", MaxChain: maxChain,
+		})
+		if err != nil {
+			t.Fatalf("test pattern %s", err)
+		}
+		feedback := NewFeedback(5)
+		p.Submit(&Event{}, "bob", "hi", NamedGroups{}, feedback)
+		return feedback
+	}
+
+	// chaining is off by default, the auth response is used as-is
+	feedback := submit("/auth", 0)
+	if hits["/fetch"] != 0 || feedback.Depth() != 1 || (<-feedback.events).Text != "authed" {
+		t.Errorf("err: next should be ignored unless enabled")
+	}
+	feedback = submit("/auth", 1)
+	if feedback.Depth() != 1 || hits["/fetch"] != 1 {
+		t.Fatalf("err: expected the follow-up request to be made")
+	}
+	if ev := <-feedback.events; ev.Text != "fetched" {
+		t.Errorf("err: have [%s] wanted the chained response", ev.Text)
+	}
+
+	feedback = submit("/loop", 2)
+	if hits["/loop"] != 3 {
+		t.Errorf("err: expected the chain capped at 2 follow-ups, saw %d",
+			hits["/loop"])
+	}
+	if feedback.Depth() != 1 || (<-feedback.events).Text != "looping" {
+		t.Errorf("err: expected the last response when the cap is hit")
+	}
+
+	// only the host the pattern was configured with
+	feedback = submit("/away", 1)
+	if hits["elsewhere"] != 0 || feedback.Depth() != 0 {
+		t.Errorf("err: expected a chain to another host refused, have %d hits",
+			hits["elsewhere"])
+	}
+	for _, bad := range []string{"ftp://x/y", "//" + srv.Listener.Addr().String(), ":"} {
+		if sameOrigin(srv.URL, bad) {
+			t.Errorf("err: expected %q refused", bad)
+		}
+	}
+	if !sameOrigin(srv.URL+"/auth", strings.ToUpper(srv.URL[:4])+srv.URL[4:]+"/other") {
+		t.Errorf("err: expected the same origin allowed")
+	}
+	if _, err := NewPatternFromConfig(&PatternConfig{RegEx: ".*", Url: srv.URL,
+		Method: "POST", MaxChain: MaxChainLimit + 1}); err == nil {
+		t.Errorf("err: expected max-chain capped at %d", MaxChainLimit)
+	}
+}
+
+func TestAllowedActors(t *testing.T) {
+	hits := make(chan string, 5)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			hits <- r.URL.Path
+			w.Header().Set("Content-Type", jsonType)
+			w.Write([]byte(`{"text":"deploying"}`))
+		}))
+	defer srv.Close()
+	kind := registerTestBroker(t, "allowed", func() Broker { return &ChanBroker{} })
+	origins := map[string]Broker{}
+	for _, key := range []string{"slack", "irc"} {
+		b, err := NewBrokerFromConfig(&BrokerConfig{Key: key, Type: kind})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		origins[key] = b
+	}
+	p, err := NewPatternFromConfig(&PatternConfig{
+		RegEx:         `^\.\.deploy`,
+		Url:           srv.URL + "/deploy",
+		Method:        "POST",
+		AllowedActors: []string{"slack:U1"},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	feedback := NewFeedback(5)
+
+	// a nick is no good, nor the right id from another network
+	for _, ev := range []*Event{
+		{Origin: origins["slack"], Actor: "alice", Text: "..deploy"},
+		{Origin: origins["irc"], Actor: "alice", ActorId: "U1", Text: "..deploy"},
+		{Actor: "alice", ActorId: "U1", Text: "..deploy"},
+	} {
+		if p.Handle(ev, feedback) {
+			t.Errorf("err: unauthorized actor should not trigger the pattern %+v", ev)
+		}
+	}
+	if !p.Handle(&Event{Origin: origins["slack"], Actor: "alice", ActorId: "U1",
+		Text: "..deploy"}, feedback) {
+		t.Errorf("err: allowed actor should trigger")
+	}
+	select {
+	case ev := <-feedback.events:
+		if ev.Text != "deploying" {
+			t.Errorf("err: have %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("err: no response for an allowed actor")
+	}
+	if len(hits) != 1 {
+		t.Errorf("err: expected only the allowed request, have %d", len(hits))
+	}
+
+	p.AllowActors([]string{"slack:U1"}, "nope, ask alice")
+	if !p.Handle(&Event{Actor: "mallory", Text: "..deploy", ReplyTarget: "mallory"}, feedback) {
+		t.Errorf("err: with a not-allowed reply the pattern should answer")
+	}
+	if ev := <-feedback.events; ev.Text != "nope, ask alice" || ev.ReplyTarget != "mallory" {
+		t.Errorf("err: have %+v", ev)
+	}
+	if p.Handle(&Event{Actor: "mallory", Text: "hello"}, feedback) || len(hits) != 1 {
+		t.Errorf("err: unmatched text should not be answered or submitted")
+	}
+
+	p.AllowActors(nil, "")
+	if !p.actorAllowed(&Event{Actor: "anyone"}) {
+		t.Errorf("err: no allowed actors means everyone")
+	}
+	if err := p.AllowActors([]string{"alice"}, ""); err == nil {
+		t.Errorf("err: expected an actor without a broker refused")
+	}
+}
+
+func TestPayloadTemplate(t *testing.T) {
+	p, err := NewPatternFromConfig(&PatternConfig{
+		Name:   "hook",
+		RegEx:  `^\.\.say (?P<what>.+)`,
+		Url:    "http://feh.com/hook",
+		Method: "POST",
+		Vars:   map[string]string{"room": "ops"},
+		Payload: `{"username": {{json .actor}}, "text": {{json .groups.what}},
+			"channel": {{json .vars.room}}, "raw": {{json .text}}}`,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	text := `..say "quoted" stuff`
+	_, named := p.ExtractMatches(text)
+	body, err := p.payload("joe", text, named)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	dat := map[string]string{}
+	if err := json.Unmarshal(body, &dat); err != nil {
+		t.Fatalf("err: rendered %s %s", body, err)
+	}
+	want := map[string]string{
+		"username": "joe", "text": `"quoted" stuff`, "channel": "ops", "raw": text}
+	for k, v := range want {
+		if dat[k] != v {
+			t.Errorf("err: %s have [%s] wanted [%s]", k, dat[k], v)
+		}
+	}
+
+	_, err = NewPatternFromConfig(&PatternConfig{
+		RegEx: `.*`, Url: "http://feh.com/hook", Method: "POST",
+		Payload: `{"text": {{json .text}`,
+	})
+	if err == nil {
+		t.Errorf("err: expected a broken template to fail setup")
+	}
+
+	p.PayloadTemplate(`text={{.text}}`)
+	if _, err := p.payload("joe", "hi", NamedGroups{}); err == nil {
+		t.Errorf("err: expected a non json body to fail")
+	}
+}
+
+func TestHttpDefaults(t *testing.T) {
+	var seen http.Header
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			seen = r.Header
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer srv.Close()
+	defer SetHttpDefaults("", nil)
+	defer func(v string) { Version = v }(Version)
+
+	Version = "9.9.9"
+	FetchUrl(srv.URL)
+	if ua := seen.Get("User-Agent"); ua != "smug-broker/9.9.9" {
+		t.Errorf("err: default user agent got %s", ua)
+	}
+
+	SetHttpDefaults("acme-bridge/1", map[string]string{
+		"X-Team": "ops", "X-Env": "prod"})
+	FetchUrl(srv.URL)
+	if seen.Get("User-Agent") != "acme-bridge/1" || seen.Get("X-Team") != "ops" {
+		t.Errorf("err: configured defaults not sent %v", seen)
+	}
+
+	p, _ := NewPatternFromConfig(&PatternConfig{
+		RegEx: ".*", Url: srv.URL, Method: "POST",
+		Headers: map[string]string{"User-Agent": "weather/2", "X-Env": "dev"},
+	})
+	p.Submit(&Event{}, "bob", "hi", NamedGroups{}, NewFeedback(1))
+	if seen.Get("User-Agent") != "weather/2" || seen.Get("X-Env") != "dev" {
+		t.Errorf("err: pattern headers should win %v", seen)
+	}
+	if seen.Get("X-Team") != "ops" {
+		t.Errorf("err: defaults the pattern didn't set should still be sent")
+	}
+}
+
+// ClockPattern never matches, but each try moves the clock along
+type ClockPattern struct {
+	clock *time.Time
+	cost  time.Duration
+	tries int
+}
+
+func (cp *ClockPattern) HelpText() string { return "" }
+
+func (cp *ClockPattern) Handle(ev *Event, feedback *Feedback) bool {
+	cp.tries++
+	*cp.clock = cp.clock.Add(cp.cost)
+	return false
+}
+
+func TestMatchBudget(t *testing.T) {
+	pb := &PatternRoutingBroker{}
+	pb.Setup()
+	clock := time.Now()
+	pb.now = func() time.Time { return clock }
+	pb.MatchBudget(100 * time.Millisecond)
+	cps := []*ClockPattern{}
+	for i := 0; i < 4; i++ {
+		cp := &ClockPattern{clock: &clock, cost: 60 * time.Millisecond}
+		cps = append(cps, cp)
+		pb.AddPattern(cp)
+	}
+	huge := strings.Repeat("a", 1<<20)
+	pb.HandleEvent(&Event{Actor: "bob", Text: huge}, nil)
+	if cps[0].tries != 1 || cps[1].tries != 1 || cps[2].tries != 0 {
+		t.Errorf("err: patterns past the budget should be skipped")
+	}
+
+	pb.MatchBudget(0)
+	pb.HandleEvent(&Event{Actor: "bob", Text: huge}, nil)
+	if cps[3].tries != 1 {
+		t.Errorf("err: no budget should try every pattern")
+	}
+}
+
+// patterns limited to slack:U1 answer bob with nope, so a true here means the
+// text got as far as the allowlist
+func TestPatternInputAndScope(t *testing.T) {
+	huge := strings.Repeat("a", DefaultMaxPatternInput+1)
+	dm := &Event{Actor: "bob", Text: "..todo " + huge[:10], Private: true}
+	channel := &Event{Actor: "bob", Text: "..todo " + huge[:10]}
+	testwants := map[string]struct {
+		maxInput int
+		scope    string
+		ev       *Event
+		want     bool
+	}{
+		"over the default max input": {0, "", &Event{Actor: "bob", Text: "..todo " + huge}, false},
+		"at the default max input":   {0, "", &Event{Actor: "bob", Text: "..todo " + huge[8:]}, true},
+		"no max input":               {-1, "", &Event{Actor: "bob", Text: "..todo " + huge + huge}, true},
+		"no scope on a dm":           {0, "", dm, true},
+		"no scope in a channel":      {0, "", channel, true},
+		"any on a dm":                {0, "any", dm, true},
+		"any in a channel":           {0, "any", channel, true},
+		"dm on a dm":                 {0, "dm", dm, true},
+		"dm in a channel":            {0, "dm", channel, false},
+		"channel on a dm":            {0, "channel", dm, false},
+		"channel in a channel":       {0, "channel", channel, true},
+	}
+	for name, tw := range testwants {
+		p, err := NewPatternFromConfig(&PatternConfig{
+			RegEx: "^..todo", Url: "http://localhost/", Method: "POST",
+			AllowedActors: []string{"slack:U1"}, NotAllowed: "nope",
+			MaxInput: tw.maxInput, Scope: tw.scope})
+		if err != nil {
+			t.Fatalf("err: %s %s", name, err)
+		}
+		if have := p.Handle(tw.ev, NewFeedback(1)); have != tw.want {
+			t.Errorf("err: %s have %v wanted %v", name, have, tw.want)
+		}
+	}
+	if _, err := NewPatternFromConfig(&PatternConfig{
+		RegEx: ".", Url: "http://localhost/", Method: "POST", Scope: "team"}); err == nil {
+		t.Errorf("err: unknown scope should fail")
+	}
+}
+
+func TestPatternTestMatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("err: a dry match made a request to %s", r.URL)
+		}))
+	defer srv.Close()
+	prb := &PatternRoutingBroker{}
+	prb.Setup()
+	for _, pc := range []*PatternConfig{
+		{Name: "weather", RegEx: `^..weather (?P<city>\w+)(?: (?P<days>\d+))?`,
+			Url: srv.URL + "/weather", Method: "POST",
+			Vars: map[string]string{"units": "metric"}, Types: map[string]string{"days": "int"}},
+		{Name: "anything", RegEx: `^\.\.`, Url: srv.URL + "/any", Method: "GET"},
+	} {
+		p, err := NewPatternFromConfig(pc)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		prb.AddPattern(p)
+	}
+
+	results := prb.TestMatch("..weather pdx 3")
+	if len(results) != 2 || results[0].Name != "weather" || results[1].Name != "anything" {
+		t.Fatalf("err: expected both patterns in order %+v", results)
+	}
+	wr := results[0]
+	if wr.Groups["city"] != "pdx" || wr.Groups["days"] != "3" ||
+		wr.Method != "POST" || wr.Url != srv.URL+"/weather" || wr.Err != nil {
+		t.Errorf("err: have %+v", wr)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(wr.Payload), &payload)
+	if payload["city"] != "pdx" || payload["days"] != float64(3) ||
+		payload["units"] != "metric" || payload["text"] != "..weather pdx 3" {
+		t.Errorf("err: payload %s", wr.Payload)
+	}
+
+	if results := prb.TestMatch("..list"); len(results) != 1 || results[0].Name != "anything" {
+		t.Errorf("err: only the catch all should match %+v", results)
+	}
+	if results := prb.TestMatch("good morning"); len(results) != 0 {
+		t.Errorf("err: expected no matches %+v", results)
+	}
+}
+
+func TestPatternNamesAndCap(t *testing.T) {
+	pattern := func(name string) PatternConfig {
+		return PatternConfig{Name: name, RegEx: `^\.\.` + name,
+			Url: "http://localhost/" + name, Method: "GET"}
+	}
+	cfg := &BrokerConfig{Type: "pattern", Patterns: []PatternConfig{
+		pattern("weather"), pattern("quote"), pattern("Weather")}}
+	err := (&PatternRoutingBroker{}).SetupFromConfig(cfg)
+	if err == nil || !strings.Contains(err.Error(), "1 and 3 are both named Weather") {
+		t.Errorf("err: expected a duplicate name error, have %v", err)
+	}
+
+	cfg.Patterns = []PatternConfig{pattern("weather"), pattern("quote"), pattern(""), pattern("")}
+	if err := (&PatternRoutingBroker{}).SetupFromConfig(cfg); err != nil {
+		t.Errorf("err: unique or blank names should be fine, have %s", err)
+	}
+	cfg.MaxPatterns = 3
+	err = (&PatternRoutingBroker{}).SetupFromConfig(cfg)
+	if err == nil || !strings.Contains(err.Error(), "has 4 patterns, max-patterns is 3") {
+		t.Errorf("err: expected the cap to be enforced, have %v", err)
+	}
+	cfg.MaxPatterns = 4
+	if err := (&PatternRoutingBroker{}).SetupFromConfig(cfg); err != nil {
+		t.Errorf("err: at the cap should be fine, have %s", err)
+	}
+}
+
+func TestReplyTemplates(t *testing.T) {
+	status, body := http.StatusInternalServerError, "oops"
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", jsonType)
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+	defer srv.Close()
+	p, err := NewPatternFromConfig(&PatternConfig{
+		RegEx:   `^..weather (?P<city>\w+)`,
+		Url:     srv.URL,
+		Method:  "POST",
+		OnError: "couldn't fetch weather for {{.groups.city}} ({{.status}})",
+		OnEmpty: "no weather for {{.groups.city}}, {{.actor}}",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	submit := func() *Event {
+		feedback := NewFeedback(1)
+		_, named := p.ExtractMatches("..weather pdx")
+		p.Submit(&Event{}, "bob", "..weather pdx", named, feedback)
+		if feedback.Depth() == 0 {
+			return nil
+		}
+		return <-feedback.events
+	}
+	ev := submit()
+	if ev == nil || ev.Text != "couldn't fetch weather for pdx (500)" || !ev.IsCmdOutput {
+		t.Errorf("err: expected the on-error reply, have %+v", ev)
+	}
+	status, body = http.StatusOK, ""
+	if ev = submit(); ev == nil || ev.Text != "no weather for pdx, bob" {
+		t.Errorf("err: expected the on-empty reply, have %+v", ev)
+	}
+	status = http.StatusNoContent
+	if ev = submit(); ev != nil {
+		t.Errorf("err: a 204 shouldn't get a reply, have %s", ev.Text)
+	}
+	status, body = http.StatusOK, `{"silent":true}`
+	if ev = submit(); ev != nil {
+		t.Errorf("err: a silent response shouldn't get a reply, have %s", ev.Text)
+	}
+
+	p.ReplyTemplates("", "")
+	status, body = http.StatusInternalServerError, "oops"
+	if ev = submit(); ev != nil {
+		t.Errorf("err: without templates errors should be silent, have %s", ev.Text)
+	}
+	if err := p.ReplyTemplates("{{.status", ""); err == nil {
+		t.Errorf("err: a bad template should error")
+	}
+}
+
+func TestDefaultPattern(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", jsonType)
+			w.Write([]byte(`{"text": "` + r.URL.Path + `"}`))
+		}))
+	defer srv.Close()
+	pb := &PatternRoutingBroker{}
+	pb.Setup()
+	for _, pc := range []*PatternConfig{
+		// listed first, still only tried last
+		{Name: "unknown", RegEx: `^\.\.`, Url: srv.URL + "/unknown", Method: "POST",
+			Default: true},
+		{Name: "weather", RegEx: `^\.\.weather`, Url: srv.URL + "/weather", Method: "POST"},
+	} {
+		p, err := NewPatternFromConfig(pc)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		pb.AddPattern(p)
+	}
+	answer := func(text string) string {
+		pb.HandleEvent(&Event{Actor: "bob", Text: text}, nil)
+		select {
+		case ev := <-pb.feedback.events:
+			return ev.Text
+		case <-time.After(2 * time.Second):
+			return ""
+		}
+	}
+
+	if have := answer("..weather pdx"); have != "/weather" {
+		t.Errorf("err: a matching pattern should win over the default, have %s", have)
+	}
+	if have := answer("..dance"); have != "/unknown" {
+		t.Errorf("err: the default should answer unmatched commands, have %s", have)
+	}
+	if have := answer("..list"); have == "/unknown" {
+		t.Errorf("err: help should still come before the default, have %s", have)
+	}
+
+	pb.HandleEvent(&Event{Actor: "bob", Text: "..dance", IsCmdOutput: true}, nil)
+	pb.HandleEvent(&Event{Actor: "bob", Text: "good morning"}, nil)
+	// localcmd answers these
+	for _, text := range []string{"..version", "..mute irc", "..stats"} {
+		pb.HandleEvent(&Event{Actor: "bob", Text: text}, nil)
+	}
+	select {
+	case ev := <-pb.feedback.events:
+		t.Errorf("err: expected no answer, have %s", ev.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if results := pb.TestMatch("..weather pdx"); len(results) != 2 ||
+		results[0].Name != "weather" || results[1].Name != "unknown" {
+		t.Errorf("err: expected the default tried last %+v", results)
+	}
+}
+
+func TestPatternFanOut(t *testing.T) {
+	var mux sync.Mutex
+	hits := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mux.Lock()
+			hits[r.URL.Path] = string(body)
+			mux.Unlock()
+			w.Header().Set("Content-Type", jsonType)
+			switch r.URL.Path {
+			case "/broken":
+				w.WriteHeader(http.StatusInternalServerError)
+			case "/quiet":
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.Write([]byte(`{"text": "deployed from ` + r.URL.Path + `"}`))
+			}
+		}))
+	defer srv.Close()
+	if _, err := NewPatternFromConfig(&PatternConfig{RegEx: ".", Url: srv.URL,
+		Method: "POST", FanOut: []string{"ftp://example.com"}}); err == nil {
+		t.Errorf("err: a fan-out url should need http")
+	}
+	submit := func(urls ...string) *Event {
+		p, err := NewPatternFromConfig(&PatternConfig{
+			RegEx: "^..deploy", Url: srv.URL + urls[0], Method: "POST",
+			FanOut: urls[1:], OnError: "deploy failed ({{.status}})"})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		feedback := NewFeedback(2)
+		p.Submit(&Event{}, "bob", "..deploy", NamedGroups{}, feedback)
+		if feedback.Depth() != 1 {
+			t.Fatalf("err: expected one merged reply, have %d", feedback.Depth())
+		}
+		return <-feedback.events
+	}
+
+	ev := submit("/broken", srv.URL+"/ci")
+	if ev.Text != "deployed from /ci" {
+		t.Errorf("err: the working endpoint should still reply, have %q", ev.Text)
+	}
+	mux.Lock()
+	if hits["/broken"] == "" || hits["/broken"] != hits["/ci"] {
+		t.Errorf("err: both endpoints should get the same payload %v", hits)
+	}
+	mux.Unlock()
+	if ev = submit("/ci", srv.URL+"/quiet", srv.URL+"/audit"); ev.Text != "deployed from /ci\ndeployed from /audit" {
+		t.Errorf("err: replies should be merged in order, have %q", ev.Text)
+	}
+	if ev = submit("/quiet", srv.URL+"/broken"); ev.Text != "deploy failed (500)" {
+		t.Errorf("err: with no replies a failure is an error, have %q", ev.Text)
+	}
+}
+
+func TestCommandPattern(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Content-Type", jsonType)
+			json.NewEncoder(w).Encode(map[string]string{"text": string(body)})
+		}))
+	defer srv.Close()
+	if _, err := NewCommandPattern("!", "two words", srv.URL); err == nil {
+		t.Errorf("err: a command should be one word")
+	}
+	pb := &PatternRoutingBroker{}
+	pb.Setup()
+	cp, err := NewCommandPatternFromConfig(&PatternConfig{Name: "deploy",
+		Command: "deploy", CommandPrefix: "!", Url: srv.URL, Method: "POST",
+		Help: "deploy an app"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	pb.AddPattern(cp)
+	status, _ := NewCommandPattern("", "status", srv.URL)
+	pb.AddPattern(status)
+
+	answer := func(text string) map[string]interface{} {
+		pb.HandleEvent(&Event{Actor: "bob", Text: text}, nil)
+		select {
+		case ev := <-pb.feedback.events:
+			sent := map[string]interface{}{}
+			json.Unmarshal([]byte(ev.Text), &sent)
+			return sent
+		case <-time.After(2 * time.Second):
+			t.Fatalf("err: no answer to %q", text)
+			return nil
+		}
+	}
+	sent := answer(`!Deploy web "at noon"`)
+	if args, _ := json.Marshal(sent["args"]); string(args) != `["web","at noon"]` ||
+		sent["actor"] != "bob" || sent["text"] != `!Deploy web "at noon"` {
+		t.Errorf("err: expected split args, have %v", sent)
+	}
+	if args, _ := json.Marshal(answer("..status")["args"]); string(args) != "[]" {
+		t.Errorf("err: no args should send an empty list, have %s", args)
+	}
+	// nothing's sent for these, so the next answer is the status after them
+	for _, text := range []string{"!deployment web", "deploy web", "..deploy web", "!dep"} {
+		pb.HandleEvent(&Event{Actor: "bob", Text: text}, nil)
+	}
+	if sent := answer("..status"); sent["text"] != "..status" {
+		t.Errorf("err: only the status should be sent, have %v", sent)
+	}
+	select {
+	case ev := <-pb.feedback.events:
+		t.Errorf("err: a near miss was sent %q", ev.Text)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if help := pb.HelpText(); help != "!deploy - deploy an app\n..status" {
+		t.Errorf("err: unexpected help %q", help)
+	}
+	if results := pb.TestMatch("!deploy 'web app'"); len(results) != 1 ||
+		!strings.Contains(results[0].Payload, `"args":["web app"]`) {
+		t.Errorf("err: expected the command's payload %+v", results)
+	}
+}
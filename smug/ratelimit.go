@@ -0,0 +1,219 @@
+// inbound rate limiting
+// one actor, or an integration gone wrong, can flood every bridged channel
+// at once.  an ActorLimiter gives each actor on each origin a token bucket
+// that broadcasts are taken from.  once it's empty their messages are
+// dropped, or held and sent joined together when they have a token again.
+
+package smug
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ActorLimiter struct {
+	log *Logger
+	// tokens added per second, and the most a bucket holds
+	rate  float64
+	burst float64
+	// hold the excess rather than dropping it
+	coalesce bool
+	maxLen   int
+	// publishes held events, see Send
+	send    func(*Event)
+	now     func() time.Time
+	after   func(d time.Duration, f func())
+	mux     sync.Mutex
+	buckets map[string]*actorBucket
+}
+
+// buckets kept before full, idle ones are cleared out
+const actorBucketsKept = 1000
+
+type actorBucket struct {
+	tokens float64
+	last   time.Time
+	// dropped since they were last let through
+	dropped int
+	// excess waiting on a token, when coalescing
+	held  *Event
+	lines []string
+	size  int
+}
+
+// lets each actor broadcast messages per interval, in bursts of up to burst
+// (messages when 0).  excess is drop or coalesce, which holds what's over
+// the limit and sends it as one message once the actor has a token again
+func NewActorLimiter(messages int, per time.Duration, burst int, excess string) (*ActorLimiter, error) {
+	if messages <= 0 || per <= 0 {
+		return nil, fmt.Errorf("rate-limit needs messages and per above 0")
+	}
+	if burst <= 0 {
+		burst = messages
+	}
+	al := &ActorLimiter{
+		log:     NewLogger("ctx", "rate-limit"),
+		rate:    float64(messages) / per.Seconds(),
+		burst:   float64(burst),
+		maxLen:  DefaultCoalesceMax,
+		now:     time.Now,
+		after:   func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+		buckets: make(map[string]*actorBucket),
+	}
+	switch excess {
+	case "", "drop":
+	case "coalesce":
+		al.coalesce = true
+	default:
+		return nil, fmt.Errorf("rate-limit excess must be either drop or coalesce")
+	}
+	return al, nil
+}
+
+// a nil rc means no limit
+func NewActorLimiterFromConfig(rc *RateLimitConfig) (*ActorLimiter, error) {
+	if rc == nil {
+		return nil, nil
+	}
+	per, err := time.ParseDuration(rc.Per)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate-limit per %s", rc.Per)
+	}
+	return NewActorLimiter(rc.Messages, per, rc.Burst, rc.Excess)
+}
+
+// where held events go once they're let through.  the dispatcher sets this
+func (al *ActorLimiter) Send(send func(*Event)) {
+	al.mux.Lock()
+	defer al.mux.Unlock()
+	al.send = send
+}
+
+// only what people say in the open is limited, not direct messages, command
+// output, presence, topics or replays
+func rateLimited(ev *Event) bool {
+	return ev.Actor != "" && !ev.Private && !ev.IsCmdOutput &&
+		ev.Presence == "" && !ev.IsTopic && !ev.IsReplay
+}
+
+func actorKey(ev *Event) string {
+	origin := ""
+	if ev.Origin != nil {
+		origin = deadLetterTarget(ev.Origin)
+	}
+	return origin + "\x00" + strings.ToLower(ev.Actor)
+}
+
+// must hold mux.  tops the bucket up for the time since it was last used
+func (al *ActorLimiter) refill(bk *actorBucket, now time.Time) {
+	bk.tokens += now.Sub(bk.last).Seconds() * al.rate
+	if bk.tokens > al.burst {
+		bk.tokens = al.burst
+	}
+	bk.last = now
+}
+
+// whether ev may be broadcast now.  a nil limiter allows everything
+func (al *ActorLimiter) Allow(ev *Event) bool {
+	if al == nil || !rateLimited(ev) {
+		return true
+	}
+	key := actorKey(ev)
+	now := al.now()
+	al.mux.Lock()
+	defer al.mux.Unlock()
+	bk, found := al.buckets[key]
+	if !found {
+		if len(al.buckets) >= actorBucketsKept {
+			al.prune(now)
+		}
+		bk = &actorBucket{tokens: al.burst, last: now}
+		al.buckets[key] = bk
+	}
+	al.refill(bk, now)
+	if bk.held != nil {
+		// after what's already waiting, to keep their order
+		al.hold(bk, ev)
+		return false
+	}
+	if bk.tokens >= 1 {
+		bk.tokens--
+		if bk.dropped > 0 {
+			al.log.Infof("%s is under the rate limit again, dropped %d",
+				ev.Actor, bk.dropped)
+			bk.dropped = 0
+		}
+		return true
+	}
+	if al.coalesce && coalescable(ev) {
+		al.hold(bk, ev)
+		wait := time.Duration((1 - bk.tokens) / al.rate * float64(time.Second))
+		al.after(wait, func() { al.release(key) })
+		return false
+	}
+	if bk.dropped == 0 {
+		al.log.Warnf("%s is over the rate limit, dropping their messages",
+			ev.Actor)
+	}
+	bk.dropped++
+	return false
+}
+
+// must hold mux.  forgets actors whose buckets have filled back up, they'd
+// start afresh the same
+func (al *ActorLimiter) prune(now time.Time) {
+	for key, bk := range al.buckets {
+		if al.refill(bk, now); bk.tokens >= al.burst && bk.held == nil {
+			delete(al.buckets, key)
+		}
+	}
+}
+
+// must hold mux.  adds ev to what bk is holding, dropping it if that's
+// grown too large, ev isn't plain text that can be joined to it or it's
+// headed somewhere else.  a direct message is never joined to what's going
+// to a channel
+func (al *ActorLimiter) hold(bk *actorBucket, ev *Event) {
+	if bk.held == nil {
+		cp := *ev
+		bk.held = &cp
+		al.log.Warnf("%s is over the rate limit, holding their messages",
+			ev.Actor)
+	} else if !coalescable(ev) || ev.Private || !sameSource(bk.held, ev) ||
+		bk.size+len(ev.Text) > al.maxLen {
+		bk.dropped++
+		return
+	}
+	bk.lines = append(bk.lines, ev.Text)
+	bk.size += len(ev.Text)
+}
+
+// sends what key's bucket is holding as one event, using a token
+func (al *ActorLimiter) release(key string) {
+	now := al.now()
+	al.mux.Lock()
+	bk := al.buckets[key]
+	if bk == nil || bk.held == nil {
+		al.mux.Unlock()
+		return
+	}
+	al.refill(bk, now)
+	if bk.tokens--; bk.tokens < 0 {
+		bk.tokens = 0
+	}
+	ev := bk.held
+	ev.Text = strings.Join(bk.lines, "\n")
+	ev.RawText = ev.Text
+	if bk.dropped > 0 {
+		al.log.Infof("%s is under the rate limit again, dropped %d",
+			ev.Actor, bk.dropped)
+	}
+	bk.held, bk.lines, bk.size, bk.dropped = nil, nil, 0, 0
+	send := al.send
+	al.mux.Unlock()
+	if send != nil {
+		send(ev)
+	}
+}
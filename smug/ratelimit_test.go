@@ -0,0 +1,157 @@
+package smug
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestActorLimiter(t *testing.T) {
+	if _, err := NewActorLimiter(0, time.Minute, 0, ""); err == nil {
+		t.Errorf("err: no messages should error")
+	}
+	if _, err := NewActorLimiterFromConfig(&RateLimitConfig{Messages: 3, Per: "soon"}); err == nil {
+		t.Errorf("err: bad per should error")
+	}
+	if _, err := NewActorLimiter(3, time.Minute, 0, "queue"); err == nil {
+		t.Errorf("err: bad excess should error")
+	}
+	al, err := NewActorLimiterFromConfig(&RateLimitConfig{Messages: 3, Per: "1m"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	now := time.Unix(1000, 0)
+	al.now = func() time.Time { return now }
+	slack, irc := &FakeBroker{}, &IrcBroker{channel: "#chan"}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if al.Allow(&Event{Origin: slack, Actor: "spammer", Text: fmt.Sprint(i)}) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("err: expected a burst of 3 let through, have %d", allowed)
+	}
+	for _, ev := range []*Event{
+		{Origin: slack, Actor: "alice", Text: "hi"},
+		{Origin: irc, Actor: "spammer", Text: "same nick, other network"},
+		{Origin: slack, Actor: "spammer", Text: "answer", IsCmdOutput: true},
+		{Origin: slack, Actor: "spammer", Text: "#chan", Presence: PresenceJoin},
+	} {
+		if !al.Allow(ev) {
+			t.Errorf("err: %q shouldn't be limited", ev.Text)
+		}
+	}
+
+	now = now.Add(20 * time.Second)
+	if !al.Allow(&Event{Origin: slack, Actor: "Spammer", Text: "later"}) {
+		t.Errorf("err: a token should have come back after 20s")
+	}
+	if al.Allow(&Event{Origin: slack, Actor: "spammer", Text: "again"}) {
+		t.Errorf("err: only one token should have come back")
+	}
+	if !(*ActorLimiter)(nil).Allow(&Event{Actor: "spammer"}) {
+		t.Errorf("err: a nil limiter should allow everything")
+	}
+}
+
+func TestActorLimiterCoalesce(t *testing.T) {
+	al, _ := NewActorLimiter(1, 10*time.Second, 0, "coalesce")
+	now := time.Unix(1000, 0)
+	al.now = func() time.Time { return now }
+	var waits []time.Duration
+	var release func()
+	al.after = func(d time.Duration, f func()) {
+		waits = append(waits, d)
+		release = f
+	}
+	sent := []*Event{}
+	al.Send(func(ev *Event) { sent = append(sent, ev) })
+
+	for _, text := range []string{"one", "two", "three"} {
+		if al.Allow(&Event{Actor: "bob", Text: text}) != (text == "one") {
+			t.Errorf("err: only the first should go straight through, %s", text)
+		}
+	}
+	if al.Allow(&Event{Actor: "bob", Text: "waves", IsAction: true}) {
+		t.Errorf("err: an action shouldn't jump the queue")
+	}
+	if len(waits) != 1 || waits[0] != 10*time.Second {
+		t.Fatalf("err: expected one release in 10s, have %v", waits)
+	}
+	now = now.Add(10 * time.Second)
+	release()
+	if len(sent) != 1 || sent[0].Text != "two\nthree" || sent[0].Actor != "bob" {
+		t.Errorf("err: expected the held messages joined, have %+v", sent)
+	}
+	if al.Allow(&Event{Actor: "bob", Text: "four"}) {
+		t.Errorf("err: the release should have used the token")
+	}
+}
+
+func TestActorLimiterCoalesceSource(t *testing.T) {
+	al, _ := NewActorLimiter(1, 10*time.Second, 0, "coalesce")
+	now := time.Unix(1000, 0)
+	al.now = func() time.Time { return now }
+	var release func()
+	al.after = func(d time.Duration, f func()) { release = f }
+	sent := []*Event{}
+	al.Send(func(ev *Event) { sent = append(sent, ev) })
+	src := &FakeBroker{}
+
+	al.Allow(&Event{Origin: src, Actor: "bob", Text: "one"})
+	if al.Allow(&Event{Origin: src, Actor: "bob", Text: "two"}) {
+		t.Fatalf("err: expected two held")
+	}
+	dm := &Event{Origin: src, ReplyBroker: src, ReplyTarget: "D123",
+		Private: true, Actor: "bob", Text: "my password is hunter2"}
+	if !al.Allow(dm) {
+		t.Errorf("err: a direct message shouldn't be limited")
+	}
+	// behind what's held and bound elsewhere, dropped rather than joined
+	threaded := &Event{Origin: src, Actor: "bob", Text: "in a thread",
+		ThreadId: "1.1", ThreadBroker: src}
+	if al.Allow(threaded) {
+		t.Errorf("err: expected the thread reply held back")
+	}
+	now = now.Add(10 * time.Second)
+	release()
+	if len(sent) != 1 || sent[0].Text != "two" || sent[0].Private ||
+		sent[0].ThreadId != "" {
+		t.Errorf("err: expected only the channel message released, have %+v", sent[0])
+	}
+}
+
+func TestDispatchRateLimit(t *testing.T) {
+	cd := &CentralDispatch{}
+	dest := &ChanBroker{events: make(chan *Event, 20)}
+	cd.AddBroker(dest)
+	limited, _ := NewActorLimiter(2, time.Minute, 0, "")
+	cd.LimitActors(limited)
+	origin := &FakeBroker{}
+	for i := 0; i < 5; i++ {
+		cd.Broadcast(&Event{Origin: origin, Actor: "spammer", Text: fmt.Sprint(i)})
+	}
+	cd.Broadcast(&Event{Origin: origin, Actor: "alice", Text: "hi"})
+	// its own limit, not the global one
+	unlimited := &IrcBroker{channel: "#chan"}
+	cd.LimitActorsFrom(unlimited, nil)
+	for i := 0; i < 3; i++ {
+		cd.Broadcast(&Event{Origin: unlimited, Actor: "spammer", Text: "irc"})
+	}
+
+	have := []string{}
+	for done := false; !done; {
+		select {
+		case ev := <-dest.events:
+			have = append(have, ev.Actor+" "+ev.Text)
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	want := "[spammer 0 spammer 1 alice hi spammer irc spammer irc spammer irc]"
+	if fmt.Sprint(have) != want {
+		t.Errorf("err: expected the excess dropped, have %v", have)
+	}
+}
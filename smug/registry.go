@@ -0,0 +1,193 @@
+// broker registry
+// brokers register a factory under their config type so they can be built
+// from config by name.  third party brokers can register from their own init
+// without touching smug itself.
+
+package smug
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// set by main, brokers may report it (eg as the irc realname)
+var Version = "dev"
+
+type BrokerFactory func() Broker
+
+// brokers that know how to set themselves up from their config stanza.
+// anything else just has Setup() called with no args
+type ConfigurableBroker interface {
+	SetupFromConfig(*BrokerConfig) error
+}
+
+var (
+	registryMux sync.RWMutex
+	registry    = map[string]BrokerFactory{}
+	// config key, type and alias of each broker built from config, by the
+	// broker's address, see LabelBroker
+	labels = map[uintptr]brokerLabel{}
+)
+
+type brokerLabel struct {
+	key   string
+	kind  string
+	alias string
+}
+
+// makes a broker type available to NewBrokerFromConfig.  registering the same
+// type twice is a programming error and panics
+func RegisterBroker(typeName string, factory BrokerFactory) {
+	registryMux.Lock()
+	defer registryMux.Unlock()
+	if factory == nil {
+		panic("smug: RegisterBroker factory is nil")
+	}
+	if _, dup := registry[typeName]; dup {
+		panic("smug: RegisterBroker called twice for " + typeName)
+	}
+	registry[typeName] = factory
+}
+
+// names of every registered broker type, sorted
+func BrokerTypes() []string {
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+	types := []string{}
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// builds and sets up a broker of cfg.Type
+func NewBrokerFromConfig(cfg *BrokerConfig) (Broker, error) {
+	registryMux.RLock()
+	factory, found := registry[cfg.Type]
+	registryMux.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unknown broker type: %s (known types: %v)",
+			cfg.Type, BrokerTypes())
+	}
+	b := factory()
+	// recorded before setup so brokers can log under their display name
+	LabelBroker(b, cfg)
+	var err error
+	if cb, ok := b.(ConfigurableBroker); ok {
+		err = cb.SetupFromConfig(cfg)
+	} else {
+		err = b.Setup()
+	}
+	if err != nil {
+		UnlabelBroker(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// b's address, which labels are kept by so two brokers that compare equal
+// are still told apart.  false for brokers that aren't pointers
+func labelKey(b Broker) (uintptr, bool) {
+	v := reflect.ValueOf(b)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return 0, false
+	}
+	return v.Pointer(), true
+}
+
+// gives b the key, type and alias of cfg, as NewBrokerFromConfig does, for
+// brokers set up some other way.  only pointers to brokers can be labelled.
+// the label outlives b until UnlabelBroker
+func LabelBroker(b Broker, cfg *BrokerConfig) {
+	id, ok := labelKey(b)
+	if !ok {
+		return
+	}
+	registryMux.Lock()
+	defer registryMux.Unlock()
+	labels[id] = brokerLabel{key: cfg.Key, kind: cfg.Type, alias: cfg.Alias}
+}
+
+// forgets b's label, once it's done with
+func UnlabelBroker(b Broker) {
+	id, ok := labelKey(b)
+	if !ok {
+		return
+	}
+	registryMux.Lock()
+	defer registryMux.Unlock()
+	delete(labels, id)
+}
+
+// broker types that act on commands rather than relay, left out when the
+// config is relay-only
+var commandBrokerTypes = map[string]bool{"pattern": true}
+
+// builds and sets up each of cfg's active brokers, in order.  relay-only
+// configs skip command handling brokers so text passes through untouched.
+// a config that fails Validate builds nothing
+func NewBrokersFromConfig(cfg *Config) ([]Broker, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	log := NewLogger("ctx", "registry")
+	brokers := []Broker{}
+	for _, key := range cfg.ActiveBrokers {
+		bcfg := cfg.Brokers[key]
+		if cfg.RelayOnly && commandBrokerTypes[bcfg.Type] {
+			log.Infof("relay-only, skipping %s broker %s", bcfg.Type, key)
+			continue
+		}
+		b, err := NewBrokerFromConfig(bcfg)
+		if err != nil {
+			return nil, fmt.Errorf("broker %s: %s", key, err)
+		}
+		brokers = append(brokers, b)
+	}
+	return brokers, nil
+}
+
+func labelOf(b Broker) brokerLabel {
+	id, ok := labelKey(b)
+	if !ok {
+		return brokerLabel{}
+	}
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+	return labels[id]
+}
+
+// what to call b in logs and metrics, its configured alias if it has one
+func DisplayName(b Broker) string {
+	if alias := labelOf(b).alias; alias != "" {
+		return alias
+	}
+	return b.Name()
+}
+
+// the config key b was built from, "" if it wasn't built from config
+func BrokerKey(b Broker) string {
+	return labelOf(b).key
+}
+
+// whether ev comes from a different network than dest, ie a different type
+// of broker.  brokers not built from config are only the same as themselves
+func CrossOrigin(ev *Event, dest Broker) bool {
+	if ev.Origin == nil || ev.Origin == dest {
+		return false
+	}
+	from, to := labelOf(ev.Origin).kind, labelOf(dest).kind
+	return from == "" || to == "" || from != to
+}
+
+// "[irc] " for events crossing into dest from another network, so folks on a
+// many way bridge can tell where a message came from.  "" for the rest
+func OriginPrefix(ev *Event, dest Broker) string {
+	if !CrossOrigin(ev, dest) {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", DisplayName(ev.Origin))
+}
@@ -0,0 +1,197 @@
+package smug
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// ConfigFakeBroker records the config it was set up from
+type ConfigFakeBroker struct {
+	FakeBroker
+	cfg *BrokerConfig
+}
+
+func (cfb *ConfigFakeBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	cfb.cfg = cfg
+	return nil
+}
+
+// registers factory under a type named for the running test, gone again once
+// the test's done so it can be run more than once
+func registerTestBroker(t *testing.T, name string, factory BrokerFactory) string {
+	typeName := "test-" + t.Name() + "-" + name
+	RegisterBroker(typeName, factory)
+	t.Cleanup(func() {
+		registryMux.Lock()
+		defer registryMux.Unlock()
+		delete(registry, typeName)
+	})
+	return typeName
+}
+
+func TestBrokerRegistry(t *testing.T) {
+	plain := registerTestBroker(t, "plain", func() Broker { return &FakeBroker{} })
+	config := registerTestBroker(t, "config", func() Broker { return &ConfigFakeBroker{} })
+
+	b, err := NewBrokerFromConfig(&BrokerConfig{Type: plain})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := b.(*FakeBroker); !ok {
+		t.Errorf("err: wrong broker built %T", b)
+	}
+
+	cfg := &BrokerConfig{Type: config, Nick: "bob"}
+	b, err = NewBrokerFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if cfb, ok := b.(*ConfigFakeBroker); !ok || cfb.cfg != cfg {
+		t.Errorf("err: expected broker set up from its config")
+	}
+
+	_, err = NewBrokerFromConfig(&BrokerConfig{Type: "nope"})
+	if err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("err: expected unknown type error, have %v", err)
+	}
+
+	for _, builtin := range []string{"irc", "slack", "pattern", "cron"} {
+		found := false
+		for _, typ := range BrokerTypes() {
+			found = found || typ == builtin
+		}
+		if !found {
+			t.Errorf("err: builtin %s not registered", builtin)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("err: expected duplicate registration to panic")
+		}
+	}()
+	RegisterBroker(plain, func() Broker { return &FakeBroker{} })
+}
+
+func TestBrokerAlias(t *testing.T) {
+	kind := registerTestBroker(t, "alias", func() Broker { return &ConfigFakeBroker{} })
+	aliased, err := NewBrokerFromConfig(
+		&BrokerConfig{Key: "slack-main", Type: kind, Alias: "slack"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	plain, _ := NewBrokerFromConfig(
+		&BrokerConfig{Key: "irc-main", Type: kind})
+
+	if DisplayName(aliased) != "slack" || DisplayName(plain) != "faker" {
+		t.Errorf("err: have display names %s %s",
+			DisplayName(aliased), DisplayName(plain))
+	}
+
+	cd := &CentralDispatch{}
+	cd.AddBroker(aliased)
+	cd.AddBroker(plain)
+	if cd.FindBroker("slack-main") != aliased || cd.FindBroker("irc-main") != plain {
+		t.Errorf("err: brokers should be found by config key")
+	}
+	if cd.FindBroker("slack") != nil {
+		t.Errorf("err: an alias is for display only, not routing")
+	}
+}
+
+// ValueBroker is a broker by value, and with its slice can't be a map key
+type ValueBroker struct{ tags []string }
+
+func (vb ValueBroker) Name() string                       { return "value" }
+func (vb ValueBroker) HandleEvent(e *Event, d Dispatcher) {}
+func (vb ValueBroker) Setup(...string) error              { return nil }
+func (vb ValueBroker) Heartbeat() bool                    { return true }
+func (vb ValueBroker) Activate(dis Dispatcher)            {}
+func (vb ValueBroker) Deactivate()                        {}
+
+func TestLabelBroker(t *testing.T) {
+	irc := &ChanBroker{}
+	slack := &ChanBroker{}
+	LabelBroker(irc, &BrokerConfig{Key: "irc-main", Type: "irc"})
+	LabelBroker(slack, &BrokerConfig{Key: "slack-main", Type: "slack", Alias: "slack"})
+	if BrokerKey(irc) != "irc-main" || BrokerKey(slack) != "slack-main" ||
+		DisplayName(slack) != "slack" || !CrossOrigin(&Event{Origin: irc}, slack) {
+		t.Errorf("err: each broker should have its own label")
+	}
+	UnlabelBroker(irc)
+	if BrokerKey(irc) != "" || BrokerKey(slack) != "slack-main" {
+		t.Errorf("err: unlabelling should only forget that broker")
+	}
+	UnlabelBroker(slack)
+
+	// brokers that aren't pointers go unlabelled rather than panicking
+	vb := ValueBroker{tags: []string{"a"}}
+	LabelBroker(vb, &BrokerConfig{Key: "value"})
+	if BrokerKey(vb) != "" || DisplayName(vb) != "value" {
+		t.Errorf("err: a value broker shouldn't be labelled")
+	}
+	UnlabelBroker(vb)
+}
+
+// ChanBroker hands every event it's sent to its channel
+type ChanBroker struct {
+	FakeBroker
+	events chan *Event
+}
+
+func (cb *ChanBroker) HandleEvent(ev *Event, dis Dispatcher) {
+	cb.events <- ev
+}
+
+func TestRelayOnly(t *testing.T) {
+	kind := registerTestBroker(t, "relay", func() Broker {
+		return &ChanBroker{events: make(chan *Event, 10)}
+	})
+	cfgyaml := []byte(`
+version: 1
+active-brokers: [mirror, pat]
+brokers:
+  mirror:
+    type: ` + kind + `
+  pat:
+    type: pattern
+`)
+	cfg, err := ParseConfig(cfgyaml)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	brokers, err := NewBrokersFromConfig(cfg)
+	if err != nil || len(brokers) != 2 {
+		t.Fatalf("err: expected both brokers normally %d %v", len(brokers), err)
+	}
+
+	cfg.RelayOnly = true
+	brokers, err = NewBrokersFromConfig(cfg)
+	if err != nil || len(brokers) != 1 {
+		t.Fatalf("err: expected only the mirror in relay-only %d %v", len(brokers), err)
+	}
+	mirror := brokers[0].(*ChanBroker)
+
+	cd := &CentralDispatch{}
+	cd.AddBroker(mirror)
+	cd.Broadcast(&Event{Origin: &FakeBroker{}, Actor: "bob", Text: "..list"})
+	select {
+	case ev := <-mirror.events:
+		if ev.Text != "..list" || ev.IsCmdOutput {
+			t.Errorf("err: command should be relayed as plain text %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("err: nothing relayed")
+	}
+	select {
+	case ev := <-mirror.events:
+		t.Errorf("err: expected only the relayed text, also have %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cfg.ActiveBrokers = append(cfg.ActiveBrokers, "nope")
+	if _, err := NewBrokersFromConfig(cfg); err == nil {
+		t.Errorf("err: expected a missing broker config to fail")
+	}
+}
@@ -12,16 +12,26 @@
 package smug
 
 import (
+	"encoding/json"
 	"fmt"
 	"html"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
 	libsl "github.com/slack-go/slack"
+	yaml "gopkg.in/yaml.v2"
 )
 
+func init() {
+	RegisterBroker("slack", func() Broker { return &SlackBroker{} })
+}
+
 /* ************************** *
  * fake the slacklib logger
  * ************************** */
@@ -35,6 +45,34 @@ func (sl *SlackLogger) Output(lvl int, msg string) error {
 	return nil
 }
 
+/* ************************** *
+ * slack api surface
+ * ************************** */
+
+// the subset of the slack client we use. *slackClient satisfies this and
+// tests can swap in a fake
+type slackAPI interface {
+	AuthTest() (*libsl.AuthTestResponse, error)
+	GetChannels(bool, ...libsl.GetChannelsOption) ([]libsl.Channel, error)
+	GetUserInfo(string) (*libsl.User, error)
+	GetUserGroups(...libsl.GetUserGroupsOption) ([]libsl.UserGroup, error)
+	GetConversationReplies(
+		*libsl.GetConversationRepliesParameters,
+	) ([]libsl.Message, bool, string, error)
+	GetConversationHistory(
+		*libsl.GetConversationHistoryParameters,
+	) (*libsl.GetConversationHistoryResponse, error)
+	PostMessage(string, ...libsl.MsgOption) (string, string, error)
+	DeleteMessage(string, string) (string, string, error)
+	JoinConversation(string) (*libsl.Channel, string, []string, error)
+	SetTopicOfConversation(string, string) (*libsl.Channel, error)
+	AddReaction(string, libsl.ItemRef) error
+	PostMetadata(string, *SlackMetadata, ...libsl.MsgOption) (string, string, error)
+	// by workspace, for enterprise grid
+	GetTeamChannels(string) ([]libsl.Channel, error)
+	GetTeamUserGroups(string) ([]libsl.UserGroup, error)
+}
+
 /* ************************** *
  * repr our slack users
  * ************************** */
@@ -43,32 +81,111 @@ type SlackUser struct {
 	Id     string
 	Nick   string
 	Avatar string
+	// their status emoji, or text without one, blank without either
+	Status string
+}
+
+// slack's own status presets, shown as themselves rather than their names
+var slackStatusEmoji = map[string]string{
+	":spiral_calendar_pad:":   "🗓️",
+	":bus:":                   "🚌",
+	":face_with_thermometer:": "🤒",
+	":palm_tree:":             "🌴",
+	":house_with_garden:":     "🏡",
+	":desert_island:":         "🏝️",
+}
+
+func newSlackUser(ukey string, user *libsl.User) *SlackUser {
+	status := user.Profile.StatusEmoji
+	if emoji, found := slackStatusEmoji[status]; found {
+		status = emoji
+	} else if status == "" {
+		status = user.Profile.StatusText
+	}
+	return &SlackUser{
+		Id:     ukey,
+		Nick:   user.Name,
+		Avatar: user.Profile.Image72,
+		Status: status,
+	}
 }
 
+// icon for actors without an avatar url, expects a custom emoji per actor
+const DefaultAvatarEmoji = ":avatar_%s:"
+
+// how long a user the api couldn't find is remembered as missing
+const DefaultUserMissTTL = 5 * time.Minute
+
+// how long users kept in a user cache file go before they're fetched again
+const DefaultUserCacheTTL = 24 * time.Hour
+
+var errUserMissing = fmt.Errorf("user lookup failed recently")
+
 type SlackUserCache struct {
 	mux   sync.RWMutex
 	users map[string]*SlackUser
 	nicks map[string]*SlackUser
+	// avatar urls actors from other networks were last seen with
+	avatars map[string]string
+	// deleted or restricted users, not asked about again until their time
+	misses  map[string]time.Time
+	missTTL time.Duration
+	now     func() time.Time
+	// when each user was fetched.  after ttl they're fetched again the next
+	// time they're looked up, 0 keeps them until they change
+	fetched map[string]time.Time
+	ttl     time.Duration
+	// changed since the last Save
+	dirty bool
 }
 
 func (suc *SlackUserCache) CacheUser(user *SlackUser) {
+	suc.cacheUserAt(user, suc.now())
+}
+
+func (suc *SlackUserCache) cacheUserAt(user *SlackUser, at time.Time) {
 	suc.mux.Lock()
 	defer suc.mux.Unlock()
 	suc.users[user.Id] = user
 	suc.nicks[strings.ToLower(user.Nick)] = user
+	suc.fetched[user.Id] = at
+	suc.dirty = true
+}
+
+// must hold mux.  true if the user with id ukey is due to be fetched again
+func (suc *SlackUserCache) stale(ukey string) bool {
+	return suc.ttl > 0 && !suc.now().Before(suc.fetched[ukey].Add(suc.ttl))
+}
+
+// true if ukey failed a lookup within the miss ttl
+func (suc *SlackUserCache) missed(ukey string) bool {
+	suc.mux.RLock()
+	defer suc.mux.RUnlock()
+	until, found := suc.misses[ukey]
+	return found && suc.now().Before(until)
 }
 
 func (suc *SlackUserCache) UserFromAPI(
 	sb *SlackBroker, ukey string) (*SlackUser, error) {
+	if suc.missed(ukey) {
+		return nil, errUserMissing
+	}
 	user, err := sb.api.GetUserInfo(ukey)
 	if err != nil {
+		if suc.missTTL > 0 {
+			now := suc.now()
+			suc.mux.Lock()
+			for k, until := range suc.misses {
+				if !now.Before(until) {
+					delete(suc.misses, k)
+				}
+			}
+			suc.misses[ukey] = now.Add(suc.missTTL)
+			suc.mux.Unlock()
+		}
 		return nil, fmt.Errorf("err fetching user from slack: %+v", err)
 	}
-	suser := &SlackUser{
-		Id:     ukey,
-		Nick:   user.Name,
-		Avatar: user.Profile.Image72,
-	}
+	suser := newSlackUser(ukey, user)
 	suc.CacheUser(suser)
 	return suser, nil
 }
@@ -87,9 +204,28 @@ func (suc *SlackUserCache) userInNickCache(nick string) (*SlackUser, bool) {
 	return user, found
 }
 
+// user, fetched again first if they're stale.  when that fails the stale
+// one will do
+func (suc *SlackUserCache) revalidate(sb *SlackBroker, user *SlackUser) *SlackUser {
+	suc.mux.RLock()
+	stale := suc.stale(user.Id)
+	suc.mux.RUnlock()
+	if !stale {
+		return user
+	}
+	if fresh, err := suc.UserFromAPI(sb, user.Id); err == nil {
+		return fresh
+	}
+	return user
+}
+
+// users that can't be looked up show as their raw id
 func (suc *SlackUserCache) UserNick(
 	sb *SlackBroker, ukey string, cacheOnly bool) string {
 	cached_user, found := suc.userInIdCache(ukey)
+	if found && !cacheOnly {
+		cached_user = suc.revalidate(sb, cached_user)
+	}
 	if found {
 		return cached_user.Nick
 	}
@@ -97,16 +233,30 @@ func (suc *SlackUserCache) UserNick(
 		return ""
 	}
 	user, err := suc.UserFromAPI(sb, ukey)
+	if err == errUserMissing {
+		return ukey
+	}
 	if err != nil {
 		sb.log.Warnf("attempted to fetch %s but got err: %v", ukey, err)
-		return ""
+		return ukey
 	}
 	return user.Nick
 }
 
+// the status of the user with id ukey, if they're cached
+func (suc *SlackUserCache) UserStatus(ukey string) string {
+	if user, found := suc.userInIdCache(ukey); found {
+		return user.Status
+	}
+	return ""
+}
+
 func (suc *SlackUserCache) UserId(
 	sb *SlackBroker, nick string, cacheOnly bool) string {
 	cached_user, found := suc.userInNickCache(nick)
+	if found && !cacheOnly {
+		cached_user = suc.revalidate(sb, cached_user)
+	}
 	if found {
 		return cached_user.Id
 	}
@@ -115,6 +265,9 @@ func (suc *SlackUserCache) UserId(
 		return ""
 	}
 	user, err := suc.UserFromAPI(sb, nick)
+	if err == errUserMissing {
+		return ""
+	}
 	if err != nil {
 		sb.log.Warnf("attempted to fetch %s but got err: %v", nick, err)
 		return ""
@@ -122,9 +275,38 @@ func (suc *SlackUserCache) UserId(
 	return user.Id
 }
 
+// remembers the avatar url actor was last bridged with
+func (suc *SlackUserCache) CacheAvatar(actor string, url string) {
+	suc.mux.Lock()
+	defer suc.mux.Unlock()
+	suc.avatars[strings.ToLower(actor)] = url
+}
+
+// the best avatar url we have for actor, the one they were last bridged with
+// or that of the slack user with their nick.  blank if neither
+func (suc *SlackUserCache) Avatar(actor string) string {
+	suc.mux.RLock()
+	url := suc.avatars[strings.ToLower(actor)]
+	suc.mux.RUnlock()
+	if url != "" {
+		return url
+	}
+	if user, found := suc.userInNickCache(actor); found {
+		return user.Avatar
+	}
+	return ""
+}
+
+// fetches the users in mems that aren't cached, or are stale
 func (suc *SlackUserCache) PopulateCache(sb *SlackBroker, mems []string) {
 	for _, uid := range mems {
-		suc.UserFromAPI(sb, uid)
+		suc.mux.RLock()
+		_, found := suc.users[uid]
+		fresh := found && !suc.stale(uid)
+		suc.mux.RUnlock()
+		if !fresh {
+			suc.UserFromAPI(sb, uid)
+		}
 	}
 }
 
@@ -133,42 +315,553 @@ func (suc *SlackUserCache) Setup() {
 	defer suc.mux.Unlock()
 	suc.users = make(map[string]*SlackUser)
 	suc.nicks = make(map[string]*SlackUser)
+	suc.avatars = make(map[string]string)
+	suc.misses = make(map[string]time.Time)
+	suc.missTTL = DefaultUserMissTTL
+	suc.now = time.Now
+	suc.fetched = make(map[string]time.Time)
+}
+
+// users are fetched again when looked up ttl after they last were, 0 keeps
+// them until slack says they've changed
+func (suc *SlackUserCache) TTL(ttl time.Duration) {
+	suc.mux.Lock()
+	defer suc.mux.Unlock()
+	suc.ttl = ttl
+}
+
+// a cached user as saved to disk
+type savedSlackUser struct {
+	Id      string `json:"id"`
+	Nick    string `json:"nick"`
+	Avatar  string `json:"avatar,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Fetched int64  `json:"fetched"`
+}
+
+// writes the cached users to path, if they've changed since the last Save.
+// the file is replaced whole so a crash midway leaves the old one
+func (suc *SlackUserCache) Save(path string) error {
+	suc.mux.Lock()
+	if !suc.dirty {
+		suc.mux.Unlock()
+		return nil
+	}
+	saved := make([]savedSlackUser, 0, len(suc.users))
+	for id, user := range suc.users {
+		saved = append(saved, savedSlackUser{
+			Id:      id,
+			Nick:    user.Nick,
+			Avatar:  user.Avatar,
+			Status:  user.Status,
+			Fetched: suc.fetched[id].Unix(),
+		})
+	}
+	suc.dirty = false
+	suc.mux.Unlock()
+	data, err := json.Marshal(saved)
+	if err == nil {
+		tmp := path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		suc.mux.Lock()
+		suc.dirty = true
+		suc.mux.Unlock()
+	}
+	return err
+}
+
+// caches the users saved to path, as of when they were fetched.  a missing
+// file is an empty cache
+func (suc *SlackUserCache) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedSlackUser
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid user cache %s: %s", path, err)
+	}
+	for _, su := range saved {
+		suc.cacheUserAt(&SlackUser{
+			Id:     su.Id,
+			Nick:   su.Nick,
+			Avatar: su.Avatar,
+			Status: su.Status,
+		}, time.Unix(su.Fetched, 0))
+	}
+	suc.mux.Lock()
+	suc.dirty = false
+	suc.mux.Unlock()
+	return nil
+}
+
+// failed lookups are retried after ttl, 0 always retries
+func (suc *SlackUserCache) MissTTL(ttl time.Duration) {
+	suc.mux.Lock()
+	defer suc.mux.Unlock()
+	suc.missTTL = ttl
+}
+
+/* ************************** *
+ * message text, keyed by ts.  holds thread roots and reacted messages
+ * ************************** */
+
+const threadCacheMax = 500
+
+type SlackThreadCache struct {
+	mux   sync.RWMutex
+	roots map[string]string
+}
+
+func (stc *SlackThreadCache) Setup() {
+	stc.mux.Lock()
+	defer stc.mux.Unlock()
+	stc.roots = make(map[string]string)
+}
+
+func (stc *SlackThreadCache) Get(ts string) (string, bool) {
+	stc.mux.RLock()
+	defer stc.mux.RUnlock()
+	root, found := stc.roots[ts]
+	return root, found
+}
+
+func (stc *SlackThreadCache) Put(ts string, root string) {
+	stc.mux.Lock()
+	defer stc.mux.Unlock()
+	if len(stc.roots) >= threadCacheMax {
+		// old threads rarely get new replies, just start over
+		stc.roots = make(map[string]string)
+	}
+	stc.roots[ts] = root
+}
+
+// how long a thread read for ReadThread is reused
+const slackRepliesTTL = time.Minute
+
+// whole threads, keyed by thread ts, as ReadThread last fetched them
+type SlackRepliesCache struct {
+	mux     sync.Mutex
+	threads map[string]slackReplies
+	now     func() time.Time
+}
+
+type slackReplies struct {
+	msgs []libsl.Message
+	at   time.Time
+}
+
+func (src *SlackRepliesCache) Setup() {
+	src.mux.Lock()
+	defer src.mux.Unlock()
+	src.threads = make(map[string]slackReplies)
+	src.now = time.Now
+}
+
+func (src *SlackRepliesCache) Get(ts string) ([]libsl.Message, bool) {
+	src.mux.Lock()
+	defer src.mux.Unlock()
+	r, found := src.threads[ts]
+	if !found || src.now().Sub(r.at) > slackRepliesTTL {
+		return nil, false
+	}
+	return r.msgs, true
+}
+
+func (src *SlackRepliesCache) Put(ts string, msgs []libsl.Message) {
+	src.mux.Lock()
+	defer src.mux.Unlock()
+	if len(src.threads) >= threadCacheMax {
+		src.threads = make(map[string]slackReplies)
+	}
+	src.threads[ts] = slackReplies{msgs: msgs, at: src.now()}
+}
+
+/* ************************** *
+ * user group handles, keyed by subteam id
+ * ************************** */
+
+type SlackGroupCache struct {
+	mux     sync.RWMutex
+	handles map[string]string
+}
+
+func (sgc *SlackGroupCache) Setup() {
+	sgc.mux.Lock()
+	defer sgc.mux.Unlock()
+	sgc.handles = make(map[string]string)
+}
+
+// the group's handle, without the @.  unknown ids refresh the whole list
+// from the api unless cacheOnly, ids still unknown after that are remembered
+// as "" so we don't ask again for every mention
+func (sgc *SlackGroupCache) Handle(
+	sb *SlackBroker, id string, cacheOnly bool) string {
+	sgc.mux.RLock()
+	handle, found := sgc.handles[id]
+	sgc.mux.RUnlock()
+	if found || cacheOnly {
+		return handle
+	}
+	groups, err := sb.listUserGroups()
+	if err != nil {
+		sb.log.Warnf("unable to fetch user groups: %s", err)
+		return ""
+	}
+	sgc.mux.Lock()
+	defer sgc.mux.Unlock()
+	for _, g := range groups {
+		sgc.handles[g.ID] = g.Handle
+	}
+	if _, found := sgc.handles[id]; !found {
+		sgc.handles[id] = ""
+	}
+	return sgc.handles[id]
+}
+
+/* ************************** *
+ * avatar urls for actors, from config and a file
+ * ************************** */
+
+type SlackAvatarMap struct {
+	mux  sync.RWMutex
+	file string
+	// when the file was last read, it's only read again once it changes
+	modTime time.Time
+	fixed   map[string]string
+	urls    map[string]string
+}
+
+// avatars are actor: url, file is a yaml file of more the same.  actors are
+// case insensitive and avatars win over the file's
+func NewSlackAvatarMap(avatars map[string]string, file string) (*SlackAvatarMap, error) {
+	sam := &SlackAvatarMap{file: file, fixed: make(map[string]string)}
+	for actor, url := range avatars {
+		sam.fixed[strings.ToLower(actor)] = url
+	}
+	sam.urls = sam.fixed
+	return sam, sam.Reload()
+}
+
+// re-reads the file if it changed since last time
+func (sam *SlackAvatarMap) Reload() error {
+	if sam == nil || sam.file == "" {
+		return nil
+	}
+	info, err := os.Stat(sam.file)
+	if err != nil {
+		return err
+	}
+	sam.mux.RLock()
+	same := info.ModTime().Equal(sam.modTime)
+	sam.mux.RUnlock()
+	if same {
+		return nil
+	}
+	data, err := ioutil.ReadFile(sam.file)
+	if err != nil {
+		return err
+	}
+	var fromFile map[string]string
+	if err := yaml.Unmarshal(data, &fromFile); err != nil {
+		return fmt.Errorf("invalid avatar file %s: %s", sam.file, err)
+	}
+	urls := make(map[string]string)
+	for actor, url := range fromFile {
+		urls[strings.ToLower(actor)] = url
+	}
+	for actor, url := range sam.fixed {
+		urls[actor] = url
+	}
+	sam.mux.Lock()
+	defer sam.mux.Unlock()
+	sam.urls = urls
+	sam.modTime = info.ModTime()
+	return nil
+}
+
+// actor's mapped avatar url, blank if they don't have one
+func (sam *SlackAvatarMap) Avatar(actor string) string {
+	if sam == nil {
+		return ""
+	}
+	sam.mux.RLock()
+	defer sam.mux.RUnlock()
+	return sam.urls[strings.ToLower(actor)]
 }
 
 /* ************************** *
  * slack broker
  * ************************** */
 
+// opens an rtm connection, returning its events and a way to hang up.  the
+// events are closed once the connection is done for
+type rtmConnector func() (<-chan libsl.RTMEvent, func() error)
+
+// between rtm reconnects, doubling from min to max each time in a row
+var (
+	rtmBackoffMin = time.Second
+	rtmBackoffMax = 5 * time.Minute
+)
+
+// how often an rtm connection is pinged unless keep-alive says otherwise,
+// and how many pings' worth of hearing nothing, not even a pong, before it's
+// given up on
+const (
+	rtmPing    = 30 * time.Second
+	rtmDeadman = 4
+)
+
+// rtm connections from sc, each dialed once, reconnecting is up to
+// Activate.  we read the websocket ourselves rather than through the lib's
+// managed connection, which would only let us at message events' raw json
+// by swapping out its global EventMapping
+func slackRTM(sc *libsl.Client, dialer *websocket.Dialer, ping time.Duration) rtmConnector {
+	return func() (<-chan libsl.RTMEvent, func() error) {
+		rc := &rtmConn{
+			events: make(chan libsl.RTMEvent),
+			done:   make(chan bool),
+			ping:   ping,
+		}
+		go rc.run(sc, dialer)
+		return rc.events, rc.hangup
+	}
+}
+
+type rtmConn struct {
+	events chan libsl.RTMEvent
+	ping   time.Duration
+	// closed by hangup
+	done chan bool
+	stop sync.Once
+	mux  sync.Mutex
+	conn *websocket.Conn
+}
+
+// closes the connection, once run's made one, and lets go of run
+func (rc *rtmConn) hangup() error {
+	rc.stop.Do(func() { close(rc.done) })
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	if rc.conn != nil {
+		return rc.conn.Close()
+	}
+	return nil
+}
+
+// hands ev on, false once hung up
+func (rc *rtmConn) send(ev libsl.RTMEvent) bool {
+	select {
+	case rc.events <- ev:
+		return true
+	case <-rc.done:
+		return false
+	}
+}
+
+// connects and hands on what slack sends until the connection drops, slack
+// says goodbye or it's hung up, then closes events
+func (rc *rtmConn) run(sc *libsl.Client, dialer *websocket.Dialer) {
+	defer close(rc.events)
+	info, wsurl, err := sc.ConnectRTM()
+	if err != nil {
+		switch err.Error() {
+		case "invalid_auth", "account_inactive", "not_authed":
+			rc.send(libsl.RTMEvent{Type: "invalid_auth", Data: &libsl.InvalidAuthEvent{}})
+		default:
+			rc.send(libsl.RTMEvent{Type: "connection_error",
+				Data: &libsl.ConnectionErrorEvent{Attempt: 1, ErrorObj: err}})
+		}
+		return
+	}
+	conn, _, err := dialer.Dial(wsurl, nil)
+	if err != nil {
+		rc.send(libsl.RTMEvent{Type: "connection_error",
+			Data: &libsl.ConnectionErrorEvent{Attempt: 1, ErrorObj: err}})
+		return
+	}
+	rc.mux.Lock()
+	select {
+	case <-rc.done:
+		rc.mux.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	rc.conn = conn
+	rc.mux.Unlock()
+	defer conn.Close()
+	stopped := make(chan bool)
+	defer close(stopped)
+	go rc.pinger(conn, stopped)
+
+	if !rc.send(libsl.RTMEvent{Type: "connected",
+		Data: &libsl.ConnectedEvent{ConnectionCount: 1, Info: info}}) {
+		return
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(rtmDeadman * rc.ping))
+		var raw json.RawMessage
+		if err := conn.ReadJSON(&raw); err != nil {
+			select {
+			case <-rc.done:
+			default:
+				rc.send(libsl.RTMEvent{Type: "incoming_error",
+					Data: &libsl.IncomingEventError{ErrorObj: err}})
+			}
+			return
+		}
+		ev, ok := decodeRTMEvent(raw)
+		if ev.Type == "goodbye" {
+			return
+		}
+		if ok && !rc.send(ev) {
+			return
+		}
+	}
+}
+
+// pings conn until stopped.  only the pinger writes to conn
+func (rc *rtmConn) pinger(conn *websocket.Conn, stopped chan bool) {
+	ticker := time.NewTicker(rc.ping)
+	defer ticker.Stop()
+	for id := 1; ; id++ {
+		select {
+		case <-ticker.C:
+			ping := map[string]interface{}{"id": id, "type": "ping"}
+			if err := conn.WriteJSON(ping); err != nil {
+				conn.Close()
+				return
+			}
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// raw as the event the lib would make of it, but with messages decoded as
+// slackRichMessage.  false for what isn't worth handing on, like pongs
+func decodeRTMEvent(raw json.RawMessage) (libsl.RTMEvent, bool) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return libsl.RTMEvent{Type: "unmarshalling_error",
+			Data: &libsl.UnmarshallingErrorEvent{ErrorObj: err}}, true
+	}
+	var data interface{}
+	switch head.Type {
+	case "", "pong":
+		// acks and answers to our pings
+		return libsl.RTMEvent{Type: head.Type}, false
+	case "goodbye":
+		return libsl.RTMEvent{Type: head.Type}, false
+	case "hello":
+		return libsl.RTMEvent{Type: head.Type, Data: &libsl.HelloEvent{}}, true
+	case "message":
+		data = &slackRichMessage{}
+	default:
+		v, found := libsl.EventMapping[head.Type]
+		if !found {
+			return libsl.RTMEvent{Type: "unmarshalling_error",
+				Data: &libsl.UnmarshallingErrorEvent{
+					ErrorObj: fmt.Errorf("unmapped rtm event %q", head.Type)}}, true
+		}
+		data = reflect.New(reflect.TypeOf(v)).Interface()
+	}
+	if err := json.Unmarshal(raw, data); err != nil {
+		return libsl.RTMEvent{Type: "unmarshalling_error",
+			Data: &libsl.UnmarshallingErrorEvent{ErrorObj: err}}, true
+	}
+	return libsl.RTMEvent{Type: head.Type, Data: data}, true
+}
+
 type SlackBroker struct {
 	log *Logger
 	// components from slack lib
-	api *libsl.Client
-	rtm *libsl.RTM
+	api     slackAPI
+	connect rtmConnector
 	// internal plumbing
 	usercache       *SlackUserCache
+	groupcache      *SlackGroupCache
 	chanid          string
 	channel         string
 	token           string
 	mybotid         string
+	unfurls         []libsl.MsgOption
+	coalesce        *Coalescer
+	threadCtxLen    int
+	threadRoots     *SlackThreadCache
+	threadReplies   *SlackRepliesCache
+	reactionCmds    map[string]string
+	reactedMsgs     *SlackThreadCache
+	presence        bool
+	avatarEmoji     string
 	re_uids         *regexp.Regexp
 	re_usernick     *regexp.Regexp
+	re_specials     *regexp.Regexp
 	re_atusers      *regexp.Regexp
 	re_embeddedurls *regexp.Regexp
 	msgsMux         sync.RWMutex
-	msgsSent        int64
-	msgsRcvd        int64
+	metrics         Metrics
+	// whether we're in the channel, as of Setup, and if it's a private one
+	member  bool
+	private bool
+	// our channel's last known topic
+	topic string
+	// closed by Deactivate, and how to hang up the current rtm connection
+	done       chan bool
+	disconnect func() error
+	// configured avatar urls for actors that don't bring their own
+	avatars *SlackAvatarMap
+	// slash commands and interactions over socket mode when set, and how to
+	// hang up the current connection
+	socket      socketConnector
+	socketClose func() error
+	// bridge bot_message posts, and the bot id our own posts carry
+	bridgeBots bool
+	botid      string
+	// where the user cache is kept between restarts, blank for nowhere, and
+	// how long its users go before they're fetched again
+	userCacheFile string
+	userCacheTTL  time.Duration
+	// people's names on other brokers, for mentions and avatars
+	identities *IdentityMap
+	// files listed per message, 0 for all, and whether to leave out links
+	maxFiles  int
+	fileNames bool
+	// bridge people's edits to their messages
+	bridgeEdits bool
+	// on enterprise grid, and the workspace channels are listed from
+	enterprise bool
+	teamId     string
+	chatOptions
+	topicSyncer
 }
 
 func (sb *SlackBroker) Name() string {
 	return fmt.Sprintf("slack-%s", sb.channel)
 }
 
+func (sb *SlackBroker) logger() *Logger { return sb.log }
+
 func (sb *SlackBroker) Heartbeat() bool {
 	sb.msgsMux.Lock()
-	mr, ms := sb.msgsRcvd, sb.msgsSent
-	sb.msgsRcvd, sb.msgsSent = 0, 0
+	m := sb.metrics
+	sb.metrics = Metrics{}
 	sb.msgsMux.Unlock()
-	sb.log.logMetrics(mr, ms)
+	sb.log.logMetrics(m)
+	if err := sb.avatars.Reload(); err != nil {
+		sb.log.Warnf("ERR reloading avatars: %s", err)
+	}
+	sb.saveUserCache()
 	return true
 }
 
@@ -178,8 +871,20 @@ func (sb *SlackBroker) SetupInternals() {
 	sb.log = NewLogger("broker", "slack")
 	sb.usercache = &SlackUserCache{}
 	sb.usercache.Setup()
-	sb.re_uids = regexp.MustCompile(`<@(U[\w|]+)>`) // get sub ids in msgs
+	sb.groupcache = &SlackGroupCache{}
+	sb.groupcache.Setup()
+	sb.threadRoots = &SlackThreadCache{}
+	sb.threadRoots.Setup()
+	sb.threadReplies = &SlackRepliesCache{}
+	sb.threadReplies.Setup()
+	sb.reactedMsgs = &SlackThreadCache{}
+	sb.reactedMsgs.Setup()
+	sb.avatarEmoji = DefaultAvatarEmoji
+	sb.done = make(chan bool)
+	sb.re_uids = regexp.MustCompile(`<@([UW][\w|]+)>`) // get sub ids in msgs
 	sb.re_usernick = regexp.MustCompile(`^(\w+):`)
+	sb.re_specials = regexp.MustCompile(
+		`<!(subteam\^\w+|here|channel|everyone)(?:\|([^>]*))?>`)
 	sb.re_atusers = regexp.MustCompile(`@(\w+)\b`)
 	sb.re_embeddedurls = regexp.MustCompile(`<(http.+\|?.*)>`)
 }
@@ -214,17 +919,42 @@ func (sb *SlackBroker) ConvertRefsToUsers(s string, cacheOnly bool) string {
 			n, //sb.usercache.UserNick(sb, u, cacheOnly),
 		)
 	}
-	return s
+	return sb.convertSpecialRefs(s, cacheOnly)
+}
+
+// <!here>, <!channel> and <!everyone> become @here etc and user group
+// mentions <!subteam^S123|@team> become @team, looking up the handle when
+// slack didn't include a label.  unknown groups are left alone
+func (sb *SlackBroker) convertSpecialRefs(s string, cacheOnly bool) string {
+	return sb.re_specials.ReplaceAllStringFunc(s, func(ref string) string {
+		m := sb.re_specials.FindStringSubmatch(ref)
+		if !strings.HasPrefix(m[1], "subteam^") {
+			return "@" + m[1]
+		}
+		if m[2] != "" {
+			return "@" + strings.TrimPrefix(m[2], "@")
+		}
+		handle := sb.groupcache.Handle(sb, strings.TrimPrefix(m[1], "subteam^"), cacheOnly)
+		if handle == "" {
+			return ref
+		}
+		return "@" + handle
+	})
 }
 
 func (sb *SlackBroker) ConvertUsersToRefs(s string, cacheOnly bool) string {
+	return sb.convertUsersToRefs(s, nil, cacheOnly)
+}
+
+// the same, with nicks as they're known on origin
+func (sb *SlackBroker) convertUsersToRefs(s string, origin Broker, cacheOnly bool) string {
 	//  first look for irc type  USER: at beginning of line
 	matches := sb.re_usernick.FindAllStringSubmatchIndex(s, -1)
 	for i := len(matches) - 1; i >= 0; i-- {
 		// start,stop,sub0,sublen := matches[i]
 		m := matches[i]
 		usernick := s[m[2]:m[3]]
-		uid := sb.usercache.UserId(sb, usernick, cacheOnly)
+		uid := sb.userIdFor(usernick, origin, cacheOnly)
 		if len(uid) > 4 {
 			s = strings.ReplaceAll(
 				s,
@@ -240,7 +970,7 @@ func (sb *SlackBroker) ConvertUsersToRefs(s string, cacheOnly bool) string {
 		// start,stop,sub0,sublen := matches[i]
 		m := matches[i]
 		usernick := s[m[2]:m[3]]
-		uid := sb.usercache.UserId(sb, usernick, cacheOnly)
+		uid := sb.userIdFor(usernick, origin, cacheOnly)
 		if len(uid) > 1 {
 			s = strings.ReplaceAll(
 				s,
@@ -253,105 +983,694 @@ func (sb *SlackBroker) ConvertUsersToRefs(s string, cacheOnly bool) string {
 	return s
 }
 
-// args [token, channel]
-func (sb *SlackBroker) Setup(args ...string) {
-	sb.SetupInternals()
-	sb.token = args[0]
-	sb.channel = args[1]
-	if strings.HasPrefix(sb.channel, "#") {
-		sb.log.Warnf("slack channels should not begin with #")
-	}
-	sc := libsl.New(
-		sb.token,
-		libsl.OptionDebug(false),
-		// libsl.OptionLog(&SlackLogger{sb.log}),
-	)
-	sb.api = sc
-	sb.rtm = sb.api.NewRTM()
-	authtest, err := sb.api.AuthTest() // gets our identity from slack api
-	myuid := authtest.UserID
-	if err != nil {
-		sb.log.Warnf("ERR occurred %+v", err)
-	}
-	sb.mybotid = myuid
+var re_slackuid = regexp.MustCompile(`^[UW][A-Z0-9]+$`)
 
-	// populate my channel info
-	// this is a bit ... lame. Should be better way?  XXX
-	channels, _ := sb.api.GetChannels(false)
-	for _, channel := range channels {
-		if channel.Name == sb.channel {
-			sb.chanid = channel.ID
-			sb.usercache.PopulateCache(sb, channel.Members)
-			break
+// the slack user id of nick, who may go by another name here according to
+// the identity map
+func (sb *SlackBroker) userIdFor(nick string, origin Broker, cacheOnly bool) string {
+	if name := sb.identities.Lookup(origin, nick).On(sb); name != "" {
+		if re_slackuid.MatchString(name) {
+			return name
 		}
+		nick = name
 	}
-	if sb.chanid == "" {
-		sb.log.Warnf("ERR channel not found (%s)", sb.channel)
+	return sb.usercache.UserId(sb, nick, cacheOnly)
+}
+
+// know people from other brokers by their names on slack
+func (sb *SlackBroker) UseIdentities(im *IdentityMap) {
+	sb.identities = im
+}
+
+// join consecutive lines from the same actor arriving within window of each
+// other into one post, up to maxLen chars.  a window of 0 posts every line
+func (sb *SlackBroker) Coalesce(window time.Duration, maxLen int) {
+	if window <= 0 {
 		return
 	}
+	sb.coalesce = NewCoalescer(window, maxLen, sb.post)
+	go sb.coalesce.Run()
 }
 
-func (sb *SlackBroker) SendComplexMsg(dest string, text string, ev *Event) {
-
+// when > 0, threaded replies carry up to n chars of the thread's root
+// message as their ThreadContext, so thread-less networks have some context
+func (sb *SlackBroker) ThreadContext(n int) {
+	sb.threadCtxLen = n
 }
 
-func (sb *SlackBroker) HandleEvent(ev *Event, dis Dispatcher) {
-	if ev.ReplyBroker != nil && ev.ReplyBroker != sb {
-		// if not intended for us, eject here
-		return
+// returns the "re: <root>: " prefix for a threaded reply or "" if the message
+// is not a reply or we can't find the root
+func (sb *SlackBroker) threadPrefix(e *libsl.MessageEvent) string {
+	if sb.threadCtxLen <= 0 || e.ThreadTimestamp == "" ||
+		e.ThreadTimestamp == e.Timestamp {
+		return ""
 	}
-	sb.msgsMux.Lock()
-	sb.msgsRcvd++
-	sb.msgsMux.Unlock()
-	txt := sb.ConvertUsersToRefs(ev.Text, false)
-	var dest string
-	if len(ev.ReplyTarget) == 0 {
-		dest = sb.chanid
-	} else {
-		dest = ev.ReplyTarget
+	root, found := sb.threadRoots.Get(e.ThreadTimestamp)
+	if !found {
+		msgs, _, _, err := sb.api.GetConversationReplies(
+			&libsl.GetConversationRepliesParameters{
+				ChannelID: e.Channel,
+				Timestamp: e.ThreadTimestamp,
+				Limit:     1,
+			})
+		if err != nil || len(msgs) == 0 {
+			sb.log.Warnf("unable to fetch thread root %s: %v",
+				e.ThreadTimestamp, err)
+			return ""
+		}
+		root = sb.SimplifyParse(sb.ConvertRefsToUsers(msgs[0].Text, false))
+		sb.threadRoots.Put(e.ThreadTimestamp, root)
+	}
+	if r := []rune(root); len(r) > sb.threadCtxLen {
+		root = strings.TrimSpace(string(r[:sb.threadCtxLen]))
 	}
+	return fmt.Sprintf("re: %s: ", root)
+}
 
-	var msgContent libsl.MsgOption
-	if ev.ContentBlocks != nil && len(ev.ContentBlocks) > 0 {
-		blockslice := []libsl.Block{}
-		for _, db := range ev.ContentBlocks {
-			var headerText *libsl.TextBlockObject
-			var headerSect *libsl.SectionBlock
-			if len(db.Title) > 0 {
-				// just bold it
-				headerText = libsl.NewTextBlockObject(
-					"mrkdwn", "*"+db.Title+"*", false, false)
-				headerSect = libsl.NewSectionBlock(
-					headerText, nil, nil)
-				blockslice = append(blockslice, headerSect)
-			}
-			// continue if nothing else but header in this block
-			if db.Text == "" && db.ImgUrl == "" {
-				continue
+// every message in thread, the root first, a page at a time
+func (sb *SlackBroker) fetchReplies(channel string, thread string) ([]libsl.Message, error) {
+	if msgs, found := sb.threadReplies.Get(thread); found {
+		return msgs, nil
+	}
+	params := &libsl.GetConversationRepliesParameters{
+		ChannelID: channel,
+		Timestamp: thread,
+		Limit:     200,
+	}
+	all := []libsl.Message{}
+	for {
+		msgs, more, cursor, err := sb.api.GetConversationReplies(params)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, msgs...)
+		if !more || cursor == "" {
+			break
+		}
+		params.Cursor = cursor
+	}
+	sb.threadReplies.Put(thread, all)
+	return all, nil
+}
+
+// the messages of the slack thread ev was said in
+func (sb *SlackBroker) ReadThread(ev *Event) ([]*Event, error) {
+	if ev.ThreadId == "" || ev.ThreadBroker != sb {
+		return nil, fmt.Errorf("not in a slack thread")
+	}
+	channel := sb.chanid
+	if ev.ReplyBroker == sb && ev.ReplyTarget != "" {
+		channel = ev.ReplyTarget
+	}
+	msgs, err := sb.fetchReplies(channel, ev.ThreadId)
+	if err != nil {
+		return nil, err
+	}
+	events := []*Event{}
+	for _, m := range msgs {
+		actor := m.Username
+		if m.User != "" {
+			actor = sb.usercache.UserNick(sb, m.User, false)
+		}
+		events = append(events, &Event{
+			Origin:    sb,
+			Actor:     actor,
+			ActorId:   m.User,
+			RawText:   m.Text,
+			Text:      sb.SimplifyParse(sb.ConvertRefsToUsers(m.Text, false)),
+			MessageId: m.Timestamp,
+			ThreadId:  ev.ThreadId,
+		})
+	}
+	return events, nil
+}
+
+// reacting to a message with one of these emoji (names without colons)
+// broadcasts the message's text again, as if the reacting user had said it,
+// after the mapped prefix.  eg {"repeat": ""} re-runs a command as is
+func (sb *SlackBroker) ReactionCommands(cmds map[string]string) {
+	sb.reactionCmds = cmds
+}
+
+// text of the message at ts in channel, cached since reacted messages tend to
+// get several reactions
+func (sb *SlackBroker) messageText(channel string, ts string) (string, bool) {
+	if text, found := sb.reactedMsgs.Get(ts); found {
+		return text, true
+	}
+	resp, err := sb.api.GetConversationHistory(
+		&libsl.GetConversationHistoryParameters{
+			ChannelID: channel,
+			Latest:    ts,
+			Inclusive: true,
+			Limit:     1,
+		})
+	if err != nil || len(resp.Messages) == 0 || resp.Messages[0].Timestamp != ts {
+		sb.log.Warnf("unable to fetch reacted message %s: %v", ts, err)
+		return "", false
+	}
+	text := sb.SimplifyParse(sb.ConvertRefsToUsers(resp.Messages[0].Text, false))
+	sb.reactedMsgs.Put(ts, text)
+	return text, true
+}
+
+func (sb *SlackBroker) handleReaction(e *libsl.ReactionAddedEvent, dis Dispatcher) {
+	prefix, found := sb.reactionCmds[e.Reaction]
+	if !found || e.Item.Type != "message" || e.User == sb.mybotid {
+		return
+	}
+	nick := sb.usercache.UserNick(sb, e.User, false)
+	if sb.ignore.Ignored(nick) {
+		return
+	}
+	text, found := sb.messageText(e.Item.Channel, e.Item.Timestamp)
+	if !found || text == "" {
+		return
+	}
+	ev := &Event{
+		Origin:       sb,
+		Actor:        nick,
+		ActorId:      e.User,
+		RawText:      prefix + text,
+		Text:         prefix + text,
+		ThreadId:     e.Item.Timestamp,
+		ThreadBroker: sb,
+		ts:           time.Now(),
+	}
+	if e.Item.Channel != sb.chanid {
+		ev.ReplyBroker = sb
+		ev.ReplyTarget = e.Item.Channel
+		ev.Private = isDirectChannel(e.Item.Channel)
+	}
+	sb.msgsMux.Lock()
+	sb.metrics.sent(ev)
+	sb.msgsMux.Unlock()
+	dis.Broadcast(ev)
+}
+
+// turns slack's link and media previews on or off for our posts.  nil leaves
+// slack's default for that kind of preview
+func (sb *SlackBroker) Unfurl(links *bool, media *bool) {
+	sb.unfurls = nil
+	if links != nil && *links {
+		sb.unfurls = append(sb.unfurls, libsl.MsgOptionEnableLinkUnfurl())
+	} else if links != nil {
+		sb.unfurls = append(sb.unfurls, libsl.MsgOptionDisableLinkUnfurl())
+	}
+	if media != nil && !*media {
+		// media previews are on unless told otherwise
+		sb.unfurls = append(sb.unfurls, libsl.MsgOptionDisableMediaUnfurl())
+	}
+}
+
+// args [token, channel]
+func (sb *SlackBroker) Setup(args ...string) error {
+	sb.SetupInternals()
+	sb.token = args[0]
+	sb.channel = args[1]
+	sb.log = NewLogger("broker", DisplayName(sb))
+	if sb.userCacheFile != "" {
+		sb.usercache.TTL(sb.userCacheTTL)
+		if err := sb.usercache.Load(sb.userCacheFile); err != nil {
+			sb.log.Warnf("ERR loading user cache, starting empty: %s", err)
+		}
+	}
+	if strings.HasPrefix(sb.channel, "#") {
+		// slack names channels without it, so #general would never match
+		sb.log.Infof("slack channels should not begin with #, using %s",
+			strings.TrimPrefix(sb.channel, "#"))
+		sb.channel = strings.TrimPrefix(sb.channel, "#")
+	}
+	if sb.api == nil {
+		sc := newSlackClient(sb.token, sb.timeouts.HttpClient(),
+			libsl.OptionDebug(false),
+			// libsl.OptionLog(&SlackLogger{sb.log}),
+		)
+		sb.api = sc
+		sb.connect = slackRTM(sc.Client, sb.wsDialer(), sb.rtmPing())
+	}
+	authtest, err := sb.api.AuthTest() // gets our identity from slack api
+	if err != nil {
+		return fmt.Errorf("slack auth failed: %s", err)
+	}
+	sb.mybotid = authtest.UserID
+	if sb.enterprise && sb.teamId == "" {
+		sb.teamId = authtest.TeamID
+	}
+
+	// populate my channel info
+	// this is a bit ... lame. Should be better way?  XXX
+	channels, err := sb.listChannels()
+	if err != nil {
+		return fmt.Errorf("unable to list slack channels: %s", err)
+	}
+	for _, channel := range channels {
+		if channel.Name == sb.channel {
+			sb.chanid = channel.ID
+			sb.usercache.PopulateCache(sb, channel.Members)
+			sb.member = channel.IsMember
+			for _, m := range channel.Members {
+				sb.member = sb.member || m == sb.mybotid
 			}
-			msgText := libsl.NewTextBlockObject("mrkdwn", db.Text, false, false)
-			if len(db.ImgUrl) > 0 {
-				msgImg := libsl.NewImageBlockElement(db.ImgUrl, "accimg")
-				msgSect := libsl.NewSectionBlock(
-					msgText, nil, libsl.NewAccessory(msgImg))
-				blockslice = append(blockslice, msgSect)
-			} else {
-				msgSect := libsl.NewSectionBlock(
-					msgText, nil, nil)
-				blockslice = append(blockslice, msgSect)
+			sb.private = channel.IsPrivate
+			break
+		}
+	}
+	if sb.chanid == "" {
+		return fmt.Errorf(
+			"slack channel not found (%s), private channels need the bot invited",
+			sb.channel)
+	}
+	if !sb.member {
+		sb.log.Warnf("not a member of %s, nothing said there will be seen",
+			sb.channel)
+	}
+	return nil
+}
+
+// joins our channel if Setup found we weren't in it.  we can only let
+// ourselves into public channels, private ones need someone to /invite us
+func (sb *SlackBroker) JoinChannel() error {
+	if sb.member {
+		return nil
+	}
+	if sb.private {
+		sb.log.Errorf("can't join %s, it's private and needs the bot /invite'd",
+			sb.channel)
+		return nil
+	}
+	if _, _, _, err := sb.api.JoinConversation(sb.chanid); err != nil {
+		return fmt.Errorf("unable to join slack channel %s: %s", sb.channel, err)
+	}
+	sb.member = true
+	sb.log.Infof("joined %s", sb.channel)
+	return nil
+}
+
+// keep the user cache in path across restarts, so a restart doesn't fetch
+// everyone in the channel again.  users are fetched again when looked up ttl
+// after they last were.  call before Setup, which loads it
+func (sb *SlackBroker) UserCacheFile(path string, ttl time.Duration) {
+	sb.userCacheFile = path
+	sb.userCacheTTL = ttl
+}
+
+func (sb *SlackBroker) saveUserCache() {
+	if sb.userCacheFile == "" || sb.usercache == nil {
+		return
+	}
+	if err := sb.usercache.Save(sb.userCacheFile); err != nil {
+		sb.log.Warnf("ERR saving user cache to %s: %s", sb.userCacheFile, err)
+	}
+}
+
+// dials the rtm and socket mode websockets with our timeouts
+func (sb *SlackBroker) wsDialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	if sb.timeouts != nil {
+		dialer.NetDial = sb.timeouts.Dialer().Dial
+		if sb.timeouts.Dial > 0 {
+			dialer.HandshakeTimeout = sb.timeouts.Dial
+		}
+	}
+	return &dialer
+}
+
+// how often rtm connections are pinged
+func (sb *SlackBroker) rtmPing() time.Duration {
+	if sb.timeouts == nil || sb.timeouts.KeepAlive <= 0 {
+		return rtmPing
+	}
+	return sb.timeouts.KeepAlive
+}
+
+func (sb *SlackBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	nt, err := NewNetTimeouts(cfg.DialTimeout, cfg.KeepAlive)
+	if err != nil {
+		return err
+	}
+	sb.ConnTimeouts(nt)
+	if cfg.Enterprise {
+		sb.EnterpriseGrid(cfg.TeamId)
+	}
+	if cfg.UserCacheFile != "" {
+		ttl := DefaultUserCacheTTL
+		if cfg.UserCacheTTL != "" {
+			if ttl, err = time.ParseDuration(cfg.UserCacheTTL); err != nil {
+				return fmt.Errorf("invalid user-cache-ttl %s", cfg.UserCacheTTL)
 			}
 		}
-		msgContent = libsl.MsgOptionBlocks(blockslice...)
+		sb.UserCacheFile(cfg.UserCacheFile, ttl)
+	}
+	if err := sb.Setup(cfg.ApiToken, cfg.Channel); err != nil {
+		return err
+	}
+	if cfg.JoinChannel {
+		if err := sb.JoinChannel(); err != nil {
+			return err
+		}
+	}
+	sb.ThreadContext(cfg.ThreadContext)
+	sb.ReactionCommands(cfg.ReactionCommands)
+	sb.Unfurl(cfg.UnfurlLinks, cfg.UnfurlMedia)
+	sb.ShowPresence(cfg.ShowPresence)
+	sb.SyncTopic(cfg.SyncTopic)
+	if err := sb.BridgeBots(cfg.BridgeBots); err != nil {
+		return err
+	}
+	sb.LimitFiles(cfg.MaxFiles, cfg.FileNames)
+	sb.BridgeEdits(cfg.BridgeEdits)
+	if cfg.SocketMode {
+		if err := sb.SocketMode(cfg.AppToken); err != nil {
+			return err
+		}
+	}
+	err = sb.StampTimes(cfg.TimestampLayout, cfg.TimestampZone, cfg.TimestampPosition)
+	if err != nil {
+		return err
+	}
+	if cfg.AvatarEmoji != nil {
+		sb.AvatarEmoji(*cfg.AvatarEmoji)
+	}
+	if len(cfg.Avatars) > 0 || cfg.AvatarFile != "" {
+		if err := sb.MapAvatars(cfg.Avatars, cfg.AvatarFile); err != nil {
+			return err
+		}
+	}
+	if err := sb.configure(cfg); err != nil {
+		return err
+	}
+	if cfg.Coalesce != "" {
+		window, err := time.ParseDuration(cfg.Coalesce)
+		if err != nil || window < 0 {
+			return fmt.Errorf("invalid coalesce %s", cfg.Coalesce)
+		}
+		sb.Coalesce(window, cfg.CoalesceMax)
+	}
+	if cfg.UserMissTTL != "" {
+		ttl, err := time.ParseDuration(cfg.UserMissTTL)
+		if err != nil {
+			return fmt.Errorf("invalid user-miss-ttl %s", cfg.UserMissTTL)
+		}
+		sb.usercache.MissTTL(ttl)
+	}
+	return nil
+}
+
+func (sb *SlackBroker) SendComplexMsg(dest string, text string, ev *Event) {
+
+}
+
+func (sb *SlackBroker) HandleEvent(ev *Event, dis Dispatcher) {
+	if ev.ReplyBroker != nil && ev.ReplyBroker != sb {
+		// if not intended for us, eject here
+		return
+	}
+	sb.msgsMux.Lock()
+	sb.metrics.rcvd(ev)
+	sb.msgsMux.Unlock()
+	if ev.IsTopic {
+		sb.setTopic(ev.Text)
+		return
+	}
+	if sb.coalesce != nil {
+		sb.coalesce.Add(ev)
+		return
+	}
+	sb.post(ev)
+}
+
+func (sb *SlackBroker) post(ev *Event) {
+	txt := sb.convertUsersToRefs(sb.rewrites.Rewrite(ev.Text), ev.Origin, false)
+	if ev.Presence != "" {
+		// no refs, a join shouldn't ping anyone
+		txt = ev.PresenceText()
+	}
+	var dest string
+	if len(ev.ReplyTarget) == 0 {
+		dest = sb.chanid
+	} else {
+		dest = ev.ReplyTarget
+	}
+	place := dest
+	if ev.ThreadId != "" && ev.ThreadBroker == sb {
+		place += "/" + ev.ThreadId
+	}
+	if len(ev.ContentBlocks) == 0 && len(ev.Attachments) == 0 &&
+		sb.dedup.DupEvent(place, ev, txt) {
+		if ev.Replaces != "" && ev.ReplacesBroker == sb {
+			// the repeat isn't coming to take its place
+			sb.DropPlaceholder(ev, ev.Replaces)
+		}
+		return
+	}
+	if ev.Presence == "" {
+		txt = sb.stamp.Stamp(ev, txt)
+	}
+
+	var contents []libsl.MsgOption
+	// plain text to send instead if slack won't take the blocks
+	var fallback libsl.MsgOption
+	if blockslice := slackBlocks(ev.ContentBlocks); len(blockslice) > 0 {
+		if txt != "" {
+			// slack shows blocks in place of the text, keep it up top
+			msgText := libsl.NewTextBlockObject("mrkdwn", txt, false, false)
+			blockslice = append(
+				[]libsl.Block{libsl.NewSectionBlock(msgText, nil, nil)},
+				blockslice...)
+		}
+		contents = append(contents, libsl.MsgOptionCompose(
+			// still used for notifications
+			libsl.MsgOptionText(txt, false),
+			libsl.MsgOptionBlocks(blockslice...)))
+		fallback = libsl.MsgOptionText(slackBlocksText(txt, ev.ContentBlocks), false)
 	} else {
-		msgContent = libsl.MsgOptionText(txt, false)
+		for _, piece := range sb.limit.Limit(txt) {
+			if ev.IsAction || ev.Presence != "" {
+				piece = "_" + piece + "_"
+			}
+			contents = append(contents, libsl.MsgOptionText(piece, false))
+		}
+	}
+	if len(ev.Attachments) > 0 {
+		// ride along with the last piece, next to any blocks
+		last := len(contents) - 1
+		atts := libsl.MsgOptionAttachments(slackAttachments(ev)...)
+		contents[last] = libsl.MsgOptionCompose(contents[last], atts)
+		if fallback != nil {
+			fallback = libsl.MsgOptionCompose(fallback, atts)
+		}
+	}
+	for i, msgContent := range contents {
+		if i == 1 && ev.Replaces != "" {
+			// only the first piece takes the placeholder's place
+			rest := *ev
+			rest.Replaces = ""
+			ev = &rest
+		}
+		sb.send(ev, dest, msgContent, fallback)
+	}
+}
+
+// where an answer to ev, from this broker, would be posted
+func (sb *SlackBroker) replyDest(ev *Event) string {
+	if ev.ReplyBroker == sb && ev.ReplyTarget != "" {
+		return ev.ReplyTarget
+	}
+	return sb.chanid
+}
+
+func (sb *SlackBroker) Placeholder(ev *Event, text string) (string, error) {
+	opts := []libsl.MsgOption{libsl.MsgOptionText(text, false)}
+	if thread, tb := ev.ReplyThread(); thread != "" && tb == sb {
+		opts = append(opts, libsl.MsgOptionTS(thread))
+	}
+	_, ts, err := sb.api.PostMessage(sb.replyDest(ev), opts...)
+	return ts, err
+}
+
+// reacts to the slack message ev was made from
+func (sb *SlackBroker) React(ev *Event, emoji string) error {
+	if ev.MessageId == "" || ev.Origin != sb {
+		return fmt.Errorf("no slack message to react to")
+	}
+	return sb.api.AddReaction(strings.Trim(emoji, ":"),
+		libsl.NewRefToMessage(sb.replyDest(ev), ev.MessageId))
+}
+
+func (sb *SlackBroker) DropPlaceholder(ev *Event, id string) {
+	if _, _, err := sb.api.DeleteMessage(sb.replyDest(ev), id); err != nil {
+		sb.log.Warnf("ERR removing placeholder %s: %s", id, err)
+	}
+}
+
+// slack blocks for ours, leaving out any with nothing in them.  titles are
+// bolded and an image without text gets an image block of its own.  code is
+// preformatted rich text, under a note of its language
+func slackBlocks(ebs []*EventBlock) []libsl.Block {
+	blockslice := []libsl.Block{}
+	for _, db := range ebs {
+		if db == nil {
+			continue
+		}
+		if len(db.Title) > 0 {
+			// just bold it
+			headerText := libsl.NewTextBlockObject(
+				"mrkdwn", "*"+db.Title+"*", false, false)
+			blockslice = append(blockslice,
+				libsl.NewSectionBlock(headerText, nil, nil))
+		}
+		if db.Type == CONTENT_CODE && db.Text != "" {
+			blockslice = append(blockslice, slackCodeBlocks(db)...)
+			continue
+		}
+		if db.Text == "" {
+			if db.ImgUrl != "" {
+				blockslice = append(blockslice,
+					libsl.NewImageBlock(db.ImgUrl, "accimg", "", nil))
+			}
+			continue
+		}
+		msgText := libsl.NewTextBlockObject("mrkdwn", db.Text, false, false)
+		var accessory *libsl.Accessory
+		if len(db.ImgUrl) > 0 {
+			accessory = libsl.NewAccessory(
+				libsl.NewImageBlockElement(db.ImgUrl, "accimg"))
+		}
+		blockslice = append(blockslice,
+			libsl.NewSectionBlock(msgText, nil, accessory))
+	}
+	return blockslice
+}
+
+func slackCodeBlocks(db *EventBlock) []libsl.Block {
+	blockslice := []libsl.Block{}
+	if db.Lang != "" {
+		blockslice = append(blockslice, libsl.NewContextBlock("",
+			libsl.NewTextBlockObject("plain_text", db.Lang, false, false)))
+	}
+	return append(blockslice, &SlackRichTextBlock{
+		Type: "rich_text",
+		Elements: []*SlackRichTextElement{{
+			Type:     "rich_text_preformatted",
+			Elements: []*SlackRichTextElement{{Type: "text", Text: db.Text}},
+		}},
+	})
+}
+
+func slackAttachments(ev *Event) []libsl.Attachment {
+	atts := []libsl.Attachment{}
+	for _, ea := range ev.Attachments {
+		att := libsl.Attachment{
+			Color:    ea.Color,
+			Title:    ea.Title,
+			Text:     ea.Text,
+			Fallback: ea.Title,
+		}
+		if att.Fallback == "" {
+			att.Fallback = ea.Text
+		}
+		for _, ef := range ea.Fields {
+			att.Fields = append(att.Fields, libsl.AttachmentField{
+				Title: ef.Title, Value: ef.Value, Short: ef.Short})
+		}
+		atts = append(atts, att)
+	}
+	return atts
+}
+
+// posts, or schedules, one message of ev's to dest
+// sends msgContent, or fallback in its place when slack refuses its blocks.
+// a nil fallback doesn't try again
+func (sb *SlackBroker) send(
+	ev *Event, dest string, msgContent libsl.MsgOption, fallback libsl.MsgOption,
+) {
+	err := sb.sendContent(ev, dest, msgContent)
+	if err != nil && fallback != nil && slackBlocksRefused(err) {
+		sb.log.Warnf("slack refused blocks from %s (%s), sending them as text",
+			ev.Actor, err)
+		err = sb.sendContent(ev, dest, fallback)
+	}
+	if err != nil {
+		sb.log.Warnf("ERR posting to %s: %s", dest, err)
+	}
+}
+
+// slack's errors for blocks it can't show, eg invalid_blocks when an image
+// url won't load
+func slackBlocksRefused(err error) bool {
+	return strings.Contains(err.Error(), "invalid_blocks")
+}
+
+// the text of ebs after txt, for when slack won't take them as blocks
+func slackBlocksText(txt string, ebs []*EventBlock) string {
+	lines := []string{}
+	if txt != "" {
+		lines = append(lines, txt)
+	}
+	for _, db := range ebs {
+		if db == nil {
+			continue
+		}
+		if db.Title != "" {
+			lines = append(lines, "*"+db.Title+"*")
+		}
+		if db.Type == CONTENT_CODE && db.Text != "" {
+			lines = append(lines, "```"+db.Text+"```")
+		} else if db.Text != "" {
+			lines = append(lines, db.Text)
+		}
+		if db.ImgUrl != "" {
+			lines = append(lines, db.ImgUrl)
+		}
 	}
-	sb.api.PostMessage(
-		dest,
+	return strings.Join(lines, "\n")
+}
+
+func (sb *SlackBroker) sendContent(ev *Event, dest string, msgContent libsl.MsgOption) error {
+	md := bridgeMetadata(ev, sb)
+	if ev.Replaces != "" && ev.ReplacesBroker == sb {
+		// swap the answer in for the placeholder
+		opts := append([]libsl.MsgOption{
+			libsl.MsgOptionText("", false), msgContent}, sb.unfurls...)
+		opts = append(opts, libsl.MsgOptionUpdate(ev.Replaces))
+		_, _, err := sb.api.PostMetadata(dest, md, opts...)
+		if err == nil {
+			return nil
+		}
+		sb.log.Warnf("ERR replacing placeholder %s, posting instead: %s",
+			ev.Replaces, err)
+		// or it'd sit there thinking forever above the answer
+		sb.DropPlaceholder(ev, ev.Replaces)
+	}
+	opts := []libsl.MsgOption{
 		libsl.MsgOptionText("", false),
 		msgContent,
 		libsl.MsgOptionUsername(ev.Actor),
-		libsl.MsgOptionIconEmoji(fmt.Sprintf(":avatar_%s:", ev.Actor)),
-	)
+	}
+	if icon := sb.icon(ev); icon != nil {
+		opts = append(opts, icon)
+	}
+	opts = append(opts, sb.unfurls...)
+	if ev.ThreadId != "" && ev.ThreadBroker == sb {
+		opts = append(opts, libsl.MsgOptionTS(ev.ThreadId))
+		if ev.ReplyBroadcast {
+			opts = append(opts, libsl.MsgOptionBroadcast())
+		}
+	}
+	if !ev.SendAt.IsZero() {
+		if ev.SendAt.After(time.Now()) {
+			postAt := fmtInt64(ev.SendAt.Unix())
+			opts = append(opts, libsl.MsgOptionSchedule(postAt))
+			if _, _, err := sb.api.PostMetadata(dest, md, opts...); err != nil {
+				return fmt.Errorf("scheduling for %s: %s", postAt, err)
+			}
+			return nil
+		}
+		sb.log.Warnf("send-at %s is in the past, posting now", ev.SendAt)
+	}
+	_, _, err := sb.api.PostMetadata(dest, md, opts...)
+	return err
 }
 
 // accept a slack string and simplify it
@@ -385,15 +1704,235 @@ func (sb *SlackBroker) SimplifyParse(s string) string {
 	return html.UnescapeString(s)
 }
 
+/* ************************** *
+ * rich text
+ * ************************** */
+
+// one piece of a rich_text block.  sections, lists, quotes and preformatted
+// text hold more elements, the rest are leaves like text or a user mention
+type SlackRichTextElement struct {
+	Type        string                  `json:"type"`
+	Elements    []*SlackRichTextElement `json:"elements,omitempty"`
+	Text        string                  `json:"text,omitempty"`
+	Url         string                  `json:"url,omitempty"`
+	UserId      string                  `json:"user_id,omitempty"`
+	ChannelId   string                  `json:"channel_id,omitempty"`
+	UsergroupId string                  `json:"usergroup_id,omitempty"`
+	Name        string                  `json:"name,omitempty"`
+	Range       string                  `json:"range,omitempty"`
+	Fallback    string                  `json:"fallback,omitempty"`
+	// for text, and bullet or ordered for lists
+	Style  json.RawMessage `json:"style,omitempty"`
+	Indent int             `json:"indent,omitempty"`
+}
+
+// the rich_text block newer clients send alongside a message's text.  the
+// slack lib we vendor decodes these as UnknownBlock, dropping the elements,
+// so decodeRTMEvent makes rtm messages slackRichMessage, which puts these in
+// their place
+type SlackRichTextBlock struct {
+	Type     libsl.MessageBlockType  `json:"type"`
+	BlockID  string                  `json:"block_id,omitempty"`
+	Elements []*SlackRichTextElement `json:"elements"`
+}
+
+func (rt *SlackRichTextBlock) BlockType() libsl.MessageBlockType {
+	return rt.Type
+}
+
+// the mrkdwn slack would have put in the message's text, mentions as refs
+// so they resolve the same way
+func (rt *SlackRichTextBlock) Mrkdwn() string {
+	parts := []string{}
+	for _, el := range rt.Elements {
+		if s := richTextPart(el); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func richTextPart(el *SlackRichTextElement) string {
+	switch el.Type {
+	case "rich_text_list":
+		var ordered string
+		json.Unmarshal(el.Style, &ordered)
+		lines := []string{}
+		for i, item := range el.Elements {
+			mark := "• "
+			if ordered == "ordered" {
+				mark = fmt.Sprintf("%d. ", i+1)
+			}
+			lines = append(lines,
+				strings.Repeat("  ", el.Indent)+mark+richTextInline(item.Elements))
+		}
+		return strings.Join(lines, "\n")
+	case "rich_text_preformatted":
+		return "```\n" + richTextInline(el.Elements) + "\n```"
+	case "rich_text_quote":
+		lines := strings.Split(richTextInline(el.Elements), "\n")
+		return "> " + strings.Join(lines, "\n> ")
+	}
+	return richTextInline(el.Elements)
+}
+
+func richTextInline(els []*SlackRichTextElement) string {
+	var out strings.Builder
+	for _, el := range els {
+		switch el.Type {
+		case "text":
+			out.WriteString(richTextStyled(el.Text, el.Style))
+		case "link":
+			if el.Text != "" {
+				out.WriteString("<" + el.Url + "|" + el.Text + ">")
+			} else {
+				out.WriteString("<" + el.Url + ">")
+			}
+		case "user":
+			out.WriteString("<@" + el.UserId + ">")
+		case "usergroup":
+			out.WriteString("<!subteam^" + el.UsergroupId + ">")
+		case "broadcast":
+			out.WriteString("<!" + el.Range + ">")
+		case "channel":
+			out.WriteString("<#" + el.ChannelId + ">")
+		case "emoji":
+			out.WriteString(":" + el.Name + ":")
+		default:
+			out.WriteString(el.Fallback)
+		}
+	}
+	return out.String()
+}
+
+// wraps text in the mrkdwn for its style, leaving surrounding space outside
+func richTextStyled(text string, raw json.RawMessage) string {
+	var style struct {
+		Bold   bool `json:"bold"`
+		Italic bool `json:"italic"`
+		Strike bool `json:"strike"`
+		Code   bool `json:"code"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &style) != nil {
+		return text
+	}
+	inner := strings.TrimSpace(text)
+	if inner == "" {
+		return text
+	}
+	lead := text[:strings.Index(text, inner)]
+	trail := text[len(lead)+len(inner):]
+	if style.Code {
+		inner = "`" + inner + "`"
+	}
+	if style.Strike {
+		inner = "~" + inner + "~"
+	}
+	if style.Italic {
+		inner = "_" + inner + "_"
+	}
+	if style.Bold {
+		inner = "*" + inner + "*"
+	}
+	return lead + inner + trail
+}
+
+// an rtm message event with its rich_text blocks, and those of the message
+// an edit carries, decoded as SlackRichTextBlock.  along with the metadata
+// of either, which the lib doesn't decode at all
+type slackRichMessage struct {
+	libsl.MessageEvent
+	Metadata    *SlackMetadata
+	SubMetadata *SlackMetadata
+}
+
+func (rm *slackRichMessage) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &rm.MessageEvent); err != nil {
+		return err
+	}
+	var raw struct {
+		Blocks  []json.RawMessage `json:"blocks"`
+		Message json.RawMessage   `json:"message"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if err := decodeRichText(raw.Blocks, &rm.Blocks); err != nil {
+		return err
+	}
+	md, err := SlackMetadataOf(data)
+	if err != nil {
+		return err
+	}
+	rm.Metadata = md
+	if len(raw.Message) == 0 || rm.SubMessage == nil {
+		return nil
+	}
+	var sub struct {
+		Blocks []json.RawMessage `json:"blocks"`
+	}
+	if err := json.Unmarshal(raw.Message, &sub); err != nil {
+		return err
+	}
+	if err := decodeRichText(sub.Blocks, &rm.SubMessage.Blocks); err != nil {
+		return err
+	}
+	rm.SubMetadata, err = SlackMetadataOf(raw.Message)
+	return err
+}
+
+// whether a smug, us or another, bridged the message here, or the message an
+// edit changed
+func (rm *slackRichMessage) bridged() bool {
+	_, _, ok := rm.Metadata.Bridged()
+	_, _, subOk := rm.SubMetadata.Bridged()
+	return ok || subOk
+}
+
+// replaces the UnknownBlocks the lib made of raw's rich_text blocks
+func decodeRichText(raw []json.RawMessage, blocks *libsl.Blocks) error {
+	if len(raw) != len(blocks.BlockSet) {
+		return nil
+	}
+	for i, b := range blocks.BlockSet {
+		if b.BlockType() != "rich_text" {
+			continue
+		}
+		rt := &SlackRichTextBlock{}
+		if err := json.Unmarshal(raw[i], rt); err != nil {
+			return err
+		}
+		blocks.BlockSet[i] = rt
+	}
+	return nil
+}
+
+// the message's text rebuilt from its rich_text blocks, false if it has none
+func richTextMrkdwn(blocks libsl.Blocks) (string, bool) {
+	parts := []string{}
+	for _, b := range blocks.BlockSet {
+		if rt, ok := b.(*SlackRichTextBlock); ok {
+			parts = append(parts, rt.Mrkdwn())
+		}
+	}
+	return strings.Join(parts, "\n"), len(parts) > 0
+}
+
 func (sb *SlackBroker) ParseToEvent(e *libsl.MessageEvent) *Event {
-	nick := sb.usercache.UserNick(sb, e.User, false)
-	outmsgs := []string{e.Text}
-	if len(e.Files) > 0 {
-		for _, f := range e.Files {
-			outmsgs = append(outmsgs,
-				fmt.Sprintf("%s(%s)", f.Name, f.URLPrivate))
+	var nick string
+	if e.SubType == "bot_message" {
+		// bots post under a name of their own, not a user's
+		if nick = e.Username; nick == "" {
+			nick = e.BotID
 		}
+	} else {
+		nick = sb.usercache.UserNick(sb, e.User, false)
 	}
+	text := e.Text
+	if rich, ok := richTextMrkdwn(e.Blocks); ok && rich != "" {
+		text = rich
+	}
+	outmsgs := append([]string{text}, sb.fileList(e.Files)...)
 	if len(e.Attachments) > 0 {
 		for _, a := range e.Attachments {
 			if len(a.Fallback) > 0 {
@@ -410,25 +1949,351 @@ func (sb *SlackBroker) ParseToEvent(e *libsl.MessageEvent) *Event {
 			}
 		}
 	}
-	// XXX TODO need to include the RespondTo stuff if priv msg...
 	outstr := strings.TrimSpace(strings.Join(outmsgs, " "))
 	ev := &Event{
+		IsAction:    e.SubType == "me_message",
+		Origin:      sb,
+		Actor:       nick,
+		ActorId:     e.User,
+		ActorStatus: sb.usercache.UserStatus(e.User),
+		RawText:     outstr,
+		Text:        sb.SimplifyParse(sb.ConvertRefsToUsers(outstr, false)),
+		ts:          time.Now(),
+	}
+	ev.MessageId = e.Timestamp
+	if e.ThreadTimestamp != "" {
+		ev.ThreadId = e.ThreadTimestamp
+		ev.ThreadBroker = sb
+	}
+	if e.Channel != sb.chanid {
+		// possibly from a private message or other non-channel, either way
+		// answers go back where it came from
+		ev.ReplyBroker = sb
+		ev.ReplyTarget = e.Channel
+		ev.Private = isDirectChannel(e.Channel)
+	}
+	return ev
+}
+
+// direct message conversation ids start with D
+func isDirectChannel(id string) bool {
+	return strings.HasPrefix(id, "D")
+}
+
+// the icon for posts from actors we have no avatar url for, any %s is
+// replaced with the actor.  blank leaves slack's default icon
+func (sb *SlackBroker) AvatarEmoji(format string) {
+	sb.avatarEmoji = format
+}
+
+// avatar urls for actors that don't have one of their own, eg from irc.  see
+// NewSlackAvatarMap
+func (sb *SlackBroker) MapAvatars(avatars map[string]string, file string) error {
+	sam, err := NewSlackAvatarMap(avatars, file)
+	if err != nil {
+		return err
+	}
+	sb.avatars = sam
+	return nil
+}
+
+// icon for a bridged post.  the event's own avatar, then a mapped one, then
+// one we know for the actor, then the avatar emoji.  nil if there's none of
+// those
+func (sb *SlackBroker) icon(ev *Event) libsl.MsgOption {
+	if ev.Avatar != "" {
+		sb.usercache.CacheAvatar(ev.Actor, ev.Avatar)
+		return libsl.MsgOptionIconURL(ev.Avatar)
+	}
+	if url := sb.avatars.Avatar(ev.Actor); url != "" {
+		return libsl.MsgOptionIconURL(url)
+	}
+	if url := sb.usercache.Avatar(ev.Actor); url != "" {
+		return libsl.MsgOptionIconURL(url)
+	}
+	if url := sb.identityAvatar(ev); url != "" {
+		return libsl.MsgOptionIconURL(url)
+	}
+	if sb.avatarEmoji != "" {
+		return libsl.MsgOptionIconEmoji(
+			strings.Replace(sb.avatarEmoji, "%s", ev.Actor, -1))
+	}
+	return nil
+}
+
+// the avatar of the slack user the identity map says ev's actor is
+func (sb *SlackBroker) identityAvatar(ev *Event) string {
+	name := sb.identities.Lookup(ev.Origin, ev.Actor).On(sb)
+	if name == "" {
+		return ""
+	}
+	user, found := sb.usercache.userInIdCache(name)
+	if !found {
+		user, found = sb.usercache.userInNickCache(name)
+	}
+	if !found {
+		return ""
+	}
+	return user.Avatar
+}
+
+// show joins and parts from other brokers in the channel
+func (sb *SlackBroker) ShowPresence(show bool) {
+	sb.presence = show
+}
+
+func (sb *SlackBroker) ShowsPresence() bool {
+	return sb.presence
+}
+
+// posting only reads our config, the caches and counters lock for themselves
+func (sb *SlackBroker) ConcurrentSends() bool {
+	return true
+}
+
+// lists at most max of a message's files, 0 for all, with the rest counted
+// as +N more.  names leaves their links out
+func (sb *SlackBroker) LimitFiles(max int, names bool) {
+	sb.maxFiles, sb.fileNames = max, names
+}
+
+// files as they're appended to a message's text
+func (sb *SlackBroker) fileList(files []libsl.File) []string {
+	shown := files
+	if sb.maxFiles > 0 && len(files) > sb.maxFiles {
+		shown = files[:sb.maxFiles]
+	}
+	out := []string{}
+	for _, f := range shown {
+		if sb.fileNames {
+			out = append(out, f.Name)
+		} else {
+			out = append(out, fmt.Sprintf("%s(%s)", f.Name, f.URLPrivate))
+		}
+	}
+	if more := len(files) - len(shown); more > 0 {
+		out = append(out, fmt.Sprintf("+%d more", more))
+	}
+	return out
+}
+
+// bridge messages from integrations and other bots, posted as bot_message.
+// our own are still ignored, so we look up the bot id they carry.  without
+// it we'd bridge our own posts back, so failing to is an error
+func (sb *SlackBroker) BridgeBots(bridge bool) error {
+	sb.bridgeBots = bridge
+	if !bridge || sb.api == nil {
+		return nil
+	}
+	user, err := sb.api.GetUserInfo(sb.mybotid)
+	if err != nil {
+		return fmt.Errorf("looking up our bot id: %s", err)
+	}
+	sb.botid = user.Profile.BotID
+	return nil
+}
+
+// bridge edits people make to their messages, as new messages marked
+// (edited).  other brokers can't edit what they were sent
+func (sb *SlackBroker) BridgeEdits(bridge bool) {
+	sb.bridgeEdits = bridge
+}
+
+// the edit a message_changed carries, nil for changes that shouldn't be
+// bridged.  slack changes our own posts too, eg when it unfurls their links,
+// and bridging those would send them back where they came from
+func (sb *SlackBroker) editedMessage(e *libsl.MessageEvent) *libsl.MessageEvent {
+	if !sb.bridgeEdits || e.SubMessage == nil {
+		return nil
+	}
+	edited := &libsl.MessageEvent{Msg: *e.SubMessage}
+	if edited.Channel == "" {
+		edited.Channel = e.Channel
+	}
+	if sb.ours(edited) || edited.User == "" || edited.SubType == "bot_message" {
+		return nil
+	}
+	if e.PreviousMessage != nil && e.PreviousMessage.Text == edited.Text {
+		// an unfurl or some other change that left the text alone
+		return nil
+	}
+	return edited
+}
+
+// whether we posted e
+func (sb *SlackBroker) ours(e *libsl.MessageEvent) bool {
+	return e.User == sb.mybotid || e.BotID == sb.mybotid ||
+		(sb.botid != "" && e.BotID == sb.botid)
+}
+
+func (sb *SlackBroker) setTopic(topic string) {
+	sb.msgsMux.Lock()
+	same := !sb.topicSync || topic == sb.topic
+	sb.topic = topic
+	sb.msgsMux.Unlock()
+	if same {
+		return
+	}
+	if _, err := sb.api.SetTopicOfConversation(sb.chanid, topic); err != nil {
+		sb.log.Warnf("ERR setting topic: %s", err)
+	}
+}
+
+// someone changing our channel's topic.  the change we just made coming back
+// around, ours or a matching one, isn't sent on so bridges don't loop
+func (sb *SlackBroker) handleTopic(e *libsl.MessageEvent, dis Dispatcher) {
+	if e.Channel != sb.chanid || e.User == sb.mybotid {
+		return
+	}
+	nick := sb.usercache.UserNick(sb, e.User, false)
+	if sb.ignore.Ignored(nick) {
+		return
+	}
+	topic := sb.SimplifyParse(sb.ConvertRefsToUsers(e.Topic, false))
+	sb.msgsMux.Lock()
+	same := topic == sb.topic
+	sb.topic = topic
+	sb.msgsMux.Unlock()
+	if same {
+		return
+	}
+	ev := &Event{
+		IsTopic: true,
 		Origin:  sb,
 		Actor:   nick,
-		RawText: outstr,
-		Text:    sb.SimplifyParse(sb.ConvertRefsToUsers(outstr, false)),
+		Text:    topic,
 		ts:      time.Now(),
 	}
-	return ev
+	sb.msgsMux.Lock()
+	sb.metrics.sent(ev)
+	sb.msgsMux.Unlock()
+	dis.Broadcast(ev)
 }
 
+// someone joining or leaving our channel
+func (sb *SlackBroker) handlePresence(
+	user string, channel string, presence string, dis Dispatcher) {
+	if channel != sb.chanid || user == sb.mybotid {
+		return
+	}
+	nick := sb.usercache.UserNick(sb, user, false)
+	if sb.ignore.Ignored(nick) {
+		return
+	}
+	ev := &Event{
+		Presence: presence,
+		Origin:   sb,
+		Actor:    nick,
+		Text:     "#" + sb.channel,
+		ts:       time.Now(),
+	}
+	sb.msgsMux.Lock()
+	sb.metrics.sent(ev)
+	sb.msgsMux.Unlock()
+	dis.Broadcast(ev)
+}
+
+func (sb *SlackBroker) handleMessage(e *libsl.MessageEvent, dis Dispatcher) {
+	if sb.ours(e) {
+		return
+	}
+	switch e.SubType {
+	case "message_replied":
+		// the thread's root with its new reply count, the reply itself
+		// comes as a message of its own
+		return
+	case "message_changed":
+		if edited := sb.editedMessage(e); edited != nil {
+			sb.handleEdit(edited, dis)
+		}
+		return
+	case "bot_message":
+		if !sb.bridgeBots {
+			return
+		}
+	case "channel_topic":
+		if len(e.User) != 0 {
+			sb.handleTopic(e, dis)
+		}
+		return
+	default:
+		// including thread_broadcast, a thread reply also sent to the
+		// channel, which is bridged like any other reply
+		if len(e.User) == 0 {
+			return
+		}
+	}
+	ev := sb.ParseToEvent(e)
+	if sb.ignore.Ignored(ev.Actor) {
+		return
+	}
+	sb.cmdout.Mark(ev)
+	ev.ThreadContext = sb.threadPrefix(e)
+	sb.msgsMux.Lock()
+	sb.metrics.sent(ev)
+	sb.msgsMux.Unlock()
+	dis.Broadcast(ev)
+}
+
+func (sb *SlackBroker) handleEdit(e *libsl.MessageEvent, dis Dispatcher) {
+	ev := sb.ParseToEvent(e)
+	if sb.ignore.Ignored(ev.Actor) {
+		return
+	}
+	// up front, so an edited command isn't run again
+	ev.Text = "(edited) " + ev.Text
+	sb.msgsMux.Lock()
+	sb.metrics.sent(ev)
+	sb.msgsMux.Unlock()
+	dis.Broadcast(ev)
+}
+
+// runs rtm connections until Deactivate, reconnecting with backoff whenever
+// one drops
 func (sb *SlackBroker) Activate(dis Dispatcher) {
-	if sb.rtm == nil {
+	if sb.connect == nil {
 		// raise some error here XXX TODO
 		sb.log.Panic(fmt.Errorf("rtm is nil.  Setup not called?"))
 	}
-	go sb.rtm.ManageConnection()
-	for msg := range sb.rtm.IncomingEvents {
+	if sb.socket != nil {
+		go sb.runSocket(dis)
+	}
+	backoff := rtmBackoffMin
+	for {
+		events, disconnect := sb.connect()
+		sb.msgsMux.Lock()
+		sb.disconnect = disconnect
+		sb.msgsMux.Unlock()
+		started := time.Now()
+		if !sb.handleEvents(events, dis) {
+			return
+		}
+		select {
+		case <-sb.done:
+			return
+		default:
+		}
+		if time.Since(started) > rtmBackoffMax {
+			// it was up a good while, this isn't a run of failures
+			backoff = rtmBackoffMin
+		}
+		sb.log.Warnf("rtm connection closed, reconnecting in %s", backoff)
+		select {
+		case <-sb.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > rtmBackoffMax {
+			backoff = rtmBackoffMax
+		}
+		sb.log.Infof("reconnecting rtm")
+	}
+}
+
+// handles events until the connection closes.  false if it's not worth
+// reconnecting
+func (sb *SlackBroker) handleEvents(events <-chan libsl.RTMEvent, dis Dispatcher) bool {
+	for msg := range events {
 		switch e := msg.Data.(type) {
 		case *libsl.HelloEvent:
 			// ignore Hello
@@ -440,32 +2305,64 @@ func (sb *SlackBroker) Activate(dis Dispatcher) {
 			// smugbot: 2019/09/14 08:47:44 websocket_managed_conn.go:369:
 			// Incoming Event:
 			// {"client_msg_id":"ed722fbc-5b37-4f78-9981-e3c9ce5c85a1","suppress_notification":false,"type":"message","text":"test","user":"U6CRHMXK4","team":"T6CRHMX5G","user_team":"T6CRHMX5G","source_team":"T6CRHMX5G","channel":"C6MR9CBGR","event_ts":"1568468854.004200","ts":"1568468854.004200"}
-			if e.BotID != sb.mybotid && len(e.User) > 0 {
-				ev := sb.ParseToEvent(e)
-				if e.Channel != sb.chanid {
-					// possibly from a private message or other non-channel
-					ev.ReplyBroker = sb
-					ev.ReplyTarget = e.Channel
-				}
-				sb.msgsMux.Lock()
-				sb.msgsSent++
-				sb.msgsMux.Unlock()
-				dis.Broadcast(ev)
+			sb.handleMessage(e, dis)
+		case *slackRichMessage:
+			if e.bridged() {
+				// bridging it again would echo it back where it came from
+				continue
 			}
+			sb.handleMessage(&e.MessageEvent, dis)
+		case *libsl.ReactionAddedEvent:
+			sb.handleReaction(e, dis)
+		case *libsl.UserChangeEvent:
+			// keeps nicks, avatars and statuses current
+			sb.usercache.CacheUser(newSlackUser(e.User.ID, &e.User))
+		case *libsl.MemberJoinedChannelEvent:
+			sb.handlePresence(e.User, e.Channel, PresenceJoin, dis)
+		case *libsl.MemberLeftChannelEvent:
+			sb.handlePresence(e.User, e.Channel, PresencePart, dis)
 		case *libsl.PresenceChangeEvent:
 			sb.log.Infof("Presence Change: %v\n", e)
 		case *libsl.LatencyReport:
 			sb.log.Infof("Current latency: %v\n", e.Value)
 		case *libsl.RTMError:
 			sb.log.Warnf("Error: %s\n", e.Error())
+		case *libsl.ConnectionErrorEvent:
+			sb.log.Warnf("ERR connecting rtm: %s", e.ErrorObj)
+		case *libsl.IncomingEventError:
+			sb.log.Warnf("ERR reading rtm: %s", e.Error())
 		case *libsl.InvalidAuthEvent:
 			sb.log.Fatalf("Invalid credentials")
-			return
+			return false
 		default:
 			// Ignore other events..
 			sb.log.Infof("Unexpected: %v\n", msg.Data)
 		}
 	}
+	return true
 }
 
-func (sb *SlackBroker) Deactivate() {}
+func (sb *SlackBroker) Deactivate() {
+	sb.msgsMux.Lock()
+	select {
+	case <-sb.done:
+		// already deactivated
+		sb.msgsMux.Unlock()
+		return
+	default:
+	}
+	close(sb.done)
+	disconnect := sb.disconnect
+	socketClose := sb.socketClose
+	sb.msgsMux.Unlock()
+	if sb.coalesce != nil {
+		sb.coalesce.Stop()
+	}
+	if disconnect != nil {
+		disconnect()
+	}
+	if socketClose != nil {
+		socketClose()
+	}
+	sb.saveUserCache()
+}
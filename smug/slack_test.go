@@ -1,7 +1,23 @@
 package smug
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	libsl "github.com/slack-go/slack"
 )
 
 func TestSimplifyParse(t *testing.T) {
@@ -66,3 +82,1841 @@ func TestConvertSlackRefs(t *testing.T) {
 	}
 
 }
+
+func slackMsg(user string, channel string, text string) *libsl.MessageEvent {
+	return &libsl.MessageEvent{
+		Msg: libsl.Msg{User: user, Channel: channel, Text: text},
+	}
+}
+
+func TestSlackIgnoredActors(t *testing.T) {
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1"}
+	sb.SetupInternals()
+	sb.IgnoreActors(`.*-bot$`)
+	sb.usercache.CacheUser(&SlackUser{Id: "U1", Nick: "relay-bot"})
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	td := &TestDispatch{}
+	sb.handleMessage(slackMsg("U1", "C1", "hi"), td)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: ignored actor was broadcast")
+	}
+	sb.handleMessage(slackMsg("U2", "C1", "hi"), td)
+	if td.lastbroadcast == nil || td.lastbroadcast.Actor != "bob" {
+		t.Errorf("err: expected bob to be broadcast")
+	}
+}
+
+func TestSlackMessageSubtypes(t *testing.T) {
+	sb := &SlackBroker{chanid: "C1", mybotid: "UBOT"}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	td := &TestDispatch{}
+
+	replied := slackMsg("U2", "C1", "root")
+	replied.SubType = "message_replied"
+	sb.handleMessage(replied, td)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: message_replied is metadata, broadcast %q", td.lastbroadcast.Text)
+	}
+
+	broadcast := slackMsg("U2", "C1", "also in the channel")
+	broadcast.SubType = "thread_broadcast"
+	broadcast.Timestamp = "100.2"
+	broadcast.ThreadTimestamp = "100.1"
+	sb.handleMessage(broadcast, td)
+	if ev := td.lastbroadcast; ev == nil || ev.Actor != "bob" ||
+		ev.Text != "also in the channel" || ev.ThreadId != "100.1" {
+		t.Errorf("err: expected thread_broadcast as a threaded reply, have %+v", ev)
+	}
+
+	td.lastbroadcast = nil
+	bot := slackMsg("", "C1", "build passed")
+	bot.SubType = "bot_message"
+	bot.BotID = "B7"
+	bot.Username = "ci"
+	sb.handleMessage(bot, td)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: bot messages shouldn't be bridged by default")
+	}
+	sb.BridgeBots(true)
+	sb.handleMessage(bot, td)
+	if ev := td.lastbroadcast; ev == nil || ev.Actor != "ci" || ev.Text != "build passed" {
+		t.Errorf("err: expected ci's message bridged, have %+v", ev)
+	}
+
+	td.lastbroadcast = nil
+	sb.botid = "B1"
+	ours := slackMsg("", "C1", "|alice| hi")
+	ours.SubType = "bot_message"
+	ours.BotID = "B1"
+	sb.handleMessage(ours, td)
+	if td.lastbroadcast != nil {
+		t.Errorf("err: our own posts shouldn't be bridged back")
+	}
+}
+
+func TestSlackBridgeBotsLookup(t *testing.T) {
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", mybotid: "UBOT", api: fs}
+	sb.SetupInternals()
+	if err := sb.BridgeBots(false); err != nil || fs.userCalls != 0 {
+		t.Errorf("err: nothing to look up without bridging bots, %v", err)
+	}
+	if err := sb.BridgeBots(true); err == nil {
+		t.Errorf("err: expected an error without our bot id")
+	}
+	bot := &libsl.User{ID: "UBOT"}
+	bot.Profile.BotID = "B1"
+	fs.users = map[string]*libsl.User{"UBOT": bot}
+	if err := sb.BridgeBots(true); err != nil || sb.botid != "B1" {
+		t.Errorf("err: expected our bot id B1, have %q %v", sb.botid, err)
+	}
+}
+
+func TestSlackUserStatus(t *testing.T) {
+	sb := &SlackBroker{chanid: "C1", mybotid: "UBOT"}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	td := &TestDispatch{}
+	sb.handleMessage(slackMsg("U2", "C1", "hi"), td)
+	if td.lastbroadcast.ActorStatus != "" {
+		t.Errorf("err: bob has no status, have %q", td.lastbroadcast.ActorStatus)
+	}
+
+	events := make(chan libsl.RTMEvent, 3)
+	for _, u := range []libsl.User{
+		{ID: "U2", Name: "bob", Profile: libsl.UserProfile{StatusEmoji: ":palm_tree:",
+			StatusText: "Vacationing"}},
+		{ID: "U3", Name: "carol", Profile: libsl.UserProfile{StatusEmoji: ":rocket:"}},
+		{ID: "U4", Name: "dave", Profile: libsl.UserProfile{StatusText: "heads down"}},
+	} {
+		u := u
+		events <- libsl.RTMEvent{Data: &libsl.UserChangeEvent{User: u}}
+	}
+	close(events)
+	sb.handleEvents(events, td)
+	for user, want := range map[string]string{
+		"U2": "🌴", "U3": ":rocket:", "U4": "heads down"} {
+		sb.handleMessage(slackMsg(user, "C1", "hi"), td)
+		if have := td.lastbroadcast.ActorStatus; have != want {
+			t.Errorf("err: expected %s's status %q, have %q", user, want, have)
+		}
+	}
+}
+
+// FakeSlackAPI stands in for the slack client. replies are keyed by thread ts
+// and every PostMessage is captured in posted
+type FakeSlackAPI struct {
+	authErr      error
+	channels     []libsl.Channel
+	replies      map[string][]libsl.Message
+	repliesCalls int
+	repliesPage  int // when set, replies come this many at a time
+	history      map[string]libsl.Message
+	historyCalls int
+	groups       []libsl.UserGroup
+	groupsCalls  int
+	userCalls    int
+	users        map[string]*libsl.User
+	posted       [][]libsl.MsgOption
+	metadata     []*SlackMetadata // of each PostMetadata
+	blocksErr    error            // when set, posts with blocks fail with it
+	scheduled    []string         // postAt of each scheduled post
+	updated      map[string][]libsl.MsgOption
+	updateErr    error // when set, updates fail with it
+	deleted      []string
+	joined       []string
+	joinErr      error
+	topics       []string
+	reactions    []string // "name channel ts" of each AddReaction
+	// by workspace, for enterprise grid
+	teamChannels map[string][]libsl.Channel
+	teamGroups   map[string][]libsl.UserGroup
+}
+
+func (fs *FakeSlackAPI) AuthTest() (*libsl.AuthTestResponse, error) {
+	if fs.authErr != nil {
+		return nil, fs.authErr
+	}
+	return &libsl.AuthTestResponse{UserID: "UBOT", TeamID: "THOME"}, nil
+}
+
+func (fs *FakeSlackAPI) GetTeamChannels(team string) ([]libsl.Channel, error) {
+	return fs.teamChannels[team], nil
+}
+
+func (fs *FakeSlackAPI) GetTeamUserGroups(team string) ([]libsl.UserGroup, error) {
+	fs.groupsCalls++
+	return fs.teamGroups[team], nil
+}
+
+func (fs *FakeSlackAPI) GetChannels(
+	bool, ...libsl.GetChannelsOption) ([]libsl.Channel, error) {
+	return fs.channels, nil
+}
+
+func (fs *FakeSlackAPI) JoinConversation(
+	ch string) (*libsl.Channel, string, []string, error) {
+	if fs.joinErr != nil {
+		return nil, "", nil, fs.joinErr
+	}
+	fs.joined = append(fs.joined, ch)
+	return &libsl.Channel{}, "", nil, nil
+}
+
+func (fs *FakeSlackAPI) SetTopicOfConversation(
+	ch string, topic string) (*libsl.Channel, error) {
+	fs.topics = append(fs.topics, ch+" "+topic)
+	return &libsl.Channel{}, nil
+}
+
+func (fs *FakeSlackAPI) GetUserInfo(u string) (*libsl.User, error) {
+	fs.userCalls++
+	if user, found := fs.users[u]; found {
+		return user, nil
+	}
+	return nil, fmt.Errorf("no such user %s", u)
+}
+
+func (fs *FakeSlackAPI) GetUserGroups(
+	...libsl.GetUserGroupsOption) ([]libsl.UserGroup, error) {
+	fs.groupsCalls++
+	return fs.groups, nil
+}
+
+func (fs *FakeSlackAPI) GetConversationReplies(
+	p *libsl.GetConversationRepliesParameters,
+) ([]libsl.Message, bool, string, error) {
+	fs.repliesCalls++
+	msgs, found := fs.replies[p.Timestamp]
+	if !found {
+		return nil, false, "", fmt.Errorf("thread_not_found")
+	}
+	if fs.repliesPage > 0 {
+		start, _ := strconv.Atoi(p.Cursor)
+		if end := start + fs.repliesPage; end < len(msgs) {
+			return msgs[start:end], true, strconv.Itoa(end), nil
+		}
+		return msgs[start:], false, "", nil
+	}
+	return msgs, false, "", nil
+}
+
+func (fs *FakeSlackAPI) GetConversationHistory(
+	p *libsl.GetConversationHistoryParameters,
+) (*libsl.GetConversationHistoryResponse, error) {
+	fs.historyCalls++
+	msg, found := fs.history[p.Latest]
+	if !found {
+		return nil, fmt.Errorf("message_not_found")
+	}
+	return &libsl.GetConversationHistoryResponse{
+		Messages: []libsl.Message{msg}}, nil
+}
+
+func (fs *FakeSlackAPI) PostMessage(
+	ch string, opts ...libsl.MsgOption) (string, string, error) {
+	fs.posted = append(fs.posted, opts)
+	return ch, "1234.5678", nil
+}
+
+// posts, schedules or updates as opts say to, like the real one
+func (fs *FakeSlackAPI) PostMetadata(
+	ch string, md *SlackMetadata, opts ...libsl.MsgOption) (string, string, error) {
+	fs.metadata = append(fs.metadata, md)
+	endpoint, vals, _ := libsl.UnsafeApplyMsgOptions("", ch, "", opts...)
+	if fs.blocksErr != nil && vals.Get("blocks") != "" {
+		return "", "", fs.blocksErr
+	}
+	switch endpoint {
+	case "chat.scheduleMessage":
+		postAt := vals.Get("post_at")
+		fs.scheduled = append(fs.scheduled, postAt)
+		fs.posted = append(fs.posted, opts)
+		return ch, postAt, nil
+	case "chat.update":
+		if fs.updateErr != nil {
+			return "", "", fs.updateErr
+		}
+		if fs.updated == nil {
+			fs.updated = make(map[string][]libsl.MsgOption)
+		}
+		fs.updated[vals.Get("ts")] = opts
+		return ch, vals.Get("ts"), nil
+	}
+	return fs.PostMessage(ch, opts...)
+}
+
+func (fs *FakeSlackAPI) DeleteMessage(ch string, ts string) (string, string, error) {
+	fs.deleted = append(fs.deleted, ts)
+	return ch, ts, nil
+}
+
+func (fs *FakeSlackAPI) AddReaction(name string, item libsl.ItemRef) error {
+	fs.reactions = append(fs.reactions,
+		name+" "+item.Channel+" "+item.Timestamp)
+	return nil
+}
+
+// the form values a PostMessage with these options would send
+func postedValues(opts []libsl.MsgOption) url.Values {
+	_, vals, _ := libsl.UnsafeApplyMsgOptions("", "", "", opts...)
+	return vals
+}
+
+// HandleEvent always sets an empty text first, we want the last one
+func postedText(opts []libsl.MsgOption) string {
+	texts := postedValues(opts)["text"]
+	if len(texts) == 0 {
+		return ""
+	}
+	return texts[len(texts)-1]
+}
+
+func TestSlackThreadSummary(t *testing.T) {
+	thread := []libsl.Message{
+		{Msg: libsl.Msg{User: "U2", Text: "who wants lunch today?", Timestamp: "100.1"}},
+		{Msg: libsl.Msg{User: "U3", Text: "me!\nand <@U2>", Timestamp: "100.2"}},
+		{Msg: libsl.Msg{BotID: "B7", Username: "lunchbot", Text: "tacos it is", Timestamp: "100.3"}},
+	}
+	fs := &FakeSlackAPI{repliesPage: 2, replies: map[string][]libsl.Message{
+		"100.1": thread,
+	}}
+	sb := &SlackBroker{chanid: "C1", channel: "lunch", mybotid: "UBOT", api: fs}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	sb.usercache.CacheUser(&SlackUser{Id: "U3", Nick: "carol"})
+
+	kind := registerTestBroker(t, "thread", func() Broker {
+		return &ChanBroker{events: make(chan *Event, 5)}
+	})
+	irc, err := NewBrokerFromConfig(&BrokerConfig{Key: "irc", Type: kind})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cd := &CentralDispatch{log: NewLogger("ctx", "test")}
+	cd.AddBroker(irc)
+	lc := &LocalCmdBroker{}
+	lc.Setup("smug", "", "1.0")
+	if err := lc.AllowMute([]string{"slack-lunch:U2"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cd.AddBroker(lc)
+
+	ask := sb.ParseToEvent(&libsl.MessageEvent{Msg: libsl.Msg{User: "U2",
+		Channel: "C1", Text: "..thread irc", Timestamp: "100.4", ThreadTimestamp: "100.1"}})
+	lc.HandleEvent(ask, cd)
+	select {
+	case ev := <-irc.(*ChanBroker).events:
+		want := "thread on slack-lunch, 3 messages, for bob:\n" +
+			"bob: who wants lunch today?\n" +
+			"carol: me! and bob\n" +
+			"lunchbot: tacos it is"
+		if ev.Text != want || ev.ThreadId != "" || !ev.IsCmdOutput {
+			t.Errorf("err: unexpected summary %q", ev.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("err: nothing sent to irc")
+	}
+	if fs.repliesCalls != 2 {
+		t.Errorf("err: expected the thread fetched over 2 pages, have %d calls", fs.repliesCalls)
+	}
+	lc.HandleEvent(ask, cd)
+	<-irc.(*ChanBroker).events
+	if fs.repliesCalls != 2 {
+		t.Errorf("err: the second summary should come from the cache")
+	}
+
+	allowed, _ := NewActorAllowlist([]string{"slack-lunch:U2"})
+	for text, ev := range map[string]*Event{
+		"usage: ..thread <broker>":        {Text: "..thread", ThreadId: "100.1", ThreadBroker: sb},
+		"..thread only works in a thread": {Text: "..thread irc"},
+		"no broker nope":                  {Text: "..thread nope", ThreadId: "100.1", ThreadBroker: sb},
+		"threads here can't be read": {Text: "..thread irc", ThreadId: "1",
+			ThreadBroker: &FakeBroker{}},
+		"carol isn't allowed to send threads": {Actor: "carol", ActorId: "U3",
+			Text: "..thread irc", ThreadId: "100.1", ThreadBroker: sb},
+	} {
+		if ev.ActorId == "" {
+			ev.Actor, ev.ActorId = "bob", "U2"
+		}
+		ev.Origin = sb
+		tc := &ThreadCommand{log: NewLogger("ctx", "test"), allowed: allowed}
+		td := &TestDispatch{}
+		tc.exec(ev, lc.NewEvent(ev), td)
+		if td.lastbroadcast == nil || td.lastbroadcast.Text != text {
+			t.Errorf("err: expected %q, have %+v", text, td.lastbroadcast)
+		}
+	}
+}
+
+func TestThreadSummaryLength(t *testing.T) {
+	msgs := []*Event{}
+	for i := 0; i < threadSummaryMax+5; i++ {
+		msgs = append(msgs, &Event{Actor: "bob", Text: fmt.Sprint(i)})
+	}
+	msgs[len(msgs)-1].Text = strings.Repeat("a", threadLineMax+10)
+	lines := strings.Split(threadSummary(msgs, "slack", "carol"), "\n")
+	if len(lines) != threadSummaryMax+2 || lines[1] != "bob: 0" ||
+		lines[2] != "… 5 more" || lines[3] != "bob: 6" {
+		t.Errorf("err: expected the root, a gap and the latest, have %q", lines[:4])
+	}
+	if last := lines[len(lines)-1]; last != "bob: "+strings.Repeat("a", threadLineMax)+"…" {
+		t.Errorf("err: expected long messages cut short, have %q", last)
+	}
+}
+
+func TestSlackThreadContext(t *testing.T) {
+	fs := &FakeSlackAPI{replies: map[string][]libsl.Message{
+		"100.1": {{Msg: libsl.Msg{Text: "who wants lunch today?"}}},
+	}}
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1", api: fs}
+	sb.SetupInternals()
+	sb.ThreadContext(10)
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	td := &TestDispatch{}
+
+	reply := slackMsg("U2", "C1", "me!")
+	reply.Timestamp = "100.2"
+	reply.ThreadTimestamp = "100.1"
+	sb.handleMessage(reply, td)
+	if td.lastbroadcast.ThreadContext != "re: who wants: " || td.lastbroadcast.Text != "me!" {
+		t.Errorf("err: thread context got [%s] [%s]",
+			td.lastbroadcast.ThreadContext, td.lastbroadcast.Text)
+	}
+	// commands in a thread are still commands
+	cmd := slackMsg("U2", "C1", "..weather pdx")
+	cmd.Timestamp = "100.4"
+	cmd.ThreadTimestamp = "100.1"
+	sb.handleMessage(cmd, td)
+	if td.lastbroadcast.Text != "..weather pdx" {
+		t.Errorf("err: a threaded command got [%s]", td.lastbroadcast.Text)
+	}
+	// second reply to same thread should come from the cache
+	sb.handleMessage(reply, td)
+	if fs.repliesCalls != 1 {
+		t.Errorf("err: expected 1 replies call, got %d", fs.repliesCalls)
+	}
+
+	// top level messages are left alone
+	top := slackMsg("U2", "C1", "plain")
+	top.Timestamp = "100.3"
+	sb.handleMessage(top, td)
+	if td.lastbroadcast.ThreadContext != "" {
+		t.Errorf("err: unthreaded got [%s]", td.lastbroadcast.ThreadContext)
+	}
+
+	// disabled by default
+	sb.ThreadContext(0)
+	sb.handleMessage(reply, td)
+	if td.lastbroadcast.ThreadContext != "" {
+		t.Errorf("err: disabled thread context got [%s]", td.lastbroadcast.ThreadContext)
+	}
+}
+
+func TestSlackScheduledMessage(t *testing.T) {
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	td := &TestDispatch{}
+
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	sb.HandleEvent(&Event{Actor: "bob", Text: "later", SendAt: later}, td)
+	if len(fs.scheduled) != 1 || fs.scheduled[0] != fmtInt64(later.Unix()) {
+		t.Errorf("err: expected schedule at %d got %v", later.Unix(), fs.scheduled)
+	}
+
+	// past times just post now, as does no time at all
+	past := time.Now().Add(-time.Hour)
+	sb.HandleEvent(&Event{Actor: "bob", Text: "oops", SendAt: past}, td)
+	sb.HandleEvent(&Event{Actor: "bob", Text: "now"}, td)
+	if len(fs.scheduled) != 1 || len(fs.posted) != 3 {
+		t.Errorf("err: expected only one scheduled message, got %v", fs.scheduled)
+	}
+}
+
+func TestSlackReplyBroadcast(t *testing.T) {
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	td := &TestDispatch{}
+	other := &FakeBroker{}
+
+	sb.HandleEvent(&Event{Text: "a", ThreadId: "100.1", ThreadBroker: sb,
+		ReplyBroadcast: true}, td)
+	sb.HandleEvent(&Event{Text: "b", ThreadId: "100.1", ThreadBroker: sb}, td)
+	sb.HandleEvent(&Event{Text: "c", ReplyBroadcast: true}, td)
+	sb.HandleEvent(&Event{Text: "d", ThreadId: "100.1", ThreadBroker: other,
+		ReplyBroadcast: true}, td)
+	wants := []struct{ thread, bcast string }{
+		{"100.1", "true"}, {"100.1", ""}, {"", ""}, {"", ""},
+	}
+	if len(fs.posted) != len(wants) {
+		t.Fatalf("err: expected %d posts got %d", len(wants), len(fs.posted))
+	}
+	for i, want := range wants {
+		vals := postedValues(fs.posted[i])
+		if vals.Get("thread_ts") != want.thread ||
+			vals.Get("reply_broadcast") != want.bcast {
+			t.Errorf("err: post %d have %v wanted %+v", i, vals, want)
+		}
+	}
+}
+
+func TestSlackSetupErrors(t *testing.T) {
+	sb := &SlackBroker{api: &FakeSlackAPI{authErr: fmt.Errorf("invalid_auth")}}
+	if err := sb.Setup("tok", "general"); err == nil {
+		t.Errorf("err: expected auth failure to fail setup")
+	}
+
+	sb = &SlackBroker{api: &FakeSlackAPI{}}
+	if err := sb.Setup("tok", "general"); err == nil {
+		t.Errorf("err: expected missing channel to fail setup")
+	}
+
+	general := libsl.Channel{}
+	general.ID, general.Name = "C1", "general"
+	sb = &SlackBroker{api: &FakeSlackAPI{channels: []libsl.Channel{general}}}
+	if err := sb.Setup("tok", "general"); err != nil {
+		t.Errorf("err: setup failed %s", err)
+		return
+	}
+	if sb.chanid != "C1" || sb.mybotid != "UBOT" {
+		t.Errorf("err: have chanid %s botid %s", sb.chanid, sb.mybotid)
+	}
+
+	random := libsl.Channel{}
+	random.ID, random.Name = "C2", "random"
+	sb = &SlackBroker{api: &FakeSlackAPI{
+		channels: []libsl.Channel{general, random}}}
+	if err := sb.Setup("tok", "#random"); err != nil {
+		t.Errorf("err: setup with #random failed %s", err)
+		return
+	}
+	if sb.chanid != "C2" || sb.channel != "random" {
+		t.Errorf("err: #random should resolve, have %s %s", sb.chanid, sb.channel)
+	}
+}
+
+func TestSlackReactionCommand(t *testing.T) {
+	fs := &FakeSlackAPI{history: map[string]libsl.Message{
+		"100.1": {Msg: libsl.Msg{Timestamp: "100.1", Text: ",weather pdx"}},
+	}}
+	sb := &SlackBroker{chanid: "C1", mybotid: "UBOT", api: fs}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "UBOB", Nick: "bob"})
+	sb.ReactionCommands(map[string]string{"repeat": "", "eyes": ",watch "})
+	td := &TestDispatch{}
+	react := func(emoji string, user string, ts string) {
+		e := &libsl.ReactionAddedEvent{User: user, Reaction: emoji}
+		e.Item.Type = "message"
+		e.Item.Channel = "C1"
+		e.Item.Timestamp = ts
+		td.lastbroadcast = nil
+		sb.handleReaction(e, td)
+	}
+
+	react("repeat", "UBOB", "100.1")
+	ev := td.lastbroadcast
+	if ev == nil || ev.Text != ",weather pdx" || ev.Actor != "bob" ||
+		ev.Origin != sb || ev.ThreadId != "100.1" || ev.ThreadBroker != sb {
+		t.Fatalf("err: expected a re-run of the command %+v", ev)
+	}
+
+	react("eyes", "UBOB", "100.1")
+	if td.lastbroadcast == nil || td.lastbroadcast.Text != ",watch ,weather pdx" {
+		t.Errorf("err: expected the mapped prefix %+v", td.lastbroadcast)
+	}
+	if fs.historyCalls != 1 {
+		t.Errorf("err: reacted message should be cached, %d fetches", fs.historyCalls)
+	}
+
+	for _, r := range [][]string{
+		{"thumbsup", "UBOB", "100.1"}, // not a trigger
+		{"repeat", "UBOT", "100.1"},   // our own reaction
+		{"repeat", "UBOB", "200.2"},   // can't find the message
+	} {
+		react(r[0], r[1], r[2])
+		if td.lastbroadcast != nil {
+			t.Errorf("err: %v should not broadcast", r)
+		}
+	}
+}
+
+func TestConvertSpecialRefs(t *testing.T) {
+	fs := &FakeSlackAPI{groups: []libsl.UserGroup{{ID: "S2", Handle: "oncall"}}}
+	sb := &SlackBroker{api: fs}
+	sb.SetupInternals()
+
+	testwants := map[string]string{
+		"<!here> lunch":                 "@here lunch",
+		"<!here|here> lunch":            "@here lunch",
+		"<!channel> lunch":              "@channel lunch",
+		"<!everyone> lunch":             "@everyone lunch",
+		"ping <!subteam^S1|@devs> pls":  "ping @devs pls",
+		"ping <!subteam^S2> pls":        "ping @oncall pls",
+		"ping <!subteam^S9> pls":        "ping <!subteam^S9> pls",
+		"<!date^1392734382^{date}|Feb>": "<!date^1392734382^{date}|Feb>",
+	}
+	for in, want := range testwants {
+		if have := sb.ConvertRefsToUsers(in, false); have != want {
+			t.Errorf("err: have [%s] wanted [%s]", have, want)
+		}
+	}
+	calls := fs.groupsCalls
+	sb.ConvertRefsToUsers("<!subteam^S2> <!subteam^S9>", false)
+	if fs.groupsCalls != calls {
+		t.Errorf("err: known and missing groups should both be cached")
+	}
+}
+
+func TestSlackUserMissCache(t *testing.T) {
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{api: fs}
+	sb.SetupInternals()
+	now := time.Now()
+	sb.usercache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if have := sb.ConvertRefsToUsers("ping <@U404>", false); have != "ping U404" {
+			t.Errorf("err: missing user should show as its id, have [%s]", have)
+		}
+	}
+	if fs.userCalls != 1 {
+		t.Errorf("err: failed lookup retried within the ttl, %d calls", fs.userCalls)
+	}
+	now = now.Add(DefaultUserMissTTL)
+	sb.usercache.UserNick(sb, "U404", false)
+	if fs.userCalls != 2 {
+		t.Errorf("err: failed lookup should be retried after the ttl")
+	}
+
+	sb.usercache.MissTTL(0)
+	sb.usercache.UserNick(sb, "U500", false)
+	sb.usercache.UserNick(sb, "U500", false)
+	if fs.userCalls != 4 {
+		t.Errorf("err: no ttl should retry every time, %d calls", fs.userCalls)
+	}
+}
+
+func TestSlackBlocksFallback(t *testing.T) {
+	fs := &FakeSlackAPI{blocksErr: fmt.Errorf("invalid_blocks")}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	sb.post(&Event{Actor: "bot", Text: "weather", ContentBlocks: []*EventBlock{
+		{Title: "Portland", Text: "rain, 12C", ImgUrl: "https://example.com/broken.png"},
+		{Text: "curl wttr.in/pdx", Type: CONTENT_CODE},
+	}})
+	if len(fs.posted) != 1 {
+		t.Fatalf("err: expected the text fallback posted, have %d posts", len(fs.posted))
+	}
+	vals := postedValues(fs.posted[0])
+	want := "weather\n*Portland*\nrain, 12C\nhttps://example.com/broken.png\n```curl wttr.in/pdx```"
+	if vals.Get("blocks") != "" || postedText(fs.posted[0]) != want {
+		t.Errorf("err: expected plain text %q, have %q", want, postedText(fs.posted[0]))
+	}
+
+	// other failures aren't the blocks' fault
+	fs.blocksErr = fmt.Errorf("channel_not_found")
+	sb.post(&Event{Actor: "bot", Text: "again", ContentBlocks: []*EventBlock{{Text: "x"}}})
+	if len(fs.posted) != 1 {
+		t.Errorf("err: only refused blocks should fall back to text")
+	}
+}
+
+func TestSlackUserCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smug")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+
+	fs := &FakeSlackAPI{users: map[string]*libsl.User{
+		"U2": {ID: "U2", Name: "bob"},
+		"U3": {ID: "U3", Name: "carol", Profile: libsl.UserProfile{StatusText: "lunch"}},
+	}}
+	sb := &SlackBroker{api: fs}
+	sb.SetupInternals()
+	sb.usercache.PopulateCache(sb, []string{"U2", "U3"})
+	if err := sb.usercache.Save(path); err != nil {
+		t.Fatalf("err: saving %s", err)
+	}
+
+	// after a restart
+	fs.userCalls = 0
+	sb.SetupInternals()
+	now := time.Now()
+	sb.usercache.now = func() time.Time { return now }
+	sb.usercache.TTL(time.Hour)
+	if err := sb.usercache.Load(path); err != nil {
+		t.Fatalf("err: loading %s", err)
+	}
+	sb.usercache.PopulateCache(sb, []string{"U2", "U3"})
+	if nick := sb.usercache.UserNick(sb, "U3", false); nick != "carol" ||
+		sb.usercache.UserStatus("U3") != "lunch" || sb.usercache.UserId(sb, "bob", false) != "U2" {
+		t.Errorf("err: users not loaded, have %s", nick)
+	}
+	if fs.userCalls != 0 {
+		t.Errorf("err: loaded users shouldn't be fetched, %d calls", fs.userCalls)
+	}
+
+	fs.users["U2"] = &libsl.User{ID: "U2", Name: "robert"}
+	now = now.Add(time.Hour)
+	if nick := sb.usercache.UserNick(sb, "U2", false); nick != "robert" || fs.userCalls != 1 {
+		t.Errorf("err: stale user should be fetched again, have %s", nick)
+	}
+	delete(fs.users, "U3")
+	if nick := sb.usercache.UserNick(sb, "U3", false); nick != "carol" {
+		t.Errorf("err: a failed refetch should keep the stale user, have %s", nick)
+	}
+	if nick := sb.usercache.UserNick(sb, "U2", false); nick != "robert" || fs.userCalls != 2 {
+		t.Errorf("err: refetched user shouldn't be stale, %d calls", fs.userCalls)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := sb.usercache.Load(path); err == nil {
+		t.Errorf("err: a corrupt cache file should error")
+	}
+	if err := sb.usercache.Load(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("err: a missing cache file is an empty cache, %s", err)
+	}
+}
+
+func TestSlackUnfurl(t *testing.T) {
+	general := libsl.Channel{}
+	general.ID, general.Name = "C1", "general"
+	postWith := func(stanza string) url.Values {
+		cfg, err := ParseConfig([]byte("version: 1\nbrokers:\n  sl:\n" + stanza))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		fs := &FakeSlackAPI{channels: []libsl.Channel{general}}
+		sb := &SlackBroker{api: fs}
+		if err := sb.SetupFromConfig(cfg.Brokers["sl"]); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		sb.HandleEvent(&Event{Actor: "bob", Text: "see http://wiki.corp/x"}, nil)
+		return postedValues(fs.posted[0])
+	}
+
+	vals := postWith("    type: slack\n    channel: general\n")
+	if _, found := vals["unfurl_links"]; found {
+		t.Errorf("err: unset should leave slack's default %v", vals)
+	}
+	if _, found := vals["unfurl_media"]; found {
+		t.Errorf("err: unset should leave slack's default %v", vals)
+	}
+
+	vals = postWith("    type: slack\n    channel: general\n" +
+		"    unfurl-links: false\n    unfurl-media: false\n")
+	if vals.Get("unfurl_links") != "false" || vals.Get("unfurl_media") != "false" {
+		t.Errorf("err: expected previews off %v", vals)
+	}
+
+	vals = postWith("    type: slack\n    channel: general\n    unfurl-links: true\n")
+	if vals.Get("unfurl_links") != "true" {
+		t.Errorf("err: expected link previews on %v", vals)
+	}
+}
+
+func TestSlackPrivateMessages(t *testing.T) {
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1", api: &FakeSlackAPI{}}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	td := &TestDispatch{}
+
+	sb.handleMessage(slackMsg("U2", "D7", "..weather"), td)
+	dm := td.lastbroadcast
+	if !dm.Private || dm.ReplyBroker != sb || dm.ReplyTarget != "D7" {
+		t.Errorf("err: dm should be private and answered in the dm %+v", dm)
+	}
+	sb.handleMessage(slackMsg("U2", "C9", "hi"), td)
+	if ev := td.lastbroadcast; ev.Private || ev.ReplyBroker != sb || ev.ReplyTarget != "C9" {
+		t.Errorf("err: another channel is answered there but isn't private %+v", ev)
+	}
+	sb.handleMessage(slackMsg("U2", "C1", "hi"), td)
+	if ev := td.lastbroadcast; ev.Private || ev.ReplyBroker != nil {
+		t.Errorf("err: our channel is neither %+v", ev)
+	}
+
+	// a pattern's answer stays private and only goes back to slack
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"text":"sunny"}`))
+		}))
+	defer srv.Close()
+	p, _ := NewPattern(`.*`, srv.URL)
+	feedback := NewFeedback(1)
+	p.Submit(dm, dm.Actor, dm.Text, NamedGroups{}, feedback)
+	reply := <-feedback.events
+	if !reply.Private || reply.ReplyBroker != sb || reply.ReplyTarget != "D7" {
+		t.Errorf("err: reply should follow the dm %+v", reply)
+	}
+	fc := &FakeIrcConn{}
+	ib := &IrcBroker{channel: "#chan", conn: fc}
+	ib.HandleEvent(reply, td)
+	time.Sleep(10 * time.Millisecond)
+	if len(fc.sent) != 0 {
+		t.Errorf("err: a dm reply should not reach irc %v", fc.sent)
+	}
+}
+
+func TestSlackAttachments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{
+				"text": "disk alert",
+				"blocks": [{"title": "db01"}],
+				"attachments": [{
+					"color": "danger",
+					"title": "disk almost full",
+					"fields": [
+						{"title": "host", "value": "db01", "short": true},
+						{"title": "used", "value": "97%", "short": true}
+					]
+				}]
+			}`))
+		}))
+	defer srv.Close()
+	p, _ := NewPatternFromConfig(&PatternConfig{
+		RegEx: ".*", Url: srv.URL, Method: "POST"})
+	feedback := NewFeedback(1)
+	p.Submit(&Event{}, "bob", "..disk", NamedGroups{}, feedback)
+	ev := <-feedback.events
+
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	sb.post(ev)
+	if len(fs.posted) != 1 {
+		t.Fatalf("err: expected one post, have %d", len(fs.posted))
+	}
+	vals := postedValues(fs.posted[0])
+	var atts []libsl.Attachment
+	if err := json.Unmarshal([]byte(vals.Get("attachments")), &atts); err != nil {
+		t.Fatalf("err: attachments not sent %s", err)
+	}
+	if len(atts) != 1 || atts[0].Color != "danger" ||
+		atts[0].Fallback != "disk almost full" || len(atts[0].Fields) != 2 ||
+		atts[0].Fields[1].Value != "97%" || !atts[0].Fields[1].Short {
+		t.Errorf("err: attachment mangled %+v", atts)
+	}
+	if vals.Get("blocks") == "" {
+		t.Errorf("err: blocks should be sent alongside attachments")
+	}
+}
+
+func TestSlackAvatarFallback(t *testing.T) {
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "dave", Avatar: "https://slack/dave.png"})
+	icon := func(ev *Event) (string, string) {
+		sb.post(ev)
+		vals := postedValues(fs.posted[len(fs.posted)-1])
+		return vals.Get("icon_url"), vals.Get("icon_emoji")
+	}
+
+	if url, _ := icon(&Event{Actor: "bob", Text: "hi", Avatar: "https://masto/bob.png"}); url != "https://masto/bob.png" {
+		t.Errorf("err: the event's avatar should be used, have [%s]", url)
+	}
+	if url, _ := icon(&Event{Actor: "Bob", Text: "hi"}); url != "https://masto/bob.png" {
+		t.Errorf("err: the actor's last avatar should be reused, have [%s]", url)
+	}
+	if url, _ := icon(&Event{Actor: "dave", Text: "hi"}); url != "https://slack/dave.png" {
+		t.Errorf("err: the slack user's avatar should be used, have [%s]", url)
+	}
+	if url, emoji := icon(&Event{Actor: "carol", Text: "hi"}); url != "" || emoji != ":avatar_carol:" {
+		t.Errorf("err: expected the avatar emoji, have [%s] [%s]", url, emoji)
+	}
+	sb.AvatarEmoji("")
+	if url, emoji := icon(&Event{Actor: "carol", Text: "hi"}); url != "" || emoji != "" {
+		t.Errorf("err: expected no icon, have [%s] [%s]", url, emoji)
+	}
+}
+
+func TestSlackBlockEdges(t *testing.T) {
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	// the type and text of each block posted, along with the message text
+	posted := func(ev *Event) (string, []string) {
+		sb.post(ev)
+		vals := postedValues(fs.posted[len(fs.posted)-1])
+		var blocks []struct {
+			Type string `json:"type"`
+			Text struct {
+				Text string `json:"text"`
+			} `json:"text"`
+		}
+		json.Unmarshal([]byte(vals.Get("blocks")), &blocks)
+		have := []string{}
+		for _, b := range blocks {
+			have = append(have, b.Type+":"+b.Text.Text)
+		}
+		return postedText(fs.posted[len(fs.posted)-1]), have
+	}
+
+	txt, blocks := posted(&Event{Text: "hi",
+		ContentBlocks: []*EventBlock{nil, {}}})
+	if txt != "hi" || len(blocks) != 0 {
+		t.Errorf("err: empty blocks should fall back to text [%s] %v", txt, blocks)
+	}
+	txt, blocks = posted(&Event{ContentBlocks: []*EventBlock{{Title: "alert"}}})
+	if strings.Join(blocks, "|") != "section:*alert*" {
+		t.Errorf("err: title only block got %v", blocks)
+	}
+	txt, blocks = posted(&Event{Text: "disk alert", ContentBlocks: []*EventBlock{
+		{Text: "db01 at 97%"}, {ImgUrl: "https://example.com/graph.png"}}})
+	if txt != "disk alert" ||
+		strings.Join(blocks, "|") != "section:disk alert|section:db01 at 97%|image:" {
+		t.Errorf("err: mixed text and blocks got [%s] %v", txt, blocks)
+	}
+}
+
+func TestSlackCodeBlocks(t *testing.T) {
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	code := "func main() {\n\tfmt.Println(\"<hi>\")\n}"
+	sb.post(&Event{Text: "try this", ContentBlocks: []*EventBlock{
+		{Type: CONTENT_CODE, Lang: "go", Text: code}, {Type: CONTENT_CODE}}})
+
+	var blocks []struct {
+		Type     string `json:"type"`
+		Elements []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			Elements []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"elements"`
+		} `json:"elements"`
+	}
+	vals := postedValues(fs.posted[0])
+	if err := json.Unmarshal([]byte(vals.Get("blocks")), &blocks); err != nil {
+		t.Fatalf("err: blocks %s: %s", err, vals.Get("blocks"))
+	}
+	if len(blocks) != 3 || blocks[0].Type != "section" {
+		t.Fatalf("err: expected text, language and code blocks %s", vals.Get("blocks"))
+	}
+	if lang := blocks[1]; lang.Type != "context" || len(lang.Elements) != 1 ||
+		lang.Elements[0].Text != "go" {
+		t.Errorf("err: expected the language as context %+v", lang)
+	}
+	rich := blocks[2]
+	if rich.Type != "rich_text" || len(rich.Elements) != 1 ||
+		rich.Elements[0].Type != "rich_text_preformatted" {
+		t.Fatalf("err: expected preformatted rich text %+v", rich)
+	}
+	if els := rich.Elements[0].Elements; len(els) != 1 || els[0].Type != "text" ||
+		els[0].Text != code {
+		t.Errorf("err: code should be posted as is %+v", els)
+	}
+	if postedText(fs.posted[0]) != "try this" {
+		t.Errorf("err: text should still be sent for notifications")
+	}
+}
+
+func TestSlackPlaceholder(t *testing.T) {
+	var mu sync.Mutex
+	answer := `{"text": "it's 3C"}`
+	setAnswer := func(a string) {
+		mu.Lock()
+		defer mu.Unlock()
+		answer = a
+	}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(answer))
+		}))
+	defer srv.Close()
+	p, _ := NewPatternFromConfig(&PatternConfig{
+		RegEx: "^..weather", Url: srv.URL, Method: "POST", Thinking: "…thinking"})
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1", api: fs}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	td := &TestDispatch{}
+	sb.handleMessage(slackMsg("U2", "C1", "..weather"), td)
+	asked := td.lastbroadcast
+
+	feedback := NewFeedback(1)
+	p.Submit(asked, asked.Actor, asked.Text, NamedGroups{}, feedback)
+	if len(fs.posted) != 1 || postedText(fs.posted[0]) != "…thinking" {
+		t.Fatalf("err: expected the placeholder posted first %v", fs.posted)
+	}
+	ev := <-feedback.events
+	if ev.Replaces != "1234.5678" || ev.ReplacesBroker != sb {
+		t.Errorf("err: answer should replace the placeholder %+v", ev)
+	}
+	sb.post(ev)
+	if len(fs.posted) != 1 || postedText(fs.updated["1234.5678"]) != "it's 3C" {
+		t.Errorf("err: placeholder not updated with the answer %v", fs.updated)
+	}
+
+	// nothing to say, the placeholder goes away
+	setAnswer(`{"silent": true}`)
+	p.Submit(asked, asked.Actor, asked.Text, NamedGroups{}, feedback)
+	if len(fs.deleted) != 1 || feedback.Depth() != 0 {
+		t.Errorf("err: silent answer should remove the placeholder %v", fs.deleted)
+	}
+
+	// no room for the answer, the placeholder goes away too
+	setAnswer(`{"text": "it's 3C"}`)
+	feedback.Send(&Event{Text: "waiting"})
+	p.Submit(asked, asked.Actor, asked.Text, NamedGroups{}, feedback)
+	if len(fs.deleted) != 2 || feedback.takeDropped() != 1 {
+		t.Errorf("err: dropped answer should remove the placeholder %v", fs.deleted)
+	}
+	<-feedback.events
+
+	// a repeat the broker dedups away doesn't replace it either
+	sb.Dedup(time.Minute)
+	sb.post(&Event{IsCmdOutput: true, Text: "it's 3C"})
+	p.Submit(asked, asked.Actor, asked.Text, NamedGroups{}, feedback)
+	sb.post(<-feedback.events)
+	if len(fs.deleted) != 3 || len(fs.updated) != 1 {
+		t.Errorf("err: deduped answer should remove the placeholder %v", fs.deleted)
+	}
+
+	// other brokers can't hold a place
+	p.Submit(&Event{Origin: &FakeBroker{}}, "bob", "..weather", NamedGroups{}, feedback)
+	if len(fs.posted) != 5 || (<-feedback.events).Replaces != "" {
+		t.Errorf("err: no placeholder expected off slack")
+	}
+
+	// one that can't be updated is posted after and goes away
+	fs.updateErr = errors.New("message_not_found")
+	sb.Dedup(0)
+	p.Submit(asked, asked.Actor, asked.Text, NamedGroups{}, feedback)
+	sb.post(<-feedback.events)
+	if len(fs.deleted) != 4 || postedText(fs.posted[len(fs.posted)-1]) != "it's 3C" {
+		t.Errorf("err: failed update should post and remove the placeholder %v", fs.deleted)
+	}
+}
+
+func TestSlackJoinChannel(t *testing.T) {
+	setup := func(ch libsl.Channel) (*SlackBroker, *FakeSlackAPI) {
+		ch.ID, ch.Name = "C1", "general"
+		fs := &FakeSlackAPI{channels: []libsl.Channel{ch}}
+		sb := &SlackBroker{api: fs}
+		if err := sb.Setup("tok", "general"); err != nil {
+			t.Fatalf("err: setup failed %s", err)
+		}
+		return sb, fs
+	}
+
+	in := libsl.Channel{}
+	in.Members = []string{"UBOT", "U2"}
+	sb, fs := setup(in)
+	if err := sb.JoinChannel(); err != nil || len(fs.joined) != 0 {
+		t.Errorf("err: already a member, shouldn't join %v %v", err, fs.joined)
+	}
+
+	sb, fs = setup(libsl.Channel{})
+	if err := sb.JoinChannel(); err != nil || len(fs.joined) != 1 ||
+		fs.joined[0] != "C1" || !sb.member {
+		t.Errorf("err: expected to join C1 %v %v", err, fs.joined)
+	}
+
+	private := libsl.Channel{}
+	private.IsPrivate = true
+	sb, fs = setup(private)
+	if err := sb.JoinChannel(); err != nil || len(fs.joined) != 0 {
+		t.Errorf("err: can't join private channels %v %v", err, fs.joined)
+	}
+
+	sb, fs = setup(libsl.Channel{})
+	fs.joinErr = fmt.Errorf("missing_scope")
+	if err := sb.JoinChannel(); err == nil {
+		t.Errorf("err: expected a failed join to error")
+	}
+}
+
+func TestSlackReconnect(t *testing.T) {
+	orig := rtmBackoffMin
+	rtmBackoffMin = time.Millisecond
+	defer func() { rtmBackoffMin = orig }()
+
+	sb := &SlackBroker{chanid: "C1", mybotid: "UBOT", api: &FakeSlackAPI{}}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	conns := make(chan chan libsl.RTMEvent, 2)
+	hungup := make(chan bool, 2)
+	sb.connect = func() (<-chan libsl.RTMEvent, func() error) {
+		events := make(chan libsl.RTMEvent, 1)
+		conns <- events
+		return events, func() error {
+			hungup <- true
+			close(events)
+			return nil
+		}
+	}
+	cd := &CentralDispatch{}
+	cb := &ChanBroker{events: make(chan *Event, 2)}
+	cd.AddBroker(cb)
+	activated := make(chan bool)
+	go func() {
+		sb.Activate(cd)
+		close(activated)
+	}()
+
+	say := func(events chan libsl.RTMEvent, text string) {
+		events <- libsl.RTMEvent{Data: slackMsg("U2", "C1", text)}
+		select {
+		case ev := <-cb.events:
+			if ev.Text != text {
+				t.Errorf("err: expected %q have %q", text, ev.Text)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("err: %q not handled", text)
+		}
+	}
+	first := <-conns
+	say(first, "before")
+	close(first)
+	var second chan libsl.RTMEvent
+	select {
+	case second = <-conns:
+	case <-time.After(time.Second):
+		t.Fatalf("err: no reconnect after the connection closed")
+	}
+	say(second, "after")
+
+	sb.Deactivate()
+	select {
+	case <-activated:
+	case <-time.After(time.Second):
+		t.Fatalf("err: still running after deactivate")
+	}
+	if len(hungup) != 1 || len(conns) != 0 {
+		t.Errorf("err: expected one hang up and no more connections")
+	}
+	// twice is harmless
+	sb.Deactivate()
+	if len(hungup) != 1 {
+		t.Errorf("err: a second deactivate shouldn't hang up again")
+	}
+}
+
+// a slack that answers rtm.connect with its own websocket, which sends
+// script then answers pings until it's sent goodbye
+func fakeRTMServer(t *testing.T, script ...string) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/rtm.connect":
+				wsurl := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+				fmt.Fprintf(w, `{"ok": true, "url": %q}`, wsurl)
+			case "/ws":
+				conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					t.Errorf("err: %s", err)
+					return
+				}
+				defer conn.Close()
+				for _, msg := range script {
+					conn.WriteMessage(websocket.TextMessage, []byte(msg))
+				}
+				for {
+					var ping map[string]interface{}
+					if conn.ReadJSON(&ping) != nil {
+						return
+					}
+					conn.WriteJSON(map[string]interface{}{
+						"type": "pong", "reply_to": ping["id"]})
+				}
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	return srv
+}
+
+func TestSlackRTM(t *testing.T) {
+	srv := fakeRTMServer(t,
+		`{"type": "hello"}`,
+		`{"type": "message", "channel": "C1", "user": "U1", "text": "hi",
+			"blocks": [{"type": "rich_text", "block_id": "b1", "elements": [
+				{"type": "rich_text_section", "elements": [
+					{"type": "text", "text": "hi"}]}]}]}`,
+		`{"type": "reaction_added", "user": "U1", "reaction": "tada"}`,
+		`{"type": "pong", "reply_to": 1}`,
+		`{"type": "goodbye"}`)
+	defer srv.Close()
+	sc := libsl.New("tok", libsl.OptionAPIURL(srv.URL+"/api/"))
+	connect := slackRTM(sc, websocket.DefaultDialer, 10*time.Millisecond)
+
+	events, hangup := connect()
+	defer hangup()
+	got := []interface{}{}
+	timeout := time.After(2 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				done = true
+				break
+			}
+			got = append(got, ev.Data)
+		case <-timeout:
+			t.Fatalf("err: rtm never said goodbye, have %d events", len(got))
+		}
+	}
+	if len(got) != 4 {
+		t.Fatalf("err: expected connected, hello, message and reaction, have %v", got)
+	}
+	if _, ok := got[0].(*libsl.ConnectedEvent); !ok {
+		t.Errorf("err: expected connected first, have %T", got[0])
+	}
+	if _, ok := got[1].(*libsl.HelloEvent); !ok {
+		t.Errorf("err: expected hello, have %T", got[1])
+	}
+	if rm, ok := got[2].(*slackRichMessage); !ok {
+		t.Errorf("err: expected a rich message, have %T", got[2])
+	} else if text, ok := richTextMrkdwn(rm.Blocks); !ok || text != "hi" {
+		t.Errorf("err: rich text blocks not decoded, have %q", text)
+	}
+	if rx, ok := got[3].(*libsl.ReactionAddedEvent); !ok || rx.Reaction != "tada" {
+		t.Errorf("err: expected the reaction, have %v", got[3])
+	}
+	// the lib's own decoding is left as it was
+	if _, ok := libsl.EventMapping["message"].(libsl.MessageEvent); !ok {
+		t.Errorf("err: the lib's message mapping shouldn't be replaced")
+	}
+
+	// hanging up closes events however far along it is
+	events, hangup = connect()
+	hangup()
+	select {
+	case <-events:
+		for range events {
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("err: events not closed after hanging up")
+	}
+}
+
+func TestSlackRTMInvalidAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"ok": false, "error": "invalid_auth"}`)
+		}))
+	defer srv.Close()
+	sc := libsl.New("tok", libsl.OptionAPIURL(srv.URL+"/api/"))
+	events, hangup := slackRTM(sc, websocket.DefaultDialer, time.Second)()
+	defer hangup()
+	ev, ok := <-events
+	if _, invalid := ev.Data.(*libsl.InvalidAuthEvent); !ok || !invalid {
+		t.Errorf("err: expected an invalid auth event, have %v", ev.Data)
+	}
+	if _, open := <-events; open {
+		t.Errorf("err: events should close after an auth failure")
+	}
+}
+
+func TestSlackAvatarMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smug")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "avatars.yaml")
+	ioutil.WriteFile(file, []byte("alice: https://x.com/alice.png\nbob: https://x.com/old.png\n"), 0644)
+
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", api: fs}
+	sb.SetupInternals()
+	err = sb.MapAvatars(map[string]string{"Bob": "https://x.com/bob.png"}, file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	icon := func(ev *Event) string {
+		sb.post(ev)
+		return postedValues(fs.posted[len(fs.posted)-1]).Get("icon_url")
+	}
+	if url := icon(&Event{Actor: "Alice", Text: "hi"}); url != "https://x.com/alice.png" {
+		t.Errorf("err: expected alice's mapped avatar, have [%s]", url)
+	}
+	if url := icon(&Event{Actor: "bob", Text: "hi"}); url != "https://x.com/bob.png" {
+		t.Errorf("err: config should win over the file, have [%s]", url)
+	}
+	if url := icon(&Event{Actor: "alice", Text: "hi", Avatar: "https://m/a.png"}); url != "https://m/a.png" {
+		t.Errorf("err: an event's own avatar should win, have [%s]", url)
+	}
+
+	ioutil.WriteFile(file, []byte("carol: https://x.com/carol.png\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file, later, later)
+	sb.Heartbeat()
+	if url := sb.avatars.Avatar("carol"); url != "https://x.com/carol.png" {
+		t.Errorf("err: changed file not reloaded, have [%s]", url)
+	}
+	if url := sb.avatars.Avatar("bob"); url != "https://x.com/bob.png" {
+		t.Errorf("err: configured avatars should survive a reload, have [%s]", url)
+	}
+
+	if err := sb.MapAvatars(nil, filepath.Join(dir, "nope.yaml")); err == nil {
+		t.Errorf("err: expected a missing avatar file to error")
+	}
+}
+
+// raw decoded the way rtm decodes a message slack sends
+func rtmMessage(t *testing.T, raw string) *slackRichMessage {
+	ev, _ := decodeRTMEvent(json.RawMessage(raw))
+	rm, ok := ev.Data.(*slackRichMessage)
+	if !ok {
+		t.Fatalf("err: rtm messages decoded as %T %v", ev.Data, ev.Data)
+	}
+	return rm
+}
+
+func TestSlackRichText(t *testing.T) {
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1"}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U1", Nick: "alice"})
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	payload := `{"type": "rich_text", "block_id": "x1", "elements": [
+		{"type": "rich_text_section", "elements": [
+			{"type": "text", "text": "hey "},
+			{"type": "user", "user_id": "U2"},
+			{"type": "text", "text": " and "},
+			{"type": "broadcast", "range": "here"},
+			{"type": "text", "text": " see ", "style": {"bold": true}},
+			{"type": "link", "url": "https://example.com", "text": "docs"},
+			{"type": "emoji", "name": "tada"}]},
+		{"type": "rich_text_list", "style": "ordered", "elements": [
+			{"type": "rich_text_section", "elements": [{"type": "text", "text": "one"}]},
+			{"type": "rich_text_section", "elements": [
+				{"type": "text", "text": "two", "style": {"code": true}}]}]},
+		{"type": "rich_text_preformatted", "elements": [
+			{"type": "text", "text": "make test"}]},
+		{"type": "rich_text_quote", "elements": [
+			{"type": "text", "text": "said\nthis"}]}]}`
+	msg := &rtmMessage(t, `{"type": "message", "channel": "C1", "user": "U1",
+		"text": "hey <@U2> and <!here>", "ts": "1.2", "blocks": [
+		{"type": "divider", "block_id": "d1"}, `+payload+`]}`).MessageEvent
+	ev := sb.ParseToEvent(msg)
+	want := "hey bob and @here *see* docs:tada:\n" +
+		"1. one\n2. `two`\n```\nmake test\n```\n> said\n> this"
+	if ev.Text != want {
+		t.Errorf("err: expected text from the blocks\n%s\nhave\n%s", want, ev.Text)
+	}
+
+	msg = &rtmMessage(t, `{"type": "message", "subtype": "message_changed", "channel": "C1",
+		"message": {"type": "message", "user": "U1", "text": "hey", "ts": "1.2",
+			"blocks": [{"type": "rich_text", "elements": [{"type": "rich_text_section",
+				"elements": [{"type": "text", "text": "fixed", "style": {"italic": true}}]}]}]}}`).MessageEvent
+	if have, _ := richTextMrkdwn(msg.SubMessage.Blocks); have != "_fixed_" {
+		t.Errorf("err: expected an edit's rich text decoded, have %s", have)
+	}
+
+	// without rich text the message's text is used
+	msg = slackMsg("U1", "C1", "hey <@U2>")
+	msg.Blocks = libsl.Blocks{BlockSet: []libsl.Block{&libsl.DividerBlock{Type: "divider"}}}
+	if ev := sb.ParseToEvent(msg); ev.Text != "hey bob" {
+		t.Errorf("err: expected the text as a fallback, have %s", ev.Text)
+	}
+}
+
+func TestSlackFileList(t *testing.T) {
+	sb := &SlackBroker{chanid: "C1", api: &FakeSlackAPI{}}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U1", Nick: "alice"})
+	msg := slackMsg("U1", "C1", "pics")
+	for _, name := range []string{"a.png", "b.png", "c.png", "d.png"} {
+		msg.Files = append(msg.Files,
+			libsl.File{Name: name, URLPrivate: "https://files/" + name})
+	}
+	for _, tc := range []struct {
+		max   int
+		names bool
+		want  string
+	}{
+		{0, false, "pics a.png(https://files/a.png) b.png(https://files/b.png) " +
+			"c.png(https://files/c.png) d.png(https://files/d.png)"},
+		{2, false, "pics a.png(https://files/a.png) b.png(https://files/b.png) +2 more"},
+		{1, true, "pics a.png +3 more"},
+		{0, true, "pics a.png b.png c.png d.png"},
+		{4, false, "pics a.png(https://files/a.png) b.png(https://files/b.png) " +
+			"c.png(https://files/c.png) d.png(https://files/d.png)"},
+	} {
+		sb.LimitFiles(tc.max, tc.names)
+		if ev := sb.ParseToEvent(msg); ev.RawText != tc.want {
+			t.Errorf("err: %d files, names %t, have %q", tc.max, tc.names, ev.RawText)
+		}
+	}
+}
+
+func TestSlackEdits(t *testing.T) {
+	sb := &SlackBroker{chanid: "C1", mybotid: "U9", botid: "B9", api: &FakeSlackAPI{}}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U1", Nick: "alice"})
+	changed := func(prev libsl.Msg, now libsl.Msg) *libsl.MessageEvent {
+		e := slackMsg("", "C1", "")
+		e.SubType = "message_changed"
+		e.SubMessage, e.PreviousMessage = &now, &prev
+		return e
+	}
+	edit := changed(libsl.Msg{User: "U1", Text: "helo", Timestamp: "1.1"},
+		libsl.Msg{User: "U1", Text: "hello", Timestamp: "1.1"})
+	td := &TestDispatch{}
+	sb.handleMessage(edit, td)
+	if len(td.broadcasts) != 0 {
+		t.Errorf("err: edits shouldn't be bridged unless asked for")
+	}
+
+	sb.BridgeEdits(true)
+	sb.handleMessage(edit, td)
+	if ev := td.lastbroadcast; ev == nil || ev.Text != "(edited) hello" ||
+		ev.Actor != "alice" || ev.MessageId != "1.1" {
+		t.Errorf("err: expected the edit bridged, have %+v", ev)
+	}
+	// our own posts, by bot id or user, and changes to anything but text
+	for _, e := range []*libsl.MessageEvent{
+		changed(libsl.Msg{BotID: "B9", SubType: "bot_message", Text: "hi http://x"},
+			libsl.Msg{BotID: "B9", SubType: "bot_message", Text: "hi http://x",
+				Attachments: []libsl.Attachment{{Title: "x"}}}),
+		changed(libsl.Msg{User: "U9", Text: "hi"}, libsl.Msg{User: "U9", Text: "hi!"}),
+		changed(libsl.Msg{User: "U1", Text: "see http://x"},
+			libsl.Msg{User: "U1", Text: "see http://x",
+				Attachments: []libsl.Attachment{{Title: "x"}}}),
+	} {
+		td.broadcasts, td.lastbroadcast = nil, nil
+		sb.handleMessage(e, td)
+		if len(td.broadcasts) != 0 {
+			t.Errorf("err: change to %+v shouldn't be bridged", e.SubMessage)
+		}
+	}
+}
+
+func TestSlackEnterpriseGrid(t *testing.T) {
+	general := libsl.Channel{}
+	general.ID, general.Name = "C9", "general"
+	fs := &FakeSlackAPI{
+		teamChannels: map[string][]libsl.Channel{"T2": {general}},
+		teamGroups: map[string][]libsl.UserGroup{
+			"T2": {{ID: "S2", Handle: "oncall"}}},
+		users: map[string]*libsl.User{
+			"W123": {ID: "W123", Name: "carol", TeamID: "T3"}},
+	}
+	sb := &SlackBroker{api: fs}
+	if err := sb.Setup("tok", "general"); err == nil {
+		t.Errorf("err: without grid the channel shouldn't be found")
+	}
+	sb = &SlackBroker{api: fs}
+	sb.EnterpriseGrid("")
+	if err := sb.Setup("tok", "general"); err == nil || sb.teamId != "THOME" {
+		t.Errorf("err: expected the token's own workspace, have %s", sb.teamId)
+	}
+	sb = &SlackBroker{api: fs}
+	sb.EnterpriseGrid("T2")
+	if err := sb.Setup("tok", "general"); err != nil || sb.chanid != "C9" {
+		t.Fatalf("err: expected the channel found in T2, have %s %v", sb.chanid, err)
+	}
+	// a user from another workspace in the org, and a group from ours
+	have := sb.ConvertRefsToUsers("<@W123> is <!subteam^S2>", false)
+	if have != "carol is @oncall" {
+		t.Errorf("err: expected refs resolved across the org, have %s", have)
+	}
+
+	var forms []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			forms = append(forms, r.PostForm)
+			switch {
+			case r.URL.Path == "/usergroups.list":
+				w.Write([]byte(`{"ok": true, "usergroups": [{"id": "S2", "handle": "oncall"}]}`))
+			case r.PostForm.Get("cursor") == "":
+				w.Write([]byte(`{"ok": true, "channels": [{"id": "C1", "name": "random"}],
+					"response_metadata": {"next_cursor": "next"}}`))
+			default:
+				w.Write([]byte(`{"ok": true, "channels": [{"id": "C9", "name": "general"}]}`))
+			}
+		}))
+	defer srv.Close()
+	sc := newSlackClient("xoxb-1", srv.Client())
+	sc.apiUrl = srv.URL + "/"
+	channels, err := sc.GetTeamChannels("T2")
+	if err != nil || len(channels) != 2 || channels[1].ID != "C9" {
+		t.Errorf("err: expected both pages of channels, have %+v %v", channels, err)
+	}
+	groups, err := sc.GetTeamUserGroups("T2")
+	if err != nil || len(groups) != 1 || groups[0].Handle != "oncall" {
+		t.Errorf("err: expected the groups, have %+v %v", groups, err)
+	}
+	for _, form := range forms {
+		if form.Get("team_id") != "T2" || form.Get("token") != "xoxb-1" {
+			t.Errorf("err: expected the workspace asked for, have %v", form)
+		}
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": false, "error": "missing_scope"}`))
+	})
+	if _, err := sc.GetTeamChannels("T2"); err == nil ||
+		!strings.Contains(err.Error(), "missing_scope") {
+		t.Errorf("err: expected slack's error, have %v", err)
+	}
+}
+
+// FakeSlackSocket plays envelopes back in order and records acks
+type FakeSlackSocket struct {
+	envs []*SlackEnvelope
+	acks []string
+}
+
+func (fs *FakeSlackSocket) Read() (*SlackEnvelope, error) {
+	if len(fs.envs) == 0 {
+		return nil, fmt.Errorf("closed")
+	}
+	env := fs.envs[0]
+	fs.envs = fs.envs[1:]
+	return env, nil
+}
+
+func (fs *FakeSlackSocket) Ack(id string) error {
+	fs.acks = append(fs.acks, id)
+	return nil
+}
+
+func (fs *FakeSlackSocket) Close() error { return nil }
+
+func TestSlackSocketMode(t *testing.T) {
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1"}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	if err := sb.SocketMode("xoxb-nope"); err == nil {
+		t.Errorf("err: a bot token should be refused")
+	}
+	envelope := func(js string) *SlackEnvelope {
+		env := &SlackEnvelope{}
+		if err := json.Unmarshal([]byte(js), env); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return env
+	}
+	sock := &FakeSlackSocket{envs: []*SlackEnvelope{
+		envelope(`{"type": "hello"}`),
+		envelope(`{"envelope_id": "e1", "type": "slash_commands",
+			"accepts_response_payload": true,
+			"payload": {"command": "/weather", "text": "pdx 3", "user_id": "U2",
+				"user_name": "bob", "channel_id": "C1", "trigger_id": "t1"}}`),
+		envelope(`{"envelope_id": "e2", "type": "interactive",
+			"payload": {"type": "block_actions", "user": {"id": "U2"},
+				"channel": {"id": "D9"},
+				"actions": [{"action_id": "a1", "block_id": "b1", "type": "button",
+					"value": "..deploy prod"}]}}`),
+		envelope(`{"envelope_id": "e3", "type": "events_api", "payload": {}}`),
+		envelope(`{"type": "disconnect", "reason": "refresh_requested"}`),
+		envelope(`{"envelope_id": "e4", "type": "slash_commands",
+			"payload": {"command": "/late", "user_id": "U2", "channel_id": "C1"}}`),
+	}}
+	td := &TestDispatch{}
+	sb.readSocket(sock, td)
+
+	if strings.Join(sock.acks, ",") != "e1,e2,e3" {
+		t.Errorf("err: expected each envelope acked until the disconnect %v", sock.acks)
+	}
+	if len(td.broadcasts) != 2 {
+		t.Fatalf("err: expected 2 commands broadcast, have %d", len(td.broadcasts))
+	}
+	slash := td.broadcasts[0]
+	if slash.Actor != "bob" || slash.Text != "..weather pdx 3" || slash.ReplyBroker != nil {
+		t.Errorf("err: slash command event %+v", slash)
+	}
+	button := td.broadcasts[1]
+	if button.Actor != "bob" || button.Text != "..deploy prod" ||
+		button.ReplyBroker != sb || button.ReplyTarget != "D9" || !button.Private {
+		t.Errorf("err: button event %+v", button)
+	}
+}
+
+func TestSlackSocketConnect(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	acked := make(chan string, 1)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/open" {
+			if r.Header.Get("Authorization") != "Bearer xapp-1" {
+				t.Errorf("err: app token not sent")
+			}
+			fmt.Fprintf(w, `{"ok": true, "url": "ws%s/ws"}`, strings.TrimPrefix(srv.URL, "http"))
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("err: %s", err)
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(map[string]interface{}{"envelope_id": "e1", "type": "slash_commands",
+			"payload": map[string]string{"command": "/ping", "user_id": "U2", "channel_id": "C1"}})
+		var ack map[string]string
+		conn.ReadJSON(&ack)
+		acked <- ack["envelope_id"]
+	}))
+	defer srv.Close()
+
+	sock, err := slackSocketMode("xapp-1", srv.URL+"/open",
+		NewHttpClient(), websocket.DefaultDialer)()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer sock.Close()
+	env, err := sock.Read()
+	if err != nil || env.Type != "slash_commands" || env.EnvelopeId != "e1" {
+		t.Fatalf("err: read %+v %v", env, err)
+	}
+	sock.Ack(env.EnvelopeId)
+	select {
+	case id := <-acked:
+		if id != "e1" {
+			t.Errorf("err: acked %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("err: no ack")
+	}
+}
+
+func TestSlackCommandThreading(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"text": "it's 3C"}`))
+		}))
+	defer srv.Close()
+	p, _ := NewPatternFromConfig(&PatternConfig{
+		RegEx: "^..weather", Url: srv.URL, Method: "POST"})
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1", api: fs}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	asked := func(channel string, ts string, thread string) *Event {
+		msg := slackMsg("U2", channel, "..weather")
+		msg.Timestamp = ts
+		msg.ThreadTimestamp = thread
+		return sb.ParseToEvent(msg)
+	}
+	answer := func(ev *Event) *Event {
+		feedback := NewFeedback(1)
+		p.Submit(ev, ev.Actor, ev.Text, NamedGroups{}, feedback)
+		reply := <-feedback.events
+		reply.Origin = &FakeBroker{}
+		return reply
+	}
+
+	// asked in the channel, answered in a thread under the question
+	reply := answer(asked("C1", "111.222", ""))
+	if reply.ThreadId != "111.222" || reply.ThreadBroker != sb {
+		t.Errorf("err: expected a reply under 111.222, have %s", reply.ThreadId)
+	}
+	sb.post(reply)
+	if vals := postedValues(fs.posted[0]); vals.Get("thread_ts") != "111.222" {
+		t.Errorf("err: expected the post threaded, have %v", vals)
+	}
+	// asked in a thread, answered in that thread
+	if reply := answer(asked("C1", "333.444", "111.222")); reply.ThreadId != "111.222" {
+		t.Errorf("err: expected the existing thread, have %s", reply.ThreadId)
+	}
+	// no ts, or a direct message, answered inline
+	if reply := answer(asked("C1", "", "")); reply.ThreadId != "" {
+		t.Errorf("err: without a ts the reply can't be threaded, have %s", reply.ThreadId)
+	}
+	if reply := answer(asked("D9", "555.666", "")); reply.ThreadId != "" {
+		t.Errorf("err: direct messages shouldn't be threaded, have %s", reply.ThreadId)
+	}
+}
+
+func TestSlackConnTimeouts(t *testing.T) {
+	sb := &SlackBroker{}
+	if sb.rtmPing() != rtmPing || sb.wsDialer().NetDial != nil {
+		t.Errorf("err: without timeouts rtm should use its defaults")
+	}
+	nt, _ := NewNetTimeouts("5s", "20s")
+	sb.ConnTimeouts(nt)
+	if dialer := sb.wsDialer(); dialer.HandshakeTimeout != 5*time.Second ||
+		dialer.NetDial == nil {
+		t.Errorf("err: websocket dialer should use our timeouts")
+	}
+	if websocket.DefaultDialer.NetDial != nil {
+		t.Errorf("err: the default dialer shouldn't be changed")
+	}
+	if sb.rtmPing() != 20*time.Second {
+		t.Errorf("err: rtm should be pinged every keep-alive, have %s", sb.rtmPing())
+	}
+}
+
+func TestSlackReactionFeedback(t *testing.T) {
+	status := http.StatusOK
+	fs := &FakeSlackAPI{}
+	// what the message had been reacted with when the endpoint was asked
+	var asked []string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			asked = append([]string{}, fs.reactions...)
+			w.WriteHeader(status)
+		}))
+	defer srv.Close()
+	p, _ := NewPatternFromConfig(&PatternConfig{
+		RegEx: "^..deploy", Url: srv.URL, Method: "POST",
+		ReactReceived: "eyes", ReactOk: "white_check_mark", ReactError: ":x:"})
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1", api: fs}
+	sb.SetupInternals()
+	sb.usercache.CacheUser(&SlackUser{Id: "U2", Nick: "bob"})
+	td := &TestDispatch{}
+	pool, _ := NewSubmitPool(1, 5, "")
+	defer pool.Close()
+	p.setWorkers(pool)
+	submit := func(channel string, ts string) {
+		msg := slackMsg("U2", channel, "..deploy")
+		msg.Timestamp = ts
+		sb.handleMessage(msg, td)
+		asked := td.lastbroadcast
+		// the only worker's busy, the match has to wait its turn
+		release := make(chan bool)
+		pool.Do(func() { <-release })
+		feedback := NewFeedback(1)
+		p.Handle(asked, feedback)
+		if have := fs.reactions[len(fs.reactions)-1]; have != "eyes "+channel+" "+ts {
+			t.Errorf("err: expected the received reaction while queued, have %s", have)
+		}
+		done := make(chan bool)
+		pool.Do(func() { close(done) })
+		close(release)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("err: match never submitted")
+		}
+		if feedback.Depth() != 0 {
+			t.Errorf("err: an empty answer shouldn't get a text reply")
+		}
+	}
+
+	submit("C1", "100.1")
+	if strings.Join(asked, "|") != "eyes C1 100.1" {
+		t.Errorf("err: expected the received reaction before asking, have %v", asked)
+	}
+	status = http.StatusBadGateway
+	submit("D9", "100.2")
+	want := []string{"eyes C1 100.1", "white_check_mark C1 100.1",
+		"eyes D9 100.2", "x D9 100.2"}
+	if strings.Join(fs.reactions, "|") != strings.Join(want, "|") {
+		t.Errorf("err: reactions have %v wanted %v", fs.reactions, want)
+	}
+	if err := sb.React(&Event{Origin: sb}, "x"); err == nil {
+		t.Errorf("err: an event without a message id can't be reacted to")
+	}
+}
+
+func TestSlackMetadata(t *testing.T) {
+	fs := &FakeSlackAPI{}
+	sb := &SlackBroker{chanid: "C1", mybotid: "B1", api: fs}
+	sb.SetupInternals()
+	sb.post(&Event{Origin: &FakeBroker{}, Actor: "bob", Text: "hi", MessageId: "m1"})
+	sb.post(&Event{Origin: sb, Actor: "bob", Text: "answering ourselves"})
+	if len(fs.metadata) != 2 {
+		t.Fatalf("err: expected two posts, have %d", len(fs.metadata))
+	}
+	if origin, id, ok := fs.metadata[0].Bridged(); !ok || origin != "faker" || id != "m1" {
+		t.Errorf("err: expected metadata from faker m1, have %+v", fs.metadata[0])
+	}
+	if _, _, ok := fs.metadata[1].Bridged(); ok {
+		t.Errorf("err: our own events aren't bridged")
+	}
+
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm
+			w.Write([]byte(`{"ok": true, "channel": "C1", "ts": "1.2"}`))
+		}))
+	defer srv.Close()
+	sc := newSlackClient("xoxb-1", srv.Client())
+	sc.apiUrl = srv.URL + "/"
+	_, ts, err := sc.PostMetadata("C1", fs.metadata[0], libsl.MsgOptionText("hi", false))
+	if err != nil || ts != "1.2" {
+		t.Fatalf("err: posting %s %s", ts, err)
+	}
+	if form.Get("text") != "hi" || form.Get("channel") != "C1" {
+		t.Errorf("err: message not sent %v", form)
+	}
+	md, err := SlackMetadataOf(json.RawMessage(
+		`{"type": "message", "text": "hi", "metadata": ` + form.Get("metadata") + `}`))
+	if origin, id, ok := md.Bridged(); err != nil || !ok || origin != "faker" || id != "m1" {
+		t.Errorf("err: metadata not read back %+v %s", md, err)
+	}
+	if md, _ := SlackMetadataOf(json.RawMessage(`{"text": "hi"}`)); md != nil {
+		t.Errorf("err: expected no metadata, have %+v", md)
+	}
+
+	// messages a smug bridged, and edits to them, aren't bridged again
+	sb.usercache.CacheUser(&SlackUser{Id: "U1", Nick: "alice"})
+	meta := `"metadata": ` + form.Get("metadata")
+	events := make(chan libsl.RTMEvent, 3)
+	for _, raw := range []string{
+		`{"type": "message", "channel": "C1", "user": "U1", "text": "bridged", ` + meta + `}`,
+		`{"type": "message", "subtype": "message_changed", "channel": "C1",
+			"message": {"user": "U1", "text": "bridged edit", ` + meta + `},
+			"previous_message": {"user": "U1", "text": "bridged"}}`,
+		`{"type": "message", "channel": "C1", "user": "U1", "text": "typed"}`,
+	} {
+		events <- libsl.RTMEvent{Type: "message", Data: rtmMessage(t, raw)}
+	}
+	close(events)
+	sb.BridgeEdits(true)
+	td := &TestDispatch{}
+	sb.handleEvents(events, td)
+	if len(td.broadcasts) != 1 || td.broadcasts[0].Text != "typed" {
+		t.Errorf("err: expected only what was typed bridged, have %+v", td.broadcasts)
+	}
+}
+
+func TestSlackClientErrors(t *testing.T) {
+	var status int
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+	defer srv.Close()
+	sc := newSlackClient("xoxb-1", srv.Client())
+	sc.apiUrl = srv.URL + "/"
+	post := func() error {
+		_, _, err := sc.PostMetadata("C1", nil, libsl.MsgOptionText("hi", false))
+		return err
+	}
+
+	// the same errors the lib gives for its own calls
+	status, body = http.StatusOK, `{"ok": false, "error": "invalid_blocks"}`
+	if err := post(); err == nil || err.Error() != "invalid_blocks" || !slackBlocksRefused(err) {
+		t.Errorf("err: expected invalid_blocks, have %v", err)
+	}
+	status, body = http.StatusTooManyRequests, `{"ok": false, "error": "ratelimited"}`
+	var limited *libsl.RateLimitedError
+	if err := post(); !errors.As(err, &limited) || limited.RetryAfter != 3*time.Second {
+		t.Errorf("err: expected a rate limited error, have %v", err)
+	}
+	if err := sc.callApi("usergroups.list", url.Values{}, &struct{}{}); !errors.As(err, &limited) {
+		t.Errorf("err: expected api calls rate limited too, have %v", err)
+	}
+	status, body = http.StatusBadGateway, "<html>"
+	if err := post(); err == nil || err.Error() != "slack server error: 502 Bad Gateway" {
+		t.Errorf("err: expected a server error, have %v", err)
+	}
+}
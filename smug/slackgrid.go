@@ -0,0 +1,110 @@
+// slack enterprise grid
+// on grid a token may be org wide, and the people and channels it sees can
+// belong to any workspace in the org.  list methods then need to be told
+// which workspace to list with team_id, which the slack lib we vendor can't
+// pass, so those calls are made here directly.  users are looked up by id
+// as usual, users.info resolves them across the org.
+
+package smug
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	libsl "github.com/slack-go/slack"
+)
+
+// channels fetched per conversations.list page
+const slackGridPageSize = 200
+
+// calls method with vals, decoding what slack answers into out
+func (sc *slackClient) callApi(method string, vals url.Values, out interface{}) error {
+	vals.Set("token", sc.token)
+	resp, err := sc.http.PostForm(sc.apiUrl+method, vals)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := slackStatusError(resp); err != nil {
+		return err
+	}
+	body, err := ReadLimited(resp.Body, DefaultMaxBodySize)
+	if err != nil {
+		return err
+	}
+	var status struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return fmt.Errorf("%s: %s", resp.Status, err)
+	}
+	if !status.Ok {
+		return errors.New(status.Error)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// the public and private channels in workspace team, all pages of them
+func (sc *slackClient) GetTeamChannels(team string) ([]libsl.Channel, error) {
+	channels := []libsl.Channel{}
+	cursor := ""
+	for {
+		vals := url.Values{
+			"team_id":          {team},
+			"types":            {"public_channel,private_channel"},
+			"exclude_archived": {"true"},
+			"limit":            {fmt.Sprint(slackGridPageSize)},
+		}
+		if cursor != "" {
+			vals.Set("cursor", cursor)
+		}
+		var page struct {
+			Channels []libsl.Channel `json:"channels"`
+			Meta     struct {
+				NextCursor string `json:"next_cursor"`
+			} `json:"response_metadata"`
+		}
+		if err := sc.callApi("conversations.list", vals, &page); err != nil {
+			return nil, err
+		}
+		channels = append(channels, page.Channels...)
+		if cursor = page.Meta.NextCursor; cursor == "" {
+			return channels, nil
+		}
+	}
+}
+
+// the user groups in workspace team
+func (sc *slackClient) GetTeamUserGroups(team string) ([]libsl.UserGroup, error) {
+	var groups struct {
+		UserGroups []libsl.UserGroup `json:"usergroups"`
+	}
+	err := sc.callApi("usergroups.list", url.Values{"team_id": {team}}, &groups)
+	return groups.UserGroups, err
+}
+
+// for an org wide token on enterprise grid, with channels and user groups
+// listed from workspace team.  blank uses the workspace auth.test reports.
+// call before Setup, which finds the channel
+func (sb *SlackBroker) EnterpriseGrid(team string) {
+	sb.enterprise = true
+	sb.teamId = team
+}
+
+// the channels our channel is looked for in
+func (sb *SlackBroker) listChannels() ([]libsl.Channel, error) {
+	if sb.enterprise {
+		return sb.api.GetTeamChannels(sb.teamId)
+	}
+	return sb.api.GetChannels(false)
+}
+
+func (sb *SlackBroker) listUserGroups() ([]libsl.UserGroup, error) {
+	if sb.enterprise {
+		return sb.api.GetTeamUserGroups(sb.teamId)
+	}
+	return sb.api.GetUserGroups()
+}
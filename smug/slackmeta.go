@@ -0,0 +1,154 @@
+// slack message metadata
+// everything we bridge into slack is tagged with metadata naming the broker
+// it came from and the id of the message there.  that lets other tools, and
+// later us, tell bridged messages apart from what people typed, and match
+// them up with their source.  we don't bridge messages carrying it again,
+// whichever smug put them there.  the slack lib we vendor predates metadata,
+// so posts carrying it are sent here directly, and it's read from rtm
+// messages as they're decoded, see slackRichMessage.
+
+package smug
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	libsl "github.com/slack-go/slack"
+)
+
+// event_type of the metadata on bridged messages
+const slackBridgedEvent = "smug_bridged"
+
+// what slack keeps alongside a message, as metadata
+type SlackMetadata struct {
+	EventType    string            `json:"event_type"`
+	EventPayload map[string]string `json:"event_payload"`
+}
+
+// the metadata for ev bridged to slack, nil for events that didn't come from
+// another broker
+func bridgeMetadata(ev *Event, sb *SlackBroker) *SlackMetadata {
+	if ev.Origin == nil || ev.Origin == sb {
+		return nil
+	}
+	payload := map[string]string{"origin": deadLetterTarget(ev.Origin)}
+	if ev.MessageId != "" {
+		payload["message_id"] = ev.MessageId
+	}
+	return &SlackMetadata{EventType: slackBridgedEvent, EventPayload: payload}
+}
+
+// reads the metadata back out of a message as slack sends it, nil when it
+// has none
+func SlackMetadataOf(raw json.RawMessage) (*SlackMetadata, error) {
+	var msg struct {
+		Metadata *SlackMetadata `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, err
+	}
+	return msg.Metadata, nil
+}
+
+// the broker and message id md says a message was bridged from, ok is false
+// for messages that weren't
+func (md *SlackMetadata) Bridged() (origin string, id string, ok bool) {
+	if md == nil || md.EventType != slackBridgedEvent {
+		return "", "", false
+	}
+	return md.EventPayload["origin"], md.EventPayload["message_id"], true
+}
+
+// the slack client, plus posting with metadata
+type slackClient struct {
+	*libsl.Client
+	token  string
+	apiUrl string
+	http   *http.Client
+}
+
+func newSlackClient(token string, client *http.Client, opts ...libsl.Option) *slackClient {
+	opts = append(opts, libsl.OptionHTTPClient(client))
+	return &slackClient{
+		Client: libsl.New(token, opts...),
+		token:  token,
+		apiUrl: libsl.APIURL,
+		http:   client,
+	}
+}
+
+// sends a message made from opts to channel with md attached.  opts decide
+// the method as they do for the lib, so with MsgOptionSchedule or
+// MsgOptionUpdate this schedules or edits.  a nil md is sent as usual
+func (sc *slackClient) PostMetadata(
+	channel string, md *SlackMetadata, opts ...libsl.MsgOption,
+) (string, string, error) {
+	endpoint, vals, err := libsl.UnsafeApplyMsgOptions(
+		sc.token, channel, sc.apiUrl, opts...)
+	if err != nil {
+		return "", "", err
+	}
+	if md != nil {
+		encoded, err := json.Marshal(md)
+		if err != nil {
+			return "", "", err
+		}
+		vals.Set("metadata", string(encoded))
+	}
+	return sc.postForm(endpoint, vals)
+}
+
+func (sc *slackClient) postForm(endpoint string, vals url.Values) (string, string, error) {
+	resp, err := sc.http.PostForm(endpoint, vals)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if err := slackStatusError(resp); err != nil {
+		return "", "", err
+	}
+	body, err := ReadLimited(resp.Body, DefaultMaxBodySize)
+	if err != nil {
+		return "", "", err
+	}
+	var posted struct {
+		Ok      bool   `json:"ok"`
+		Error   string `json:"error"`
+		Channel string `json:"channel"`
+		Ts      string `json:"ts"`
+		// for scheduled messages, instead of ts
+		ScheduledId string `json:"scheduled_message_id"`
+	}
+	if err := json.Unmarshal(body, &posted); err != nil {
+		return "", "", fmt.Errorf("%s: %s", resp.Status, err)
+	}
+	if !posted.Ok {
+		return "", "", errors.New(posted.Error)
+	}
+	if posted.Ts == "" {
+		posted.Ts = posted.ScheduledId
+	}
+	return posted.Channel, posted.Ts, nil
+}
+
+// the error the slack lib makes of a response that isn't a 200, nil for one
+// that is, so our calls fail the same way as the lib's.  being rate limited
+// is a *libsl.RateLimitedError
+func slackStatusError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retry, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
+		if err != nil {
+			return err
+		}
+		return &libsl.RateLimitedError{RetryAfter: time.Duration(retry) * time.Second}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack server error: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// slack socket mode
+// slash commands and button presses don't come over rtm.  with an app level
+// token (xapp-...) slack will hand them to us over a socket mode connection
+// instead, as envelopes we ack by id.  each becomes a command event from the
+// user, so the pattern router and local commands can answer it like anything
+// typed in the channel.  the slack lib we vendor predates socket mode so the
+// protocol is spoken here directly.
+
+package smug
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	libsl "github.com/slack-go/slack"
+)
+
+const slackConnectionsOpen = "https://slack.com/api/apps.connections.open"
+
+// what socket mode sends us.  payload depends on type
+type SlackEnvelope struct {
+	EnvelopeId string          `json:"envelope_id"`
+	Type       string          `json:"type"`
+	Payload    json.RawMessage `json:"payload"`
+	// for type disconnect, eg refresh_requested
+	Reason string `json:"reason"`
+}
+
+type slackSocket interface {
+	// the next envelope, an error once the connection is done
+	Read() (*SlackEnvelope, error)
+	Ack(envelopeId string) error
+	Close() error
+}
+
+// opens a new socket mode connection.  swapped out in tests
+type socketConnector func() (slackSocket, error)
+
+// a websocket to socket mode, from the url apps.connections.open gives the
+// app token
+type wsSlackSocket struct {
+	conn *websocket.Conn
+	// writes can come from both the reader and Close
+	wmux sync.Mutex
+}
+
+func slackSocketMode(
+	appToken string, openUrl string, client *http.Client, dialer *websocket.Dialer,
+) socketConnector {
+	return func() (slackSocket, error) {
+		req, err := http.NewRequest("POST", openUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+appToken)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := ReadLimited(resp.Body, DefaultMaxBodySize)
+		if err != nil {
+			return nil, err
+		}
+		var opened struct {
+			Ok    bool   `json:"ok"`
+			Error string `json:"error"`
+			Url   string `json:"url"`
+		}
+		if err := json.Unmarshal(body, &opened); err != nil {
+			return nil, err
+		}
+		if !opened.Ok {
+			return nil, fmt.Errorf("apps.connections.open: %s", opened.Error)
+		}
+		conn, _, err := dialer.Dial(opened.Url, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &wsSlackSocket{conn: conn}, nil
+	}
+}
+
+func (ws *wsSlackSocket) Read() (*SlackEnvelope, error) {
+	env := &SlackEnvelope{}
+	if err := ws.conn.ReadJSON(env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func (ws *wsSlackSocket) Ack(envelopeId string) error {
+	ws.wmux.Lock()
+	defer ws.wmux.Unlock()
+	return ws.conn.WriteJSON(map[string]string{"envelope_id": envelopeId})
+}
+
+func (ws *wsSlackSocket) Close() error {
+	return ws.conn.Close()
+}
+
+// take slash commands and interactions over socket mode with appToken, an
+// app level token with the connections:write scope
+func (sb *SlackBroker) SocketMode(appToken string) error {
+	if !strings.HasPrefix(appToken, "xapp-") {
+		return fmt.Errorf("socket mode needs an app level token, xapp-...")
+	}
+	sb.socket = slackSocketMode(appToken, slackConnectionsOpen,
+		sb.timeouts.HttpClient(), sb.wsDialer())
+	return nil
+}
+
+// runs socket mode connections until Deactivate, reconnecting with the same
+// backoff as rtm
+func (sb *SlackBroker) runSocket(dis Dispatcher) {
+	backoff := rtmBackoffMin
+	for {
+		started := time.Now()
+		sock, err := sb.socket()
+		if err != nil {
+			sb.log.Warnf("ERR opening socket mode: %s", err)
+		} else {
+			sb.msgsMux.Lock()
+			sb.socketClose = sock.Close
+			sb.msgsMux.Unlock()
+			sb.readSocket(sock, dis)
+			sock.Close()
+		}
+		select {
+		case <-sb.done:
+			return
+		default:
+		}
+		if time.Since(started) > rtmBackoffMax {
+			backoff = rtmBackoffMin
+		}
+		sb.log.Warnf("socket mode closed, reconnecting in %s", backoff)
+		select {
+		case <-sb.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > rtmBackoffMax {
+			backoff = rtmBackoffMax
+		}
+	}
+}
+
+// handles envelopes until the connection closes or slack asks us to
+// reconnect
+func (sb *SlackBroker) readSocket(sock slackSocket, dis Dispatcher) {
+	for {
+		env, err := sock.Read()
+		if err != nil {
+			return
+		}
+		if env.Type == "disconnect" {
+			sb.log.Infof("socket mode disconnect: %s", env.Reason)
+			return
+		}
+		sb.handleEnvelope(env, sock, dis)
+	}
+}
+
+// acks env, as slack wants within 3 seconds, then broadcasts the command
+// it carries
+func (sb *SlackBroker) handleEnvelope(env *SlackEnvelope, sock slackSocket, dis Dispatcher) {
+	if env.EnvelopeId != "" {
+		if err := sock.Ack(env.EnvelopeId); err != nil {
+			sb.log.Warnf("ERR acking %s: %s", env.EnvelopeId, err)
+		}
+	}
+	var ev *Event
+	switch env.Type {
+	case "hello":
+		sb.log.Infof("socket mode connected")
+		return
+	case "slash_commands":
+		var cmd libsl.SlashCommand
+		if err := json.Unmarshal(env.Payload, &cmd); err != nil {
+			sb.log.Warnf("ERR parsing slash command: %s", err)
+			return
+		}
+		ev = sb.slashEvent(&cmd)
+	case "interactive":
+		var cb libsl.InteractionCallback
+		if err := json.Unmarshal(env.Payload, &cb); err != nil {
+			sb.log.Warnf("ERR parsing interaction: %s", err)
+			return
+		}
+		ev = sb.interactionEvent(&cb)
+	default:
+		sb.log.Debugf("ignoring socket mode %s", env.Type)
+		return
+	}
+	if ev == nil || sb.ignore.Ignored(ev.Actor) {
+		return
+	}
+	sb.msgsMux.Lock()
+	sb.metrics.sent(ev)
+	sb.msgsMux.Unlock()
+	dis.Broadcast(ev)
+}
+
+// an event from userId in channel, answered there if it's not ours
+func (sb *SlackBroker) commandEvent(userId string, channel string, text string) *Event {
+	ev := &Event{
+		Origin:  sb,
+		Actor:   sb.usercache.UserNick(sb, userId, false),
+		ActorId: userId,
+		Text:    text,
+		RawText: text,
+		ts:      time.Now(),
+	}
+	if channel != "" && channel != sb.chanid {
+		ev.ReplyBroker = sb
+		ev.ReplyTarget = channel
+		ev.Private = isDirectChannel(channel)
+	}
+	return ev
+}
+
+// /weather pdx arrives as ..weather pdx
+func (sb *SlackBroker) slashEvent(cmd *libsl.SlashCommand) *Event {
+	name := strings.TrimPrefix(cmd.Command, "/")
+	if name == "" {
+		return nil
+	}
+	text := strings.TrimSpace(Prefix + name + " " + cmd.Text)
+	return sb.commandEvent(cmd.UserID, cmd.ChannelID, text)
+}
+
+// a button or menu's value is the text, eg a button valued "..deploy prod"
+func (sb *SlackBroker) interactionEvent(cb *libsl.InteractionCallback) *Event {
+	var text string
+	for _, a := range cb.ActionCallback.BlockActions {
+		if text = a.Value; text == "" {
+			text = a.SelectedOption.Value
+		}
+		if text != "" {
+			break
+		}
+	}
+	for _, a := range cb.ActionCallback.AttachmentActions {
+		if text != "" {
+			break
+		}
+		text = a.Value
+	}
+	if text == "" {
+		return nil
+	}
+	return sb.commandEvent(cb.User.ID, cb.Channel.ID, text)
+}
@@ -0,0 +1,450 @@
+// broker: sqlite
+// archives every event it sees into a sqlite database and offers simple
+// lookups (by actor, time range, substring) via Query and optionally a small
+// read-only http endpoint.  writes are queued and batched so archiving never
+// blocks the dispatcher.
+//
+// NOTE sqlite support requires building with cgo, the driver is only built
+// in with it.  without it, Setup fails.
+
+package smug
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBroker("sqlite", func() Broker { return &SqliteBroker{} })
+}
+
+const (
+	archiveQueueSize = 1000
+	archiveBatchSize = 100
+	archiveFlush     = time.Second
+	archiveMaxRows   = 1000
+	defaultReplayMax = 100
+	// how long a replay waits for its target broker to show up
+	replayWait = 30 * time.Second
+)
+
+// each entry upgrades the schema by one version. only ever append here
+var archiveMigrations = []string{
+	`CREATE TABLE events (
+		id     INTEGER PRIMARY KEY AUTOINCREMENT,
+		origin TEXT NOT NULL,
+		actor  TEXT NOT NULL,
+		text   TEXT NOT NULL,
+		ts     INTEGER NOT NULL,
+		blocks TEXT
+	)`,
+	`CREATE INDEX events_actor_ts ON events (actor, ts)`,
+	`CREATE INDEX events_ts ON events (ts)`,
+	`ALTER TABLE events ADD COLUMN private INTEGER NOT NULL DEFAULT 0`,
+}
+
+type ArchivedEvent struct {
+	Origin string        `json:"origin"`
+	Actor  string        `json:"actor"`
+	Text   string        `json:"text"`
+	Ts     time.Time     `json:"ts"`
+	Blocks []*EventBlock `json:"blocks,omitempty"`
+	// a direct message to, or reply from, the bot
+	Private bool `json:"private,omitempty"`
+}
+
+// zero values are ignored when filtering
+type ArchiveQuery struct {
+	Actor    string
+	Since    time.Time
+	Until    time.Time
+	Contains string
+	Limit    int
+	// keep the newest matches rather than the oldest when limited
+	Latest bool
+	// include private events, they're left out otherwise
+	Private bool
+}
+
+type archiveReplay struct {
+	since  time.Duration
+	target string
+	max    int
+}
+
+type SqliteBroker struct {
+	log    *Logger
+	db     *sql.DB
+	path   string
+	listen string
+	queue  chan *Event
+	// set by Deactivate, nothing more is queued
+	closed  bool
+	replay  *archiveReplay
+	wg      sync.WaitGroup
+	mux     sync.RWMutex
+	metrics Metrics
+	// leave out events from the inject endpoint
+	skipInjected bool
+}
+
+func (sb *SqliteBroker) Name() string {
+	return fmt.Sprintf("sqlite-%s", sb.path)
+}
+
+func (sb *SqliteBroker) logger() *Logger { return sb.log }
+
+func (sb *SqliteBroker) Heartbeat() bool {
+	sb.mux.Lock()
+	m := sb.metrics
+	sb.metrics = Metrics{}
+	sb.mux.Unlock()
+	sb.log.logMetrics(m)
+	return sb.db != nil
+}
+
+// args [dbpath, listen addr]
+func (sb *SqliteBroker) Setup(args ...string) error {
+	sb.path = args[0]
+	if len(args) > 1 {
+		sb.listen = args[1]
+	}
+	sb.log = NewLogger("broker", DisplayName(sb))
+	if sqliteDriver == "" {
+		return fmt.Errorf("opening archive %s: smug was built without cgo", sb.path)
+	}
+	sb.queue = make(chan *Event, archiveQueueSize)
+	sb.closed = false
+	db, err := sql.Open(sqliteDriver, sb.path)
+	if err == nil {
+		// sqlite only really wants one writer
+		db.SetMaxOpenConns(1)
+		err = migrateArchive(db)
+	}
+	if err != nil {
+		return fmt.Errorf("opening archive %s: %s", sb.path, err)
+	}
+	sb.db = db
+	sb.wg.Add(1)
+	go sb.writer()
+	return nil
+}
+
+func (sb *SqliteBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	if cfg.Path == "" {
+		return fmt.Errorf("sqlite broker path must not be blank")
+	}
+	if cfg.ReplaySince != "" {
+		since, err := time.ParseDuration(cfg.ReplaySince)
+		if err != nil {
+			return fmt.Errorf("invalid replay-since %s", cfg.ReplaySince)
+		}
+		if err := sb.Replay(since, cfg.ReplayTarget, cfg.ReplayMax); err != nil {
+			return err
+		}
+	}
+	sb.SkipInjected(cfg.SkipInjected)
+	return sb.Setup(cfg.Path, cfg.Listen)
+}
+
+// don't archive injected events, which nobody actually said
+func (sb *SqliteBroker) SkipInjected(skip bool) {
+	sb.skipInjected = skip
+}
+
+// when activated, resend archived events newer than since to the target
+// broker, at most max (defaultReplayMax when <= 0) of the latest.  private
+// events stay in the archive
+func (sb *SqliteBroker) Replay(since time.Duration, target string, max int) error {
+	if since <= 0 {
+		return nil
+	}
+	if target == "" {
+		return fmt.Errorf("replay needs a replay-target broker")
+	}
+	if max <= 0 {
+		max = defaultReplayMax
+	}
+	sb.replay = &archiveReplay{since: since, target: target, max: max}
+	return nil
+}
+
+// brings the schema up to date, tracking where we are in schema_version
+func migrateArchive(db *sql.DB) error {
+	_, err := db.Exec(
+		`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	var version int
+	row := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`)
+	if err := row.Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(archiveMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(archiveMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", i+1, err)
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO schema_version (version) VALUES (?)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sb *SqliteBroker) HandleEvent(ev *Event, dis Dispatcher) {
+	if sb.db == nil || ev.IsReplay || (ev.IsInjected && sb.skipInjected) {
+		return
+	}
+	sb.mux.Lock()
+	defer sb.mux.Unlock()
+	if sb.closed {
+		return
+	}
+	sb.metrics.rcvd(ev)
+	select {
+	case sb.queue <- ev:
+	default:
+		sb.log.Warnf("archive queue full, dropping event from %s", ev.Actor)
+	}
+}
+
+// drains the queue, writing in batches
+func (sb *SqliteBroker) writer() {
+	defer sb.wg.Done()
+	ticker := time.NewTicker(archiveFlush)
+	defer ticker.Stop()
+	batch := []*Event{}
+	for {
+		select {
+		case ev, ok := <-sb.queue:
+			if !ok {
+				sb.insert(batch)
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) < archiveBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		sb.insert(batch)
+		batch = batch[:0]
+	}
+}
+
+func (sb *SqliteBroker) insert(evs []*Event) {
+	if len(evs) == 0 {
+		return
+	}
+	tx, err := sb.db.Begin()
+	if err != nil {
+		sb.log.Errorf("ERR archiving: %s", err)
+		return
+	}
+	stmt, err := tx.Prepare(`INSERT INTO events
+		(origin, actor, text, ts, blocks, private) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		sb.log.Errorf("ERR archiving: %s", err)
+		return
+	}
+	defer stmt.Close()
+	for _, ev := range evs {
+		origin := ""
+		if ev.Origin != nil {
+			origin = ev.Origin.Name()
+		}
+		ts := ev.ts
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		var blocks []byte
+		if len(ev.ContentBlocks) > 0 {
+			blocks, _ = json.Marshal(ev.ContentBlocks)
+		}
+		if _, err := stmt.Exec(
+			origin, ev.Actor, ev.Text, ts.UnixNano(), blocks, ev.Private); err != nil {
+			sb.log.Warnf("ERR archiving event from %s: %s", ev.Actor, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		sb.log.Errorf("ERR archiving: %s", err)
+	}
+}
+
+// returns matching events, oldest first
+func (sb *SqliteBroker) Query(q ArchiveQuery) ([]*ArchivedEvent, error) {
+	if sb.db == nil {
+		return nil, fmt.Errorf("archive not open")
+	}
+	where, args := "1=1", []interface{}{}
+	if !q.Private {
+		where += " AND private = 0"
+	}
+	if q.Actor != "" {
+		where += " AND actor = ?"
+		args = append(args, q.Actor)
+	}
+	if !q.Since.IsZero() {
+		where += " AND ts >= ?"
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where += " AND ts < ?"
+		args = append(args, q.Until.UnixNano())
+	}
+	if q.Contains != "" {
+		where += " AND instr(lower(text), lower(?)) > 0"
+		args = append(args, q.Contains)
+	}
+	limit := q.Limit
+	if limit <= 0 || limit > archiveMaxRows {
+		limit = archiveMaxRows
+	}
+	args = append(args, limit)
+	order := "ts, id"
+	if q.Latest {
+		order = "ts DESC, id DESC"
+	}
+	rows, err := sb.db.Query(
+		`SELECT origin, actor, text, ts, blocks, private FROM events WHERE `+where+
+			` ORDER BY `+order+` LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []*ArchivedEvent{}
+	for rows.Next() {
+		var ts int64
+		var blocks []byte
+		ae := &ArchivedEvent{}
+		if err := rows.Scan(
+			&ae.Origin, &ae.Actor, &ae.Text, &ts, &blocks, &ae.Private); err != nil {
+			return nil, err
+		}
+		ae.Ts = time.Unix(0, ts)
+		if len(blocks) > 0 {
+			json.Unmarshal(blocks, &ae.Blocks)
+		}
+		results = append(results, ae)
+	}
+	if q.Latest {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+	return results, rows.Err()
+}
+
+// GET ?actor=bob&since=<unix>&until=<unix>&q=lunch&limit=10
+// private events are never served
+func (sb *SqliteBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "read only", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	q := ArchiveQuery{Actor: params.Get("actor"), Contains: params.Get("q")}
+	if n, err := strconv.ParseInt(params.Get("since"), 10, 64); err == nil {
+		q.Since = time.Unix(n, 0)
+	}
+	if n, err := strconv.ParseInt(params.Get("until"), 10, 64); err == nil {
+		q.Until = time.Unix(n, 0)
+	}
+	if n, err := strconv.Atoi(params.Get("limit")); err == nil {
+		q.Limit = n
+	}
+	results, err := sb.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// resends what the archive saw recently to the replay target, oldest first.
+// only the target is sent them, routers and commands elsewhere would take
+// replayed text for something just said
+func (sb *SqliteBroker) replayTo(dis Dispatcher, wait time.Duration) {
+	rp := sb.replay
+	target := dis.FindBroker(rp.target)
+	for deadline := time.Now().Add(wait); target == nil && time.Now().Before(deadline); {
+		// brokers are added one at a time, give it a moment to show up
+		time.Sleep(time.Second)
+		target = dis.FindBroker(rp.target)
+	}
+	if target == nil {
+		sb.log.Warnf("replay target broker not found: %s", rp.target)
+		return
+	}
+	results, err := sb.Query(ArchiveQuery{
+		Since:  time.Now().Add(-rp.since),
+		Limit:  rp.max,
+		Latest: true,
+	})
+	if err != nil {
+		sb.log.Errorf("ERR replaying archive: %s", err)
+		return
+	}
+	n := 0
+	for _, ae := range results {
+		dis.BroadcastTo(&Event{
+			Origin:        sb,
+			ReplyBroker:   target,
+			IsReplay:      true,
+			Actor:         ae.Actor,
+			Text:          ae.Text,
+			ContentBlocks: ae.Blocks,
+			ts:            ae.Ts,
+		}, rp.target)
+		n++
+	}
+	sb.log.Infof("replayed %d archived events to %s", n, rp.target)
+}
+
+func (sb *SqliteBroker) Activate(dis Dispatcher) {
+	if sb.replay != nil && sb.db != nil {
+		go sb.replayTo(dis, replayWait)
+	}
+	if sb.listen == "" || sb.db == nil {
+		return
+	}
+	sb.log.Infof("archive queries listening on %s", sb.listen)
+	if err := http.ListenAndServe(sb.listen, sb); err != nil {
+		sb.log.Errorf("ERR archive http: %s", err)
+	}
+}
+
+// flushes anything queued and closes the db
+func (sb *SqliteBroker) Deactivate() {
+	if sb.db == nil {
+		return
+	}
+	sb.mux.Lock()
+	if sb.closed {
+		sb.mux.Unlock()
+		return
+	}
+	sb.closed = true
+	close(sb.queue)
+	sb.mux.Unlock()
+	sb.wg.Wait()
+	sb.db.Close()
+}
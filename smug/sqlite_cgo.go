@@ -0,0 +1,11 @@
+//go:build cgo
+// +build cgo
+
+package smug
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// the database/sql driver archives are opened with
+const sqliteDriver = "sqlite3"
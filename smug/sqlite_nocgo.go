@@ -0,0 +1,8 @@
+//go:build !cgo
+// +build !cgo
+
+package smug
+
+// go-sqlite3 needs cgo, without it there's no driver and archives fail to
+// set up
+const sqliteDriver = ""
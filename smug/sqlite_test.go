@@ -0,0 +1,183 @@
+package smug
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupArchive(t *testing.T) *SqliteBroker {
+	sb := &SqliteBroker{}
+	if err := sb.Setup(filepath.Join(t.TempDir(), "archive.db")); err != nil {
+		t.Skipf("sqlite unavailable, likely built without cgo: %s", err)
+	}
+	return sb
+}
+
+func TestArchiveQueries(t *testing.T) {
+	sb := setupArchive(t)
+	base := time.Date(2020, 3, 4, 12, 0, 0, 0, time.UTC)
+	origin := &FakeBroker{}
+	evs := []*Event{
+		{Origin: origin, Actor: "bob", Text: "who wants lunch", ts: base},
+		{Origin: origin, Actor: "alice", Text: "me!", ts: base.Add(time.Minute)},
+		{Origin: origin, Actor: "bob", Text: "LUNCH it is", ts: base.Add(time.Hour),
+			ContentBlocks: []*EventBlock{{Title: "menu"}}, Private: true},
+		{Origin: origin, Actor: "ops", Text: "lunch test", IsInjected: true},
+	}
+	sb.SkipInjected(true)
+	for _, ev := range evs {
+		sb.HandleEvent(ev, nil)
+	}
+	// flushes the queue
+	sb.Deactivate()
+	sb.Setup(sb.path)
+
+	testwants := map[string]struct {
+		q    ArchiveQuery
+		want int
+	}{
+		"all":      {ArchiveQuery{Private: true}, 3},
+		"public":   {ArchiveQuery{}, 2},
+		"actor":    {ArchiveQuery{Actor: "bob", Private: true}, 2},
+		"since":    {ArchiveQuery{Since: base.Add(time.Minute), Private: true}, 2},
+		"until":    {ArchiveQuery{Until: base.Add(time.Minute)}, 1},
+		"contains": {ArchiveQuery{Contains: "lunch", Private: true}, 2},
+		"combined": {ArchiveQuery{Actor: "bob", Since: base.Add(time.Second)}, 0},
+		"limit":    {ArchiveQuery{Limit: 1}, 1},
+	}
+	for name, tw := range testwants {
+		results, err := sb.Query(tw.q)
+		if err != nil {
+			t.Errorf("err: %s query failed %s", name, err)
+			continue
+		}
+		if len(results) != tw.want {
+			t.Errorf("err: %s have %d results wanted %d", name, len(results), tw.want)
+		}
+	}
+
+	results, _ := sb.Query(ArchiveQuery{Actor: "bob", Private: true})
+	last := results[len(results)-1]
+	if last.Origin != "faker" || !last.Ts.Equal(base.Add(time.Hour)) {
+		t.Errorf("err: archived event mangled %+v", last)
+	}
+	if len(last.Blocks) != 1 || last.Blocks[0].Title != "menu" {
+		t.Errorf("err: blocks not round tripped %+v", last.Blocks)
+	}
+	if !last.Private || results[0].Private {
+		t.Errorf("err: private flag not round tripped")
+	}
+
+	w := httptest.NewRecorder()
+	sb.ServeHTTP(w, httptest.NewRequest("GET", "/?actor=alice", nil))
+	var served []*ArchivedEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || len(served) != 1 {
+		t.Errorf("err: http query got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	sb.ServeHTTP(w, httptest.NewRequest("GET", "/?actor=bob", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || len(served) != 1 ||
+		served[0].Private {
+		t.Errorf("err: http query should leave out private events, got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	sb.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != 405 {
+		t.Errorf("err: archive http should be read only")
+	}
+	sb.Deactivate()
+}
+
+func TestArchiveMigrationsIdempotent(t *testing.T) {
+	sb := setupArchive(t)
+	defer sb.Deactivate()
+	if err := migrateArchive(sb.db); err != nil {
+		t.Errorf("err: re-running migrations %s", err)
+	}
+	var version int
+	sb.db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if version != len(archiveMigrations) {
+		t.Errorf("err: schema version %d wanted %d", version, len(archiveMigrations))
+	}
+}
+
+func TestArchiveReplay(t *testing.T) {
+	sb := setupArchive(t)
+	now := time.Now()
+	origin := &FakeBroker{}
+	for _, ev := range []*Event{
+		{Origin: origin, Actor: "bob", Text: "old news", ts: now.Add(-2 * time.Hour)},
+		{Origin: origin, Actor: "bob", Text: "deploy started", ts: now.Add(-10 * time.Minute)},
+		{Origin: origin, Actor: "alice", Text: "just us", ts: now.Add(-7 * time.Minute),
+			Private: true},
+		{Origin: origin, Actor: "alice", Text: "deploy done", ts: now.Add(-5 * time.Minute)},
+	} {
+		sb.HandleEvent(ev, nil)
+	}
+	sb.Deactivate()
+	sb.Setup(sb.path)
+	defer sb.Deactivate()
+
+	cd := &CentralDispatch{}
+	sink := &ChanBroker{events: make(chan *Event, 10)}
+	bystander := &ChanBroker{events: make(chan *Event, 10)}
+	LabelBroker(sink, &BrokerConfig{Type: "chan", Key: "sink"})
+	LabelBroker(bystander, &BrokerConfig{Type: "chan", Key: "bystander"})
+	defer func() {
+		UnlabelBroker(sink)
+		UnlabelBroker(bystander)
+	}()
+	cd.AddBroker(sink)
+	cd.AddBroker(bystander)
+	replayed := func() []string {
+		sb.replayTo(cd, 0)
+		texts := []string{}
+		for {
+			select {
+			case ev := <-sink.events:
+				if !ev.IsReplay || ev.ReplyBroker != sink {
+					t.Errorf("err: replay not marked for its target %+v", ev)
+				}
+				texts = append(texts, ev.Text)
+			case ev := <-bystander.events:
+				t.Errorf("err: replay sent beyond its target %+v", ev)
+			case <-time.After(100 * time.Millisecond):
+				sort.Strings(texts)
+				return texts
+			}
+		}
+	}
+
+	sb.Replay(30*time.Minute, "sink", 0)
+	if have := replayed(); strings.Join(have, "|") != "deploy done|deploy started" {
+		t.Errorf("err: expected only recent public events replayed %v", have)
+	}
+	sb.Replay(30*time.Minute, "sink", 1)
+	if have := replayed(); strings.Join(have, "|") != "deploy done" {
+		t.Errorf("err: expected the newest event within the bound %v", have)
+	}
+
+	// replays aren't archived again
+	sb.HandleEvent(&Event{Origin: sb, Actor: "bob", Text: "deploy done", IsReplay: true}, nil)
+	sb.Deactivate()
+	sb.Setup(sb.path)
+	if results, _ := sb.Query(ArchiveQuery{Contains: "deploy done"}); len(results) != 1 {
+		t.Errorf("err: replayed event archived again %d", len(results))
+	}
+	if err := sb.Replay(time.Minute, "", 0); err == nil {
+		t.Errorf("err: replay without a target should fail")
+	}
+}
+
+func TestArchiveAfterDeactivate(t *testing.T) {
+	sb := setupArchive(t)
+	sb.Deactivate()
+	// sends still in flight when we're removed are dropped
+	sb.HandleEvent(&Event{Origin: &FakeBroker{}, Actor: "bob", Text: "late"}, nil)
+	sb.Deactivate()
+}
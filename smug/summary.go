@@ -0,0 +1,199 @@
+// metrics summary
+// every broker logs a heartbeat of its own, which adds up to a lot of lines.
+// a MetricsSummary collects those heartbeats, along with who's been talking
+// and what's been failing, and logs one line across all brokers each
+// interval.
+
+package smug
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// talkers named in each summary
+const summaryTopTalkers = 5
+
+// a broker whose heartbeat metrics can be summarized, those it logs with
+// logMetrics on its logger
+type meteredBroker interface {
+	logger() *Logger
+}
+
+type MetricsSummary struct {
+	mux sync.Mutex
+	log *Logger
+	// heartbeat metrics added up per broker
+	brokers map[Broker]*Metrics
+	// failed heartbeats and dead letters per broker
+	errors map[Broker]int64
+	// broadcasts per actor
+	talkers map[string]int64
+	since   time.Time
+	// stops Every
+	stop     chan bool
+	stopOnce sync.Once
+}
+
+func NewMetricsSummary() *MetricsSummary {
+	return &MetricsSummary{
+		log:     NewLogger("ctx", "summary"),
+		brokers: make(map[Broker]*Metrics),
+		errors:  make(map[Broker]int64),
+		talkers: make(map[string]int64),
+		since:   time.Now(),
+		stop:    make(chan bool),
+	}
+}
+
+func (ms *MetricsSummary) record(broker Broker, m Metrics) {
+	if ms == nil {
+		return
+	}
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	sum := ms.brokers[broker]
+	if sum == nil {
+		sum = &Metrics{}
+		ms.brokers[broker] = sum
+	}
+	sum.Rcvd += m.Rcvd
+	sum.Sent += m.Sent
+	sum.BytesRcvd += m.BytesRcvd
+	sum.BytesSent += m.BytesSent
+}
+
+func (ms *MetricsSummary) failed(broker Broker) {
+	if ms == nil {
+		return
+	}
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	ms.errors[broker]++
+}
+
+// counts what people say, not command output, presence or topics
+func (ms *MetricsSummary) talked(ev *Event) {
+	if ms == nil || ev.Actor == "" || ev.IsCmdOutput || ev.Presence != "" ||
+		ev.IsTopic || ev.IsReplay {
+		return
+	}
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	ms.talkers[ev.Actor]++
+}
+
+// one interval's worth, see Take
+type Summary struct {
+	Brokers int
+	Totals  Metrics
+	Errors  int64
+	// by broker key, or name for brokers not built from config.  only those
+	// with any
+	ErrorsBy map[string]int64
+	// most first, at most summaryTopTalkers
+	TopTalkers []Talker
+	Interval   time.Duration
+}
+
+type Talker struct {
+	Actor string
+	Count int64
+}
+
+// what's been collected since the last Take, starting afresh
+func (ms *MetricsSummary) Take() *Summary {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	now := time.Now()
+	s := &Summary{
+		Brokers:  len(ms.brokers),
+		ErrorsBy: make(map[string]int64),
+		Interval: now.Sub(ms.since),
+	}
+	for _, m := range ms.brokers {
+		s.Totals.Rcvd += m.Rcvd
+		s.Totals.Sent += m.Sent
+		s.Totals.BytesRcvd += m.BytesRcvd
+		s.Totals.BytesSent += m.BytesSent
+	}
+	for b, n := range ms.errors {
+		s.Errors += n
+		s.ErrorsBy[deadLetterTarget(b)] += n
+	}
+	for actor, n := range ms.talkers {
+		s.TopTalkers = append(s.TopTalkers, Talker{actor, n})
+	}
+	sort.Slice(s.TopTalkers, func(i, j int) bool {
+		ti, tj := s.TopTalkers[i], s.TopTalkers[j]
+		return ti.Count > tj.Count || (ti.Count == tj.Count && ti.Actor < tj.Actor)
+	})
+	if len(s.TopTalkers) > summaryTopTalkers {
+		s.TopTalkers = s.TopTalkers[:summaryTopTalkers]
+	}
+	ms.brokers = make(map[Broker]*Metrics)
+	ms.errors = make(map[Broker]int64)
+	ms.talkers = make(map[string]int64)
+	ms.since = now
+	return s
+}
+
+// logs a summary of everything since the last one
+func (ms *MetricsSummary) Log() {
+	s := ms.Take()
+	secs := s.Interval.Seconds()
+	talkers := []string{}
+	for _, t := range s.TopTalkers {
+		talkers = append(talkers, fmt.Sprintf("%s=%d", t.Actor, t.Count))
+	}
+	failing := []string{}
+	for b, n := range s.ErrorsBy {
+		failing = append(failing, fmt.Sprintf("%s=%d", b, n))
+	}
+	sort.Strings(failing)
+	ms.log.WithFields(log.Fields{
+		"brokers":       s.Brokers,
+		"rcvd":          s.Totals.Rcvd,
+		"sent":          s.Totals.Sent,
+		"rcvd_bytes":    s.Totals.BytesRcvd,
+		"sent_bytes":    s.Totals.BytesSent,
+		"rcvd_per_sec":  perSec(s.Totals.Rcvd, secs),
+		"sent_per_sec":  perSec(s.Totals.Sent, secs),
+		"errors":        s.Errors,
+		"errors_by":     strings.Join(failing, " "),
+		"top_talkers":   strings.Join(talkers, " "),
+		"interval_secs": secs,
+	}).Info("summary")
+}
+
+// logs a summary every interval until Stop
+func (ms *MetricsSummary) Every(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case <-ms.stop:
+					// both were ready, stopping wins
+					return
+				default:
+				}
+				ms.Log()
+			case <-ms.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stops logging summaries, safe to call more than once
+func (ms *MetricsSummary) Stop() {
+	ms.stopOnce.Do(func() { close(ms.stop) })
+}
@@ -0,0 +1,100 @@
+package smug
+
+import (
+	"testing"
+	"time"
+)
+
+// MeteredBroker reports fixed metrics each heartbeat
+type MeteredBroker struct {
+	FakeBroker
+	log  *Logger
+	m    Metrics
+	fail bool
+}
+
+func (mb *MeteredBroker) logger() *Logger { return mb.log }
+
+func (mb *MeteredBroker) Heartbeat() bool {
+	mb.log.logMetrics(mb.m)
+	return !mb.fail
+}
+
+func TestMetricsSummary(t *testing.T) {
+	cd := &CentralDispatch{log: NewLogger("ctx", "test")}
+	ms := NewMetricsSummary()
+	cd.Summarize(ms)
+	// another dispatcher's summary doesn't take our heartbeats
+	other := &CentralDispatch{log: NewLogger("ctx", "test")}
+	otherMs := NewMetricsSummary()
+	other.Summarize(otherMs)
+
+	metered := Metrics{}
+	kind := registerTestBroker(t, "metered", func() Broker {
+		return &MeteredBroker{log: NewLogger("broker", "faker"), m: metered}
+	})
+	metered = Metrics{Rcvd: 3, Sent: 2, BytesRcvd: 30, BytesSent: 20}
+	irc, _ := NewBrokerFromConfig(&BrokerConfig{Key: "irc", Type: kind})
+	metered = Metrics{Rcvd: 5, Sent: 7, BytesRcvd: 50, BytesSent: 70}
+	slack, _ := NewBrokerFromConfig(&BrokerConfig{Key: "slack", Type: kind})
+	slack.(*MeteredBroker).fail = true
+	cd.AddBroker(irc)
+	cd.AddBroker(slack)
+	cd.Heartbeat()
+	cd.Heartbeat()
+
+	for _, actor := range []string{"ann", "bob", "ann", "cy", "ann", "bob"} {
+		cd.Broadcast(&Event{Origin: irc, Actor: actor, Text: "hi"})
+	}
+	cd.Broadcast(&Event{Origin: irc, Actor: "bot", Text: "pong", IsCmdOutput: true})
+
+	s := ms.Take()
+	if s.Brokers != 2 {
+		t.Errorf("err: expected 2 brokers, have %d", s.Brokers)
+	}
+	want := Metrics{Rcvd: 16, Sent: 18, BytesRcvd: 160, BytesSent: 180}
+	if s.Totals != want {
+		t.Errorf("err: totals have %+v wanted %+v", s.Totals, want)
+	}
+	// both are called faker, they're told apart by key
+	if s.Errors != 2 || s.ErrorsBy["slack"] != 2 || len(s.ErrorsBy) != 1 {
+		t.Errorf("err: expected 2 failed heartbeats, have %d %v", s.Errors, s.ErrorsBy)
+	}
+	talkers := []Talker{{"ann", 3}, {"bob", 2}, {"cy", 1}}
+	if len(s.TopTalkers) != len(talkers) {
+		t.Fatalf("err: top talkers have %v wanted %v", s.TopTalkers, talkers)
+	}
+	for i, talker := range talkers {
+		if s.TopTalkers[i] != talker {
+			t.Errorf("err: top talkers have %v wanted %v", s.TopTalkers, talkers)
+		}
+	}
+
+	if s = ms.Take(); s.Brokers != 0 || s.Totals.Rcvd != 0 || len(s.TopTalkers) != 0 {
+		t.Errorf("err: a summary should start afresh, have %+v", s)
+	}
+	if s = otherMs.Take(); s.Brokers != 0 || s.Errors != 0 {
+		t.Errorf("err: another dispatcher's summary shouldn't collect ours, have %+v", s)
+	}
+	cd.Summarize(nil)
+	cd.Heartbeat()
+	if s = ms.Take(); s.Brokers != 0 {
+		t.Errorf("err: heartbeats shouldn't be collected once unset")
+	}
+}
+
+func TestMetricsSummaryStop(t *testing.T) {
+	ms := NewMetricsSummary()
+	ms.Every(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	ms.Stop()
+	ms.Stop()
+	// a summary already being logged finishes
+	time.Sleep(5 * time.Millisecond)
+	// nothing's logged or taken once stopped, so what's collected stays put
+	ms.talked(&Event{Actor: "ann", Text: "hi"})
+	time.Sleep(5 * time.Millisecond)
+	if s := ms.Take(); len(s.TopTalkers) != 1 {
+		t.Errorf("err: expected summaries stopped, have %+v", s)
+	}
+}
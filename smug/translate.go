@@ -0,0 +1,232 @@
+// translation
+// a Translator is a transform (see AddTransform) that runs what a broker
+// brings in through a LibreTranslate style api.  when the api detects a
+// language other than the target the translation is appended to, or takes
+// the place of, the original text, marked with where it came from.  once
+// started the api is asked from a goroutine of its own, so a slow one holds
+// up the broker's messages but not the broker.
+
+package smug
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	DefaultTranslateTimeout = 5 * time.Second
+	// shorter text is left alone, too little to detect a language from
+	DefaultTranslateMinLen = 12
+	// messages waiting on the api before more go out untranslated
+	DefaultTranslateQueue = 100
+)
+
+type Translator struct {
+	log     *Logger
+	url     string
+	apiKey  string
+	target  string
+	replace bool
+	minLen  int
+	retries int
+	client  *http.Client
+	// what's waiting on the api and where it goes after, see Start
+	queue chan *Event
+	dis   Dispatcher
+}
+
+// url is the api's translate endpoint and target the language to translate
+// into, eg en.  mode is append (the default) or replace
+func NewTranslator(url string, target string, mode string) (*Translator, error) {
+	if url == "" || target == "" {
+		return nil, fmt.Errorf("translate needs a url and target language")
+	}
+	tr := &Translator{
+		log:     NewLogger("ctx", "translate"),
+		url:     url,
+		target:  strings.ToLower(target),
+		minLen:  DefaultTranslateMinLen,
+		retries: 1,
+		client:  NewHttpClient(),
+	}
+	tr.client.Timeout = DefaultTranslateTimeout
+	switch mode {
+	case "", "append":
+	case "replace":
+		tr.replace = true
+	default:
+		return nil, fmt.Errorf("translate mode must be either append or replace")
+	}
+	return tr, nil
+}
+
+func NewTranslatorFromConfig(tc *TranslateConfig) (*Translator, error) {
+	tr, err := NewTranslator(tc.Url, tc.Target, tc.Mode)
+	if err != nil {
+		return nil, err
+	}
+	tr.apiKey = tc.ApiKey
+	if tc.MinLength > 0 {
+		tr.minLen = tc.MinLength
+	}
+	if tc.Retries > 0 {
+		tr.retries = tc.Retries
+	}
+	if tc.Timeout != "" {
+		d, err := time.ParseDuration(tc.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid translate timeout %s", tc.Timeout)
+		}
+		tr.client.Timeout = d
+	}
+	return tr, nil
+}
+
+// commands, code, links and the like aren't worth translating, and private
+// messages aren't ours to send off to an api
+func (tr *Translator) skip(ev *Event) bool {
+	if ev.IsCmdOutput || ev.Presence != "" || ev.IsTopic || ev.IsReplay ||
+		ev.Private {
+		return true
+	}
+	text := strings.TrimSpace(ev.Text)
+	if len([]rune(text)) < tr.minLen || strings.HasPrefix(text, Prefix) ||
+		strings.HasPrefix(text, "/") || strings.Contains(text, "`") {
+		return true
+	}
+	// mostly symbols, numbers or a url isn't prose
+	letters, total := 0, 0
+	for _, word := range strings.Fields(text) {
+		if strings.Contains(word, "://") {
+			continue
+		}
+		for _, r := range word {
+			total++
+			if unicode.IsLetter(r) {
+				letters++
+			}
+		}
+	}
+	return letters*2 < total || letters == 0
+}
+
+type translation struct {
+	Text     string `json:"translatedText"`
+	Detected struct {
+		Language string `json:"language"`
+	} `json:"detectedLanguage"`
+}
+
+// the translation of text and the language it was detected as.  network
+// errors and 5xx responses are retried
+func (tr *Translator) Translate(text string) (string, string, error) {
+	req := map[string]string{
+		"q": text, "source": "auto", "target": tr.target, "format": "text"}
+	if tr.apiKey != "" {
+		req["api_key"] = tr.apiKey
+	}
+	body, _ := json.Marshal(req)
+	var err error
+	for attempt := 0; attempt <= tr.retries; attempt++ {
+		var out *translation
+		var retry bool
+		out, retry, err = tr.post(body)
+		if err == nil {
+			return out.Text, strings.ToLower(out.Detected.Language), nil
+		}
+		if !retry {
+			break
+		}
+	}
+	return "", "", err
+}
+
+// one request, and whether a failure is worth trying again
+func (tr *Translator) post(body []byte) (*translation, bool, error) {
+	resp, err := tr.client.Post(tr.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	data, err := ReadLimited(resp.Body, DefaultMaxBodySize)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= 500,
+			fmt.Errorf("translate returned %s", resp.Status)
+	}
+	out := &translation{}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, false, err
+	}
+	return out, false, nil
+}
+
+// translates from now on in the background, broadcasting each message on
+// dis once it's been through the api.  call before the broker's activated
+func (tr *Translator) Start(dis Dispatcher) {
+	tr.dis = dis
+	tr.queue = make(chan *Event, DefaultTranslateQueue)
+	go tr.run()
+}
+
+// broadcasts what's queued, in order, as it comes back from the api.  the
+// transforms ahead of ours run again, ours lets it through
+func (tr *Translator) run() {
+	for ev := range tr.queue {
+		out := tr.translate(ev)
+		out.translated = true
+		tr.dis.Broadcast(out)
+	}
+}
+
+// a TransformFunc.  once started, messages are taken off the broker's hands
+// and broadcast after they've been translated, see Start.  until then ev
+// with its translation, or ev as it was when there's nothing to translate
+// or the api can't be reached
+func (tr *Translator) Transform(ev *Event) *Event {
+	if ev.translated || ev.Private || ev.IsReplay || tr.queue == nil {
+		// replays are sent to just the broker asking for them, which
+		// broadcasting them again would lose
+		return tr.translate(ev)
+	}
+	// everything waits its turn, so what's skipped can't overtake what isn't
+	select {
+	case tr.queue <- ev:
+		return nil
+	default:
+		tr.log.Warnf("ERR translate queue full, sending as is from %s", ev.Actor)
+		return ev
+	}
+}
+
+// ev with its translation, or as it was
+func (tr *Translator) translate(ev *Event) *Event {
+	if ev.translated || tr.skip(ev) {
+		return ev
+	}
+	text, lang, err := tr.Translate(ev.Text)
+	if err != nil {
+		tr.log.Warnf("ERR translating from %s: %s", ev.Actor, err)
+		return ev
+	}
+	text = strings.TrimSpace(text)
+	if lang == tr.target || lang == "" || text == "" ||
+		strings.EqualFold(text, strings.TrimSpace(ev.Text)) {
+		return ev
+	}
+	marked := fmt.Sprintf("[%s>%s] %s", lang, tr.target, text)
+	out := *ev
+	if tr.replace {
+		out.Text = marked
+	} else {
+		out.Text = ev.Text + "\n" + marked
+	}
+	return &out
+}
@@ -0,0 +1,150 @@
+package smug
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a translate api that knows a little french and fails when told to
+type FakeTranslateApi struct {
+	mux      sync.Mutex
+	requests []map[string]string
+	failures int
+}
+
+func (fa *FakeTranslateApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := map[string]string{}
+	json.NewDecoder(r.Body).Decode(&req)
+	fa.mux.Lock()
+	fa.requests = append(fa.requests, req)
+	fail := fa.failures > 0
+	fa.failures--
+	fa.mux.Unlock()
+	if fail {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	lang, text := "en", req["q"]
+	if req["q"] == "bonjour tout le monde" {
+		lang, text = "fr", "hello everyone"
+	}
+	fmt.Fprintf(w, `{"translatedText": %q, "detectedLanguage": {"confidence": 90, "language": %q}}`,
+		text, lang)
+}
+
+func (fa *FakeTranslateApi) count() int {
+	fa.mux.Lock()
+	defer fa.mux.Unlock()
+	return len(fa.requests)
+}
+
+func TestTranslator(t *testing.T) {
+	api := &FakeTranslateApi{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	if _, err := NewTranslator(srv.URL, "en", "shout"); err == nil {
+		t.Errorf("err: bad mode should error")
+	}
+	tr, err := NewTranslatorFromConfig(&TranslateConfig{
+		Url: srv.URL, Target: "EN", ApiKey: "k1", Timeout: "1s"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ev := &Event{Actor: "marie", Text: "bonjour tout le monde"}
+	out := tr.Transform(ev)
+	if out.Text != "bonjour tout le monde\n[fr>en] hello everyone" || out.Actor != "marie" {
+		t.Errorf("err: expected the translation appended, have %q", out.Text)
+	}
+	if ev.Text != "bonjour tout le monde" {
+		t.Errorf("err: the original event was changed")
+	}
+	if req := api.requests[0]; req["target"] != "en" || req["source"] != "auto" ||
+		req["api_key"] != "k1" {
+		t.Errorf("err: request %v", req)
+	}
+
+	before := api.count()
+	for _, text := range []string{
+		"hi there", "..weather pdx tomorrow", "/giphy dancing cats",
+		"try `make test` first", "https://example.com/a/long/link 12345",
+	} {
+		if out := tr.Transform(&Event{Text: text}); out.Text != text {
+			t.Errorf("err: %q should be left alone, have %q", text, out.Text)
+		}
+	}
+	if out := tr.Transform(&Event{Text: "bonjour tout le monde", IsCmdOutput: true}); out.Text != "bonjour tout le monde" {
+		t.Errorf("err: command output shouldn't be translated")
+	}
+	if out := tr.Transform(&Event{Text: "bonjour tout le monde", Private: true}); out.Text != "bonjour tout le monde" {
+		t.Errorf("err: private messages shouldn't be translated")
+	}
+	if api.count() != before {
+		t.Errorf("err: skipped messages shouldn't hit the api")
+	}
+	if out := tr.Transform(&Event{Text: "good morning everyone"}); out.Text != "good morning everyone" {
+		t.Errorf("err: text already in the target shouldn't change, have %q", out.Text)
+	}
+
+	tr, _ = NewTranslator(srv.URL, "en", "replace")
+	api.failures = 1
+	if out := tr.Transform(&Event{Text: "bonjour tout le monde"}); out.Text != "[fr>en] hello everyone" {
+		t.Errorf("err: expected a retried replacement, have %q", out.Text)
+	}
+	api.failures = 2
+	if out := tr.Transform(&Event{Text: "bonjour tout le monde"}); out.Text != "bonjour tout le monde" {
+		t.Errorf("err: a failing api should leave the text, have %q", out.Text)
+	}
+}
+
+// ChanDispatch hands what's broadcast to events
+type ChanDispatch struct {
+	TestDispatch
+	events chan *Event
+}
+
+func (cd *ChanDispatch) Broadcast(ev *Event) {
+	cd.events <- ev
+}
+
+func TestTranslatorStarted(t *testing.T) {
+	api := &FakeTranslateApi{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	tr, _ := NewTranslator(srv.URL, "en", "")
+	dis := &ChanDispatch{events: make(chan *Event, 5)}
+	tr.Start(dis)
+
+	// taken off the broker's hands, then broadcast in the order they came
+	for _, text := range []string{"bonjour tout le monde", "ok"} {
+		if out := tr.Transform(&Event{Actor: "marie", Text: text}); out != nil {
+			t.Errorf("err: expected %q queued, have %+v", text, out)
+		}
+	}
+	var sent []*Event
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-dis.events:
+			sent = append(sent, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("err: queued message never broadcast")
+		}
+	}
+	if sent[0].Text != "bonjour tout le monde\n[fr>en] hello everyone" || sent[1].Text != "ok" {
+		t.Errorf("err: have %q then %q", sent[0].Text, sent[1].Text)
+	}
+	// broadcast again, it goes through the transforms once more
+	if out := tr.Transform(sent[0]); out != sent[0] {
+		t.Errorf("err: a translated message should pass through, have %+v", out)
+	}
+
+	dm := &Event{Actor: "marie", Text: "bonjour tout le monde", Private: true}
+	if out := tr.Transform(dm); out != dm || api.count() != 1 {
+		t.Errorf("err: private messages should go straight through untranslated")
+	}
+}
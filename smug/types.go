@@ -2,17 +2,22 @@
 
 package smug
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type ContentType int
 
 const (
 	CONTENT_DISPLAY = iota
 	CONTENT_META    = iota
+	// preformatted, eg a code snippet, shown monospaced where possible
+	CONTENT_CODE = iota
 )
 
 func (c ContentType) String() string {
-	return [...]string{"Display", "Meta"}[c]
+	return [...]string{"Display", "Meta", "Code"}[c]
 }
 
 type Broker interface {
@@ -21,7 +26,8 @@ type Broker interface {
 	HandleEvent(*Event, Dispatcher)
 	// after Setup(), the broker should be able to Handle(event) as needed.
 	// may require a queue until Activate() is called by dispatcher.AddBroker
-	Setup(...string)
+	// an error means the broker is unusable and should not be activated
+	Setup(...string) error
 	// this will setup a runloop if needed for the broker
 	Activate(Dispatcher)
 	// called during destruction
@@ -31,11 +37,87 @@ type Broker interface {
 	Heartbeat() bool
 }
 
+// brokers that want to see joins and parts from the others implement this.
+// presence events never reach anyone else
+type PresenceBroker interface {
+	ShowsPresence() bool
+}
+
+// brokers that can post a stand-in reply now and swap in the real one once
+// it arrives implement this
+type PlaceholderBroker interface {
+	// posts text where an answer to ev would go, returning its id for
+	// Event.Replaces
+	Placeholder(ev *Event, text string) (string, error)
+	// removes a placeholder that won't be getting an answer
+	DropPlaceholder(ev *Event, id string)
+}
+
+// brokers that can mark the message an event came from with an emoji
+// implement this
+type ReactionBroker interface {
+	// emoji is its name, eg white_check_mark
+	React(ev *Event, emoji string) error
+}
+
+// brokers that can fetch the messages of one of their threads implement this
+type ThreadReader interface {
+	// the messages in ev's thread, oldest first, as events
+	ReadThread(ev *Event) ([]*Event, error)
+}
+
+// brokers that resolve mentions or avatars of people from other brokers
+// implement this to know them by their names there
+type IdentityBroker interface {
+	UseIdentities(im *IdentityMap)
+}
+
+// brokers that mirror other brokers' channel topics onto their own implement
+// this.  topic events never reach anyone else
+type TopicBroker interface {
+	SyncsTopic() bool
+}
+
+// brokers whose HandleEvent is safe to call from several goroutines at once
+// implement this, see CentralDispatch.SendWorkers
+type ConcurrentBroker interface {
+	ConcurrentSends() bool
+}
+
+// dispatchers that can mute a broker without removing it implement this.  a
+// disabled broker stays connected but nothing it hears is broadcast and
+// nothing is sent to it
+type BrokerSwitch interface {
+	Enable(Broker)
+	Disable(Broker)
+	Enabled(Broker) bool
+}
+
+// how a broker's sends are going.  Latency is a moving average of the time
+// from an event being queued for the broker until it's been handled, zero
+// before anything has been.  brokers that send in the background, like irc,
+// have handled an event once it's handed off, so theirs is the time to
+// enqueue it rather than to send it
+type SendStat struct {
+	Broker  string
+	Queued  int
+	Latency time.Duration
+}
+
+// dispatchers that queue sends to each broker implement this
+type SendStatter interface {
+	SendStats() []SendStat
+}
+
 type Dispatcher interface {
 	Broadcast(*Event)
+	// like Broadcast but only to the brokers with these keys or names
+	BroadcastTo(*Event, ...string)
 	AddBroker(Broker)
 	RemoveBroker(Broker) error
 	NumBrokers() int
+	// returns the broker with the given Name() or nil
+	FindBroker(string) Broker
 	Heartbeat()
 }
 
@@ -45,10 +127,47 @@ type EventBlock struct {
 	Text   string
 	ImgUrl string
 	Type   ContentType
+	// for CONTENT_CODE, the language if known, eg go
+	Lang string
+}
+
+// what an Event.Presence is
+const (
+	PresenceJoin = "join"
+	PresencePart = "part"
+)
+
+// kinds of event, see Event.Kind.  joins and parts are PresenceJoin and
+// PresencePart
+const (
+	EventMessage = "message"
+	EventAction  = "action"
+	EventTopic   = "topic"
+)
+
+// a monitoring style alert.  slack shows these with a colored bar down the
+// side and the fields laid out as a table, others may ignore them like blocks
+type EventAttachment struct {
+	// good, warning, danger or a hex color like #439FE0
+	Color  string
+	Title  string
+	Text   string
+	Fields []*EventField
+}
+
+type EventField struct {
+	Title string
+	Value string
+	// short enough to sit beside another field
+	Short bool
 }
 
 type Event struct {
 	IsCmdOutput bool
+	IsAction    bool // an emote, irc's /me or slack's me_message
+	// a join or part, Actor came or went and Text is the channel
+	Presence    string
+	IsTopic     bool // Actor changed the channel topic to Text
 	Origin      Broker
 	ReplyBroker Broker // all brokers will see message but may choose to ignore
 	// unless beneficial (bot handlers, etc)
@@ -56,10 +175,102 @@ type Event struct {
 	// either privately or some other mechanism. this should
 	// not be changed once set by the originating event as it
 	// may specific to a given broker's format
-	Actor         string
+	Private bool // a direct message to us, replies carry this along too
+	Actor   string
+	// who Actor is on their network in a way they can't change or take from
+	// someone else, eg a slack user id or irc services account.  blank when
+	// the network has no such thing, see ActorAllowlist
+	ActorId       string
 	Avatar        string
 	Text          string
 	RawText       string
 	ContentBlocks []*EventBlock
-	ts            time.Time
+	Attachments   []*EventAttachment
+	// the actor's status where their network has one, eg slack's status
+	// emoji.  brokers set to show it put it after the actor, see ActorLabel
+	ActorStatus string
+	// what a threaded reply is replying to, eg "re: who wants lunch: ", for
+	// brokers without threads to show before Text.  kept out of Text so
+	// commands in a thread are still recognised
+	ThreadContext string
+	// broker specific thread this event belongs to, eg slack's thread_ts.
+	// only ThreadBroker makes use of it, others post as usual
+	ThreadId     string
+	ThreadBroker Broker
+	// broker specific channel this event was said in, for brokers in several,
+	// eg irc's #ops.  answers carry it along so they go back there, only
+	// ChannelBroker makes use of it
+	Channel       string
+	ChannelBroker Broker
+	// broker specific id of this message itself, eg slack's ts
+	MessageId string
+	// threaded replies are also shown in the channel where supported
+	ReplyBroadcast bool
+	// the placeholder ReplacesBroker posted that this takes the place of,
+	// others post as usual
+	Replaces       string
+	ReplacesBroker Broker
+	// re-sent from an archive, archives don't store it again
+	IsReplay bool
+	// put on the bridge through the inject endpoint rather than said by
+	// anyone, archives may leave it out and command brokers ignore it
+	IsInjected bool
+	// when set, brokers that support it deliver the message at this time
+	SendAt time.Time
+	ts     time.Time
+	// been through a Translator already, see Translator.Start
+	translated bool
+}
+
+// when the event happened at its origin, zero if the origin didn't say
+func (ev *Event) Time() time.Time {
+	return ev.ts
+}
+
+// the thread, and its broker, an answer to ev belongs in.  ev's own thread,
+// or for something said in a channel a new one under ev itself, so command
+// replies don't clutter the channel.  blank when there's neither
+func (ev *Event) ReplyThread() (string, Broker) {
+	if ev.ThreadId != "" {
+		return ev.ThreadId, ev.ThreadBroker
+	}
+	if ev.MessageId != "" && !ev.Private {
+		return ev.MessageId, ev.Origin
+	}
+	return "", nil
+}
+
+// actor with their status after it, eg "alice [🌴]", or just the actor
+// without one
+func ActorLabel(actor string, status string) string {
+	if status == "" {
+		return actor
+	}
+	return fmt.Sprintf("%s [%s]", actor, status)
+}
+
+// message, action, join, part or topic.  command output is a message
+func (ev *Event) Kind() string {
+	switch {
+	case ev.Presence != "":
+		return ev.Presence
+	case ev.IsTopic:
+		return EventTopic
+	case ev.IsAction:
+		return EventAction
+	}
+	return EventMessage
+}
+
+// how brokers without a native emote should render an action
+func (ev *Event) ActionText() string {
+	return fmt.Sprintf("* %s %s", ev.Actor, ev.Text)
+}
+
+// eg "alice joined #general"
+func (ev *Event) PresenceText() string {
+	if ev.Presence == PresencePart {
+		return fmt.Sprintf("%s left %s", ev.Actor, ev.Text)
+	}
+	return fmt.Sprintf("%s joined %s", ev.Actor, ev.Text)
 }
@@ -0,0 +1,290 @@
+// broker: unix
+// listens on a unix domain socket so local daemons and sidecars can join the
+// bridge without a network or a chat account.  each line a client writes is
+// a json event that's broadcast, and everything the bridge sees is written
+// to every connected client as a json line.  clients may come and go, and
+// any number can be connected at once.
+
+package smug
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBroker("unix", func() Broker { return &UnixSocketBroker{} })
+}
+
+// how long a client gets to take a line before it's dropped
+const unixWriteTimeout = 5 * time.Second
+
+// only we may use the socket unless it's opened up with socket-perms
+const unixSocketPerms os.FileMode = 0600
+
+// an event as it's written to and read from the socket.  origin is only
+// set on what we write
+type unixEvent struct {
+	Origin string `json:"origin,omitempty"`
+	Actor  string `json:"actor"`
+	Text   string `json:"text"`
+	Avatar string `json:"avatar,omitempty"`
+	Action bool   `json:"action,omitempty"`
+}
+
+type UnixSocketBroker struct {
+	// only ignore-actors applies to the socket
+	chatOptions
+	log  *Logger
+	path string
+	// actor for lines that don't name one
+	nick     string
+	listener net.Listener
+	done     chan bool
+	stop     sync.Once
+	mux      sync.Mutex
+	clients  map[net.Conn]bool
+	metrics  Metrics
+}
+
+func (ub *UnixSocketBroker) Name() string {
+	return fmt.Sprintf("unix-%s", ub.path)
+}
+
+func (ub *UnixSocketBroker) logger() *Logger { return ub.log }
+
+func (ub *UnixSocketBroker) Heartbeat() bool {
+	ub.mux.Lock()
+	m := ub.metrics
+	ub.metrics = Metrics{}
+	clients := len(ub.clients)
+	ub.mux.Unlock()
+	ub.log.logMetrics(m)
+	ub.log.Debugf("%d clients connected", clients)
+	return true
+}
+
+// args [path, nick]
+// path is the socket, created on setup so only our user may connect, see
+// SocketPerms.  a stale one left by a previous run is replaced, one something
+// is still listening on is an error
+func (ub *UnixSocketBroker) Setup(args ...string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("unix broker needs 2 args, got %d", len(args))
+	}
+	ub.path = args[0]
+	if ub.path == "" {
+		return fmt.Errorf("unix broker needs a path")
+	}
+	ub.log = NewLogger("broker", DisplayName(ub))
+	ub.nick = "smug"
+	if args[1] != "" {
+		ub.nick = args[1]
+	}
+	if err := removeStaleSocket(ub.path); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", ub.path)
+	if err != nil {
+		return err
+	}
+	ub.listener = l
+	if err := ub.SocketPerms(unixSocketPerms); err != nil {
+		l.Close()
+		return err
+	}
+	ub.clients = make(map[net.Conn]bool)
+	ub.done = make(chan bool)
+	return nil
+}
+
+func (ub *UnixSocketBroker) SetupFromConfig(cfg *BrokerConfig) error {
+	mode := unixSocketPerms
+	if cfg.SocketPerms != "" {
+		m, err := strconv.ParseUint(cfg.SocketPerms, 8, 32)
+		if err != nil || m > 0777 {
+			return fmt.Errorf("invalid socket-perms %s", cfg.SocketPerms)
+		}
+		mode = os.FileMode(m)
+	}
+	if err := ub.Setup(cfg.Path, cfg.Nick); err != nil {
+		return err
+	}
+	if err := ub.SocketPerms(mode); err != nil {
+		ub.Deactivate()
+		return err
+	}
+	return ub.IgnoreActors(cfg.IgnoreActors...)
+}
+
+// who may connect to the socket, eg 0660 to let the group in.  anyone who
+// can connect can speak on the bridge
+func (ub *UnixSocketBroker) SocketPerms(mode os.FileMode) error {
+	return os.Chmod(ub.path, mode)
+}
+
+// removes the socket at path if nothing answers on it
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+func (ub *UnixSocketBroker) HandleEvent(ev *Event, dis Dispatcher) {
+	if ev.ReplyBroker != nil && ev.ReplyBroker != ub {
+		return
+	}
+	ue := &unixEvent{
+		Actor:  ev.Actor,
+		Text:   ev.Text,
+		Avatar: ev.Avatar,
+		Action: ev.IsAction,
+	}
+	if ev.Origin != nil {
+		ue.Origin = deadLetterTarget(ev.Origin)
+	}
+	line, err := json.Marshal(ue)
+	if err != nil {
+		ub.log.Warnf("ERR encoding event: %s", err)
+		return
+	}
+	line = append(line, '\n')
+	ub.mux.Lock()
+	ub.metrics.rcvd(ev)
+	clients := make([]net.Conn, 0, len(ub.clients))
+	for conn := range ub.clients {
+		clients = append(clients, conn)
+	}
+	ub.mux.Unlock()
+	// written unlocked so a slow client doesn't hold up accepting, serving
+	// or heartbeats for as long as its write deadline
+	for _, conn := range clients {
+		conn.SetWriteDeadline(time.Now().Add(unixWriteTimeout))
+		if _, err := conn.Write(line); err != nil {
+			ub.log.Warnf("ERR writing to client, dropping it: %s", err)
+			conn.Close()
+			ub.mux.Lock()
+			delete(ub.clients, conn)
+			ub.mux.Unlock()
+		}
+	}
+}
+
+// the event a client's line makes, nil for blank lines
+func (ub *UnixSocketBroker) parseLine(line []byte) (*Event, error) {
+	if len(strings.TrimSpace(string(line))) == 0 {
+		return nil, nil
+	}
+	ue := &unixEvent{}
+	if err := json.Unmarshal(line, ue); err != nil {
+		return nil, err
+	}
+	if ue.Text == "" {
+		return nil, fmt.Errorf("event has no text")
+	}
+	if ue.Actor == "" {
+		ue.Actor = ub.nick
+	}
+	return &Event{
+		Origin:   ub,
+		Actor:    ue.Actor,
+		Text:     ue.Text,
+		RawText:  ue.Text,
+		Avatar:   ue.Avatar,
+		IsAction: ue.Action,
+		ts:       time.Now(),
+	}, nil
+}
+
+// broadcasts each line conn sends until it hangs up
+func (ub *UnixSocketBroker) serve(conn net.Conn, dis Dispatcher) {
+	defer func() {
+		ub.mux.Lock()
+		delete(ub.clients, conn)
+		ub.mux.Unlock()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), int(DefaultMaxBodySize))
+	for scanner.Scan() {
+		ev, err := ub.parseLine(scanner.Bytes())
+		if err != nil {
+			ub.log.Warnf("ERR reading client event: %s", err)
+			continue
+		}
+		if ev == nil || ub.ignore.Ignored(ev.Actor) {
+			continue
+		}
+		ub.mux.Lock()
+		ub.metrics.sent(ev)
+		ub.mux.Unlock()
+		dis.Broadcast(ev)
+	}
+	select {
+	case <-ub.done:
+		// hung up on by Deactivate
+	default:
+		if err := scanner.Err(); err != nil {
+			ub.log.Warnf("ERR reading client: %s", err)
+		}
+	}
+}
+
+// accepts clients until Deactivate
+func (ub *UnixSocketBroker) Activate(dis Dispatcher) {
+	ub.log.Infof("listening on %s", ub.path)
+	for {
+		conn, err := ub.listener.Accept()
+		if err != nil {
+			select {
+			case <-ub.done:
+				return
+			default:
+			}
+			ub.log.Warnf("ERR accepting client: %s", err)
+			select {
+			case <-ub.done:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		ub.mux.Lock()
+		ub.clients[conn] = true
+		ub.mux.Unlock()
+		go ub.serve(conn, dis)
+	}
+}
+
+// hangs up on every client and removes the socket.  safe to call more than
+// once
+func (ub *UnixSocketBroker) Deactivate() {
+	ub.stop.Do(func() {
+		close(ub.done)
+		ub.listener.Close()
+		ub.mux.Lock()
+		for conn := range ub.clients {
+			conn.Close()
+			delete(ub.clients, conn)
+		}
+		ub.mux.Unlock()
+	})
+}
@@ -0,0 +1,137 @@
+package smug
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocketBroker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smug")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bridge.sock")
+	ub := &UnixSocketBroker{}
+	if err := ub.Setup(path, "sidecar"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := (&UnixSocketBroker{}).Setup(path, ""); err == nil {
+		t.Errorf("err: a socket in use shouldn't be taken over")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("err: expected the socket only we may use, have %v %v", fi.Mode(), err)
+	}
+	cd := &CentralDispatch{}
+	other := &ChanBroker{events: make(chan *Event, 10)}
+	cd.AddBroker(other)
+	cd.AddBroker(ub)
+	defer ub.Deactivate()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	received := func() *Event {
+		select {
+		case ev := <-other.events:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("err: nothing was broadcast")
+		}
+		return nil
+	}
+	// clients are only written to once they've been accepted
+	waitClients := func(n int) {
+		for i := 0; i < 100; i++ {
+			ub.mux.Lock()
+			have := len(ub.clients)
+			ub.mux.Unlock()
+			if have == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("err: expected %d clients", n)
+	}
+	first, firstLines := dial()
+	second, secondLines := dial()
+	defer second.Close()
+	waitClients(2)
+
+	first.Write([]byte(`{"actor": "deployer", "text": "build 42 is out"}` + "\n"))
+	first.Write([]byte("not json\n\n"))
+	first.Write([]byte(`{"text": "waves", "action": true}` + "\n"))
+	if ev := received(); ev.Origin != ub || ev.Actor != "deployer" ||
+		ev.Text != "build 42 is out" {
+		t.Errorf("err: expected the client's event, have %+v", ev)
+	}
+	if ev := received(); ev.Actor != "sidecar" || !ev.IsAction {
+		t.Errorf("err: expected an action as the nick, have %+v", ev)
+	}
+
+	cd.Broadcast(&Event{Origin: other, Actor: "alice", Text: "hi"})
+	for _, lines := range []*bufio.Reader{firstLines, secondLines} {
+		line, err := lines.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		ue := &unixEvent{}
+		if err := json.Unmarshal(line, ue); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if ue.Origin != "faker" || ue.Actor != "alice" || ue.Text != "hi" {
+			t.Errorf("err: expected the event as json, have %s", line)
+		}
+	}
+
+	// hanging up and coming back
+	first.Close()
+	waitClients(1)
+	again, againLines := dial()
+	defer again.Close()
+	waitClients(2)
+	again.Write([]byte(`{"actor": "deployer", "text": "back"}` + "\n"))
+	if ev := received(); ev.Text != "back" {
+		t.Errorf("err: expected the reconnected client's event, have %+v", ev)
+	}
+	cd.Broadcast(&Event{Origin: other, Actor: "alice", Text: "welcome back"})
+	if line, err := againLines.ReadString('\n'); err != nil ||
+		line != `{"origin":"faker","actor":"alice","text":"welcome back"}`+"\n" {
+		t.Errorf("err: expected the event on the new connection, have %q %v", line, err)
+	}
+}
+
+func TestUnixSocketPerms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smug")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bridge.sock")
+	if err := (&UnixSocketBroker{}).SetupFromConfig(
+		&BrokerConfig{Path: path, SocketPerms: "rw"}); err == nil {
+		t.Errorf("err: expected an invalid socket-perms refused")
+	}
+	ub := &UnixSocketBroker{}
+	if err := ub.SetupFromConfig(&BrokerConfig{Path: path, SocketPerms: "0660"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("err: expected the socket opened to the group, have %v %v", fi.Mode(), err)
+	}
+	ub.Deactivate()
+	ub.Deactivate()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("err: expected the socket removed, have %v", err)
+	}
+}
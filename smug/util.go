@@ -1,11 +1,64 @@
 package smug
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// splits s into words like a shell: on whitespace, except within single or
+// double quotes, with a backslash outside single quotes taking the next
+// character as is.  an unterminated quote runs to the end
+func ShellSplit(s string) []string {
+	words := []string{}
+	var word strings.Builder
+	inWord, escaped := false, false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
 func ChunkSplit(body string, limit int) []string {
 	result := []string{}
 	var charSlice []rune
@@ -27,17 +80,1036 @@ func ChunkSplit(body string, limit int) []string {
 	return result
 }
 
+// default cap on how much we'll read from any remote body
+const DefaultMaxBodySize int64 = 1 << 20
+
+// what ReadLimited's error wraps when there was more than max to be had
+var ErrBodyTooLarge = errors.New("body too large")
+
+// reads at most max bytes from r, erroring if there was more to be had
+func ReadLimited(r io.Reader, max int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, fmt.Errorf("%w, over %d bytes", ErrBodyTooLarge, max)
+	}
+	return body, nil
+}
+
+// sent with every outbound http request that doesn't set its own
+var httpDefaults = struct {
+	mux       sync.RWMutex
+	userAgent string
+	headers   map[string]string
+}{}
+
+// ua blank uses smug-broker/<version>.  headers already on a request, like a
+// pattern's own, win over these
+func SetHttpDefaults(ua string, headers map[string]string) {
+	httpDefaults.mux.Lock()
+	defer httpDefaults.mux.Unlock()
+	httpDefaults.userAgent = ua
+	httpDefaults.headers = headers
+}
+
+// fills in the default user agent and headers before sending
+type defaultsTransport struct {
+	base http.RoundTripper
+}
+
+func (dt *defaultsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	httpDefaults.mux.RLock()
+	for h, v := range httpDefaults.headers {
+		if req.Header.Get(h) == "" {
+			req.Header.Set(h, v)
+		}
+	}
+	ua := httpDefaults.userAgent
+	httpDefaults.mux.RUnlock()
+	if ua == "" {
+		ua = "smug-broker/" + Version
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	return dt.base.RoundTrip(req)
+}
+
+// all our outbound http goes through one of these
+func NewHttpClient() *http.Client {
+	return &http.Client{
+		Transport: &defaultsTransport{base: http.DefaultTransport},
+	}
+}
+
+// how long a broker waits to connect, and how often it checks an idle
+// connection is still there.  zero leaves the library's default
+type NetTimeouts struct {
+	Dial      time.Duration
+	KeepAlive time.Duration
+}
+
+// dial and keepalive are durations, eg 10s, either may be blank
+func NewNetTimeouts(dial string, keepalive string) (*NetTimeouts, error) {
+	nt := &NetTimeouts{}
+	if dial != "" {
+		d, err := time.ParseDuration(dial)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid dial-timeout %s", dial)
+		}
+		nt.Dial = d
+	}
+	if keepalive != "" {
+		d, err := time.ParseDuration(keepalive)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid keepalive %s", keepalive)
+		}
+		nt.KeepAlive = d
+	}
+	return nt, nil
+}
+
+// a dialer with our timeouts, a nil NetTimeouts gives the defaults
+func (nt *NetTimeouts) Dialer() *net.Dialer {
+	d := &net.Dialer{}
+	if nt != nil {
+		d.Timeout, d.KeepAlive = nt.Dial, nt.KeepAlive
+	}
+	return d
+}
+
+// NewHttpClient with connections made through Dialer
+func (nt *NetTimeouts) HttpClient() *http.Client {
+	client := NewHttpClient()
+	if nt == nil || (nt.Dial == 0 && nt.KeepAlive == 0) {
+		return client
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = nt.Dialer().DialContext
+	if nt.Dial > 0 {
+		tr.TLSHandshakeTimeout = nt.Dial
+	}
+	client.Transport = &defaultsTransport{base: tr}
+	return client
+}
+
 func FetchUrl(url string) ([]byte, error) {
 	// Get the data
-	resp, err := http.Get(url)
+	resp, err := NewHttpClient().Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	text, err := ioutil.ReadAll(resp.Body)
-	return text, err
+	return ReadLimited(resp.Body, DefaultMaxBodySize)
 }
 
 func fmtInt64(i int64) string {
 	return strconv.FormatInt(i, 10)
 }
+
+// ActorFilter matches actor names against a set of regexes.  brokers use this
+// to drop inbound messages from other bridges/bots before broadcasting so two
+// smug instances on overlapping channels don't echo each other forever
+type ActorFilter struct {
+	res []*regexp.Regexp
+}
+
+func NewActorFilter(patterns []string) (*ActorFilter, error) {
+	af := &ActorFilter{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling actor filter %s: %s", p, err)
+		}
+		af.res = append(af.res, re)
+	}
+	return af, nil
+}
+
+// true if actor matches any of our patterns. a nil filter ignores nobody
+func (af *ActorFilter) Ignored(actor string) bool {
+	if af == nil {
+		return false
+	}
+	for _, re := range af.res {
+		if re.MatchString(actor) {
+			return true
+		}
+	}
+	return false
+}
+
+// ActorAllowlist is who may run something, by the broker they're on and
+// their id there rather than their nick, which anyone on any bridged network
+// can take.  entries are "<broker>:<id>", broker being a config key or name,
+// eg slack:U0123ABC for a slack user or irc:alice for whoever's logged in to
+// the services account alice.  see Event.ActorId
+type ActorAllowlist struct {
+	// ids allowed by broker
+	ids map[string]map[string]bool
+}
+
+func NewActorAllowlist(entries []string) (*ActorAllowlist, error) {
+	aa := &ActorAllowlist{ids: make(map[string]map[string]bool)}
+	for _, entry := range entries {
+		// names may have a : of their own, ids don't
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf(
+				"allowed actor %s should be <broker>:<id>, eg slack:U0123ABC", entry)
+		}
+		broker, id := entry[:i], entry[i+1:]
+		if aa.ids[broker] == nil {
+			aa.ids[broker] = make(map[string]bool)
+		}
+		aa.ids[broker][id] = true
+	}
+	return aa, nil
+}
+
+// whether ev's actor is on the list.  actors without an id, or on brokers
+// the list doesn't name, never are.  a nil list allows nobody
+func (aa *ActorAllowlist) Allows(ev *Event) bool {
+	if aa == nil || ev.Origin == nil || ev.ActorId == "" {
+		return false
+	}
+	if key := BrokerKey(ev.Origin); key != "" && aa.ids[key][ev.ActorId] {
+		return true
+	}
+	return aa.ids[ev.Origin.Name()][ev.ActorId]
+}
+
+// CmdOutputMarker recognizes text that is really command output relayed by
+// another bridge or bot, eg "[bot] ..." so it never re-enters a pattern router
+type CmdOutputMarker struct {
+	prefixes []string
+	suffixes []string
+}
+
+func NewCmdOutputMarker(prefixes []string, suffixes []string) *CmdOutputMarker {
+	return &CmdOutputMarker{prefixes: prefixes, suffixes: suffixes}
+}
+
+// returns s with any matching prefix and suffix stripped and whether either
+// matched.  a nil marker matches nothing
+func (cm *CmdOutputMarker) Strip(s string) (string, bool) {
+	if cm == nil {
+		return s, false
+	}
+	found := false
+	for _, p := range cm.prefixes {
+		if p != "" && strings.HasPrefix(s, p) {
+			s, found = strings.TrimSpace(s[len(p):]), true
+			break
+		}
+	}
+	for _, sfx := range cm.suffixes {
+		if sfx != "" && strings.HasSuffix(s, sfx) {
+			s, found = strings.TrimSpace(s[:len(s)-len(sfx)]), true
+			break
+		}
+	}
+	return s, found
+}
+
+// marks ev as command output if its text carries one of our markers
+func (cm *CmdOutputMarker) Mark(ev *Event) {
+	if txt, found := cm.Strip(ev.Text); found {
+		ev.Text = txt
+		ev.IsCmdOutput = true
+	}
+}
+
+// characters irc allows in a nick, besides letters and digits
+const DefaultNickChars = "A-Za-z0-9_\\-\\[\\]\\\\^{}|`"
+
+// NICKLEN on most modern networks
+const DefaultNickLen = 30
+
+// NickSanitizer rewrites actor names into something a strict network will
+// accept.  once an actor is mapped it keeps that name, colliding names get a
+// numeric suffix so two actors never render the same
+type NickSanitizer struct {
+	mux     sync.Mutex
+	invalid *regexp.Regexp
+	maxLen  int
+	names   map[string]string // actor -> nick
+	taken   map[string]bool
+}
+
+// chars is the contents of a regex character class of allowed characters
+func NewNickSanitizer(chars string, maxLen int) (*NickSanitizer, error) {
+	if chars == "" {
+		chars = DefaultNickChars
+	}
+	if maxLen <= 0 {
+		maxLen = DefaultNickLen
+	}
+	invalid, err := regexp.Compile("[^" + chars + "]+")
+	if err != nil {
+		return nil, fmt.Errorf("invalid nick chars %s: %s", chars, err)
+	}
+	return &NickSanitizer{
+		invalid: invalid,
+		maxLen:  maxLen,
+		names:   make(map[string]string),
+		taken:   make(map[string]bool),
+	}, nil
+}
+
+func truncRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// a nil sanitizer leaves actors untouched
+func (ns *NickSanitizer) Sanitize(actor string) string {
+	if ns == nil {
+		return actor
+	}
+	ns.mux.Lock()
+	defer ns.mux.Unlock()
+	if nick, found := ns.names[actor]; found {
+		return nick
+	}
+	base := ns.invalid.ReplaceAllString(strings.TrimSpace(actor), "_")
+	if base == "" {
+		base = "_"
+	}
+	nick := truncRunes(base, ns.maxLen)
+	for i := 2; ns.taken[nick]; i++ {
+		suffix := strconv.Itoa(i)
+		nick = truncRunes(base, ns.maxLen-len(suffix)) + suffix
+	}
+	ns.names[actor] = nick
+	ns.taken[nick] = true
+	return nick
+}
+
+// finds urls in plain text
+var re_urls = regexp.MustCompile(`https?://[^\s<>|]+`)
+
+type urlRewrite struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// UrlRewriter applies regex replacements to only the urls found in a string,
+// eg stripping tracking params or pointing internal hosts at a proxy
+type UrlRewriter struct {
+	rules []urlRewrite
+}
+
+func NewUrlRewriter(rules []UrlRewriteConfig) (*UrlRewriter, error) {
+	ur := &UrlRewriter{}
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling url rewrite %s: %s", r.Match, err)
+		}
+		ur.rules = append(ur.rules, urlRewrite{re: re, replace: r.Replace})
+	}
+	return ur, nil
+}
+
+// rules are applied in order to each url.  a nil rewriter changes nothing
+func (ur *UrlRewriter) Rewrite(s string) string {
+	if ur == nil || len(ur.rules) == 0 {
+		return s
+	}
+	return re_urls.ReplaceAllStringFunc(s, func(u string) string {
+		for _, r := range ur.rules {
+			u = r.re.ReplaceAllString(u, r.replace)
+		}
+		return u
+	})
+}
+
+// what a MessageLimiter does with text over its max length
+const (
+	PolicyChunk    = "chunk"
+	PolicyTruncate = "truncate"
+)
+
+const DefaultTruncateMarker = "…(truncated)"
+
+// MessageLimiter keeps outbound text within a broker's max length, either by
+// splitting it into several messages or by cutting it short with a marker and
+// optional link to the full content
+type MessageLimiter struct {
+	maxLen   int
+	truncate bool
+	tail     string
+	// maxLen is in bytes rather than chars, see InBytes
+	bytes bool
+}
+
+// policy is PolicyChunk (the default) or PolicyTruncate.  marker and link
+// only apply when truncating, a blank marker uses DefaultTruncateMarker
+func NewMessageLimiter(
+	maxLen int, policy string, marker string, link string) (*MessageLimiter, error) {
+	ml := &MessageLimiter{maxLen: maxLen}
+	switch policy {
+	case "", PolicyChunk:
+	case PolicyTruncate:
+		ml.truncate = true
+		if marker == "" {
+			marker = DefaultTruncateMarker
+		}
+		ml.tail = marker
+		if link != "" {
+			ml.tail += " " + link
+		}
+	default:
+		return nil, fmt.Errorf("unknown message policy %s", policy)
+	}
+	return ml, nil
+}
+
+// counts maxLen in bytes rather than chars, for networks like irc whose
+// limit is on the encoded line.  text is still only cut between chars
+func (ml *MessageLimiter) InBytes() {
+	ml.bytes = true
+}
+
+// the messages to send for text, each at most maxLen chars, or bytes.  a nil
+// limiter or maxLen <= 0 leaves text whole
+func (ml *MessageLimiter) Limit(text string) []string {
+	if ml == nil || ml.maxLen <= 0 || ml.size(text) <= ml.maxLen {
+		return []string{text}
+	}
+	if !ml.truncate {
+		outs := []string{}
+		for text != "" {
+			var out string
+			out, text = ml.cut(text, ml.maxLen)
+			outs = append(outs, out)
+		}
+		return outs
+	}
+	keep := ml.maxLen - ml.size(ml.tail)
+	if keep < 0 {
+		keep = 0
+	}
+	head, _ := ml.cut(text, keep)
+	tail, _ := ml.cut(ml.tail, ml.maxLen)
+	return []string{head + tail}
+}
+
+func (ml *MessageLimiter) size(s string) int {
+	if ml.bytes {
+		return len(s)
+	}
+	return utf8.RuneCountInString(s)
+}
+
+// splits s after at most n chars, or bytes, never within a char.  a first
+// char wider than n bytes is still taken whole so chunking gets somewhere
+func (ml *MessageLimiter) cut(s string, n int) (string, string) {
+	if !ml.bytes {
+		if r := []rune(s); len(r) > n {
+			return string(r[:n]), string(r[n:])
+		}
+		return s, ""
+	}
+	if len(s) <= n {
+		return s, ""
+	}
+	i := n
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	if i == 0 && n > 0 {
+		_, i = utf8.DecodeRuneInString(s)
+	}
+	return s[:i], s[i:]
+}
+
+// Deduper remembers what was recently sent to each destination so the same
+// message arriving twice in quick succession, eg from a pattern response and
+// a bridge relaying it, only goes out once
+type Deduper struct {
+	ttl  time.Duration
+	now  func() time.Time
+	mux  sync.Mutex
+	seen map[[sha256.Size]byte]time.Time
+	// what of an event makes it a repeat, nil is who said it and its text
+	key *DedupKey
+}
+
+// builds what DupEvent compares.  by default that's who said it and the text
+// as it'll be sent, text leaves out who said it and match narrows the text
+// to what a regex finds in it (its first group if it has one), eg an
+// alert's id
+type DedupKey struct {
+	textOnly bool
+	match    *regexp.Regexp
+}
+
+// kind is actor-text (the default) or text, match is optional
+func NewDedupKey(kind string, match string) (*DedupKey, error) {
+	dk := &DedupKey{}
+	switch kind {
+	case "", "actor-text":
+	case "text":
+		dk.textOnly = true
+	default:
+		return nil, fmt.Errorf("dedup-key must be either text or actor-text")
+	}
+	if match != "" {
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dedup-match %s: %s", match, err)
+		}
+		dk.match = re
+	}
+	return dk, nil
+}
+
+// the key for ev sent as text.  text the match doesn't find anything in is
+// keyed whole.  a nil DedupKey keys on actor and text
+func (dk *DedupKey) Key(ev *Event, text string) string {
+	if text == "" {
+		return text
+	}
+	if dk == nil {
+		return ev.Actor + "\x00" + text
+	}
+	key := text
+	if dk.match != nil {
+		if m := dk.match.FindStringSubmatch(text); len(m) > 1 && m[1] != "" {
+			key = m[1]
+		} else if len(m) > 0 && m[0] != "" {
+			key = m[0]
+		}
+	}
+	if !dk.textOnly {
+		key = ev.Actor + "\x00" + key
+	}
+	return key
+}
+
+func NewDeduper(ttl time.Duration) *Deduper {
+	return &Deduper{
+		ttl:  ttl,
+		now:  time.Now,
+		seen: make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// true if text already went to dest within the ttl, otherwise remembers it.
+// a nil deduper never suppresses anything
+func (dd *Deduper) Dup(dest string, text string) bool {
+	if dd == nil || text == "" {
+		return false
+	}
+	key := sha256.Sum256([]byte(dest + "\x00" + text))
+	now := dd.now()
+	dd.mux.Lock()
+	defer dd.mux.Unlock()
+	for k, at := range dd.seen {
+		if now.Sub(at) >= dd.ttl {
+			delete(dd.seen, k)
+		}
+	}
+	if _, found := dd.seen[key]; found {
+		return true
+	}
+	dd.seen[key] = now
+	return false
+}
+
+// decides what makes an event a repeat, see NewDedupKey
+func (dd *Deduper) KeyBy(kind string, match string) error {
+	dk, err := NewDedupKey(kind, match)
+	if err != nil || dd == nil {
+		return err
+	}
+	dd.key = dk
+	return nil
+}
+
+// Dup for ev going out as text, keyed as KeyBy says
+func (dd *Deduper) DupEvent(dest string, ev *Event, text string) bool {
+	if dd == nil {
+		return false
+	}
+	return dd.Dup(dest, dd.key.Key(ev, text))
+}
+
+const Redacted = "[REDACTED]"
+
+// common secrets folks paste by accident
+var defaultRedactions = []string{
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,                          // aws access key ids
+	`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`, // jwts
+	`\bxox[abposr]-[A-Za-z0-9-]{10,}`,                        // slack tokens
+	`\bgh[pousr]_[A-Za-z0-9]{36,}`,                           // github tokens
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(?:-----END [A-Z ]*PRIVATE KEY-----|$)`,
+}
+
+// Redactor replaces anything matching its regexes with Redacted so secrets
+// don't get bridged out of the network they were pasted in
+type Redactor struct {
+	res []*regexp.Regexp
+}
+
+// withDefaults adds the built in patterns for common keys and tokens
+func NewRedactor(patterns []string, withDefaults bool) (*Redactor, error) {
+	if withDefaults {
+		patterns = append(append([]string{}, defaultRedactions...), patterns...)
+	}
+	rd := &Redactor{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %s: %s", p, err)
+		}
+		rd.res = append(rd.res, re)
+	}
+	return rd, nil
+}
+
+// a nil rc means no redaction
+func NewRedactorFromConfig(rc *RedactConfig) (*Redactor, error) {
+	if rc == nil {
+		return nil, nil
+	}
+	return NewRedactor(rc.Patterns, rc.Defaults)
+}
+
+// a nil redactor changes nothing
+func (rd *Redactor) Redact(s string) string {
+	if rd == nil {
+		return s
+	}
+	for _, re := range rd.res {
+		s = re.ReplaceAllLiteralString(s, Redacted)
+	}
+	return s
+}
+
+// redacts the text of ev, its blocks and attachments, in place
+func (rd *Redactor) RedactEvent(ev *Event) {
+	if rd == nil {
+		return
+	}
+	ev.Text = rd.Redact(ev.Text)
+	ev.RawText = rd.Redact(ev.RawText)
+	for _, b := range ev.ContentBlocks {
+		b.Text = rd.Redact(b.Text)
+	}
+	for _, a := range ev.Attachments {
+		a.Text = rd.Redact(a.Text)
+		for _, f := range a.Fields {
+			f.Value = rd.Redact(f.Value)
+		}
+	}
+}
+
+var (
+	ErrUnsigned     = fmt.Errorf("message is not signed")
+	ErrBadSignature = fmt.Errorf("message signature is invalid")
+)
+
+// Signer hmacs the serialized events brokers pass between smug instances
+// with a shared secret, so nothing else on a shared bus can inject messages
+type Signer struct {
+	secret []byte
+}
+
+// a blank secret means no signing, NewSigner returns nil
+func NewSigner(secret string) *Signer {
+	if secret == "" {
+		return nil
+	}
+	return &Signer{secret: []byte(secret)}
+}
+
+func (sg *Signer) mac(msg []byte) []byte {
+	h := hmac.New(sha256.New, sg.secret)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// hex hmac-sha256 of msg to send alongside it.  a nil signer signs nothing
+func (sg *Signer) Sign(msg []byte) string {
+	if sg == nil {
+		return ""
+	}
+	return hex.EncodeToString(sg.mac(msg))
+}
+
+// whether sig is ours for msg, messages without one are refused.  a nil
+// signer accepts everything
+func (sg *Signer) Verify(msg []byte, sig string) error {
+	if sg == nil {
+		return nil
+	}
+	if sig == "" {
+		return ErrUnsigned
+	}
+	have, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(have, sg.mac(msg)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// settings the chat brokers share, embedded to give each the same setters
+type chatOptions struct {
+	// when each message was sent, nil leaves them unstamped
+	stamp *TimeStamper
+	// for the connections Setup makes, nil leaves the library's
+	timeouts *NetTimeouts
+	// drops repeats of what was just sent, nil sends everything
+	dedup *Deduper
+	// actors whose messages aren't broadcast
+	ignore *ActorFilter
+	// rewrites urls in what's sent
+	rewrites *UrlRewriter
+	// recognizes command output relayed by another bridge
+	cmdout *CmdOutputMarker
+	// chunks or truncates long messages, nil for the broker's default.
+	// limitBytes counts their length in bytes, for networks that do
+	limit      *MessageLimiter
+	limitBytes bool
+}
+
+// the settings from cfg that every broker embedding chatOptions takes
+func (co *chatOptions) configure(cfg *BrokerConfig) error {
+	if err := co.IgnoreActors(cfg.IgnoreActors...); err != nil {
+		return err
+	}
+	if err := co.RewriteUrls(cfg.UrlRewrites); err != nil {
+		return err
+	}
+	co.MarkCmdOutput(cfg.CmdOutputPrefixes, cfg.CmdOutputSuffixes)
+	if cfg.MaxMessageLen > 0 {
+		err := co.LimitMessages(cfg.MaxMessageLen, cfg.MessagePolicy,
+			cfg.TruncateMarker, cfg.TruncateLink)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Dedup != "" {
+		ttl, err := time.ParseDuration(cfg.Dedup)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid dedup %s", cfg.Dedup)
+		}
+		co.Dedup(ttl)
+		if err := co.dedup.KeyBy(cfg.DedupKey, cfg.DedupMatch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop outbound messages identical to one the same actor sent to the same
+// place within ttl, see DedupKey.  0 turns it off, as it is by default since
+// sometimes folks mean to repeat themselves
+func (co *chatOptions) Dedup(ttl time.Duration) {
+	if ttl <= 0 {
+		co.dedup = nil
+		return
+	}
+	co.dedup = NewDeduper(ttl)
+}
+
+// show when each message was originally sent, see NewTimeStamper.  a blank
+// layout leaves them unstamped
+func (co *chatOptions) StampTimes(layout string, zone string, position string) error {
+	if layout == "" {
+		co.stamp = nil
+		return nil
+	}
+	ts, err := NewTimeStamper(layout, zone, position)
+	if err != nil {
+		return err
+	}
+	co.stamp = ts
+	return nil
+}
+
+// actors matching any of these regexes will not be broadcast
+func (co *chatOptions) IgnoreActors(patterns ...string) error {
+	af, err := NewActorFilter(patterns)
+	if err != nil {
+		return err
+	}
+	co.ignore = af
+	return nil
+}
+
+// rewrite urls in outbound text with these rules, in order
+func (co *chatOptions) RewriteUrls(rules []UrlRewriteConfig) error {
+	ur, err := NewUrlRewriter(rules)
+	if err != nil {
+		return err
+	}
+	co.rewrites = ur
+	return nil
+}
+
+// inbound text carrying one of these is relayed command output, it has the
+// marker stripped and is never handed to a pattern router
+func (co *chatOptions) MarkCmdOutput(prefixes []string, suffixes []string) {
+	co.cmdout = NewCmdOutputMarker(prefixes, suffixes)
+}
+
+// messages longer than maxLen are chunked or truncated per policy, see
+// NewMessageLimiter.  without a limit irc chunks at 500 bytes, mastodon
+// truncates at the usual toot length and slack posts are left whole
+func (co *chatOptions) LimitMessages(
+	maxLen int, policy string, marker string, link string) error {
+	ml, err := NewMessageLimiter(maxLen, policy, marker, link)
+	if err != nil {
+		return err
+	}
+	if co.limitBytes {
+		ml.InBytes()
+	}
+	co.limit = ml
+	return nil
+}
+
+// how long to wait connecting and how often to check on an idle connection,
+// which brokers that ping remake when a ping goes unanswered.  Setup
+// connects so call this first
+func (co *chatOptions) ConnTimeouts(nt *NetTimeouts) {
+	co.timeouts = nt
+}
+
+// embedded by brokers with a channel topic to mirror, see TopicBroker
+type topicSyncer struct {
+	topicSync bool
+}
+
+// set our channel's topic to topics changed on other brokers
+func (ts *topicSyncer) SyncTopic(sync bool) {
+	ts.topicSync = sync
+}
+
+func (ts *topicSyncer) SyncsTopic() bool {
+	return ts.topicSync
+}
+
+// TimeStamper shows when a message was originally sent, eg "[14:05] hi", for
+// archives and places where relayed messages can land well after the fact
+type TimeStamper struct {
+	layout string
+	loc    *time.Location
+	suffix bool
+}
+
+// layout is a go time layout like 15:04, zone an IANA name like
+// America/Chicago (blank for local time) and position prefix (the default)
+// or suffix
+func NewTimeStamper(layout string, zone string, position string) (*TimeStamper, error) {
+	ts := &TimeStamper{layout: layout, loc: time.Local}
+	if zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp zone %s", zone)
+		}
+		ts.loc = loc
+	}
+	switch position {
+	case "", "prefix":
+	case "suffix":
+		ts.suffix = true
+	default:
+		return nil, fmt.Errorf("timestamp position must be either prefix or suffix")
+	}
+	return ts, nil
+}
+
+func (ts *TimeStamper) render(ev *Event) string {
+	if ts == nil || ev.Time().IsZero() {
+		return ""
+	}
+	return "[" + ev.Time().In(ts.loc).Format(ts.layout) + "]"
+}
+
+// what goes before ev's text, blank if stamping after it.  a nil stamper or
+// an event without a time stamps nothing
+func (ts *TimeStamper) Prefix(ev *Event) string {
+	if s := ts.render(ev); s != "" && !ts.suffix {
+		return s + " "
+	}
+	return ""
+}
+
+// what goes after ev's text, blank if stamping before it
+func (ts *TimeStamper) Suffix(ev *Event) string {
+	if s := ts.render(ev); s != "" && ts.suffix {
+		return " " + s
+	}
+	return ""
+}
+
+// text with ev's time before or after it, empty text stays empty
+func (ts *TimeStamper) Stamp(ev *Event, text string) string {
+	if text == "" {
+		return text
+	}
+	return ts.Prefix(ev) + text + ts.Suffix(ev)
+}
+
+// what a TextNormalizer does with a character it doesn't trust
+const (
+	NormalizeStrip   = "strip"
+	NormalizeReplace = "replace"
+)
+
+// TextNormalizer takes out characters that render as garbage or can be used
+// to disguise text: control characters, bidi overrides and isolates, and
+// invisible ones like zero width spaces.  newlines, tabs, rtl marks and the
+// joiners emoji and many scripts depend on are left alone
+type TextNormalizer struct {
+	replace bool
+}
+
+// mode is strip (the default) or replace, which swaps each one for U+FFFD so
+// readers can see something was there
+func NewTextNormalizer(mode string) (*TextNormalizer, error) {
+	switch mode {
+	case "", NormalizeStrip:
+		return &TextNormalizer{}, nil
+	case NormalizeReplace:
+		return &TextNormalizer{replace: true}, nil
+	}
+	return nil, fmt.Errorf("normalize-text must be either strip or replace")
+}
+
+// black flag, the start of subdivision flags spelled with tag characters
+const flagBase = '\U0001F3F4'
+
+func isTagChar(r rune) bool {
+	return r >= 0xE0000 && r <= 0xE007F
+}
+
+func untrustedRune(r rune, prev rune) bool {
+	switch {
+	case r == '\n' || r == '\t':
+		return false
+	case r < 0x20 || (r >= 0x7F && r <= 0x9F):
+		return true
+	case r >= 0x202A && r <= 0x202E, r >= 0x2066 && r <= 0x2069:
+		// bidi embeddings, overrides and isolates
+		return true
+	case r == 0x200B, r == 0x2060, r == 0xFEFF, r == 0x00AD, r == 0x180E,
+		r >= 0x2061 && r <= 0x2064:
+		// zero width space, word joiner, bom, soft hyphen and friends
+		return true
+	case isTagChar(r):
+		// fine inside a flag, otherwise a way to hide text
+		return prev != flagBase && !isTagChar(prev)
+	}
+	return false
+}
+
+// a nil normalizer changes nothing
+func (tn *TextNormalizer) Normalize(s string) string {
+	if tn == nil {
+		return s
+	}
+	var out strings.Builder
+	prev := rune(0)
+	changed := false
+	for _, r := range s {
+		if untrustedRune(r, prev) {
+			changed = true
+			if tn.replace {
+				out.WriteRune('\uFFFD')
+			}
+			continue
+		}
+		out.WriteRune(r)
+		prev = r
+	}
+	if !changed {
+		return s
+	}
+	return out.String()
+}
+
+// normalizes the text of ev, its blocks and attachments, in place
+func (tn *TextNormalizer) NormalizeEvent(ev *Event) {
+	if tn == nil {
+		return
+	}
+	ev.Text = tn.Normalize(ev.Text)
+	ev.RawText = tn.Normalize(ev.RawText)
+	for _, b := range ev.ContentBlocks {
+		b.Text = tn.Normalize(b.Text)
+	}
+	for _, a := range ev.Attachments {
+		a.Text = tn.Normalize(a.Text)
+		for _, f := range a.Fields {
+			f.Value = tn.Normalize(f.Value)
+		}
+	}
+}
+
+// whether line is quoted, eg "> said this" or ">> and this"
+func quotedLine(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), ">")
+}
+
+// drops quoted history from the start and end of text: a leading block of
+// > lines, as chat replies carry, and a trailing one, as email replies do,
+// with the On ... wrote: above it, or anything after -----Original
+// Message-----.  quotes between new lines are left as the context they give,
+// as is code, and text that's all quote is left whole rather than bridging
+// nothing
+func StripReplyQuotes(text string) string {
+	if strings.Contains(text, "```") {
+		return text
+	}
+	blank := func(line string) bool { return strings.TrimSpace(line) == "" }
+	lines := strings.Split(text, "\n")
+	start, end := 0, len(lines)
+	for start < end && (quotedLine(lines[start]) || blank(lines[start])) {
+		start++
+	}
+	for i := start; i < end; i++ {
+		if strings.Contains(lines[i], "-----Original Message-----") {
+			end = i
+			break
+		}
+	}
+	quoted := false
+	for end > start && (quotedLine(lines[end-1]) || blank(lines[end-1])) {
+		quoted = quoted || quotedLine(lines[end-1])
+		end--
+	}
+	if quoted && end > start && re_replyheader.MatchString(strings.TrimSpace(lines[end-1])) {
+		end--
+	}
+	kept := strings.TrimSpace(strings.Join(lines[start:end], "\n"))
+	if kept == "" {
+		return text
+	}
+	return kept
+}
+
+// a TransformFunc stripping reply quotes from what people say, see
+// StripReplyQuotes
+func StripQuotes(ev *Event) *Event {
+	if ev.IsCmdOutput || ev.Presence != "" || ev.IsTopic || ev.IsReplay {
+		return ev
+	}
+	stripped := StripReplyQuotes(ev.Text)
+	if stripped == ev.Text {
+		return ev
+	}
+	out := *ev
+	out.Text = stripped
+	return &out
+}